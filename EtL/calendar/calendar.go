@@ -0,0 +1,158 @@
+// Package calendar is the trading calendar of the US exchanges (NYSE and NASDAQ), used to tell
+// how many trading days the loaded data is behind.
+package calendar
+
+import (
+	"time"
+	_ "time/tzdata" // the exchange time zone must resolve on hosts without tzdata, e.g. scratch images
+)
+
+// Exchange is the time zone of the exchanges.
+var Exchange = mustLoadLocation("America/New_York")
+
+// closeHour is the hour the regular session closes in the exchange time zone. Early closes,
+// e.g. the day after Thanksgiving, are treated as regular closes.
+const closeHour = 16
+
+// closures are the unscheduled closures of the exchanges since 2012.
+var closures = []time.Time{
+	Date(2012, time.October, 29), // Hurricane Sandy
+	Date(2012, time.October, 30),
+	Date(2018, time.December, 5), // National Day of Mourning for George H.W. Bush
+	Date(2025, time.January, 9),  // National Day of Mourning for Jimmy Carter
+}
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// Date returns the date as midnight UTC, which is how dates are compared in this package.
+func Date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// truncate returns the date of t in its location as midnight UTC.
+func truncate(t time.Time) time.Time {
+	return Date(t.Year(), t.Month(), t.Day())
+}
+
+// IsTradingDay reports whether the exchanges are open on the date of t.
+func IsTradingDay(t time.Time) bool {
+	d := truncate(t)
+	if d.Weekday() == time.Saturday || d.Weekday() == time.Sunday {
+		return false
+	}
+	for _, h := range Holidays(d.Year()) {
+		if h.Equal(d) {
+			return false
+		}
+	}
+	for _, c := range closures {
+		if c.Equal(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// PreviousTradingDay returns the last trading day before the date of t.
+func PreviousTradingDay(t time.Time) time.Time {
+	d := truncate(t).AddDate(0, 0, -1)
+	for !IsTradingDay(d) {
+		d = d.AddDate(0, 0, -1)
+	}
+	return d
+}
+
+// LastSession returns the date of the last trading day whose session had closed at now.
+func LastSession(now time.Time) time.Time {
+	local := now.In(Exchange)
+	d := truncate(local)
+	if !IsTradingDay(d) || local.Hour() < closeHour {
+		return PreviousTradingDay(d)
+	}
+	return d
+}
+
+// TradingDaysBetween returns the number of trading days after the date of from, up to and
+// including the date of to, or 0 if to is not after from.
+func TradingDaysBetween(from, to time.Time) int {
+	n := 0
+	end := truncate(to)
+	for d := truncate(from).AddDate(0, 0, 1); !d.After(end); d = d.AddDate(0, 0, 1) {
+		if IsTradingDay(d) {
+			n++
+		}
+	}
+	return n
+}
+
+// Holidays returns the dates the exchanges are closed for holidays in the year, as observed when
+// a holiday falls on a weekend. New Year's Day on a Saturday is not observed, since the exchanges
+// do not close on the last trading day of the year.
+func Holidays(year int) []time.Time {
+	holidays := []time.Time{
+		nthWeekday(year, time.January, time.Monday, 3),    // Martin Luther King Jr. Day
+		nthWeekday(year, time.February, time.Monday, 3),   // Washington's Birthday
+		easter(year).AddDate(0, 0, -2),                    // Good Friday
+		lastWeekday(year, time.May, time.Monday),          // Memorial Day
+		observed(Date(year, time.July, 4)),                // Independence Day
+		nthWeekday(year, time.September, time.Monday, 1),  // Labor Day
+		nthWeekday(year, time.November, time.Thursday, 4), // Thanksgiving Day
+		observed(Date(year, time.December, 25)),           // Christmas Day
+	}
+	if newYear := Date(year, time.January, 1); newYear.Weekday() != time.Saturday {
+		holidays = append(holidays, observed(newYear))
+	}
+	if year >= 2022 {
+		holidays = append(holidays, observed(Date(year, time.June, 19))) // Juneteenth
+	}
+	return holidays
+}
+
+// observed returns the weekday a holiday is observed on: the Friday before if it falls on a
+// Saturday, and the Monday after if it falls on a Sunday.
+func observed(d time.Time) time.Time {
+	switch d.Weekday() {
+	case time.Saturday:
+		return d.AddDate(0, 0, -1)
+	case time.Sunday:
+		return d.AddDate(0, 0, 1)
+	default:
+		return d
+	}
+}
+
+// nthWeekday returns the nth weekday of the month, e.g. the third Monday of January.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	d := Date(year, month, 1)
+	offset := (int(weekday) - int(d.Weekday()) + 7) % 7
+	return d.AddDate(0, 0, offset+7*(n-1))
+}
+
+// lastWeekday returns the last weekday of the month, e.g. the last Monday of May.
+func lastWeekday(year int, month time.Month, weekday time.Weekday) time.Time {
+	d := Date(year, month+1, 1).AddDate(0, 0, -1)
+	offset := (int(d.Weekday()) - int(weekday) + 7) % 7
+	return d.AddDate(0, 0, -offset)
+}
+
+// easter returns Easter Sunday in the Gregorian calendar, with the anonymous Gregorian algorithm.
+func easter(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return Date(year, time.Month(month), day)
+}
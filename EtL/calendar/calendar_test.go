@@ -0,0 +1,88 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHolidays(t *testing.T) {
+	assert.ElementsMatch(t, []time.Time{
+		Date(2024, time.January, 1),
+		Date(2024, time.January, 15),
+		Date(2024, time.February, 19),
+		Date(2024, time.March, 29),
+		Date(2024, time.May, 27),
+		Date(2024, time.June, 19),
+		Date(2024, time.July, 4),
+		Date(2024, time.September, 2),
+		Date(2024, time.November, 28),
+		Date(2024, time.December, 25),
+	}, Holidays(2024))
+}
+
+func TestIsTradingDay(t *testing.T) {
+	tests := []struct {
+		name string
+		date time.Time
+		want bool
+	}{
+		{"weekday", Date(2024, time.January, 2), true},
+		{"saturday", Date(2024, time.January, 6), false},
+		{"sunday", Date(2024, time.January, 7), false},
+		{"good friday", Date(2023, time.April, 7), false},
+		{"independence day on a sunday is observed on monday", Date(2021, time.July, 5), false},
+		{"christmas on a saturday is observed on friday", Date(2021, time.December, 24), false},
+		{"new year's day on a saturday is not observed", Date(2021, time.December, 31), true},
+		{"juneteenth before 2022", Date(2020, time.June, 19), true},
+		{"unscheduled closure", Date(2025, time.January, 9), false},
+		{"time of day is ignored", time.Date(2024, time.January, 2, 23, 59, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsTradingDay(tt.date))
+		})
+	}
+}
+
+func TestLastSession(t *testing.T) {
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"after the close", time.Date(2024, time.January, 3, 21, 30, 0, 0, time.UTC), Date(2024, time.January, 3)},
+		{"before the close", time.Date(2024, time.January, 3, 20, 30, 0, 0, time.UTC), Date(2024, time.January, 2)},
+		{"after midnight UTC, before midnight in New York", time.Date(2024, time.January, 4, 2, 0, 0, 0, time.UTC), Date(2024, time.January, 3)},
+		{"weekend", time.Date(2024, time.January, 7, 12, 0, 0, 0, time.UTC), Date(2024, time.January, 5)},
+		{"after a holiday weekend", time.Date(2024, time.January, 16, 12, 0, 0, 0, time.UTC), Date(2024, time.January, 12)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, LastSession(tt.now))
+		})
+	}
+}
+
+func TestTradingDaysBetween(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int
+	}{
+		{"same day", Date(2024, time.January, 2), Date(2024, time.January, 2), 0},
+		{"next day", Date(2024, time.January, 2), Date(2024, time.January, 3), 1},
+		{"over a holiday weekend", Date(2024, time.January, 12), Date(2024, time.January, 16), 1},
+		{"a year", Date(2023, time.December, 29), Date(2024, time.December, 31), 252},
+		{"to before from", Date(2024, time.January, 3), Date(2024, time.January, 2), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, TradingDaysBetween(tt.from, tt.to))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Validate and inspect the configuration",
+}
+
+// loadConfig loads the configuration like initializeConfigAndLogger, and returns the config files loaded.
+func loadConfig() (*config.Config, []string, error) {
+	if err := loadDotEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	opts, err := configOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, files, err := config.Load(opts)
+	if err == nil {
+		err = cfg.ValidateFiles()
+	}
+	return cfg, files, err
+}
+
+func newConfigValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Checks the config files for unknown keys and invalid values",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			_, files, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: valid\n", strings.Join(files, ", "))
+			return nil
+		},
+	}
+}
+
+func newConfigShowCmd() *cobra.Command {
+	var resolved bool
+
+	cmd := &cobra.Command{
+		Use:   "show [--resolved]",
+		Short: "Prints the merged configuration as YAML, with secrets redacted",
+		Long: `Prints the merged configuration as YAML, with secrets redacted. From highest to lowest
+precedence, the values come from:
+
+  1. --set key=value flags, e.g. --set tiingo.eod.start_date=today-72h
+  2. ETL_ environment variables, e.g. ETL_TIINGO_EOD_START_DATE=today-72h
+  3. the config file of the environment, config.<env>.yaml next to the base config file, where
+     the environment is set with --env or APP_ENV
+  4. the base config file, config.base.yaml or the file set with --config
+
+The sources in effect are listed at the top. With --resolved, start dates are resolved relative to
+today, paths are made absolute and defaults are filled in, as the pipelines use them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cfg, files, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if resolved {
+				if cfg, err = cfg.Resolved(time.Now()); err != nil {
+					return fmt.Errorf("error resolving config: %w", err)
+				}
+			}
+
+			out, err := cfg.YAML()
+			if err != nil {
+				return fmt.Errorf("error encoding config: %w", err)
+			}
+			w := cmd.OutOrStdout()
+			fmt.Fprintln(w, "# Sources, from highest to lowest precedence:")
+			for _, source := range configSources(files) {
+				fmt.Fprintf(w, "#   %s\n", source)
+			}
+			fmt.Fprintf(w, "%s", out)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&resolved, "resolved", false, "Show the values as the pipelines use them")
+	return cmd
+}
+
+// configSources describes the sources of the configuration in effect, from highest to lowest
+// precedence, given the config files loaded.
+func configSources(files []string) []string {
+	var sources []string
+	for _, o := range configSet {
+		key, _, _ := strings.Cut(o, "=")
+		sources = append(sources, fmt.Sprintf("--set %s", strings.TrimSpace(key)))
+	}
+	for _, v := range config.EnvOverrides() {
+		sources = append(sources, fmt.Sprintf("$%s", v))
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		sources = append(sources, files[i])
+	}
+	return sources
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/snapshot"
+	"github.com/spf13/cobra"
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Snapshot and restore the DuckDB database",
+}
+
+func newDBSnapshotCmd() *cobra.Command {
+	var (
+		dir  string
+		keep int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "snapshot [--dir DIR] [--keep N]",
+		Short: "Exports all schemas to a new snapshot directory, and prunes old snapshots",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			if !cmd.Flags().Changed("dir") {
+				dir = cfg.Snapshot.Dir
+			}
+			if !cmd.Flags().Changed("keep") {
+				keep = cfg.Snapshot.Keep
+			}
+
+			db, err := load.NewDuckDB(cfg, log)
+			if err != nil {
+				return fmt.Errorf("error opening DuckDB: %w", err)
+			}
+			defer db.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			m, err := snapshot.Create(ctx, db, dir, time.Now())
+			if err != nil {
+				return fmt.Errorf("error creating snapshot: %w", err)
+			}
+			pruned, err := snapshot.Prune(dir, keep)
+			if err != nil {
+				return fmt.Errorf("error pruning snapshots: %w", err)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "Snapshot\t%s (%d bytes, schema version %s)\n", m.Dir, m.Bytes(), m.SchemaVersion)
+			for _, p := range pruned {
+				fmt.Fprintf(w, "Pruned\t%s\n", p.Dir)
+			}
+			fmt.Fprintln(w, "\nTable\tRows")
+			for _, t := range m.Tables {
+				fmt.Fprintf(w, "%s\t%d\n", t.Table, t.Rows)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory to create the snapshot in (default snapshot.dir in the config)")
+	cmd.Flags().IntVar(&keep, "keep", 0, "Number of snapshots to keep, 0 keeps all (default snapshot.keep in the config)")
+	return cmd
+}
+
+func newDBRestoreCmd() *cobra.Command {
+	var (
+		to    string
+		force bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "restore SNAPSHOT [--to PATH] [--force]",
+		Short: "Rebuilds a database from a snapshot, given as a directory or a name in snapshot.dir",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+
+			dir := args[0]
+			if _, err := os.Stat(dir); err != nil {
+				dir = filepath.Join(cfg.Snapshot.Dir, args[0])
+			}
+			if to == "" {
+				to = cfg.DuckDB.Path
+			}
+
+			db, err := snapshot.OpenTarget(cfg, to, log)
+			if err != nil {
+				return fmt.Errorf("error opening DuckDB: %w", err)
+			}
+			defer db.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			m, err := snapshot.Restore(ctx, db, dir, force)
+			if err != nil {
+				return fmt.Errorf("error restoring snapshot: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Restored %s from %s, created at %s\n", to, m.Dir, m.CreatedAt.Format(time.RFC3339))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&to, "to", "", "Database to restore into (default duckdb.path in the config)")
+	cmd.Flags().BoolVar(&force, "force", false, "Drop all tables in the database before restoring")
+	return cmd
+}
+
+func newDBListCmd() *cobra.Command {
+	var dir string
+
+	cmd := &cobra.Command{
+		Use:   "list [--dir DIR]",
+		Short: "Lists the snapshots, newest first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			if dir == "" {
+				dir = cfg.Snapshot.Dir
+			}
+
+			snapshots, err := snapshot.List(dir)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCREATED\tDATABASE\tTABLES\tBYTES\tSCHEMA VERSION")
+			for _, m := range snapshots {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n",
+					m.Name, m.CreatedAt.Format(time.RFC3339), m.Database, len(m.Tables), m.Bytes(), m.SchemaVersion)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory of the snapshots (default snapshot.dir in the config)")
+	return cmd
+}
+
+func newDBPruneCmd() *cobra.Command {
+	var (
+		dir  string
+		keep int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prune [--dir DIR] [--keep N]",
+		Short: "Deletes the snapshots but the newest ones",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			if !cmd.Flags().Changed("dir") {
+				dir = cfg.Snapshot.Dir
+			}
+			if !cmd.Flags().Changed("keep") {
+				keep = cfg.Snapshot.Keep
+			}
+
+			pruned, err := snapshot.Prune(dir, keep)
+			if err != nil {
+				return err
+			}
+			for _, m := range pruned {
+				fmt.Fprintf(cmd.OutOrStdout(), "Pruned %s\n", m.Dir)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory of the snapshots (default snapshot.dir in the config)")
+	cmd.Flags().IntVar(&keep, "keep", 0, "Number of snapshots to keep, 0 keeps all (default snapshot.keep in the config)")
+	return cmd
+}
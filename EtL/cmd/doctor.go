@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/doctor"
+	"github.com/spf13/cobra"
+)
+
+// checkColors are the ANSI colors of the statuses of doctor checks.
+var checkColors = map[string]string{
+	doctor.StatusOK:   "\033[32m",
+	doctor.StatusWarn: "\033[33m",
+	doctor.StatusFail: "\033[31m",
+	doctor.StatusSkip: "\033[90m",
+}
+
+func newDoctorCmd() *cobra.Command {
+	var (
+		format  string
+		noColor bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "doctor [--format table|json]",
+		Short: "Checks the config, tokens, Tiingo API, DuckDB and disk space, and suggests fixes",
+		Long: `Checks the setup etl runs in, in the order etl sets itself up: the .env file, the config files,
+TIINGO_TOKEN and MOTHERDUCK_TOKEN, the Tiingo API with a cheap request, DuckDB with the connection
+init queries, the SQL files, and the free disk space for temporary files. Exits with an error if
+any check fails.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "table" && format != "json" {
+				return fmt.Errorf("invalid --format %q, must be table or json", format)
+			}
+
+			opts, err := configOptions()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			checks := doctor.Run(ctx, doctor.Options{DotEnv: !isRunningOnGitHubActions(), Config: opts})
+
+			out := cmd.OutOrStdout()
+			if format == "json" {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(checks); err != nil {
+					return err
+				}
+			} else {
+				color := !noColor && useColor(out)
+				w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+				for _, c := range checks {
+					// Every line starts with color codes of the same length, so they do not misalign the columns
+					status, indent := fmt.Sprintf("%-4s", c.Status), "    "
+					if color {
+						status = checkColors[c.Status] + status + "\033[0m"
+						indent = checkColors[c.Status] + indent + "\033[0m"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", status, c.Name, c.Detail)
+					if c.Fix != "" {
+						fmt.Fprintf(w, "%s\t\t-> %s\n", indent, c.Fix)
+					}
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+
+			if n := doctor.Failed(checks); n > 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("%d of %d checks failed", n, len(checks))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "table", "Output format: table or json")
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Do not color the status, which is only colored on a terminal")
+	return cmd
+}
@@ -13,11 +13,14 @@ func newBackfillCmd() *cobra.Command {
 		Use:   "backfill [tickers]",
 		Short: "Backfills historical data for specified tickers",
 		Args:  cobra.MinimumNArgs(1), // Requires at least one ticker symbol
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			cfg, log, err := initializeConfigAndLogger()
 			if err != nil {
 				return err
 			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			defer func() { notifyRun(cmd, cfg, log, report, err) }()
 
 			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
 			if err != nil {
@@ -25,12 +28,18 @@ func newBackfillCmd() *cobra.Command {
 			}
 			defer pipeline.Close()
 
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
 			tickers := strings.Split(strings.ToUpper(args[0]), ",") // Convert tickers to uppercase
-			nSuccess, err := pipeline.BackfillEndOfDay(tickers)
+			report, err = pipeline.BackfillEndOfDay(ctx, tickers)
+			writeReport(ctx, cmd, pipeline, report, log)
 			if err != nil {
 				return fmt.Errorf("error backfilling tickers: %w", err)
 			}
-			log.Info(fmt.Sprintf("Backfilled %d tickers", nSuccess))
+			log.Info(fmt.Sprintf("Backfilled %d tickers", report.Processed))
 			return nil
 		},
 	}
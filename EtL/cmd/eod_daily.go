@@ -11,11 +11,22 @@ func newDailyCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "daily",
 		Short: "Runs the daily end-of-day ETL pipeline",
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			cfg, log, err := initializeConfigAndLogger()
 			if err != nil {
 				return err
 			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			// Data that fails validation is notified about, but does not fail the command
+			var validationErr error
+			defer func() {
+				notifyErr := err
+				if notifyErr == nil {
+					notifyErr = validationErr
+				}
+				notifyRun(cmd, cfg, log, report, notifyErr)
+			}()
 
 			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
 			if err != nil {
@@ -23,7 +34,14 @@ func newDailyCmd() *cobra.Command {
 			}
 			defer pipeline.Close()
 
-			nTickers, err := pipeline.DailyEndOfDay()
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
+			report, err = pipeline.DailyEndOfDay(ctx)
+			writeReport(ctx, cmd, pipeline, report, log)
+			nTickers := report.Processed
 			if err != nil {
 				if nTickers > 0 {
 					log.Error(fmt.Sprintf("Error running pipeline: %v. Backfilled %d tickers", err, nTickers))
@@ -32,6 +50,10 @@ func newDailyCmd() *cobra.Command {
 				}
 				return err
 			}
+
+			if validationErr = pipeline.ValidateEndOfDay(ctx); validationErr != nil {
+				log.Warn(fmt.Sprintf("Error validating the last trading day: %v", validationErr))
+			}
 			log.Info(fmt.Sprintf("Batch job completed without errors. Backfilled %d tickers", nTickers))
 			return nil
 		},
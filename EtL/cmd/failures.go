@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/spf13/cobra"
+)
+
+var failuresCmd = &cobra.Command{
+	Use:   "failures",
+	Short: "Manage tickers recorded in the failed_tickers table",
+}
+
+func newFailuresListCmd() *cobra.Command {
+	var endpoint string
+
+	cmd := &cobra.Command{
+		Use:   "list [--endpoint TABLE]",
+		Short: "Lists tickers that have failed to be fetched or loaded",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			failed, err := pipeline.ListFailures(ctx, endpoint)
+			if err != nil {
+				return fmt.Errorf("error listing failures: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TICKER\tENDPOINT\tSTATUS\tATTEMPTS\tLAST FAILED\tBODY")
+			for _, f := range failed {
+				status := "-"
+				if f.StatusCode != 0 {
+					status = fmt.Sprintf("%d", f.StatusCode)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+					f.Ticker, f.Endpoint, status, f.Attempts,
+					f.LastFailedAt.Format(time.RFC3339), strings.ReplaceAll(f.BodyExcerpt, "\n", " "))
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "Only list failures for this table (e.g. fundamentals.daily)")
+	return cmd
+}
+
+func newFailuresRetryCmd() *cobra.Command {
+	var (
+		endpoint string
+		tickers  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "retry [--endpoint TABLE] [--tickers TICKER1,TICKER2,...]",
+		Short: "Retries failed tickers now, ignoring the cooldown",
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			defer func() { notifyRun(cmd, cfg, log, report, err) }()
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
+			var tickerSlice []string
+			if tickers != "" {
+				tickerSlice = strings.Split(strings.ToUpper(tickers), ",")
+			}
+
+			report, err = pipeline.RetryFailures(ctx, endpoint, tickerSlice)
+			writeReport(ctx, cmd, pipeline, report, log)
+			if err != nil {
+				return fmt.Errorf("error retrying failures: %w", err)
+			}
+
+			log.Info(fmt.Sprintf("Successfully retried %d tickers", report.Processed))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "Only retry failures for this table (e.g. fundamentals.daily)")
+	cmd.Flags().StringVar(&tickers, "tickers", "", "Comma-separated list of tickers to retry (e.g., AAPL,MSFT)")
+	return cmd
+}
+
+func newFailuresClearCmd() *cobra.Command {
+	var (
+		endpoint string
+		tickers  string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "clear [--endpoint TABLE] [--tickers TICKER1,TICKER2,...]",
+		Short: "Removes tickers from the failed_tickers table, so they are no longer skipped",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			var tickerSlice []string
+			if tickers != "" {
+				tickerSlice = strings.Split(strings.ToUpper(tickers), ",")
+			}
+
+			nCleared, err := pipeline.ClearFailures(ctx, endpoint, tickerSlice)
+			if err != nil {
+				return fmt.Errorf("error clearing failures: %w", err)
+			}
+
+			log.Info(fmt.Sprintf("Cleared %d failed tickers", nCleared))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "Only clear failures for this table (e.g. fundamentals.daily)")
+	cmd.Flags().StringVar(&tickers, "tickers", "", "Comma-separated list of tickers to clear (e.g., AAPL,MSFT)")
+	return cmd
+}
+
+func init() {
+	failuresCmd.AddCommand(newFailuresListCmd())
+	failuresCmd.AddCommand(newFailuresRetryCmd())
+	failuresCmd.AddCommand(newFailuresClearCmd())
+}
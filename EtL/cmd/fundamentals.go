@@ -34,11 +34,14 @@ func newFundamentalsDailyCmd() *cobra.Command {
 			}
 			return nil
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			cfg, log, err := initializeConfigAndLogger()
 			if err != nil {
 				return err
 			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			defer func() { notifyRun(cmd, cfg, log, report, err) }()
 
 			pipeline, err := pipeline.NewPipeline(cfg, log, utils.RealTimeProvider{})
 			if err != nil {
@@ -46,6 +49,11 @@ func newFundamentalsDailyCmd() *cobra.Command {
 			}
 			defer pipeline.Close()
 
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
 			var tickerSlice []string
 			if tickers != "" {
 				tickerSlice = strings.Split(strings.ToUpper(tickers), ",")
@@ -56,12 +64,13 @@ func newFundamentalsDailyCmd() *cobra.Command {
 				skipTickerSlice = strings.Split(skipTickers, ",")
 			}
 
-			rowsAffected, err := pipeline.DailyFundamentals(tickerSlice, halfOnly, dailyBatchSize, skipTickerSlice, skipExisting, lookback)
+			report, err = pipeline.DailyFundamentals(ctx, tickerSlice, halfOnly, dailyBatchSize, skipTickerSlice, skipExisting, lookback)
+			writeReport(ctx, cmd, pipeline, report, log)
 			if err != nil {
 				return fmt.Errorf("error updating daily fundamentals: %w", err)
 			}
 
-			log.Info(fmt.Sprintf("Successfully updated daily fundamentals for %d tickers", rowsAffected))
+			log.Info(fmt.Sprintf("Successfully updated daily fundamentals for %d tickers", report.Processed))
 
 			return nil
 		},
@@ -80,11 +89,14 @@ func newMetadataCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "metadata",
 		Short: "Updates fundamentals metadata for all tickers",
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			cfg, log, err := initializeConfigAndLogger()
 			if err != nil {
 				return err
 			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			defer func() { notifyRun(cmd, cfg, log, report, err) }()
 
 			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
 			if err != nil {
@@ -92,12 +104,18 @@ func newMetadataCmd() *cobra.Command {
 			}
 			defer pipeline.Close()
 
-			rowsAffected, err := pipeline.UpdateMetadata()
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
+			report, err = pipeline.UpdateMetadata(ctx)
+			writeReport(ctx, cmd, pipeline, report, log)
 			if err != nil {
 				return fmt.Errorf("error updating metadata: %w", err)
 			}
 
-			log.Info(fmt.Sprintf("Successfully updated metadata for %d tickers", rowsAffected))
+			log.Info(fmt.Sprintf("Successfully updated metadata for %d tickers", report.Processed))
 
 			return nil
 		},
@@ -124,11 +142,14 @@ func newStatementsCmd() *cobra.Command {
 			}
 			return nil
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			cfg, log, err := initializeConfigAndLogger()
 			if err != nil {
 				return err
 			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			var report *pipeline.Report
+			defer func() { notifyRun(cmd, cfg, log, report, err) }()
 
 			pipeline, err := pipeline.NewPipeline(cfg, log, utils.RealTimeProvider{})
 			if err != nil {
@@ -136,6 +157,11 @@ func newStatementsCmd() *cobra.Command {
 			}
 			defer pipeline.Close()
 
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
 			var tickerSlice []string
 			if tickers != "" {
 				tickerSlice = strings.Split(strings.ToUpper(tickers), ",")
@@ -146,12 +172,13 @@ func newStatementsCmd() *cobra.Command {
 				skipTickerSlice = strings.Split(skipTickers, ",")
 			}
 
-			rowsAffected, err := pipeline.Statements(tickerSlice, halfOnly, statementsBatchSize, skipTickerSlice, skipExisting, lookback)
+			report, err = pipeline.Statements(ctx, tickerSlice, halfOnly, statementsBatchSize, skipTickerSlice, skipExisting, lookback)
+			writeReport(ctx, cmd, pipeline, report, log)
 			if err != nil {
 				return fmt.Errorf("error updating statements: %w", err)
 			}
 
-			log.Info(fmt.Sprintf("Successfully updated statements for %d tickers", rowsAffected))
+			log.Info(fmt.Sprintf("Successfully updated statements for %d tickers", report.Processed))
 
 			return nil
 		},
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/promote"
+	"github.com/spf13/cobra"
+)
+
+func newPromoteCmd() *cobra.Command {
+	var (
+		tables string
+		since  string
+		source string
+		target string
+		dryRun bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "promote --since DATE [--tables TABLE1,TABLE2,...]",
+		Short: "Checks rows in the stage database and merges them into the prod database",
+		Long: fmt.Sprintf(`Checks the rows dated on or after --since in the source database, and merges them
+into the target database in a single transaction. Nothing is merged if any check fails.
+The databases default to promote.source and promote.target in the config.
+
+Tables that can be promoted: %s.`, strings.Join(promote.Tables(), ", ")),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			sinceDate, err := time.Parse(time.DateOnly, since)
+			if err != nil {
+				return fmt.Errorf("invalid --since date %q, expected YYYY-MM-DD: %w", since, err)
+			}
+
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			defer func() { pushMetrics(cmd, cfg, log, err) }()
+			defer func() { notifyRun(cmd, cfg, log, nil, err) }()
+
+			if source == "" {
+				source = cfg.Promote.Source
+			}
+			if target == "" {
+				target = cfg.Promote.Target
+			}
+			tableList := cfg.Promote.Tables
+			if tables != "" {
+				tableList = strings.Split(tables, ",")
+			}
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			ctx, endTrace := startTracing(ctx, cmd, cfg, log)
+			defer func() { endTrace(err) }()
+
+			promoter, err := promote.New(ctx, source, target, cfg.DuckDB.ChangedKeysLimit, cfg.Secrets, log)
+			if err != nil {
+				return fmt.Errorf("error attaching databases: %w", err)
+			}
+			defer promoter.Close()
+
+			result, err := promoter.Promote(ctx, tableList, sinceDate, dryRun)
+			write := result.WriteTable
+			if reportFormat == "json" {
+				write = result.WriteJSON
+			}
+			if wErr := write(cmd.OutOrStdout()); wErr != nil {
+				log.Warn(fmt.Sprintf("Error printing promote result: %v", wErr))
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&tables, "tables", "", "Comma-separated tables to promote (default promote.tables in the config)")
+	cmd.Flags().StringVar(&since, "since", "", "Promote rows dated on or after this date (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&source, "from", "", "Database to promote from, e.g. md:stage (default promote.source in the config)")
+	cmd.Flags().StringVar(&target, "to", "", "Database to promote into, e.g. md:prod (default promote.target in the config)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Check and count the rows to promote, without merging them")
+	cmd.MarkFlagRequired("since")
+	return cmd
+}
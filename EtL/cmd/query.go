@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/logger"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/query"
+	"github.com/spf13/cobra"
+)
+
+func newQueryCmd() *cobra.Command {
+	var (
+		file   string
+		params map[string]string
+		format string
+		out    string
+	)
+
+	cmd := &cobra.Command{
+		Use:   `query ["SQL" | -f FILE] [--param KEY=VALUE]... [--format FORMAT] [--out PATH]`,
+		Short: "Runs a SQL query on DuckDB and prints the results",
+		Long: `Runs a SQL query on DuckDB, connected with the same configuration and connection init queries as the pipelines.
+
+The SQL is a template like the SQL files of the pipelines, executed with the --param values,
+e.g. --param Ticker=AAPL for {{.Ticker}}.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (len(args) == 1) == (file != "") {
+				return fmt.Errorf("pass either the SQL or a file with -f")
+			}
+			if !slices.Contains(query.Formats, format) {
+				return fmt.Errorf("invalid --format %q, must be one of %s", format, strings.Join(query.Formats, ", "))
+			}
+			if format == query.FormatParquet && out == "" {
+				return fmt.Errorf("--out is required with --format parquet")
+			}
+
+			sql := ""
+			if file != "" {
+				b, err := os.ReadFile(file)
+				if err != nil {
+					return fmt.Errorf("error reading query file: %w", err)
+				}
+				sql = string(b)
+			} else {
+				sql = args[0]
+			}
+			sql, err := query.Render(sql, params)
+			if err != nil {
+				return err
+			}
+
+			cfg, _, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			// Log to stderr, so the logs do not mix with the results
+			log := logger.New(cmd.ErrOrStderr())
+			db, err := load.NewDuckDB(cfg, log)
+			if err != nil {
+				return fmt.Errorf("error opening DuckDB: %w", err)
+			}
+			defer db.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			if format == query.FormatParquet {
+				return query.CopyParquet(ctx, db, sql, out)
+			}
+
+			w := cmd.OutOrStdout()
+			var f *os.File
+			if out != "" {
+				if f, err = os.Create(out); err != nil {
+					return fmt.Errorf("error creating output file: %w", err)
+				}
+				defer f.Close()
+				w = f
+			}
+			if _, err := query.Run(ctx, db, sql, format, w); err != nil {
+				return err
+			}
+			if f != nil {
+				if err := f.Close(); err != nil {
+					return fmt.Errorf("error writing output file: %w", err)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "File with the SQL to run")
+	cmd.Flags().StringToStringVar(&params, "param", nil, "Template parameter as KEY=VALUE, may be repeated")
+	cmd.Flags().StringVar(&format, "format", query.FormatTable, "Output format: "+strings.Join(query.Formats, ", "))
+	cmd.Flags().StringVarP(&out, "out", "o", "", "Write the results to this file instead of stdout (required for parquet)")
+	return cmd
+}
@@ -1,78 +1,310 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"log/slog"
 
 	"github.com/joho/godotenv"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/logger"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/notify"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/scheduler"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
 	"github.com/spf13/cobra"
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "etl",
 	Short: "etl cli for different etl tasks",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateReportFormat()
+	},
 }
 
+// timeout is the maximum duration of a command, set with the global --timeout flag.
+var timeout time.Duration
+
+// reportFormat and reportFile set how the report of a pipeline run is output, with the
+// global --report-format and --report-file flags.
+var (
+	reportFormat string
+	reportFile   string
+)
+
+// configFile, configEnv and configSet set where the configuration is loaded from, with the global
+// --config, --env and --set flags; see configOptions.
+var (
+	configFile string
+	configEnv  string
+	configSet  []string
+)
+
+// exitCodeInterrupted is the exit code when a command is stopped by SIGINT/SIGTERM.
+const exitCodeInterrupted = 130
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	// The first SIGINT/SIGTERM cancels the context, letting the current batch finish.
+	// After that the default behaviour is restored, so a second signal kills the process.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		fmt.Fprintf(os.Stderr, "Received %s, finishing current batch. Send it again to force quit.\n", sig)
+		cancel()
+	}()
+
+	// Errors are printed here rather than by cobra, so secrets are redacted from them
+	rootCmd.SilenceErrors = true
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", secrets.Redact(err.Error()))
+		if errors.Is(err, pipeline.ErrInterrupted) && errors.Is(err, context.Canceled) {
+			os.Exit(exitCodeInterrupted)
+		}
 		os.Exit(1)
 	}
 }
 
+// commandContext returns the context of the command, bounded by the --timeout flag if set.
+func commandContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(cmd.Context(), timeout)
+	}
+	return context.WithCancel(cmd.Context())
+}
+
 func init() {
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Maximum duration of the command, e.g. 30m (0 means no timeout)")
+	rootCmd.PersistentFlags().StringVar(&reportFormat, "report-format", "table", "Format of the end-of-run report: table or json")
+	rootCmd.PersistentFlags().StringVar(&reportFile, "report-file", "", "Also write the end-of-run report to this file")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Base config file, with the environment config files next to it (default config.base.yaml)")
+	rootCmd.PersistentFlags().StringVar(&configEnv, "env", "", "Environment whose config file is merged into the base config (default $APP_ENV)")
+	rootCmd.PersistentFlags().StringArrayVar(&configSet, "set", nil, "Override a config key, e.g. --set duckdb.path=md:prod, taking precedence over files and ETL_ variables")
 	rootCmd.AddCommand(endOfDayCmd)
 	rootCmd.AddCommand(fundamentalsCmd)
+	rootCmd.AddCommand(failuresCmd)
+	rootCmd.AddCommand(newServeCmd())
+	rootCmd.AddCommand(newPromoteCmd())
+	rootCmd.AddCommand(dbCmd)
+	rootCmd.AddCommand(tickersCmd)
+	rootCmd.AddCommand(newQueryCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newDoctorCmd())
+	rootCmd.AddCommand(configCmd)
 	endOfDayCmd.AddCommand(newDailyCmd())
 	endOfDayCmd.AddCommand(newBackfillCmd())
+	dbCmd.AddCommand(newDBSnapshotCmd())
+	dbCmd.AddCommand(newDBRestoreCmd())
+	dbCmd.AddCommand(newDBListCmd())
+	dbCmd.AddCommand(newDBPruneCmd())
+	tickersCmd.AddCommand(newTickersHistoryCmd())
+	configCmd.AddCommand(newConfigValidateCmd())
+	configCmd.AddCommand(newConfigShowCmd())
+}
+
+// pushMetrics records the completion of a batch command and pushes its metrics to the
+// Pushgateway, if configured. Failing to push is logged, but does not fail the command.
+func pushMetrics(cmd *cobra.Command, cfg *config.Config, log *slog.Logger, err error) {
+	command := commandName(cmd)
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	metrics.RunLastCompletion.WithLabelValues(outcome).SetToCurrentTime()
+
+	if cfg.Metrics.PushgatewayURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	grouping := map[string]string{"command": command, "env": cfg.Env}
+	if err := metrics.Push(ctx, cfg.Metrics.PushgatewayURL, cfg.Metrics.Job, grouping); err != nil {
+		log.Warn(fmt.Sprintf("Error pushing metrics: %v", err))
+	}
+}
+
+// notifyRun notifies the configured targets of the outcome of a batch command. It opens its own
+// connection to DuckDB for de-duplication, so failures to create the pipeline are notified too.
+// Failing to notify is logged, but does not fail the command.
+func notifyRun(cmd *cobra.Command, cfg *config.Config, log *slog.Logger, report *pipeline.Report, err error) {
+	if len(cfg.Notify.Targets) == 0 {
+		return
+	}
+
+	db, dbErr := load.NewDuckDB(cfg, log)
+	if dbErr != nil {
+		log.Warn(fmt.Sprintf("Error opening DuckDB, notifying without de-duplication: %v", dbErr))
+		db = nil
+	} else {
+		defer db.Close()
+	}
+
+	notifier, nErr := notify.New(cfg.Notify, db, log)
+	if nErr != nil {
+		log.Warn(fmt.Sprintf("Error creating notifier: %v", nErr))
+		return
+	}
+
+	event := notify.RunEvent(commandName(cmd), report, err)
+	event.Env = cfg.Env
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if nErr := notifier.Notify(ctx, event); nErr != nil {
+		log.Warn(fmt.Sprintf("Error sending notifications: %v", nErr))
+	}
 }
 
 func isRunningOnGitHubActions() bool {
 	return os.Getenv("GITHUB_ACTIONS") == "true"
 }
 
+// loadDotEnv loads the .env file into the environment, except on GitHub Actions. A missing .env
+// file is not an error, since the secrets may come from other providers; see secrets.New.
+func loadDotEnv() error {
+	if isRunningOnGitHubActions() {
+		return nil
+	}
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error loading .env file: %w", err)
+	}
+	return nil
+}
+
 func initializeConfigAndLogger() (*config.Config, *slog.Logger, error) {
 	log := logger.NewLogger()
-	if !isRunningOnGitHubActions() {
-		err := godotenv.Load()
-		if err != nil {
-			log.Error("Error loading .env file")
-			return nil, nil, err
-		}
+	if err := loadDotEnv(); err != nil {
+		log.Error(err.Error())
+		return nil, nil, err
 	}
 
-	// 1. Open the base configuration file
-	baseConfigFile, err := os.Open("config.base.yaml") // Update with your base config file path
+	opts, err := configOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, _, err := config.Load(opts)
+	if err == nil {
+		err = cfg.ValidateFiles()
+	}
 	if err != nil {
-		log.Error(fmt.Sprintf("Error opening base config file: %v", err))
+		log.Error(fmt.Sprintf("Error reading config: %v", err))
 		return nil, nil, err
 	}
-	defer baseConfigFile.Close()
 
-	// 2. Prepare environment-specific config reader (if needed)
-	env := os.Getenv("APP_ENV")
-	var envConfigFile *os.File
-	envConfigFilename := fmt.Sprintf("config.%s.yaml", env)
-	if _, err := os.Stat(envConfigFilename); err == nil {
-		// Environment-specific config file exists
-		envConfigFile, err = os.Open(envConfigFilename)
+	return cfg, log, nil
+}
+
+// configOptions returns where the configuration is loaded from, as set with the --config, --env
+// and --set flags.
+func configOptions() (config.Options, error) {
+	set, err := config.ParseSet(configSet)
+	if err != nil {
+		return config.Options{}, err
+	}
+	return config.Options{File: configFile, Env: configEnv, Set: set}, nil
+}
+
+// commandName returns the path of the command without the root, e.g. eod_daily.
+func commandName(cmd *cobra.Command) string {
+	return strings.ReplaceAll(strings.TrimPrefix(cmd.CommandPath(), rootCmd.Name()+" "), " ", "_")
+}
+
+// startTracing exports the spans of a command to the configured OTLP collector, under a root
+// span attributed with a new run id. The returned function ends the root span and flushes
+// the spans. Failing to set up or flush tracing is logged, but does not fail the command.
+func startTracing(ctx context.Context, cmd *cobra.Command, cfg *config.Config, log *slog.Logger) (context.Context, func(err error)) {
+	// The run id is set even without tracing, since the report of the run is saved under it
+	ctx = tracing.WithRunID(ctx, scheduler.NewRunID())
+	shutdown, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error setting up tracing: %v", err))
+		return ctx, func(error) {}
+	}
+
+	command := commandName(cmd)
+	ctx, span := tracing.Start(ctx, command, tracing.CommandKey.String(command))
+	return ctx, func(err error) {
+		tracing.End(span, err)
+		flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdown(flushCtx); err != nil {
+			log.Warn(fmt.Sprintf("Error flushing spans: %v", err))
+		}
+	}
+}
+
+// writeReport prints the report of a pipeline run to stdout in the --report-format, writes
+// it to the --report-file if set, and persists it in run_reports. Failing to output the
+// report is logged, but does not fail the command.
+func writeReport(ctx context.Context, cmd *cobra.Command, p *pipeline.Pipeline, report *pipeline.Report, log *slog.Logger) {
+	if report == nil {
+		return
+	}
+	report.Command = commandName(cmd)
+
+	write := report.WriteTable
+	if reportFormat == "json" {
+		write = report.WriteJSON
+	}
+	if err := write(cmd.OutOrStdout()); err != nil {
+		log.Warn(fmt.Sprintf("Error printing report: %v", err))
+	}
+
+	if reportFile != "" {
+		f, err := os.Create(reportFile)
 		if err != nil {
-			log.Error(fmt.Sprintf("Error opening environment config file: %v", err))
-			return nil, nil, err
+			log.Warn(fmt.Sprintf("Error creating report file: %v", err))
+		} else {
+			if err := write(f); err != nil {
+				log.Warn(fmt.Sprintf("Error writing report file: %v", err))
+			}
+			f.Close()
+		}
+	}
+
+	// In GitHub Actions, later steps can skip transformations when no data changed
+	if output := os.Getenv("GITHUB_OUTPUT"); output != "" {
+		if err := appendStepOutput(output, "data_changed", strconv.FormatBool(report.DataChanged)); err != nil {
+			log.Warn(fmt.Sprintf("Error writing step output: %v", err))
 		}
-		defer envConfigFile.Close()
 	}
 
-	// 3. Create the config
-	cfg, err := config.NewConfig(baseConfigFile, envConfigFile, env)
+	if err := p.SaveReport(context.WithoutCancel(ctx), report); err != nil {
+		log.Warn(fmt.Sprintf("Error saving report: %v", err))
+	}
+}
+
+// appendStepOutput appends name=value to the GitHub Actions step output file at path.
+func appendStepOutput(path, name, value string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error reading config: %v", err))
-		return nil, nil, err
+		return err
 	}
+	if _, err := fmt.Fprintf(f, "%s=%s\n", name, value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	return cfg, log, nil
+// validateReportFormat checks the --report-format flag.
+func validateReportFormat() error {
+	if reportFormat != "table" && reportFormat != "json" {
+		return fmt.Errorf("--report-format must be table or json, got %q", reportFormat)
+	}
+	return nil
 }
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/scheduler"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/server"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/utils"
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "serve",
+		Short: "Runs the jobs configured under `serve` on their cron schedules, with an HTTP status and control API",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, utils.RealTimeProvider{})
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					log.Warn(fmt.Sprintf("Error flushing spans: %v", err))
+				}
+			}()
+
+			sched, err := scheduler.New(cfg.Serve, pipeline.DuckDB, scheduler.PipelineTasks(pipeline), log)
+			if err != nil {
+				return fmt.Errorf("error creating scheduler: %w", err)
+			}
+			if err := sched.Start(ctx); err != nil {
+				return fmt.Errorf("error starting scheduler: %w", err)
+			}
+			log.Info(fmt.Sprintf("Scheduler started with %d jobs", len(cfg.Serve.Jobs)))
+
+			var httpServer *http.Server
+			if cfg.Serve.Listen != "" {
+				token, err := apiToken(ctx, cfg.Secrets)
+				if err != nil {
+					return err
+				}
+				if err := server.CheckListen(cfg.Serve.Listen, token); err != nil {
+					return fmt.Errorf("error starting HTTP API: %w", err)
+				}
+				httpServer = &http.Server{
+					Addr:              cfg.Serve.Listen,
+					Handler:           server.New(pipeline, sched, token, log).Handler(),
+					ReadHeaderTimeout: 10 * time.Second,
+				}
+				go func() {
+					if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						log.Error(fmt.Sprintf("Error serving HTTP API: %v", err))
+						cancel()
+					}
+				}()
+				log.Info(fmt.Sprintf("HTTP API listening on %s", cfg.Serve.Listen))
+			}
+
+			<-ctx.Done()
+			if httpServer != nil {
+				shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancelShutdown()
+				if err := httpServer.Shutdown(shutdownCtx); err != nil {
+					log.Error(fmt.Sprintf("Error shutting down HTTP API: %v", err))
+				}
+			}
+			log.Info("Stopping scheduler, waiting for running jobs to finish their current batch")
+			sched.Stop()
+			return nil
+		},
+	}
+}
+
+// apiToken reads the token required by the POST endpoints of the API, which is empty if not set.
+func apiToken(ctx context.Context, cfg config.SecretsConfig) (string, error) {
+	provider, err := secrets.New(cfg)
+	if err != nil {
+		return "", fmt.Errorf("error creating secrets provider: %w", err)
+	}
+	token, err := provider.Secret(ctx, "ETL_API_TOKEN")
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		return "", err
+	}
+	return token, nil
+}
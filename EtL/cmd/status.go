@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/logger"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/spf13/cobra"
+)
+
+// statusColors are the ANSI colors of the freshness statuses.
+var statusColors = map[string]string{
+	pipeline.FreshnessOK:    "\033[32m",
+	pipeline.FreshnessWarn:  "\033[33m",
+	pipeline.FreshnessStale: "\033[31m",
+}
+
+func newStatusCmd() *cobra.Command {
+	var (
+		format  string
+		noColor bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "status [--format table|json]",
+		Short: "Shows how up to date each table is, relative to the trading calendar",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "table" && format != "json" {
+				return fmt.Errorf("invalid --format %q, must be table or json", format)
+			}
+
+			cfg, _, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+			// Log to stderr, so the logs do not mix with the status
+			log := logger.New(cmd.ErrOrStderr())
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			freshness, err := pipeline.Freshness(ctx)
+			if err != nil {
+				return fmt.Errorf("error getting freshness: %w", err)
+			}
+
+			out := cmd.OutOrStdout()
+			if format == "json" {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(freshness)
+			}
+
+			color := !noColor && useColor(out)
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TABLE\tMAX DATE\tROWS\tTICKERS\tCOVERAGE\tBEHIND\tSTATUS")
+			for _, f := range freshness {
+				coverage, behind := "-", "-"
+				if f.Coverage != nil {
+					coverage = fmt.Sprintf("%.1f%%", *f.Coverage)
+				}
+				if f.StaleDays != nil {
+					behind = fmt.Sprintf("%d", *f.StaleDays)
+				}
+				// The status is the last column, so its color codes do not misalign the others
+				status := f.Status
+				if color {
+					status = statusColors[f.Status] + status + "\033[0m"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+					f.Table, dash(f.MaxDate), f.Rows, f.Tickers, coverage, behind, status)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "table", "Output format: table or json")
+	cmd.Flags().BoolVar(&noColor, "no-color", false, "Do not color the status, which is only colored on a terminal")
+	return cmd
+}
+
+// useColor reports whether w is a terminal and NO_COLOR is not set.
+func useColor(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
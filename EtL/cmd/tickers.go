@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/spf13/cobra"
+)
+
+var tickersCmd = &cobra.Command{
+	Use:   "tickers",
+	Short: "Inspect the tickers supported by Tiingo",
+}
+
+func newTickersHistoryCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "history TICKER",
+		Short: "Shows how the listing of a ticker in supported_tickers changed over time",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, log, err := initializeConfigAndLogger()
+			if err != nil {
+				return err
+			}
+
+			pipeline, err := pipeline.NewPipeline(cfg, log, nil)
+			if err != nil {
+				return fmt.Errorf("error creating pipeline: %w", err)
+			}
+			defer pipeline.Close()
+
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+
+			versions, err := pipeline.TickerHistory(ctx, args[0])
+			if err != nil {
+				return fmt.Errorf("error getting ticker history: %w", err)
+			}
+			if len(versions) == 0 {
+				return fmt.Errorf("ticker %s is not in supported_tickers_history", args[0])
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TICKER\tEXCHANGE\tASSET TYPE\tCURRENCY\tSTART DATE\tEND DATE\tFIRST SEEN\tLAST SEEN\tCURRENT")
+			for _, v := range versions {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+					v.Ticker, v.Exchange, v.AssetType, v.PriceCurrency, dash(v.StartDate), dash(v.EndDate),
+					v.FirstSeen.Format(time.RFC3339), v.LastSeen.Format(time.RFC3339), v.Current)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// dash returns s, or "-" if it is empty.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
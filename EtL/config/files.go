@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BaseFile is the name of the base configuration file.
+const BaseFile = "config.base.yaml"
+
+// EnvFile returns the name of the configuration file of the environment, which overrides the base
+// configuration.
+func EnvFile(env string) string {
+	return fmt.Sprintf("config.%s.yaml", env)
+}
+
+// Options are where Load loads the configuration from, besides the ETL_ environment variables.
+type Options struct {
+	// File is the base configuration file. Defaults to config.base.yaml in the working directory.
+	File string
+	// Env is the environment, whose configuration file next to File is merged into the base
+	// configuration if it exists. Defaults to APP_ENV.
+	Env string
+	// Set overrides the values of single keys, e.g. duckdb.path=md:prod; see ParseSet.
+	Set map[string]string
+}
+
+// Load loads the base configuration file, merged with the configuration file of the environment
+// and overridden by the ETL_ environment variables and opts.Set. It returns the configuration and
+// the paths of the files loaded.
+func Load(opts Options) (*Config, []string, error) {
+	basePath := opts.File
+	if basePath == "" {
+		basePath = BaseFile
+	}
+	env := opts.Env
+	if env == "" {
+		env = os.Getenv("APP_ENV")
+	}
+
+	baseFile, err := os.Open(basePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening base config file: %w", err)
+	}
+	defer baseFile.Close()
+	files := []string{basePath}
+
+	var envReader io.Reader
+	if env != "" {
+		envPath := filepath.Join(filepath.Dir(basePath), EnvFile(env))
+		envFile, err := os.Open(envPath)
+		switch {
+		case err == nil:
+			defer envFile.Close()
+			envReader = envFile
+			files = append(files, envPath)
+		case !os.IsNotExist(err):
+			return nil, nil, fmt.Errorf("error opening environment config file: %w", err)
+		}
+	}
+
+	cfg, err := newConfig(baseFile, envReader, env, opts.Set)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, files, nil
+}
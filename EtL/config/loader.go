@@ -3,32 +3,190 @@ package config
 import (
 	"fmt"
 	"io"
-	"log"
+	"maps"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Extract ExtractConfig
-	DuckDB  DuckDBConfig
-	Tiingo  TiingoConfig
-	Env     string
+	Extract  ExtractConfig
+	Failures FailuresConfig
+	Serve    ServeConfig
+	Metrics  MetricsConfig
+	Tracing  TracingConfig
+	Notify   NotifyConfig
+	Promote  PromoteConfig
+	Snapshot SnapshotConfig
+	Secrets  SecretsConfig
+	DuckDB   DuckDBConfig
+	Tiingo   TiingoConfig
+	Env      string
 }
 
 type ExtractConfig struct {
 	Backoff BackoffConfig
+	Quota   QuotaConfig
+	// SpoolDir is the directory downloads are written to before they are loaded.
+	// Empty means the default directory for temporary files.
+	SpoolDir string `mapstructure:"spool_dir"`
+	// CacheDir is the directory of downloads cached between runs. Empty disables the cache.
+	CacheDir string `mapstructure:"cache_dir"`
+	// SupportedTickersMaxAge is how long a refresh of supported_tickers is reused within a
+	// process. Zero reuses it for the lifetime of the process.
+	SupportedTickersMaxAge time.Duration `mapstructure:"supported_tickers_max_age"`
 }
 
 type BackoffConfig struct {
 	RetryWaitMin time.Duration `mapstructure:"retry_wait_min"`
 	RetryWaitMax time.Duration `mapstructure:"retry_wait_max"`
 	RetryMax     int           `mapstructure:"retry_max"`
+	// RetryAfterMax is the longest Retry-After of a 429 response that is waited out before
+	// retrying. Longer waits fail the request immediately. Zero means no limit.
+	RetryAfterMax time.Duration `mapstructure:"retry_after_max"`
+}
+
+// QuotaConfig holds the limits of the Tiingo plan, used when reporting quota usage.
+// Zero means unknown.
+type QuotaConfig struct {
+	RequestsPerHour int   `mapstructure:"requests_per_hour"`
+	RequestsPerDay  int   `mapstructure:"requests_per_day"`
+	BytesPerMonth   int64 `mapstructure:"bytes_per_month"`
+}
+
+// FailuresConfig controls when tickers recorded in the failed_tickers table are skipped.
+// A ticker is skipped when it has failed MaxAttempts times in a row and its last failure
+// happened less than Cooldown ago. MaxAttempts = 0 disables skipping.
+type FailuresConfig struct {
+	MaxAttempts int           `mapstructure:"max_attempts"`
+	Cooldown    time.Duration `mapstructure:"cooldown"`
+}
+
+// ServeConfig configures the jobs run on cron schedules by `etl serve`.
+type ServeConfig struct {
+	// Timezone of the cron schedules, e.g. UTC or Europe/Oslo. Defaults to UTC.
+	Timezone string `mapstructure:"timezone"`
+	// CatchUpWindow is how far back missed runs are caught up on startup. Zero disables catch-up.
+	CatchUpWindow time.Duration `mapstructure:"catch_up_window"`
+	// Listen is the address of the HTTP status and control API, e.g. :8080. Empty disables it.
+	// Other than loopback addresses require the ETL_API_TOKEN secret; see server.CheckListen.
+	Listen string      `mapstructure:"listen"`
+	Jobs   []JobConfig `mapstructure:"jobs"`
+}
+
+// JobConfig is a task run on a cron schedule by `etl serve`.
+type JobConfig struct {
+	Name     string `mapstructure:"name"`
+	Schedule string `mapstructure:"schedule"`
+	// Task is one of eod_daily, fundamentals_daily, fundamentals_statements and fundamentals_metadata.
+	Task string `mapstructure:"task"`
+	// OnlyIfFailed is the name of another job. If set, the job only runs when the latest
+	// run of that job did not succeed, e.g. because its data failed validation.
+	OnlyIfFailed string `mapstructure:"only_if_failed"`
+	// BatchSize, Lookback and HalfOnly are passed on to the fundamentals tasks.
+	BatchSize int  `mapstructure:"batch_size"`
+	Lookback  int  `mapstructure:"lookback"`
+	HalfOnly  bool `mapstructure:"half_only"`
+}
+
+// MetricsConfig configures pushing Prometheus metrics at the end of batch commands.
+type MetricsConfig struct {
+	// PushgatewayURL is the Pushgateway metrics are pushed to. Empty disables pushing.
+	PushgatewayURL string `mapstructure:"pushgateway_url"`
+	// Job is the job label of the pushed metrics.
+	Job string `mapstructure:"job"`
+}
+
+// TracingConfig configures exporting OpenTelemetry traces over OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g. http://localhost:4318, with /v1/traces
+	// appended if it has no path. Empty disables tracing.
+	Endpoint string `mapstructure:"endpoint"`
+	// ServiceName is the service.name resource attribute of the spans.
+	ServiceName string `mapstructure:"service_name"`
+}
+
+// NotifyConfig configures the notifications the batch commands send about their runs.
+type NotifyConfig struct {
+	// DedupWindow is how long a notification is not sent again to the same target. Zero disables de-duplication.
+	DedupWindow time.Duration  `mapstructure:"dedup_window"`
+	Targets     []NotifyTarget `mapstructure:"targets"`
+}
+
+// NotifyTarget is a webhook, Slack channel or email recipients notifications are sent to.
+type NotifyTarget struct {
+	Name string `mapstructure:"name"`
+	// Type is one of webhook, slack and email.
+	Type string `mapstructure:"type"`
+	// MinSeverity is the lowest severity sent to the target: info, warning or error. Defaults to warning.
+	MinSeverity string `mapstructure:"min_severity"`
+	// URL is the URL of a webhook or Slack incoming webhook.
+	URL string `mapstructure:"url"`
+	// Template is a text/template rendering the JSON body of a webhook. Defaults to the event as JSON.
+	Template string            `mapstructure:"template"`
+	Headers  map[string]string `mapstructure:"headers"`
+	// SMTP server and addresses of an email target. No authentication is used if Username is empty.
+	SMTPHost string   `mapstructure:"smtp_host"`
+	SMTPPort int      `mapstructure:"smtp_port"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+}
+
+// PromoteConfig configures `etl promote`, which merges validated rows from the source into the target database.
+type PromoteConfig struct {
+	// Source and Target are DuckDB paths, e.g. md:stage and md:prod.
+	Source string `mapstructure:"source"`
+	Target string `mapstructure:"target"`
+	// Tables are promoted if the --tables flag is not set.
+	Tables []string `mapstructure:"tables"`
+}
+
+// SnapshotConfig configures `etl db snapshot`.
+type SnapshotConfig struct {
+	// Dir is the directory snapshots are created in, one subdirectory per snapshot.
+	Dir string `mapstructure:"dir"`
+	// Keep is the number of snapshots kept when pruning. Zero keeps all snapshots.
+	Keep int `mapstructure:"keep"`
+}
+
+// SecretsConfig configures where the tokens, e.g. TIINGO_TOKEN and MOTHERDUCK_TOKEN, are read from.
+type SecretsConfig struct {
+	// Providers are tried in order until one has the secret: env, file, dotenv and vault.
+	// Defaults to env.
+	Providers []string `mapstructure:"providers"`
+	// Dir is the directory of the file provider, with a file per secret named like the secret in
+	// upper or lower case, e.g. /run/secrets/tiingo_token.
+	Dir string `mapstructure:"dir"`
+	// DotEnv is the .env file of the dotenv provider. Defaults to .env.
+	DotEnv string      `mapstructure:"dotenv"`
+	Vault  VaultConfig `mapstructure:"vault"`
+}
+
+// VaultConfig configures the vault provider, which reads the secrets from a HashiCorp Vault KV
+// version 2 secrets engine. The Vault token is read from VAULT_TOKEN.
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200. Defaults to VAULT_ADDR.
+	Address string `mapstructure:"address"`
+	// Mount is the path the secrets engine is mounted at. Defaults to secret.
+	Mount string `mapstructure:"mount"`
+	// Path of the secret in the secrets engine, with a key per secret, e.g. etl/prod.
+	Path string `mapstructure:"path"`
 }
 
 type DuckDBConfig struct {
-	Path              string   `mapstructure:"path"`
+	Path string `mapstructure:"path"`
+	// ConnInitFnQueries are the SQL files run whenever a connection is opened. Names, e.g.
+	// schemas.sql, are the files of SQLDir, and paths, e.g. ./init.sql, are files on disk.
 	ConnInitFnQueries []string `mapstructure:"conn_init_fn_queries"`
+	// SQLDir is the directory the SQL files are read from instead of the files embedded in the
+	// binary, e.g. ./sql when developing the queries. Empty means the embedded files.
+	SQLDir string `mapstructure:"sql_dir"`
+	// ChangedKeysLimit is the maximum number of changed keys reported per upsert. Zero reports none.
+	ChangedKeysLimit int `mapstructure:"changed_keys_limit"`
 }
 
 type TiingoConfig struct {
@@ -49,34 +207,83 @@ type TiingoAPIConfig struct {
 }
 
 // NewConfig loads the configuration from the provided base config reader
-// and merges it with the environment-specific configuration.
+// and merges it with the environment-specific configuration. ETL_ environment variables
+// override the keys of both, e.g. ETL_DUCKDB_PATH overrides duckdb.path. It fails if the merged
+// configuration has unknown keys or invalid values; see Config.Validate.
+//
+// Every call returns a new Config that shares nothing with other configs, and that is not
+// modified after it is returned. To change values, e.g. in tests, modify a Clone.
 func NewConfig(baseConfigReader io.Reader, envConfigReader io.Reader, env string) (*Config, error) {
+	return newConfig(baseConfigReader, envConfigReader, env, nil)
+}
+
+// newConfig is NewConfig with the values of single keys overridden by set. From highest to lowest
+// precedence, the values come from set, the ETL_ environment variables, the environment config
+// and the base config.
+func newConfig(baseConfigReader io.Reader, envConfigReader io.Reader, env string, set map[string]string) (*Config, error) {
 	if env == "" { // Use the provided 'env' or default to "dev"
 		env = "dev"
 	}
 
-	viper.SetConfigType("yaml")
+	// Every config has its own viper instance, so configs loaded in the same process, e.g. of
+	// the source and target of a promotion, do not overwrite each other
+	v := viper.New()
+	v.SetConfigType("yaml")
+
+	// AutomaticEnv only looks up keys viper knows of, so every key is bound to its variable,
+	// including keys that are in none of the config files
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for _, key := range Keys() {
+		if err := v.BindEnv(key, EnvVar(key)); err != nil {
+			return nil, fmt.Errorf("error binding environment variable: %w", err)
+		}
+	}
 
 	// Read the base configuration
-	if err := viper.ReadConfig(baseConfigReader); err != nil {
+	if err := v.ReadConfig(baseConfigReader); err != nil {
 		return nil, fmt.Errorf("error reading base config: %w", err)
 	}
 
 	// Merge with environment-specific configuration (only if provided)
 	if envConfigReader != nil {
-		if err := viper.MergeConfig(envConfigReader); err != nil {
-			log.Printf("Error merging environment-specific config: %s", err)
-			// Handle the error as needed (log, return error, etc.)
+		if err := v.MergeConfig(envConfigReader); err != nil {
+			return nil, fmt.Errorf("error merging environment config: %w", err)
 		}
 	}
 
+	for key, value := range set {
+		v.Set(key, value)
+	}
+
+	// Unknown keys are errors, so a misspelled key does not silently fall back to its zero value
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := v.UnmarshalExact(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct: %w", err)
 	}
 
 	// Set the environment directly
 	config.Env = env
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+
 	return &config, nil
 }
+
+// Clone returns a deep copy of the configuration, which can be modified without affecting c.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Serve.Jobs = slices.Clone(c.Serve.Jobs)
+	clone.Notify.Targets = slices.Clone(c.Notify.Targets)
+	for i, target := range clone.Notify.Targets {
+		clone.Notify.Targets[i].Headers = maps.Clone(target.Headers)
+		clone.Notify.Targets[i].To = slices.Clone(target.To)
+	}
+	clone.Promote.Tables = slices.Clone(c.Promote.Tables)
+	clone.Secrets.Providers = slices.Clone(c.Secrets.Providers)
+	clone.DuckDB.ConnInitFnQueries = slices.Clone(c.DuckDB.ConnInitFnQueries)
+	return &clone
+}
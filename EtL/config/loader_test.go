@@ -1,12 +1,13 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -101,12 +102,36 @@ tiingo:
 			},
 			wantErr: false,
 		},
+		{
+			name: "Unknown Key",
+			baseYAML: `
+duckdb:
+  path: "test.db"
+  append_table: daily_adjusted
+`,
+			wantErr: true,
+		},
+		{
+			name:     "Invalid Environment Config",
+			baseYAML: `duckdb: {path: "test.db"}`,
+			envYAML:  "duckdb: [unclosed",
+			wantErr:  true,
+		},
+		{
+			name: "Invalid Value",
+			baseYAML: `
+tiingo:
+  eod:
+    format: xml
+`,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Reset Viper for each test
-			viper.Reset()
+			// Configs are loaded with their own viper instance, so they can be loaded in parallel
+			t.Parallel()
 
 			// Create a reader for the base YAML
 			baseConfigReader := strings.NewReader(tt.baseYAML)
@@ -125,3 +150,60 @@ tiingo:
 		})
 	}
 }
+
+func TestNewConfig_Concurrent(t *testing.T) {
+	paths := []string{"md:stage", "md:prod", "stage.db", "prod.db"}
+	configs := make([]*Config, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			base := strings.NewReader("duckdb:\n  path: base.db\npromote:\n  tables: [daily_adjusted]\n")
+			env := strings.NewReader(fmt.Sprintf("duckdb:\n  path: %s\n", path))
+			configs[i], errs[i] = NewConfig(base, env, path)
+		}()
+	}
+	wg.Wait()
+
+	for i, path := range paths {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, path, configs[i].DuckDB.Path)
+		assert.Equal(t, path, configs[i].Env)
+	}
+	// The configs share no values
+	configs[0].Promote.Tables[0] = "fundamentals.daily"
+	assert.Equal(t, []string{"daily_adjusted"}, configs[1].Promote.Tables)
+}
+
+func TestConfig_Clone(t *testing.T) {
+	c := &Config{
+		Notify: NotifyConfig{Targets: []NotifyTarget{{
+			Name:    "ops",
+			Headers: map[string]string{"X-Env": "prod"},
+			To:      []string{"ops@example.com"},
+		}}},
+		Serve:   ServeConfig{Jobs: []JobConfig{{Name: "eod-daily"}}},
+		Promote: PromoteConfig{Tables: []string{"daily_adjusted"}},
+		DuckDB:  DuckDBConfig{Path: "md:prod", ConnInitFnQueries: []string{"./sql/schemas.sql"}},
+	}
+
+	clone := c.Clone()
+	assert.Equal(t, c, clone)
+
+	clone.Notify.Targets[0].Headers["X-Env"] = "stage"
+	clone.Notify.Targets[0].To[0] = "dev@example.com"
+	clone.Serve.Jobs[0].Name = "eod-daily-rerun"
+	clone.Promote.Tables[0] = "fundamentals.daily"
+	clone.DuckDB.ConnInitFnQueries[0] = "./sql/other.sql"
+	clone.DuckDB.Path = "md:stage"
+
+	assert.Equal(t, "prod", c.Notify.Targets[0].Headers["X-Env"])
+	assert.Equal(t, "ops@example.com", c.Notify.Targets[0].To[0])
+	assert.Equal(t, "eod-daily", c.Serve.Jobs[0].Name)
+	assert.Equal(t, []string{"daily_adjusted"}, c.Promote.Tables)
+	assert.Equal(t, []string{"./sql/schemas.sql"}, c.DuckDB.ConnInitFnQueries)
+	assert.Equal(t, "md:prod", c.DuckDB.Path)
+}
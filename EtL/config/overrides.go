@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding keys of the config files, e.g.
+// ETL_DUCKDB_PATH overrides duckdb.path.
+const EnvPrefix = "ETL"
+
+// Keys returns the keys of the configuration that hold a value, e.g. tiingo.eod.start_date, in the
+// order of the config structs. Env is not a key, since it is set with APP_ENV or --env.
+func Keys() []string {
+	var keys []string
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if prefix == "" && field.Name == "Env" {
+				continue
+			}
+			key := prefix + fieldKey(field)
+			if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(field.Type, key+".")
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+// fieldKey returns the key of a field of the config structs in the config files.
+func fieldKey(field reflect.StructField) string {
+	if key := field.Tag.Get("mapstructure"); key != "" {
+		return key
+	}
+	return strings.ToLower(field.Name)
+}
+
+// EnvVar returns the environment variable overriding key, e.g. ETL_TIINGO_EOD_START_DATE for
+// tiingo.eod.start_date.
+func EnvVar(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// EnvOverrides returns the environment variables that are set and override a key.
+func EnvOverrides() []string {
+	var vars []string
+	for _, key := range Keys() {
+		if os.Getenv(EnvVar(key)) != "" {
+			vars = append(vars, EnvVar(key))
+		}
+	}
+	return vars
+}
+
+// ParseSet parses key=value overrides, e.g. from --set flags. Lists are comma-separated, e.g.
+// promote.tables=daily_adjusted,fundamentals.daily.
+func ParseSet(overrides []string) (map[string]string, error) {
+	keys := Keys()
+	set := make(map[string]string, len(overrides))
+	for _, o := range overrides {
+		key, value, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid override %q, must be key=value", o)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !slices.Contains(keys, key) {
+			return nil, fmt.Errorf("invalid override %q, unknown key %s", o, key)
+		}
+		set[key] = value
+	}
+	return set, nil
+}
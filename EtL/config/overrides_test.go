@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeys(t *testing.T) {
+	keys := Keys()
+	assert.Contains(t, keys, "extract.backoff.retry_wait_min")
+	assert.Contains(t, keys, "serve.jobs")
+	assert.Contains(t, keys, "tiingo.fundamentals.daily.start_date")
+	assert.NotContains(t, keys, "env")
+	assert.NotContains(t, keys, "extract.backoff")
+	assert.Equal(t, "ETL_TIINGO_EOD_START_DATE", EnvVar("tiingo.eod.start_date"))
+}
+
+func TestParseSet(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []string
+		want      map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "valid",
+			overrides: []string{"duckdb.path=md:prod", "Promote.Tables=daily_adjusted,fundamentals.daily", "metrics.job="},
+			want: map[string]string{
+				"duckdb.path":    "md:prod",
+				"promote.tables": "daily_adjusted,fundamentals.daily",
+				"metrics.job":    "",
+			},
+		},
+		{
+			name:      "missing value",
+			overrides: []string{"duckdb.path"},
+			wantErr:   `invalid override "duckdb.path", must be key=value`,
+		},
+		{
+			name:      "unknown key",
+			overrides: []string{"duckdb.append_table=daily_adjusted"},
+			wantErr:   "unknown key duckdb.append_table",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSet(tt.overrides)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, BaseFile)
+	files := map[string]string{
+		base:                              "duckdb:\n  path: base.db\npromote:\n  source: md:stage\n  target: md:base\nmetrics:\n  job: etl\n",
+		filepath.Join(dir, EnvFile("ci")): "duckdb:\n  path: ci.db\npromote:\n  target: md:ci\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	t.Run("precedence", func(t *testing.T) {
+		t.Setenv("APP_ENV", "")
+		t.Setenv("ETL_PROMOTE_TARGET", "md:env")
+		t.Setenv("ETL_DUCKDB_PATH", "env.db")
+		// Keys that are in no config file are overridden too
+		t.Setenv("ETL_EXTRACT_BACKOFF_RETRY_MAX", "7")
+		t.Setenv("ETL_PROMOTE_TABLES", "daily_adjusted,fundamentals.daily")
+
+		cfg, loaded, err := Load(Options{File: base, Env: "ci", Set: map[string]string{"duckdb.path": "set.db"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{base, filepath.Join(dir, "config.ci.yaml")}, loaded)
+		assert.Equal(t, "ci", cfg.Env)
+		assert.Equal(t, "set.db", cfg.DuckDB.Path)
+		assert.Equal(t, "md:env", cfg.Promote.Target)
+		assert.Equal(t, "md:stage", cfg.Promote.Source)
+		assert.Equal(t, []string{"daily_adjusted", "fundamentals.daily"}, cfg.Promote.Tables)
+		assert.Equal(t, 7, cfg.Extract.Backoff.RetryMax)
+		assert.Equal(t, "etl", cfg.Metrics.Job)
+		assert.Equal(t, []string{"ETL_EXTRACT_BACKOFF_RETRY_MAX", "ETL_PROMOTE_TARGET", "ETL_PROMOTE_TABLES", "ETL_DUCKDB_PATH"}, EnvOverrides())
+	})
+
+	t.Run("environment from APP_ENV", func(t *testing.T) {
+		t.Setenv("APP_ENV", "ci")
+
+		cfg, _, err := Load(Options{File: base})
+		assert.NoError(t, err)
+		assert.Equal(t, "ci.db", cfg.DuckDB.Path)
+	})
+
+	t.Run("invalid override", func(t *testing.T) {
+		_, _, err := Load(Options{File: base, Set: map[string]string{"extract.backoff.retry_max": "many"}})
+		assert.ErrorContains(t, err, "retry_max")
+	})
+}
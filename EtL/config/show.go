@@ -0,0 +1,168 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	sqlfiles "github.com/rasnes/tiingo-duckdb-framework/EtL/sql"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in the YAML of a configuration.
+const redacted = "[redacted]"
+
+// secretKeys are the keys whose values are redacted in the YAML of a configuration.
+var secretKeys = []string{"password", "headers"}
+
+// Resolved returns a copy of the configuration with the values as the pipelines use them: start
+// dates resolved relative to now, paths made absolute, and defaults filled in.
+func (c *Config) Resolved(now time.Time) (*Config, error) {
+	r := c.Clone()
+	for _, api := range []*TiingoAPIConfig{
+		&r.Tiingo.Eod,
+		&r.Tiingo.Fundamentals.Daily,
+		&r.Tiingo.Fundamentals.Statements,
+		&r.Tiingo.Fundamentals.Meta,
+	} {
+		if api.StartDate == "" {
+			continue
+		}
+		startDate, err := ResolveStartDate(api.StartDate, now)
+		if err != nil {
+			return nil, err
+		}
+		api.StartDate = startDate
+	}
+
+	if r.Extract.SpoolDir == "" {
+		r.Extract.SpoolDir = os.TempDir()
+	}
+	if r.Serve.Timezone == "" {
+		r.Serve.Timezone = "UTC"
+	}
+
+	var err error
+	for _, path := range []*string{&r.Extract.SpoolDir, &r.Extract.CacheDir, &r.Snapshot.Dir, &r.DuckDB.SQLDir} {
+		if *path, err = absPath(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range []*string{&r.DuckDB.Path, &r.Promote.Source, &r.Promote.Target} {
+		if *path, err = absDBPath(*path); err != nil {
+			return nil, err
+		}
+	}
+	for i, path := range r.DuckDB.ConnInitFnQueries {
+		// Names of SQL files are not relative to the working directory
+		if !sqlfiles.IsPath(path) {
+			continue
+		}
+		if r.DuckDB.ConnInitFnQueries[i], err = absPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// absPath returns path relative to the working directory as an absolute path. Empty paths stay empty.
+func absPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %w", path, err)
+	}
+	return abs, nil
+}
+
+// absDBPath returns the path of a local DuckDB database as an absolute path. MotherDuck and
+// in-memory databases are returned as is.
+func absDBPath(path string) (string, error) {
+	if path == ":memory:" || strings.HasPrefix(path, "md:") {
+		return path, nil
+	}
+	return absPath(path)
+}
+
+// YAML returns the configuration as YAML, with the keys in the order of the config structs and
+// secrets redacted.
+func (c *Config) YAML() ([]byte, error) {
+	node, err := yamlNode(reflect.ValueOf(*c), false)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// yamlNode converts a value of the configuration into a YAML node, redacting it if secret is set.
+func yamlNode(v reflect.Value, secret bool) (*yaml.Node, error) {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return scalarNode(d.String())
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		for i := 0; i < v.NumField(); i++ {
+			key := fieldKey(v.Type().Field(i))
+			value, err := yamlNode(v.Field(i), slices.Contains(secretKeys, key))
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+		}
+		return node, nil
+	case reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			item, err := yamlNode(v.Index(i), secret)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	case reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, err := yamlNode(v.MapIndex(reflect.ValueOf(k)), secret)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, value)
+		}
+		return node, nil
+	}
+
+	if secret && !v.IsZero() {
+		return scalarNode(redacted)
+	}
+	return scalarNode(v.Interface())
+}
+
+func scalarNode(v any) (*yaml.Node, error) {
+	node := &yaml.Node{}
+	if err := node.Encode(v); err != nil {
+		return nil, fmt.Errorf("error encoding %v: %w", v, err)
+	}
+	return node, nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Resolved(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	c := &Config{
+		Extract: ExtractConfig{CacheDir: ".cache"},
+		DuckDB:  DuckDBConfig{Path: "md:prod", ConnInitFnQueries: []string{"./sql/schemas.sql", "table__daily_adjusted.sql"}, SQLDir: "sql"},
+		Promote: PromoteConfig{Source: "stage.db", Target: ":memory:"},
+		Tiingo:  TiingoConfig{Eod: TiingoAPIConfig{StartDate: "today-48h"}},
+	}
+
+	r, err := c.Resolved(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-01-08", r.Tiingo.Eod.StartDate)
+	assert.Equal(t, os.TempDir(), r.Extract.SpoolDir)
+	assert.Equal(t, filepath.Join(wd, ".cache"), r.Extract.CacheDir)
+	assert.Equal(t, "", r.Snapshot.Dir)
+	assert.Equal(t, "UTC", r.Serve.Timezone)
+	assert.Equal(t, "md:prod", r.DuckDB.Path)
+	assert.Equal(t, filepath.Join(wd, "stage.db"), r.Promote.Source)
+	assert.Equal(t, ":memory:", r.Promote.Target)
+	assert.Equal(t, filepath.Join(wd, "sql"), r.DuckDB.SQLDir)
+	// Names of SQL files stay names
+	assert.Equal(t, []string{filepath.Join(wd, "sql/schemas.sql"), "table__daily_adjusted.sql"}, r.DuckDB.ConnInitFnQueries)
+	// The configuration itself is not changed
+	assert.Equal(t, "today-48h", c.Tiingo.Eod.StartDate)
+	assert.Equal(t, []string{"./sql/schemas.sql", "table__daily_adjusted.sql"}, c.DuckDB.ConnInitFnQueries)
+}
+
+func TestConfig_YAML(t *testing.T) {
+	c := &Config{
+		Extract: ExtractConfig{Backoff: BackoffConfig{RetryWaitMin: time.Second, RetryMax: 5}},
+		Notify: NotifyConfig{Targets: []NotifyTarget{{
+			Name:     "ops",
+			Type:     "email",
+			Headers:  map[string]string{"Authorization": "Bearer hunter2"},
+			Password: "hunter2",
+			To:       []string{"ops@example.com"},
+		}}},
+		DuckDB: DuckDBConfig{Path: "md:prod"},
+		Env:    "prod",
+	}
+
+	out, err := c.YAML()
+	assert.NoError(t, err)
+	s := string(out)
+	assert.Contains(t, s, "extract:\n  backoff:\n    retry_wait_min: 1s\n    retry_wait_max: 0s\n    retry_max: 5\n")
+	assert.Contains(t, s, "      password: '[redacted]'\n")
+	assert.Contains(t, s, "      headers:\n        Authorization: '[redacted]'\n")
+	assert.Contains(t, s, "      to:\n        - ops@example.com\n")
+	assert.Contains(t, s, "  path: md:prod\n")
+	assert.Contains(t, s, "env: prod\n")
+	assert.NotContains(t, s, "hunter2")
+}
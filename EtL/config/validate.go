@@ -0,0 +1,159 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+
+	sqlfiles "github.com/rasnes/tiingo-duckdb-framework/EtL/sql"
+)
+
+// SecretProviders are the providers secrets can be read from; see SecretsConfig.
+var SecretProviders = []string{"env", "file", "dotenv", "vault"}
+
+// TiingoFormats are the formats of Tiingo API responses the pipelines can load.
+var TiingoFormats = []string{"csv"}
+
+const (
+	// maxRetries and maxRetryWait bound the backoff, so a failing request cannot stall a run for hours.
+	maxRetries   = 20
+	maxRetryWait = 10 * time.Minute
+)
+
+// ParseTodayString converts a string in the format "today" or "today-<duration>" into an ISO 8601 date string.
+// The duration part supports any valid time.ParseDuration format (e.g., "24h", "7h30m", "1h30m10s").
+//
+// Examples:
+//   - "today" returns the date of now
+//   - "today-24h" returns the date before
+//   - "today-168h" returns the date 7 days before
+//   - "today-30m" returns the date of now (as it's less than a day)
+//
+// Returns:
+//   - string: ISO 8601 formatted date (YYYY-MM-DD)
+//   - error: if the input format is invalid or duration parsing fails
+func ParseTodayString(todayString string, now time.Time) (string, error) {
+	// Handle the "today" case
+	if todayString == "today" {
+		return now.Format("2006-01-02"), nil
+	}
+
+	// Split the string by "-"
+	parts := strings.Split(todayString, "-")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid today string format: %s", todayString)
+	}
+
+	if parts[0] != "today" {
+		return "", fmt.Errorf("string must start with 'today': %s", todayString)
+	}
+
+	duration, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to parse duration: %w", err)
+	}
+
+	today := now.Add(-duration)
+	return today.Format("2006-01-02"), nil
+}
+
+// ResolveStartDate returns the start date of a Tiingo API config as YYYY-MM-DD, which is either
+// a date or a "today" expression; see ParseTodayString.
+func ResolveStartDate(startDate string, now time.Time) (string, error) {
+	if strings.Contains(startDate, "today") {
+		return ParseTodayString(startDate, now)
+	}
+	if _, err := time.Parse(time.DateOnly, startDate); err != nil {
+		return "", fmt.Errorf("invalid date %q, must be YYYY-MM-DD, today or today-<duration>", startDate)
+	}
+	return startDate, nil
+}
+
+// Validate checks the values of the configuration, and returns an error listing every invalid value.
+// Values that are not set are not checked, since they may be set by the environment config.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	apis := []struct {
+		key string
+		api TiingoAPIConfig
+	}{
+		{"tiingo.eod", c.Tiingo.Eod},
+		{"tiingo.fundamentals.daily", c.Tiingo.Fundamentals.Daily},
+		{"tiingo.fundamentals.statements", c.Tiingo.Fundamentals.Statements},
+		{"tiingo.fundamentals.meta", c.Tiingo.Fundamentals.Meta},
+	}
+	for _, a := range apis {
+		if a.api.Format != "" && !slices.Contains(TiingoFormats, a.api.Format) {
+			invalid(a.key+".format", "%q is not supported, must be one of %s", a.api.Format, strings.Join(TiingoFormats, ", "))
+		}
+		if a.api.StartDate != "" {
+			if _, err := ResolveStartDate(a.api.StartDate, time.Now()); err != nil {
+				invalid(a.key+".start_date", "%v", err)
+			}
+		}
+	}
+
+	b := c.Extract.Backoff
+	switch {
+	case b.RetryWaitMin < 0:
+		invalid("extract.backoff.retry_wait_min", "must not be negative")
+	case b.RetryWaitMax < b.RetryWaitMin:
+		invalid("extract.backoff.retry_wait_max", "%s is less than retry_wait_min %s", b.RetryWaitMax, b.RetryWaitMin)
+	case b.RetryWaitMax > maxRetryWait:
+		invalid("extract.backoff.retry_wait_max", "%s is more than %s", b.RetryWaitMax, maxRetryWait)
+	}
+	if b.RetryMax < 0 || b.RetryMax > maxRetries {
+		invalid("extract.backoff.retry_max", "%d must be between 0 and %d", b.RetryMax, maxRetries)
+	}
+	if b.RetryAfterMax < 0 {
+		invalid("extract.backoff.retry_after_max", "must not be negative")
+	}
+
+	for _, p := range c.Secrets.Providers {
+		if !slices.Contains(SecretProviders, p) {
+			invalid("secrets.providers", "%q is not supported, must be one of %s", p, strings.Join(SecretProviders, ", "))
+		}
+	}
+	if slices.Contains(c.Secrets.Providers, "file") && c.Secrets.Dir == "" {
+		invalid("secrets.dir", "must be set for the file provider")
+	}
+	if slices.Contains(c.Secrets.Providers, "vault") && c.Secrets.Vault.Path == "" {
+		invalid("secrets.vault.path", "must be set for the vault provider")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateFiles checks that the files the configuration refers to exist, in the SQL files or
+// relative to the working directory.
+func (c *Config) ValidateFiles() error {
+	registry, err := sqlfiles.New(c.DuckDB.SQLDir)
+	if err != nil {
+		return fmt.Errorf("duckdb.sql_dir: %w", err)
+	}
+
+	var errs []error
+	for _, path := range c.DuckDB.ConnInitFnQueries {
+		if _, err := registry.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("duckdb.conn_init_fn_queries: %s does not exist in %s", path, source(registry, path)))
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("duckdb.conn_init_fn_queries: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// source describes where the SQL file is read from.
+func source(registry *sqlfiles.Registry, name string) string {
+	if sqlfiles.IsPath(name) {
+		return "the working directory"
+	}
+	return fmt.Sprintf("the SQL files (%s)", registry.Source())
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveStartDate(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		startDate string
+		want      string
+		wantErr   string
+	}{
+		{startDate: "1995-01-01", want: "1995-01-01"},
+		{startDate: "today", want: "2024-01-10"},
+		{startDate: "today-192h", want: "2024-01-02"},
+		{startDate: "today-8d", wantErr: "failed to parse duration"},
+		{startDate: "2024-13-01", wantErr: "must be YYYY-MM-DD, today or today-<duration>"},
+		{startDate: "01/01/1995", wantErr: "must be YYYY-MM-DD, today or today-<duration>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.startDate, func(t *testing.T) {
+			got, err := ResolveStartDate(tt.startDate, now)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Extract: ExtractConfig{Backoff: BackoffConfig{RetryWaitMin: time.Second, RetryWaitMax: 30 * time.Second, RetryMax: 5}},
+			Tiingo: TiingoConfig{
+				Eod:          TiingoAPIConfig{Format: "csv", StartDate: "1995-01-01"},
+				Fundamentals: FundamentalsConfig{Daily: TiingoAPIConfig{Format: "csv", StartDate: "today-192h"}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "unset values are not checked",
+			modify: func(c *Config) { *c = Config{} },
+		},
+		{
+			name: "invalid formats and dates",
+			modify: func(c *Config) {
+				c.Tiingo.Eod.Format = "xml"
+				c.Tiingo.Fundamentals.Daily.StartDate = "yesterday"
+			},
+			wantErr: []string{
+				`tiingo.eod.format: "xml" is not supported, must be one of csv`,
+				"tiingo.fundamentals.daily.start_date: invalid date \"yesterday\"",
+			},
+		},
+		{
+			name: "backoff out of bounds",
+			modify: func(c *Config) {
+				c.Extract.Backoff.RetryWaitMax = 500 * time.Millisecond
+				c.Extract.Backoff.RetryMax = 100
+				c.Extract.Backoff.RetryAfterMax = -time.Second
+			},
+			wantErr: []string{
+				"extract.backoff.retry_wait_max: 500ms is less than retry_wait_min 1s",
+				"extract.backoff.retry_max: 100 must be between 0 and 20",
+				"extract.backoff.retry_after_max: must not be negative",
+			},
+		},
+		{
+			name: "invalid secrets",
+			modify: func(c *Config) {
+				c.Secrets.Providers = []string{"env", "file", "vault", "keychain"}
+			},
+			wantErr: []string{
+				`secrets.providers: "keychain" is not supported, must be one of env, file, dotenv, vault`,
+				"secrets.dir: must be set for the file provider",
+				"secrets.vault.path: must be set for the vault provider",
+			},
+		},
+		{
+			name:    "backoff too long",
+			modify:  func(c *Config) { c.Extract.Backoff.RetryWaitMax = time.Hour },
+			wantErr: []string{"extract.backoff.retry_wait_max: 1h0m0s is more than 10m0s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			err := c.Validate()
+			if len(tt.wantErr) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, want := range tt.wantErr {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateFiles(t *testing.T) {
+	c := &Config{DuckDB: DuckDBConfig{ConnInitFnQueries: []string{"schemas.sql", "./validate_test.go", "missing.sql", "./missing.sql"}}}
+	err := c.ValidateFiles()
+	assert.ErrorContains(t, err, "duckdb.conn_init_fn_queries: missing.sql does not exist in the SQL files (embedded)")
+	assert.ErrorContains(t, err, "duckdb.conn_init_fn_queries: ./missing.sql does not exist in the working directory")
+	assert.NotContains(t, err.Error(), "schemas.sql")
+	assert.NotContains(t, err.Error(), "validate_test.go")
+
+	dir := t.TempDir()
+	c.DuckDB.SQLDir = dir
+	err = c.ValidateFiles()
+	assert.ErrorContains(t, err, fmt.Sprintf("schemas.sql does not exist in the SQL files (%s)", dir))
+
+	c.DuckDB.SQLDir = filepath.Join(dir, "missing")
+	assert.ErrorContains(t, c.ValidateFiles(), "duckdb.sql_dir: error opening SQL directory")
+}
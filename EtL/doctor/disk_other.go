@@ -0,0 +1,10 @@
+//go:build !unix
+
+package doctor
+
+import "errors"
+
+// freeBytes is not supported on this platform.
+func freeBytes(dir string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,334 @@
+// Package doctor diagnoses the setup etl runs in, e.g. missing tokens or an unreachable database,
+// before they surface as errors in the middle of a pipeline run.
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/snapshot"
+	sqlfiles "github.com/rasnes/tiingo-duckdb-framework/EtL/sql"
+)
+
+// Statuses of a check.
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+const (
+	// apiTimeout bounds the request checking the Tiingo token.
+	apiTimeout = 15 * time.Second
+	// warnFreeBytes and minFreeBytes are the free disk space below which a directory for
+	// temporary files is reported as warn and fail.
+	warnFreeBytes = 1 << 30
+	minFreeBytes  = 100 << 20
+)
+
+// Check is the outcome of a diagnostic, with a suggested fix if it did not pass.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// Options configures Run.
+type Options struct {
+	// DotEnv loads the .env file, which etl requires except on GitHub Actions.
+	DotEnv bool
+	// TiingoBaseURL overrides the URL of the Tiingo API, e.g. in tests.
+	TiingoBaseURL string
+	// Config is where the configuration is loaded from.
+	Config config.Options
+}
+
+// Run runs the checks in the working directory, in the order etl sets itself up, and returns
+// their outcomes. Checks that depend on a failed check are skipped.
+func Run(ctx context.Context, opts Options) []Check {
+	// The checks report errors themselves, so the logs of the clients are discarded
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	checks := []Check{checkDotEnv(opts.DotEnv)}
+	cfg, check := checkConfig(opts.Config)
+	tiingoToken := checkToken(ctx, cfg, "TIINGO_TOKEN", "the API token of your Tiingo account")
+	checks = append(checks, check, tiingoToken)
+	if cfg == nil {
+		skipped := "the configuration did not load"
+		for _, name := range []string{"MOTHERDUCK_TOKEN", "Tiingo API", "DuckDB", "SQL files", "Disk space"} {
+			checks = append(checks, Check{Name: name, Status: StatusSkip, Detail: skipped})
+		}
+		return checks
+	}
+
+	motherDuckToken := checkMotherDuckToken(ctx, cfg)
+	checks = append(checks,
+		motherDuckToken,
+		checkTiingoAPI(ctx, cfg, log, opts.TiingoBaseURL, tiingoToken.Status == StatusOK),
+		checkDuckDB(ctx, cfg, log, motherDuckToken.Status == StatusOK),
+		checkSQLFiles(cfg),
+	)
+	return append(checks, checkDiskSpace(cfg)...)
+}
+
+// Failed returns the number of failed checks.
+func Failed(checks []Check) int {
+	n := 0
+	for _, c := range checks {
+		if c.Status == StatusFail {
+			n++
+		}
+	}
+	return n
+}
+
+func checkDotEnv(load bool) Check {
+	c := Check{Name: ".env"}
+	if !load {
+		c.Status, c.Detail = StatusSkip, "not loaded on GitHub Actions"
+		return c
+	}
+	if err := godotenv.Load(); err != nil {
+		c.Status = StatusFail
+		if errors.Is(err, os.ErrNotExist) {
+			c.Status, c.Detail = StatusWarn, "no .env file in the working directory"
+			c.Fix = "Create .env with TIINGO_TOKEN=<token>, and MOTHERDUCK_TOKEN=<token> for a md: database, unless the tokens are read from another provider in secrets.providers."
+		} else {
+			c.Detail = fmt.Sprintf("invalid .env file: %v", err)
+			c.Fix = "Fix .env to have one KEY=VALUE per line."
+		}
+		return c
+	}
+	c.Status, c.Detail = StatusOK, "loaded .env"
+	return c
+}
+
+func checkConfig(opts config.Options) (*config.Config, Check) {
+	c := Check{Name: "Config"}
+	env := opts.Env
+	if env == "" {
+		env = os.Getenv("APP_ENV")
+	}
+	cfg, files, err := config.Load(opts)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, strings.ReplaceAll(err.Error(), "\n", "; ")
+		if errors.Is(err, os.ErrNotExist) {
+			c.Fix = fmt.Sprintf("Run etl from the EtL directory, which has %s, or set the base config file with --config.", config.BaseFile)
+		} else {
+			c.Fix = "Fix the config files. `etl config validate` lists every invalid value."
+		}
+		return nil, c
+	}
+
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("loaded %s (env %s)", strings.Join(files, ", "), cfg.Env)
+	switch {
+	case env == "":
+		c.Status = StatusWarn
+		c.Detail = fmt.Sprintf("neither --env nor APP_ENV is set, loaded %s only", strings.Join(files, ", "))
+		c.Fix = "Set APP_ENV, e.g. APP_ENV=dev in .env, or pass --env to merge the config file of the environment."
+	case len(files) == 1:
+		c.Status = StatusWarn
+		c.Detail = fmt.Sprintf("no %s, loaded %s only", config.EnvFile(env), files[0])
+		c.Fix = fmt.Sprintf("Create %s, or set APP_ENV or --env to an environment with a config file.", config.EnvFile(env))
+	}
+	return cfg, c
+}
+
+// checkToken checks that the secret name is set in the secret providers of the configuration, or in
+// the environment if the configuration did not load.
+func checkToken(ctx context.Context, cfg *config.Config, name, description string) Check {
+	c := Check{Name: name}
+	provider := secrets.Chain{secrets.Env{}}
+	if cfg != nil {
+		var err error
+		if provider, err = secrets.New(cfg.Secrets); err != nil {
+			c.Status, c.Detail = StatusFail, err.Error()
+			c.Fix = "Fix secrets in the config, or set the environment variables of the vault provider."
+			return c
+		}
+	}
+
+	_, source, err := provider.Find(ctx, name)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		c.Fix = fmt.Sprintf("Set %s to %s in one of the providers in secrets.providers, e.g. in .env or the environment.", name, description)
+		return c
+	}
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("set in %s", source)
+	return c
+}
+
+func checkMotherDuckToken(ctx context.Context, cfg *config.Config) Check {
+	if !strings.HasPrefix(cfg.DuckDB.Path, "md:") {
+		return Check{Name: "MOTHERDUCK_TOKEN", Status: StatusOK, Detail: fmt.Sprintf("not needed, duckdb.path is %q", cfg.DuckDB.Path)}
+	}
+	c := checkToken(ctx, cfg, "MOTHERDUCK_TOKEN", "a MotherDuck access token")
+	if c.Status == StatusFail {
+		c.Detail += fmt.Sprintf(", but duckdb.path is %s", cfg.DuckDB.Path)
+	}
+	return c
+}
+
+func checkTiingoAPI(ctx context.Context, cfg *config.Config, log *slog.Logger, baseURL string, hasToken bool) Check {
+	c := Check{Name: "Tiingo API"}
+	if !hasToken {
+		c.Status, c.Detail = StatusSkip, "TIINGO_TOKEN is not set"
+		return c
+	}
+
+	client, err := extract.NewTiingoClient(cfg, log)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	}
+	client.HTTPClient.RetryMax = 0
+	if baseURL != "" {
+		client.BaseURL = baseURL
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if err := client.CheckToken(ctx); err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		if errors.Is(err, extract.ErrUnauthorized) {
+			c.Fix = "TIINGO_TOKEN was rejected. Copy the token from your Tiingo account settings."
+		} else {
+			c.Fix = fmt.Sprintf("Check the network connection to %s.", client.BaseURL)
+		}
+		return c
+	}
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("token accepted by %s", client.BaseURL)
+	return c
+}
+
+func checkDuckDB(ctx context.Context, cfg *config.Config, log *slog.Logger, hasToken bool) Check {
+	c := Check{Name: "DuckDB"}
+	if !hasToken {
+		c.Status, c.Detail = StatusSkip, "MOTHERDUCK_TOKEN is not set"
+		return c
+	}
+
+	fail := func(err error) Check {
+		c.Status, c.Detail = StatusFail, err.Error()
+		c.Fix = "Check duckdb.path and duckdb.conn_init_fn_queries. A local database file is locked while another etl process uses it."
+		return c
+	}
+	db, err := load.NewDuckDB(cfg, log)
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	// Connecting runs the connection init queries
+	if err := db.DB.PingContext(ctx); err != nil {
+		return fail(err)
+	}
+	version, err := snapshot.SchemaVersion(ctx, db)
+	if err != nil {
+		return fail(err)
+	}
+
+	c.Status, c.Detail = StatusOK, fmt.Sprintf("connected to %s, schema version %s", db.DBType, version)
+	snapshots, err := snapshot.List(cfg.Snapshot.Dir)
+	if err == nil && len(snapshots) > 0 && snapshots[0].SchemaVersion != version {
+		c.Status = StatusWarn
+		c.Detail += fmt.Sprintf(", but the latest snapshot %s has schema version %s", snapshots[0].Name, snapshots[0].SchemaVersion)
+		c.Fix = "Take a new snapshot with `etl db snapshot` after changing the schema."
+	}
+	return c
+}
+
+func checkSQLFiles(cfg *config.Config) Check {
+	c := Check{Name: "SQL files"}
+	if err := cfg.ValidateFiles(); err != nil {
+		c.Status, c.Detail = StatusFail, strings.ReplaceAll(err.Error(), "\n", "; ")
+		c.Fix = "Fix duckdb.sql_dir and duckdb.conn_init_fn_queries in the config. Names are SQL files, and paths are relative to the working directory."
+		return c
+	}
+	registry, err := sqlfiles.New(cfg.DuckDB.SQLDir)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	}
+	names, err := registry.Names()
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	}
+	c.Status = StatusOK
+	c.Detail = fmt.Sprintf("found %d SQL files (%s) and the %d connection init queries", len(names), registry.Source(), len(cfg.DuckDB.ConnInitFnQueries))
+	return c
+}
+
+// checkDiskSpace checks the free space for the temporary files written while loading: the spool of
+// downloads, and the files DuckDB spills to next to a local database.
+func checkDiskSpace(cfg *config.Config) []Check {
+	dirs := []struct{ name, dir string }{{"spool", cfg.Extract.SpoolDir}}
+	if dirs[0].dir == "" {
+		dirs[0].dir = os.TempDir()
+	}
+	if path := cfg.DuckDB.Path; path != "" && path != ":memory:" && !strings.HasPrefix(path, "md:") {
+		dirs = append(dirs, struct{ name, dir string }{"DuckDB", filepath.Dir(path)})
+	}
+
+	var checks []Check
+	for _, d := range dirs {
+		c := Check{Name: fmt.Sprintf("Disk space (%s)", d.name)}
+		free, err := freeBytes(existingParent(d.dir))
+		switch {
+		case err != nil:
+			c.Status, c.Detail = StatusWarn, fmt.Sprintf("cannot get the free space of %s: %v", d.dir, err)
+		case free < minFreeBytes:
+			c.Status = StatusFail
+		case free < warnFreeBytes:
+			c.Status = StatusWarn
+		default:
+			c.Status = StatusOK
+		}
+		if err == nil {
+			c.Detail = fmt.Sprintf("%s free in %s", formatBytes(free), d.dir)
+		}
+		if c.Status == StatusWarn || c.Status == StatusFail {
+			c.Fix = fmt.Sprintf("Free up space in %s, or point extract.spool_dir or duckdb.path to a larger disk.", d.dir)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// existingParent returns dir, or its closest parent that exists, since the directories for
+// temporary files are created when needed.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	default:
+		return fmt.Sprintf("%.0f MiB", float64(n)/(1<<20))
+	}
+}
@@ -0,0 +1,129 @@
+package doctor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/stretchr/testify/assert"
+)
+
+// chdir changes the working directory to a new temporary directory for the test.
+func chdir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// unsetenv unsets the variables for the test, so .env can set them.
+func unsetenv(t *testing.T, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// statuses returns the status of each check by name.
+func statuses(checks []Check) map[string]string {
+	s := make(map[string]string, len(checks))
+	for _, c := range checks {
+		s[c.Name] = c.Status
+	}
+	return s
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"message":"You successfully sent a request"}`))
+	})))
+	defer server.Close()
+
+	t.Run("working setup", func(t *testing.T) {
+		chdir(t)
+		unsetenv(t, "TIINGO_TOKEN", "MOTHERDUCK_TOKEN", "APP_ENV")
+		writeFile(t, ".env", "TIINGO_TOKEN=test-token\nAPP_ENV=test\n")
+		// The SQL files are embedded, so no sql/ directory is needed
+		writeFile(t, "config.base.yaml", "duckdb:\n  path: data/test.db\n  conn_init_fn_queries:\n    - schemas.sql\n")
+		writeFile(t, "config.test.yaml", "extract:\n  spool_dir: spool\n")
+		if err := os.Mkdir("data", 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+
+		checks := Run(context.Background(), Options{DotEnv: true, TiingoBaseURL: server.URL})
+		// The free disk space depends on the host, so only the other checks must pass
+		got := statuses(checks)
+		assert.Contains(t, got, "Disk space (spool)")
+		assert.Contains(t, got, "Disk space (DuckDB)")
+		delete(got, "Disk space (spool)")
+		delete(got, "Disk space (DuckDB)")
+		assert.Equal(t, map[string]string{
+			".env":             StatusOK,
+			"Config":           StatusOK,
+			"TIINGO_TOKEN":     StatusOK,
+			"MOTHERDUCK_TOKEN": StatusOK,
+			"Tiingo API":       StatusOK,
+			"DuckDB":           StatusOK,
+			"SQL files":        StatusOK,
+		}, got)
+	})
+
+	t.Run("broken setup", func(t *testing.T) {
+		chdir(t)
+		unsetenv(t, "TIINGO_TOKEN", "MOTHERDUCK_TOKEN", "APP_ENV")
+		t.Setenv("TIINGO_TOKEN", "wrong-token")
+		writeFile(t, "config.base.yaml", "duckdb:\n  path: md:prod\n  conn_init_fn_queries:\n    - missing.sql\n")
+
+		checks := Run(context.Background(), Options{DotEnv: true, TiingoBaseURL: server.URL})
+		got := statuses(checks)
+		delete(got, "Disk space (spool)")
+		assert.Equal(t, map[string]string{
+			".env":             StatusWarn,
+			"Config":           StatusWarn,
+			"TIINGO_TOKEN":     StatusOK,
+			"MOTHERDUCK_TOKEN": StatusFail,
+			"Tiingo API":       StatusFail,
+			"DuckDB":           StatusSkip,
+			"SQL files":        StatusFail,
+		}, got)
+		for _, c := range checks {
+			if c.Status == StatusFail {
+				assert.NotEmpty(t, c.Fix, c.Name)
+			}
+		}
+	})
+
+	t.Run("missing config", func(t *testing.T) {
+		chdir(t)
+		unsetenv(t, "TIINGO_TOKEN", "MOTHERDUCK_TOKEN", "APP_ENV")
+
+		checks := Run(context.Background(), Options{})
+		assert.Equal(t, StatusSkip, checks[0].Status)
+		assert.Equal(t, StatusFail, checks[1].Status)
+		assert.Contains(t, checks[1].Fix, "config.base.yaml")
+		assert.Equal(t, StatusFail, checks[2].Status)
+		assert.Equal(t, StatusSkip, checks[len(checks)-1].Status)
+	})
+}
@@ -0,0 +1,50 @@
+package extract
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// responseBody is the body of a response streamed by OpenData. It counts the bytes read from
+// the connection, and reports them with the first read error, if any, when closed.
+type responseBody struct {
+	*bufio.Reader
+	body   io.ReadCloser
+	n      int64
+	err    error
+	done   func(n int64, err error)
+	closed bool
+}
+
+func newResponseBody(body io.ReadCloser, done func(n int64, err error)) *responseBody {
+	b := &responseBody{body: body, done: done}
+	b.Reader = bufio.NewReader(readerFunc(b.read))
+	return b
+}
+
+// read reads from the connection, counting the bytes.
+func (b *responseBody) read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.n += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.body.Close()
+	b.done(b.n, b.err)
+	return err
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,139 @@
+package extract
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CachedFile is a file downloaded with FetchCached, with the SHA-256 hash of its content.
+type CachedFile struct {
+	Body   []byte
+	SHA256 string
+	// NotModified is true if the server responded 304 Not Modified, and Body was read from the cache.
+	NotModified bool
+}
+
+// cacheEntry holds the validators of a cached file, stored next to it as <name>.json.
+type cacheEntry struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// FetchCached fetches the URL like FetchData, caching the body as name in the cache directory.
+// When the file is cached, the request is conditional on its ETag and Last-Modified, and a
+// 304 Not Modified response returns the cached file without downloading it again. Failing to
+// write the cache is logged, but does not fail the fetch.
+func (c *TiingoClient) FetchCached(ctx context.Context, url, description, name string) (*CachedFile, error) {
+	entry, cached := c.readCache(name)
+
+	header := http.Header{}
+	if entry != nil {
+		if entry.ETag != "" {
+			header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	body, resp, err := c.open(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		c.Logger.Info(fmt.Sprintf("%s is not modified, using the cached file", description), "fetched_at", entry.FetchedAt)
+		return &CachedFile{Body: cached, SHA256: entry.SHA256, NotModified: true}, nil
+	}
+	if err := checkResponse(body, resp, description); err != nil {
+		return nil, err
+	}
+
+	b, err := readAll(body, nil)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	file := &CachedFile{Body: b, SHA256: hex.EncodeToString(sum[:])}
+
+	err = c.writeCache(name, b, cacheEntry{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		SHA256:       file.SHA256,
+		FetchedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		c.Logger.Warn(fmt.Sprintf("Error caching %s: %v", description, err))
+	}
+	return file, nil
+}
+
+// readCache returns the cache entry and content of name, or nil if caching is disabled, the file
+// is not cached, or its content does not match its hash.
+func (c *TiingoClient) readCache(name string) (*cacheEntry, []byte) {
+	if c.cacheDir == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(c.cacheDir, name+".json"))
+	if err != nil {
+		return nil, nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, nil
+	}
+	content, err := os.ReadFile(filepath.Join(c.cacheDir, name))
+	if err != nil {
+		return nil, nil
+	}
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != entry.SHA256 {
+		c.Logger.Warn(fmt.Sprintf("Cached %s does not match its hash, downloading it again", name))
+		return nil, nil
+	}
+	return &entry, content
+}
+
+// writeCache writes the content of name and its entry to the cache directory. Each file is
+// written to a temporary file first and renamed, so a failed write never leaves a partial file.
+func (c *TiingoClient) writeCache(name string, content []byte, entry cacheEntry) error {
+	if c.cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.cacheDir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.cacheDir, name), content); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.cacheDir, name+".json"), append(b, '\n'))
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,79 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_FetchCached(t *testing.T) {
+	setup()
+	defer teardown()
+
+	var downloads atomic.Int32
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("zip content"))
+	})))
+	defer server.Close()
+
+	newClient := func(cacheDir string) *TiingoClient {
+		client, err := NewTiingoClient(getTestConfig(), getTestLogger(&bytes.Buffer{}))
+		assert.NoError(t, err)
+		client.cacheDir = cacheDir
+		return client
+	}
+	ctx := context.Background()
+
+	t.Run("downloads only when modified", func(t *testing.T) {
+		downloads.Store(0)
+		dir := t.TempDir()
+
+		file, err := newClient(dir).FetchCached(ctx, server.URL, "test.zip", "test.zip")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("zip content"), file.Body)
+		assert.False(t, file.NotModified)
+		assert.Len(t, file.SHA256, 64)
+
+		// Another process finds the file in the cache
+		cached, err := newClient(dir).FetchCached(ctx, server.URL, "test.zip", "test.zip")
+		assert.NoError(t, err)
+		assert.True(t, cached.NotModified)
+		assert.Equal(t, file.Body, cached.Body)
+		assert.Equal(t, file.SHA256, cached.SHA256)
+		assert.Equal(t, int32(1), downloads.Load())
+
+		// A corrupt cache is downloaded again
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "test.zip"), []byte("corrupt"), 0o644))
+		file, err = newClient(dir).FetchCached(ctx, server.URL, "test.zip", "test.zip")
+		assert.NoError(t, err)
+		assert.False(t, file.NotModified)
+		assert.Equal(t, []byte("zip content"), file.Body)
+		assert.Equal(t, int32(2), downloads.Load())
+	})
+
+	t.Run("without cache directory", func(t *testing.T) {
+		downloads.Store(0)
+		client := newClient("")
+
+		for range 2 {
+			file, err := client.FetchCached(ctx, server.URL, "test.zip", "test.zip")
+			assert.NoError(t, err)
+			assert.False(t, file.NotModified)
+		}
+		assert.Equal(t, int32(2), downloads.Load())
+	})
+}
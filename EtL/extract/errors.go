@@ -0,0 +1,107 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors classifying the responses of the Tiingo API. FetchData returns them
+// wrapped in a *ResponseError, so callers can use errors.Is to tell them apart.
+var (
+	// ErrUnauthorized means the token was rejected (401). Retrying other tickers is pointless.
+	ErrUnauthorized = errors.New("tiingo: unauthorized, check TIINGO_TOKEN")
+	// ErrNotFound means the ticker or resource is unknown to Tiingo, either as a 404 or as
+	// a {"detail":"Not found."} body.
+	ErrNotFound = errors.New("tiingo: ticker or resource not found")
+	// ErrRateLimited means the request was rejected with 429 Too Many Requests.
+	ErrRateLimited = errors.New("tiingo: rate limit exceeded")
+	// ErrNoEntitlement means the subscription does not cover the requested data,
+	// which Tiingo signals with 400 Bad Request and a body of "None".
+	ErrNoEntitlement = errors.New("tiingo: no entitlement for requested data")
+	// ErrServer means Tiingo responded with a 5xx status.
+	ErrServer = errors.New("tiingo: server error")
+)
+
+// ResponseError is returned by FetchData when the Tiingo API responds with a non-200 status,
+// or with a 200 status and an error detail body.
+type ResponseError struct {
+	Description string
+	StatusCode  int
+	Status      string
+	Body        string
+	// RetryAfter is the parsed Retry-After header of the response, if any.
+	RetryAfter time.Duration
+	// Err is one of the sentinel errors above, or nil if the response could not be classified.
+	Err error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("failed to fetch the `%s` file, status: %s, body: %s", e.Description, e.Status, e.Body)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// classifyResponse returns the sentinel error matching the status code and body,
+// or nil if the response is successful or does not match any of them.
+func classifyResponse(statusCode int, body []byte) error {
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case statusCode == http.StatusNotFound:
+		return ErrNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode == http.StatusBadRequest && string(trimmed) == "None":
+		return ErrNoEntitlement
+	case statusCode >= 500:
+		return ErrServer
+	case isNotFoundDetail(trimmed):
+		return ErrNotFound
+	}
+	return nil
+}
+
+// isNotFoundDetail reports whether the body is a JSON error like {"detail":"Not found."}
+func isNotFoundDetail(body []byte) bool {
+	if !bytes.HasPrefix(body, []byte("{")) {
+		return false
+	}
+	var detail struct {
+		Detail string `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &detail); err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(detail.Detail), "not found")
+}
+
+// parseRetryAfter parses a Retry-After header given either as seconds or as an HTTP date.
+// It returns false if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := date.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -1,52 +1,100 @@
 package extract
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+// maxErrorBody is the most of an unsuccessful response's body that is read into a ResponseError.
+const maxErrorBody = 64 << 10
+
+// classifyPeek is how much of a successful response is peeked at to classify it, which is
+// enough for error details like {"detail":"Not found."}.
+const classifyPeek = 512
+
 type TiingoClient struct {
 	HTTPClient   *retryablehttp.Client
 	Logger       *slog.Logger
-	TiingoConfig *config.TiingoConfig
+	TiingoConfig config.TiingoConfig
 	tiingoToken  string
 	BaseURL      string
 	InTest       bool
+
+	// retryAfterMax is the longest Retry-After a 429 response may ask for and still be retried.
+	retryAfterMax time.Duration
+	quota         *quotaTracker
+	quotaLimits   config.QuotaConfig
+	// cacheDir is the directory of the files downloaded with FetchCached. Empty disables caching.
+	cacheDir string
 }
 
 func NewTiingoClient(config *config.Config, logger *slog.Logger) (*TiingoClient, error) {
-	tiingoToken := os.Getenv("TIINGO_TOKEN")
-	if tiingoToken == "" {
-		return nil, fmt.Errorf("TIINGO_TOKEN env variable is not set")
+	provider, err := secrets.New(config.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("error creating secrets provider: %w", err)
+	}
+	tiingoToken, err := provider.Secret(context.Background(), "TIINGO_TOKEN")
+	if err != nil {
+		return nil, err
 	}
 
 	client := &TiingoClient{
 		HTTPClient:   retryablehttp.NewClient(),
 		Logger:       logger,
-		TiingoConfig: &config.Tiingo,
+		TiingoConfig: config.Tiingo,
 		tiingoToken:  tiingoToken,
 		BaseURL:      "https://api.tiingo.com",
+
+		retryAfterMax: config.Extract.Backoff.RetryAfterMax,
+		quota:         newQuotaTracker(time.Now()),
+		quotaLimits:   config.Extract.Quota,
+		cacheDir:      config.Extract.CacheDir,
 	}
 
 	client.HTTPClient.RetryWaitMin = config.Extract.Backoff.RetryWaitMin
 	client.HTTPClient.RetryWaitMax = config.Extract.Backoff.RetryWaitMax
 	client.HTTPClient.RetryMax = config.Extract.Backoff.RetryMax
 	client.HTTPClient.Logger = logger
+	// Return the last response when retries are exhausted, so FetchData can report its status and body
+	client.HTTPClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	client.HTTPClient.CheckRetry = client.checkRetry
+	client.HTTPClient.Backoff = client.backoff
+	// Count every attempt, since retries count towards the Tiingo quota too
+	client.HTTPClient.RequestLogHook = func(_ retryablehttp.Logger, req *http.Request, attempt int) {
+		if u := runUsage(req.Context()); u != nil {
+			u.requests.Add(1)
+		}
+		if attempt > 0 {
+			metrics.TiingoRetries.WithLabelValues(endpointLabel(req.URL)).Inc()
+		}
+	}
+	client.HTTPClient.ResponseLogHook = func(_ retryablehttp.Logger, resp *http.Response) {
+		metrics.TiingoRequests.WithLabelValues(endpointLabel(resp.Request.URL), strconv.Itoa(resp.StatusCode)).Inc()
+	}
 
 	return client, nil
 }
 
-// GetSupportedTickers fetches the supported tickers from the Tiingo API and returns the zip file downloaded
-func (c *TiingoClient) GetSupportedTickers() ([]byte, error) {
+// GetSupportedTickers fetches the supported tickers from the Tiingo API and returns the zip file downloaded.
+// The file is cached, and only downloaded again if it changed; see FetchCached.
+func (c *TiingoClient) GetSupportedTickers(ctx context.Context) (*CachedFile, error) {
 	var baseURL string
 	if !c.InTest {
 		baseURL = "https://apimedia.tiingo.com"
@@ -62,11 +110,11 @@ func (c *TiingoClient) GetSupportedTickers() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.FetchData(url, "supported_tickers.zip")
+	return c.FetchCached(ctx, url, "supported_tickers.zip", "supported_tickers.zip")
 }
 
 // GetLastTradingDay fetches prices for all tickers on the last completed training day
-func (c *TiingoClient) GetLastTradingDay() ([]byte, error) {
+func (c *TiingoClient) GetLastTradingDay(ctx context.Context) ([]byte, error) {
 	url, err := c.addTiingoConfigToURL(
 		c.TiingoConfig.Eod,
 		fmt.Sprintf("%s/tiingo/daily/prices", c.BaseURL),
@@ -75,11 +123,16 @@ func (c *TiingoClient) GetLastTradingDay() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.FetchData(url, fmt.Sprintf("last_trading_day.%s", c.TiingoConfig.Eod.Format))
+	return c.FetchData(ctx, url, fmt.Sprintf("last_trading_day.%s", c.TiingoConfig.Eod.Format))
 }
 
 // GetHistory fetches the historical EoD prices for a ticker, from c.TiingoStartDate to the present
-func (c *TiingoClient) GetHistory(ticker string) ([]byte, error) {
+func (c *TiingoClient) GetHistory(ctx context.Context, ticker string) ([]byte, error) {
+	return readAll(c.OpenHistory(ctx, ticker))
+}
+
+// OpenHistory is GetHistory, but returns the body to be streamed. The caller must close it.
+func (c *TiingoClient) OpenHistory(ctx context.Context, ticker string) (io.ReadCloser, error) {
 	url, err := c.addTiingoConfigToURL(
 		c.TiingoConfig.Eod,
 		fmt.Sprintf("%s/tiingo/daily/%s/prices", c.BaseURL, ticker),
@@ -88,12 +141,17 @@ func (c *TiingoClient) GetHistory(ticker string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.FetchData(url, fmt.Sprintf("history for ticker %s", ticker))
+	return c.OpenData(ctx, url, fmt.Sprintf("history for ticker %s", ticker))
 }
 
 // GetStatements fetches the financial statements for a ticker
 // https://www.tiingo.com/documentation/fundamentals section 2.6.3
-func (c *TiingoClient) GetStatements(ticker string) ([]byte, error) {
+func (c *TiingoClient) GetStatements(ctx context.Context, ticker string) ([]byte, error) {
+	return readAll(c.OpenStatements(ctx, ticker))
+}
+
+// OpenStatements is GetStatements, but returns the body to be streamed. The caller must close it.
+func (c *TiingoClient) OpenStatements(ctx context.Context, ticker string) (io.ReadCloser, error) {
 	url, err := c.addTiingoConfigToURL(
 		c.TiingoConfig.Fundamentals.Statements,
 		fmt.Sprintf("%s/tiingo/fundamentals/%s/statements", c.BaseURL, ticker),
@@ -102,14 +160,14 @@ func (c *TiingoClient) GetStatements(ticker string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.FetchData(url, fmt.Sprintf("statements for ticker %s", ticker))
+	return c.OpenData(ctx, url, fmt.Sprintf("statements for ticker %s", ticker))
 }
 
 // GetMeta fetches the meta information for a ticker.
 // `tickers` is a comma separated list of tickers, e.g. "AAPL,GOOGL"
 // If `tickers` is zero value, it fetches the meta information for all tickers.
 // https://www.tiingo.com/documentation/fundamentals section 2.6.5
-func (c *TiingoClient) GetMeta(tickers string) ([]byte, error) {
+func (c *TiingoClient) GetMeta(ctx context.Context, tickers string) ([]byte, error) {
 	metaURL := fmt.Sprintf("%s/tiingo/fundamentals/meta", c.BaseURL)
 	if tickers != "" {
 		parsedURL, _ := url.Parse(metaURL)
@@ -127,12 +185,18 @@ func (c *TiingoClient) GetMeta(tickers string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.FetchData(url, fmt.Sprintf("meta.%s", c.TiingoConfig.Fundamentals.Meta.Format))
+	return c.FetchData(ctx, url, fmt.Sprintf("meta.%s", c.TiingoConfig.Fundamentals.Meta.Format))
 }
 
 // GetDailyFundamentals fetches the daily fundamentals for a ticker
 // https://www.tiingo.com/documentation/fundamentals section 2.6.4
-func (c *TiingoClient) GetDailyFundamentals(ticker string) ([]byte, error) {
+func (c *TiingoClient) GetDailyFundamentals(ctx context.Context, ticker string) ([]byte, error) {
+	return readAll(c.OpenDailyFundamentals(ctx, ticker))
+}
+
+// OpenDailyFundamentals is GetDailyFundamentals, but returns the body to be streamed.
+// The caller must close it.
+func (c *TiingoClient) OpenDailyFundamentals(ctx context.Context, ticker string) (io.ReadCloser, error) {
 	url, err := c.addTiingoConfigToURL(
 		c.TiingoConfig.Fundamentals.Daily,
 		fmt.Sprintf("%s/tiingo/fundamentals/%s/daily", c.BaseURL, ticker),
@@ -141,25 +205,121 @@ func (c *TiingoClient) GetDailyFundamentals(ticker string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return c.OpenData(ctx, url, fmt.Sprintf("daily fundamentals for ticker %s", ticker))
+}
 
-	return c.FetchData(url, fmt.Sprintf("daily fundamentals for ticker %s", ticker))
+// CheckToken sends a request to the Tiingo test endpoint, which returns no data, to check that
+// the API is reachable and accepts the token. A rejected token returns an error wrapping
+// ErrUnauthorized.
+func (c *TiingoClient) CheckToken(ctx context.Context) error {
+	u, err := url.Parse(fmt.Sprintf("%s/api/test", c.BaseURL))
+	if err != nil {
+		return fmt.Errorf("failed to parse URL: %w", err)
+	}
+	body, err := c.FetchData(ctx, u.String(), "api test")
+	if err != nil {
+		return err
+	}
+	// Tiingo may respond 200 OK with an error detail, e.g. {"detail":"Invalid token."}
+	var detail struct {
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(body, &detail) == nil && detail.Detail != "" {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, detail.Detail)
+	}
+	return nil
 }
 
 // FetchData handles the common logic of making the HTTP request and checking the response status
-func (c *TiingoClient) FetchData(url, description string) ([]byte, error) {
-	body, resp, err := c.get(url)
+func (c *TiingoClient) FetchData(ctx context.Context, url, description string) ([]byte, error) {
+	return readAll(c.OpenData(ctx, url, description))
+}
+
+// OpenData makes the HTTP request and checks the response status like FetchData, but returns
+// the body to be streamed instead of reading it into memory. The caller must close it.
+func (c *TiingoClient) OpenData(ctx context.Context, url, description string) (io.ReadCloser, error) {
+	body, resp, err := c.open(ctx, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkResponse(body, resp, description); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
 
+// checkResponse returns a ResponseError if the response is unsuccessful, or is successful but
+// has an error detail body. Only what is needed to tell is read from the body.
+func checkResponse(body *responseBody, resp *http.Response, description string) error {
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch the `%s` file, status: %s, body: %s", description, resp.Status, string(body))
+		b, err := io.ReadAll(io.LimitReader(body, maxErrorBody))
+		if err != nil {
+			return err
+		}
+		return responseError(resp, b, description)
 	}
 
-	return body, nil
+	// A successful response may still be an error detail, which fits in the peeked bytes
+	peek, err := body.Peek(classifyPeek)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if classifyResponse(resp.StatusCode, peek) != nil {
+		return responseError(resp, peek, description)
+	}
+	return nil
 }
 
-// addTiingoConfigToURL adds the Tiingo token, format, startDate and columns to the URL
+// responseError returns the ResponseError of an unsuccessful response with the body.
+func responseError(resp *http.Response, body []byte, description string) *ResponseError {
+	respErr := &ResponseError{
+		Description: description,
+		StatusCode:  resp.StatusCode,
+		Status:      resp.Status,
+		Body:        string(body),
+		Err:         classifyResponse(resp.StatusCode, body),
+	}
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		respErr.RetryAfter = wait
+	}
+	return respErr
+}
+
+// readAll reads and closes the body returned by OpenData.
+func readAll(body io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// checkRetry is retryablehttp's default retry policy, except that 429 responses with a
+// Retry-After longer than retryAfterMax are not retried, since waiting would stall the job.
+func (c *TiingoClient) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if err == nil && resp != nil && resp.StatusCode == http.StatusTooManyRequests && c.retryAfterMax > 0 {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && wait > c.retryAfterMax {
+			c.Logger.Warn("Rate limited by Tiingo, not retrying", "retry_after", wait.String())
+			return false, nil
+		}
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// backoff waits for the Retry-After of 429 and 503 responses, and falls back to
+// retryablehttp's exponential backoff between min and max otherwise.
+func (c *TiingoClient) backoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return wait
+		}
+	}
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+}
+
+// addTiingoConfigToURL adds the format, startDate and columns to the URL. The token is sent in
+// the Authorization header rather than the URL, which ends up in logs; see open.
 func (c *TiingoClient) addTiingoConfigToURL(apiConfig config.TiingoAPIConfig, rawURL string, history bool) (string, error) {
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
@@ -167,7 +327,6 @@ func (c *TiingoClient) addTiingoConfigToURL(apiConfig config.TiingoAPIConfig, ra
 	}
 
 	query := parsedURL.Query()
-	query.Set("token", c.tiingoToken)
 	query.Set("format", apiConfig.Format)
 	if apiConfig.Columns != "" {
 		query.Set("columns", apiConfig.Columns)
@@ -193,55 +352,85 @@ func (c *TiingoClient) addTiingoConfigToURL(apiConfig config.TiingoAPIConfig, ra
 	return parsedURL.String(), nil
 }
 
-// get fetches the URL and returns the body and response
-func (c *TiingoClient) get(url string) (body []byte, resp *http.Response, err error) {
-	resp, err = c.HTTPClient.Get(url)
+// open fetches the URL with the extra request headers, and returns the response with its body to be streamed.
+// The request, including retries and backoff waits, is aborted when ctx is done.
+// The span of the request ends, and the bytes downloaded are counted, when the body is closed.
+func (c *TiingoClient) open(ctx context.Context, url string, header http.Header) (_ *responseBody, _ *http.Response, err error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, redactURLError(err)
 	}
-	defer resp.Body.Close()
+	req.Header.Set("Authorization", "Token "+c.tiingoToken)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	// The span carries the endpoint rather than the URL, which has the ticker
+	endpoint := endpointLabel(req.URL)
+	_, span := tracing.Start(ctx, "tiingo.get", tracing.EndpointKey.String(endpoint), semconv.HTTPRequestMethodGet)
 
-	body, err = io.ReadAll(resp.Body)
+	start := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	metrics.TiingoRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return nil, nil, err
+		metrics.TiingoRequests.WithLabelValues(endpoint, "error").Inc()
+		tracing.End(span, spanError(err))
+		return nil, nil, redactURLError(err)
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
 	}
 
+	body := newResponseBody(resp.Body, func(n int64, err error) {
+		c.quota.record(time.Now(), int(n))
+		if u := runUsage(ctx); u != nil {
+			u.bytes.Add(n)
+		}
+		tracing.End(span, err)
+	})
 	return body, resp, nil
 }
 
-// parseTodayString converts a string in the format "today" or "today-<duration>" into an ISO 8601 date string.
-// The duration part supports any valid time.ParseDuration format (e.g., "24h", "7h30m", "1h30m10s").
-//
-// Examples:
-//   - "today" returns current date
-//   - "today-24h" returns yesterday's date
-//   - "today-168h" returns date from 7 days ago
-//   - "today-30m" returns today's date (as it's less than a day)
-//
-// Returns:
-//   - string: ISO 8601 formatted date (YYYY-MM-DD)
-//   - error: if the input format is invalid or duration parsing fails
-func parseTodayString(todayString string) (string, error) {
-	// Handle the "today" case
-	if todayString == "today" {
-		return time.Now().Format("2006-01-02"), nil
+// spanError returns the error to record on the span of a request. Transport errors are
+// url.Errors, whose message includes the URL, so only their cause is recorded.
+func spanError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
 	}
+	return err
+}
 
-	// Split the string by "-"
-	parts := strings.Split(todayString, "-")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid today string format: %s", todayString)
+// redactURLError redacts credentials from the URL of a url.Error, whose message includes the URL,
+// in case a caller passed a URL with a token.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = secrets.Redact(urlErr.URL)
 	}
+	return err
+}
 
-	if parts[0] != "today" {
-		return "", fmt.Errorf("string must start with 'today': %s", todayString)
-	}
+// QuotaUsage returns the number of requests made and bytes downloaded by this client,
+// next to the limits of the Tiingo plan.
+func (c *TiingoClient) QuotaUsage() QuotaUsage {
+	return c.quota.usage(time.Now(), c.quotaLimits)
+}
 
-	duration, err := time.ParseDuration(parts[1])
-	if err != nil {
-		return "", fmt.Errorf("failed to parse duration: %w", err)
-	}
+// parseTodayString converts a string in the format "today" or "today-<duration>" into an ISO 8601
+// date string, relative to the current time; see config.ParseTodayString.
+func parseTodayString(todayString string) (string, error) {
+	return config.ParseTodayString(todayString, time.Now())
+}
 
-	today := time.Now().Add(-duration)
-	return today.Format("2006-01-02"), nil
+// endpointLabel returns the path of a Tiingo API URL with the ticker replaced by {ticker},
+// e.g. /tiingo/daily/{ticker}/prices, to keep the cardinality of metric labels low.
+func endpointLabel(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	// Ticker endpoints are /tiingo/daily/<ticker>/prices and /tiingo/fundamentals/<ticker>/<dataset>
+	if len(segments) == 4 && segments[0] == "tiingo" {
+		segments[2] = "{ticker}"
+	}
+	return "/" + strings.Join(segments, "/")
 }
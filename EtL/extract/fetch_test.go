@@ -2,26 +2,29 @@ package extract
 
 import (
 	"bytes"
+	"context"
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-func setupTestServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Verify token is present
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
+func setupTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/tiingo/fundamentals/AAPL/statements":
 			w.Header().Set("Content-Type", "text/csv")
@@ -68,7 +71,7 @@ func setupTestServer() *httptest.Server {
 			w.WriteHeader(http.StatusNotFound)
 			_, _ = w.Write([]byte("Not found"))
 		}
-	}))
+	})))
 }
 
 func setup() {
@@ -128,6 +131,20 @@ func TestNewClient_NoToken(t *testing.T) {
 	assert.Nil(t, client)
 }
 
+func TestNewClient_TokenFromFile(t *testing.T) {
+	t.Setenv("TIINGO_TOKEN", "")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tiingo_token"), []byte("file_token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	cfg := getTestConfig()
+	cfg.Secrets = config.SecretsConfig{Providers: []string{"env", "file"}, Dir: dir}
+
+	client, err := NewTiingoClient(cfg, getTestLogger(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "file_token", client.tiingoToken)
+}
+
 func TestClient_FetchData(t *testing.T) {
 	setup()
 	defer teardown()
@@ -139,16 +156,16 @@ func TestClient_FetchData(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Mock HTTP server
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("test content"))
-	}))
+	})))
 	defer server.Close()
 
 	client.HTTPClient = retryablehttp.NewClient()
 	client.HTTPClient.HTTPClient = server.Client()
 
-	body, err := client.FetchData(server.URL, "test description")
+	body, err := client.FetchData(context.Background(), server.URL, "test description")
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("test content"), body)
 }
@@ -233,14 +250,14 @@ func TestClient_addTiingoConfigToURL(t *testing.T) {
 	assert.NoError(t, err)
 
 	rawURL := "https://api.tiingo.com/tiingo/daily/prices"
-	expectedURL := "https://api.tiingo.com/tiingo/daily/prices?columns=open%2Cclose&format=csv&startDate=2020-01-01&token=test_token"
+	expectedURL := "https://api.tiingo.com/tiingo/daily/prices?columns=open%2Cclose&format=csv&startDate=2020-01-01"
 
 	resultURL, err := client.addTiingoConfigToURL(client.TiingoConfig.Eod, rawURL, true)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedURL, resultURL)
 
 	// Test without history
-	expectedURLWithoutHistory := "https://api.tiingo.com/tiingo/daily/prices?columns=open%2Cclose&format=csv&token=test_token"
+	expectedURLWithoutHistory := "https://api.tiingo.com/tiingo/daily/prices?columns=open%2Cclose&format=csv"
 	resultURL, err = client.addTiingoConfigToURL(client.TiingoConfig.Eod, rawURL, false)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedURLWithoutHistory, resultURL)
@@ -288,7 +305,7 @@ func setupTestClient(t *testing.T, server *httptest.Server) *TiingoClient {
 }
 
 func TestGetStatements(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	client := setupTestClient(t, server)
@@ -331,7 +348,7 @@ func TestGetStatements(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			data, err := client.GetStatements(tt.ticker)
+			data, err := client.GetStatements(context.Background(), tt.ticker)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -350,7 +367,7 @@ func TestGetStatements(t *testing.T) {
 }
 
 func TestGetMeta(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	client := setupTestClient(t, server)
@@ -377,7 +394,7 @@ func TestGetMeta(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			data, err := client.GetMeta(tt.tickers)
+			data, err := client.GetMeta(context.Background(), tt.tickers)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -391,7 +408,7 @@ func TestGetMeta(t *testing.T) {
 }
 
 func TestGetDailyFundamentals(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	client := setupTestClient(t, server)
@@ -434,7 +451,7 @@ func TestGetDailyFundamentals(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			data, err := client.GetDailyFundamentals(tt.ticker)
+			data, err := client.GetDailyFundamentals(context.Background(), tt.ticker)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -451,3 +468,327 @@ func TestGetDailyFundamentals(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchData_ResponseError(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	client := setupTestClient(t, server)
+
+	_, err := client.GetStatements(context.Background(), "ERROR")
+	assert.Error(t, err)
+
+	var respErr *ResponseError
+	if assert.ErrorAs(t, err, &respErr) {
+		assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+		assert.Equal(t, "Not found", respErr.Body)
+		assert.Equal(t, "statements for ticker ERROR", respErr.Description)
+	}
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       error
+	}{
+		{name: "ok", statusCode: http.StatusOK, body: "date,close\n2024-01-01,1.0", want: nil},
+		{name: "ok with None body", statusCode: http.StatusOK, body: "None", want: nil},
+		{name: "unauthorized", statusCode: http.StatusUnauthorized, body: `{"detail":"Invalid token."}`, want: ErrUnauthorized},
+		{name: "not found", statusCode: http.StatusNotFound, body: "Not found", want: ErrNotFound},
+		{name: "not found detail with 200", statusCode: http.StatusOK, body: `{"detail":"Not found."}`, want: ErrNotFound},
+		{name: "other detail with 200", statusCode: http.StatusOK, body: `{"detail":"Something else"}`, want: nil},
+		{name: "rate limited", statusCode: http.StatusTooManyRequests, body: "", want: ErrRateLimited},
+		{name: "no entitlement", statusCode: http.StatusBadRequest, body: "None\n", want: ErrNoEntitlement},
+		{name: "bad request", statusCode: http.StatusBadRequest, body: "invalid startDate", want: nil},
+		{name: "server error", statusCode: http.StatusBadGateway, body: "", want: ErrServer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, classifyResponse(tt.statusCode, []byte(tt.body)))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "missing", header: "", want: 0, wantOK: false},
+		{name: "seconds", header: "120", want: 2 * time.Minute, wantOK: true},
+		{name: "negative seconds", header: "-1", want: 0, wantOK: false},
+		{name: "http date", header: "Mon, 01 Jan 2024 12:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{name: "http date in the past", header: "Mon, 01 Jan 2024 11:00:00 GMT", want: 0, wantOK: true},
+		{name: "invalid", header: "soon", want: 0, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header, now)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClient_RateLimitRetryAfter(t *testing.T) {
+	setup()
+	defer teardown()
+
+	tests := []struct {
+		name         string
+		retryAfter   string
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "short Retry-After is waited out", retryAfter: "0", wantRequests: 2, wantErr: false},
+		{name: "long Retry-After fails immediately", retryAfter: "3600", wantRequests: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				_, _ = w.Write([]byte("date,close\n2024-01-01,1.0"))
+			})))
+			defer server.Close()
+
+			cfg := getTestConfig()
+			cfg.Extract.Backoff.RetryAfterMax = time.Minute
+			client, err := NewTiingoClient(cfg, getTestLogger(&bytes.Buffer{}))
+			assert.NoError(t, err)
+			client.HTTPClient.HTTPClient = server.Client()
+
+			_, err = client.FetchData(context.Background(), server.URL, "rate limited")
+			assert.Equal(t, tt.wantRequests, requests)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrRateLimited)
+			var respErr *ResponseError
+			if assert.ErrorAs(t, err, &respErr) {
+				assert.Equal(t, time.Hour, respErr.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestClient_FetchData_ContextCanceled(t *testing.T) {
+	setup()
+	defer teardown()
+
+	requests := 0
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	})))
+	defer server.Close()
+
+	client, err := NewTiingoClient(getTestConfig(), getTestLogger(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	client.HTTPClient.HTTPClient = server.Client()
+
+	// A cancelled context stops the request and its retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.FetchData(ctx, server.URL, "cancelled")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, requests)
+}
+
+func TestClient_FetchData_RedactsToken(t *testing.T) {
+	setup()
+	defer teardown()
+
+	// Nothing listens on the URL of a closed server
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	var logs bytes.Buffer
+	client, err := NewTiingoClient(getTestConfig(), slog.New(secrets.NewHandler(slog.NewTextHandler(&logs, nil))))
+	assert.NoError(t, err)
+	client.HTTPClient.RetryMax = 0
+
+	_, err = client.FetchData(context.Background(), server.URL+"/api/test?token=test_token", "api test")
+	assert.Error(t, err)
+	// The message of the error has the URL, but not the token
+	assert.Contains(t, err.Error(), server.URL+"/api/test?token=[REDACTED]")
+	assert.NotContains(t, err.Error(), "test_token")
+	assert.NotContains(t, logs.String(), "test_token")
+}
+
+func TestClient_Metrics(t *testing.T) {
+	setup()
+	defer teardown()
+
+	requests := 0
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("date,close\n2024-01-01,1.0"))
+	})))
+	defer server.Close()
+
+	cfg := getTestConfig()
+	cfg.Extract.Backoff.RetryWaitMin = time.Millisecond
+	cfg.Extract.Backoff.RetryWaitMax = time.Millisecond
+	client, err := NewTiingoClient(cfg, getTestLogger(&bytes.Buffer{}))
+	assert.NoError(t, err)
+	client.HTTPClient.HTTPClient = server.Client()
+
+	endpoint := "/tiingo/daily/{ticker}/prices"
+	failed := testutil.ToFloat64(metrics.TiingoRequests.WithLabelValues(endpoint, "500"))
+	succeeded := testutil.ToFloat64(metrics.TiingoRequests.WithLabelValues(endpoint, "200"))
+	retries := testutil.ToFloat64(metrics.TiingoRetries.WithLabelValues(endpoint))
+
+	_, err = client.FetchData(context.Background(), server.URL+"/tiingo/daily/MSFT/prices", "metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, failed+1, testutil.ToFloat64(metrics.TiingoRequests.WithLabelValues(endpoint, "500")))
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(metrics.TiingoRequests.WithLabelValues(endpoint, "200")))
+	assert.Equal(t, retries+1, testutil.ToFloat64(metrics.TiingoRetries.WithLabelValues(endpoint)))
+}
+
+func TestEndpointLabel(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/tiingo/daily/AAPL/prices", want: "/tiingo/daily/{ticker}/prices"},
+		{path: "/tiingo/fundamentals/MSFT/statements", want: "/tiingo/fundamentals/{ticker}/statements"},
+		{path: "/tiingo/fundamentals/meta", want: "/tiingo/fundamentals/meta"},
+		{path: "/tiingo/daily/prices", want: "/tiingo/daily/prices"},
+		{path: "/docs/tiingo/daily/supported_tickers.zip", want: "/docs/tiingo/daily/supported_tickers.zip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, endpointLabel(&url.URL{Path: tt.path}))
+		})
+	}
+}
+
+func TestClient_OpenData(t *testing.T) {
+	setup()
+	defer teardown()
+
+	client, err := NewTiingoClient(getTestConfig(), getTestLogger(&bytes.Buffer{}))
+	assert.NoError(t, err)
+
+	large := strings.Repeat("2024-01-01,1.0\n", 10000)
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			_, _ = w.Write([]byte(large))
+		case "/detail":
+			_, _ = w.Write([]byte(`{"detail":"Not found."}`))
+		}
+	})))
+	defer server.Close()
+
+	t.Run("streams the body", func(t *testing.T) {
+		usage := &RunUsage{}
+		body, err := client.OpenData(WithRunUsage(context.Background(), usage), server.URL+"/large", "large")
+		assert.NoError(t, err)
+
+		n, err := io.Copy(io.Discard, body)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(large)), n)
+		// The bytes are counted when the body is closed
+		assert.Equal(t, int64(0), usage.Bytes())
+		assert.NoError(t, body.Close())
+		assert.Equal(t, int64(len(large)), usage.Bytes())
+		assert.NoError(t, body.Close())
+		assert.Equal(t, int64(len(large)), usage.Bytes())
+	})
+
+	t.Run("classifies error details", func(t *testing.T) {
+		_, err := client.OpenData(context.Background(), server.URL+"/detail", "detail")
+		var respErr *ResponseError
+		if assert.ErrorAs(t, err, &respErr) {
+			assert.ErrorIs(t, err, ErrNotFound)
+			assert.Equal(t, `{"detail":"Not found."}`, respErr.Body)
+		}
+	})
+}
+
+func TestClient_CheckToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/test", r.URL.Path)
+		assert.Empty(t, tiingotest.Credentials(r.URL))
+		switch r.Header.Get("Authorization") {
+		case "Token test-token":
+			_, _ = w.Write([]byte(`{"message":"You successfully sent a request"}`))
+		case "Token detail-token":
+			_, _ = w.Write([]byte(`{"detail":"Invalid token."}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	client := setupTestClient(t, server)
+	assert.NoError(t, client.CheckToken(context.Background()))
+
+	client.tiingoToken = "detail-token"
+	err := client.CheckToken(context.Background())
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.ErrorContains(t, err, "Invalid token.")
+
+	client.tiingoToken = "wrong-token"
+	assert.ErrorIs(t, client.CheckToken(context.Background()), ErrUnauthorized)
+}
+
+func TestClient_NoCredentialsInURLs(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		_, _ = w.Write([]byte("date,close\n2024-01-02,185.64"))
+	})))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	client := setupTestClient(t, server)
+	client.InTest = true
+	client.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client.HTTPClient.Logger = client.Logger
+	client.TiingoConfig.Eod = config.TiingoAPIConfig{Format: "csv", StartDate: "2024-01-01"}
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"supported tickers": func() error { _, err := client.GetSupportedTickers(ctx); return err },
+		"last trading day":  func() error { _, err := client.GetLastTradingDay(ctx); return err },
+		"history":           func() error { _, err := client.GetHistory(ctx, "AAPL"); return err },
+		"statements":        func() error { _, err := client.GetStatements(ctx, "AAPL"); return err },
+		"meta":              func() error { _, err := client.GetMeta(ctx, "AAPL,MSFT"); return err },
+		"daily":             func() error { _, err := client.GetDailyFundamentals(ctx, "AAPL"); return err },
+		"check token":       func() error { return client.CheckToken(ctx) },
+	}
+	for name, call := range calls {
+		// RequireToken fails the test if the URL has the token, and responds 401 without the header
+		assert.NoError(t, call(), name)
+	}
+
+	assert.Len(t, paths, len(calls))
+	assert.NotContains(t, logs.String(), "test-token")
+}
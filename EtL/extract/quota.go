@@ -0,0 +1,87 @@
+package extract
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+)
+
+// QuotaUsage is the usage of the Tiingo API by this process, next to the limits of the plan.
+// Limits are zero when not configured.
+type QuotaUsage struct {
+	Since            time.Time `json:"since"`
+	RequestsLastHour int       `json:"requests_last_hour"`
+	RequestsLastDay  int       `json:"requests_last_day"`
+	BytesThisMonth   int64     `json:"bytes_this_month"`
+	RequestsPerHour  int       `json:"requests_per_hour_limit"`
+	RequestsPerDay   int       `json:"requests_per_day_limit"`
+	BytesPerMonth    int64     `json:"bytes_per_month_limit"`
+}
+
+// quotaTracker counts the requests made to, and bytes downloaded from, the Tiingo API.
+// Tiingo limits requests per hour and per day, and bandwidth per calendar month.
+type quotaTracker struct {
+	mu       sync.Mutex
+	since    time.Time
+	requests []time.Time // made within the last 24 hours, oldest first
+	month    time.Time   // start of the month bytes are counted for
+	bytes    int64
+}
+
+func newQuotaTracker(now time.Time) *quotaTracker {
+	return &quotaTracker{since: now, month: startOfMonth(now)}
+}
+
+// record counts a request that downloaded n bytes.
+func (q *quotaTracker) record(now time.Time, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune(now)
+	q.requests = append(q.requests, now)
+	q.bytes += int64(n)
+}
+
+// usage returns the usage at now, with the limits from cfg.
+func (q *quotaTracker) usage(now time.Time, cfg config.QuotaConfig) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune(now)
+	lastHour := 0
+	for _, t := range q.requests {
+		if now.Sub(t) < time.Hour {
+			lastHour++
+		}
+	}
+
+	return QuotaUsage{
+		Since:            q.since,
+		RequestsLastHour: lastHour,
+		RequestsLastDay:  len(q.requests),
+		BytesThisMonth:   q.bytes,
+		RequestsPerHour:  cfg.RequestsPerHour,
+		RequestsPerDay:   cfg.RequestsPerDay,
+		BytesPerMonth:    cfg.BytesPerMonth,
+	}
+}
+
+// prune drops requests older than 24 hours, and resets the byte count in a new month.
+func (q *quotaTracker) prune(now time.Time) {
+	i := 0
+	for i < len(q.requests) && now.Sub(q.requests[i]) >= 24*time.Hour {
+		i++
+	}
+	q.requests = q.requests[i:]
+
+	if month := startOfMonth(now); month.After(q.month) {
+		q.month = month
+		q.bytes = 0
+	}
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,46 @@
+package extract
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	start := time.Date(2024, 10, 31, 12, 0, 0, 0, time.UTC)
+	limits := config.QuotaConfig{RequestsPerHour: 10000, RequestsPerDay: 100000, BytesPerMonth: 1000}
+	q := newQuotaTracker(start)
+
+	q.record(start, 100)
+	q.record(start.Add(30*time.Minute), 200)
+	q.record(start.Add(90*time.Minute), 300)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want QuotaUsage
+	}{
+		{
+			name: "within the hour",
+			at:   start.Add(100 * time.Minute),
+			want: QuotaUsage{RequestsLastHour: 1, RequestsLastDay: 3, BytesThisMonth: 600},
+		},
+		{
+			name: "next day, new month",
+			at:   start.Add(24*time.Hour + 45*time.Minute),
+			want: QuotaUsage{RequestsLastHour: 0, RequestsLastDay: 1, BytesThisMonth: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Since = start
+			tt.want.RequestsPerHour = limits.RequestsPerHour
+			tt.want.RequestsPerDay = limits.RequestsPerDay
+			tt.want.BytesPerMonth = limits.BytesPerMonth
+			assert.Equal(t, tt.want, q.usage(tt.at, limits))
+		})
+	}
+}
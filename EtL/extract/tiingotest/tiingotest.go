@@ -0,0 +1,40 @@
+// Package tiingotest checks how requests to stand-ins of the Tiingo API in tests authenticate.
+package tiingotest
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+// credentialParam matches the names of query parameters that hold credentials.
+var credentialParam = regexp.MustCompile(`(?i)token|password|secret|api_?key`)
+
+// RequireToken wraps the handler of a test server, so requests only reach it when they
+// authenticate with the Authorization: Token <token> header, and are rejected with 401 otherwise.
+// The test fails if a request URL carries credentials, since URLs end up in logs.
+func RequireToken(t testing.TB, token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if params := Credentials(r.URL); len(params) > 0 {
+			t.Errorf("request URL %s carries credentials in %v", r.URL.Path, params)
+		}
+		if r.Header.Get("Authorization") != "Token "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"detail":"Invalid token."}`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Credentials returns the names of the query parameters of u that hold credentials, e.g. token.
+func Credentials(u *url.URL) []string {
+	var params []string
+	for name := range u.Query() {
+		if credentialParam.MatchString(name) {
+			params = append(params, name)
+		}
+	}
+	return params
+}
@@ -0,0 +1,36 @@
+package extract
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// RunUsage counts the requests made to, including retries, and bytes downloaded from the
+// Tiingo API within a run. Attach it to the context of the run with WithRunUsage.
+type RunUsage struct {
+	requests atomic.Int64
+	bytes    atomic.Int64
+}
+
+type runUsageKey struct{}
+
+// WithRunUsage returns a context whose requests are counted in u.
+func WithRunUsage(ctx context.Context, u *RunUsage) context.Context {
+	return context.WithValue(ctx, runUsageKey{}, u)
+}
+
+// Requests returns the number of requests counted, including retries.
+func (u *RunUsage) Requests() int64 {
+	return u.requests.Load()
+}
+
+// Bytes returns the number of response bytes counted.
+func (u *RunUsage) Bytes() int64 {
+	return u.bytes.Load()
+}
+
+// runUsage returns the RunUsage of ctx, or nil if it has none.
+func runUsage(ctx context.Context) *RunUsage {
+	u, _ := ctx.Value(runUsageKey{}).(*RunUsage)
+	return u
+}
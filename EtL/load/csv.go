@@ -7,26 +7,34 @@ import (
 	"io"
 )
 
+// AddTickerColumn appends a ticker column with the value ticker to the CSV data.
 func AddTickerColumn(csvData []byte, ticker string) ([]byte, error) {
-	// Create a reader for the CSV data
-	reader := csv.NewReader(bytes.NewReader(csvData))
-
-	// Create a buffer to hold the modified CSV data
 	var buffer bytes.Buffer
-	writer := csv.NewWriter(&buffer)
+	if err := AddTickerColumnTo(&buffer, bytes.NewReader(csvData), ticker); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// AddTickerColumnTo is AddTickerColumn for CSV data streamed from r to w, one record at a time.
+func AddTickerColumnTo(w io.Writer, r io.Reader, ticker string) error {
+	reader := csv.NewReader(r)
+	// Reuse the record slice, since each record is written before the next is read
+	reader.ReuseRecord = true
+	writer := csv.NewWriter(w)
 
 	// Read the header row
 	header, err := reader.Read()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+		return fmt.Errorf("failed to read CSV header: %w", err)
 	}
 
 	// Append the "ticker" column name to the header
 	header = append(header, "ticker")
 
-	// Write the modified header to the buffer
+	// Write the modified header
 	if err := writer.Write(header); err != nil {
-		return nil, fmt.Errorf("failed to write CSV header: %w", err)
+		return fmt.Errorf("failed to write CSV header: %w", err)
 	}
 
 	// Read and modify the remaining CSV data
@@ -36,25 +44,25 @@ func AddTickerColumn(csvData []byte, ticker string) ([]byte, error) {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read CSV data: %w", err)
+			return fmt.Errorf("failed to read CSV data: %w", err)
 		}
 
 		// Append the ticker value to the record
 		record = append(record, ticker)
 
-		// Write the modified record to the buffer
+		// Write the modified record
 		if err := writer.Write(record); err != nil {
-			return nil, fmt.Errorf("failed to write CSV data: %w", err)
+			return fmt.Errorf("failed to write CSV data: %w", err)
 		}
 	}
 
-	// Flush the writer to ensure all data is written to the buffer
+	// Flush the writer to ensure all data is written
 	writer.Flush()
 	if err := writer.Error(); err != nil {
-		return nil, fmt.Errorf("failed to flush CSV writer: %w", err)
+		return fmt.Errorf("failed to flush CSV writer: %w", err)
 	}
 
-	return buffer.Bytes(), nil
+	return nil
 }
 
 // ConcatCsvs concatenates multiple CSV files into a single CSV file.
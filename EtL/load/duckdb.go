@@ -6,18 +6,28 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
-	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
+	"time"
 
 	_ "github.com/marcboeker/go-duckdb"
 	duckdb "github.com/marcboeker/go-duckdb"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/constants"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	sqlfiles "github.com/rasnes/tiingo-duckdb-framework/EtL/sql"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+// otherQueries is the table label of query durations for queries not tied to a table or SQL file.
+const otherQueries = "other"
+
 type DuckDB struct {
 	Logger    *slog.Logger
 	DB        *sql.DB
@@ -25,15 +35,28 @@ type DuckDB struct {
 	Conn      driver.Conn
 	Appender  *duckdb.Appender
 	DBType    string
+	// SQL resolves the SQL files run by name, e.g. insert__daily_adjusted.sql; see sql.Registry.
+	SQL *sqlfiles.Registry
+	// ChangedKeysLimit is the maximum number of changed keys returned by upserts. Zero returns none.
+	ChangedKeysLimit int
+
+	// tx is the transaction all queries run in, if any; see InTx.
+	tx *sql.Tx
+	// committed are run when tx commits; see AfterCommit.
+	committed *[]func()
 }
 
 func NewDuckDB(config *config.Config, logger *slog.Logger) (*DuckDB, error) {
 	var path string
 	var dbType string
 	if strings.HasPrefix(config.DuckDB.Path, "md:") {
-		motherduckToken := os.Getenv("MOTHERDUCK_TOKEN")
-		if motherduckToken == "" {
-			return nil, fmt.Errorf("MOTHERDUCK_TOKEN env variable is not set")
+		provider, err := secrets.New(config.Secrets)
+		if err != nil {
+			return nil, fmt.Errorf("error creating secrets provider: %w", err)
+		}
+		motherduckToken, err := provider.Secret(context.Background(), "MOTHERDUCK_TOKEN")
+		if err != nil {
+			return nil, err
 		}
 		path = fmt.Sprintf("%s?motherduck_token=%s", config.DuckDB.Path, motherduckToken)
 		dbType = ":md:"
@@ -45,13 +68,20 @@ func NewDuckDB(config *config.Config, logger *slog.Logger) (*DuckDB, error) {
 		dbType = path
 	}
 
+	registry, err := sqlfiles.New(config.DuckDB.SQLDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The queries run whenever a connection is opened, so they are copied from the config
+	connInitFnQueries := slices.Clone(config.DuckDB.ConnInitFnQueries)
 	var connInitFn func(driver.ExecerContext) error
-	if len(config.DuckDB.ConnInitFnQueries) == 0 {
+	if len(connInitFnQueries) == 0 {
 		connInitFn = nil
 	} else {
 		connInitFn = func(exec driver.ExecerContext) error {
-			for _, path := range config.DuckDB.ConnInitFnQueries {
-				query, err := readQuery(path)
+			for _, path := range connInitFnQueries {
+				query, err := registry.Read(path)
 				if err != nil {
 					return err
 				}
@@ -64,12 +94,13 @@ func NewDuckDB(config *config.Config, logger *slog.Logger) (*DuckDB, error) {
 			}
 			return nil
 		}
-		logger.Debug(fmt.Sprintf("Connection initialization queries: %v", config.DuckDB.ConnInitFnQueries))
+		logger.Debug(fmt.Sprintf("Connection initialization queries: %v", connInitFnQueries), "sql", registry.Source())
 	}
 
 	connector, err := duckdb.NewConnector(path, connInitFn)
 	if err != nil {
-		return nil, err
+		// The path of a MotherDuck database includes the token
+		return nil, secrets.RedactError(err)
 	}
 
 	db := sql.OpenDB(connector)
@@ -84,49 +115,68 @@ func NewDuckDB(config *config.Config, logger *slog.Logger) (*DuckDB, error) {
 	}
 
 	return &DuckDB{
-		Logger:    logger,
-		DB:        db,
-		Connector: connector,
-		DBType:    dbType,
+		Logger:           logger,
+		DB:               db,
+		Connector:        connector,
+		DBType:           dbType,
+		SQL:              registry,
+		ChangedKeysLimit: config.DuckDB.ChangedKeysLimit,
 	}, nil
 }
 
-func readQuery(path string) ([]byte, error) {
-	// Open the file
-	file, err := os.Open(path)
+func (db *DuckDB) Close() {
+	db.DB.Close()
+	db.Connector.Close()
+}
+
+// LoadCSVWithQuery loads CSV data using a templated SQL query.
+// The query template should use {{.CsvFile}} where the temporary CSV filename should be inserted.
+func (db *DuckDB) LoadCSVWithQuery(ctx context.Context, csv []byte, queryTemplate string, params map[string]any) (sql.Result, error) {
+	// Create a temporary file
+	tmpFile, err := createTmpFile(csv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+		return nil, err
 	}
+	defer os.Remove(tmpFile.Name())
 
-	// Read the content of the file
-	query, err := io.ReadAll(file)
+	query, err := renderCSVQuery(tmpFile, queryTemplate, params)
 	if err != nil {
-		file.Close() // Ensure the file is closed if reading fails
-		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+		return nil, err
 	}
 
-	// Close the file after reading its content
-	if err := file.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close file %s: %w", path, err)
+	res, err := db.exec(ctx, otherQueries, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
-	return query, nil
-}
 
-func (db *DuckDB) Close() {
-	db.DB.Close()
-	db.Connector.Close()
+	return res, nil
 }
 
-// LoadCSVWithQuery loads CSV data using a templated SQL query.
-// The query template should use {{.CsvFile}} where the temporary CSV filename should be inserted.
-func (db *DuckDB) LoadCSVWithQuery(csv []byte, queryTemplate string, params map[string]any) (sql.Result, error) {
-	// Create a temporary file
+// UpsertCSVWithQuery loads CSV data into table using a templated 'insert or replace' query,
+// like LoadCSVWithQuery, and returns the new, changed and unchanged rows, counted like in LoadTmpFile.
+func (db *DuckDB) UpsertCSVWithQuery(ctx context.Context, csv []byte, queryTemplate string, params map[string]any, table string) (LoadResult, error) {
 	tmpFile, err := createTmpFile(csv)
 	if err != nil {
-		return nil, err
+		return LoadResult{}, err
 	}
 	defer os.Remove(tmpFile.Name())
 
+	query, err := renderCSVQuery(tmpFile, queryTemplate, params)
+	if err != nil {
+		return LoadResult{}, err
+	}
+
+	res, err := db.upsert(ctx, table, table, func(stage string) (string, error) {
+		return stageUpsertQuery(query, table, stage)
+	})
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("failed to execute query: %w", err)
+	}
+	return res, nil
+}
+
+// renderCSVQuery executes the query template with params, and the path of tmpFile as CsvFile.
+func renderCSVQuery(tmpFile *os.File, queryTemplate string, params map[string]any) (string, error) {
 	// Add the temporary file path to the template parameters
 	if params == nil {
 		params = make(map[string]any)
@@ -136,59 +186,83 @@ func (db *DuckDB) LoadCSVWithQuery(csv []byte, queryTemplate string, params map[
 	// Parse and execute the template
 	tmpl, err := template.New("sql").Parse(queryTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse query template: %w", err)
+		return "", fmt.Errorf("failed to parse query template: %w", err)
 	}
 
 	var queryBuffer bytes.Buffer
 	if err := tmpl.Execute(&queryBuffer, params); err != nil {
-		return nil, fmt.Errorf("failed to execute query template: %w", err)
+		return "", fmt.Errorf("failed to execute query template: %w", err)
 	}
-
-	res, err := db.DB.ExecContext(context.Background(), queryBuffer.String())
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute query: %w", err)
-	}
-
-	return res, nil
+	return queryBuffer.String(), nil
 }
 
 // LoadCSV loads CSV data into a table in DuckDB
 // If insert is true, 'insert or replace' semantics are used,
 // else the 'copy' command is used to load the data (which truncates the table).
-func (db *DuckDB) LoadCSV(csv []byte, table string, insert bool) error {
+func (db *DuckDB) LoadCSV(ctx context.Context, csv []byte, table string, insert bool) (LoadResult, error) {
 	// Create a temporary file
 	tmpFile, err := createTmpFile(csv)
 	if err != nil {
-		return err
+		return LoadResult{}, err
 	}
 	defer os.Remove(tmpFile.Name())
 
-	if err := db.LoadTmpFile(tmpFile, table, insert); err != nil {
-		return err
-	}
-
-	return nil
+	return db.LoadTmpFile(ctx, tmpFile, table, insert)
 }
 
 // LoadTmpFile loads a temporary file into a table in DuckDB
 // If insert is true, 'insert or replace' semantics are used,
 // else the write-truncate semantics are used.
-func (db *DuckDB) LoadTmpFile(tmpFile *os.File, table string, insert bool) error {
-	// Use the COPY statement or INSERT OR REPLACE to read the data from the temporary file into DuckDB
-	var query string
+// With 'insert or replace', the rows are staged first to count the new, changed and unchanged rows.
+func (db *DuckDB) LoadTmpFile(ctx context.Context, tmpFile *os.File, table string, insert bool) (LoadResult, error) {
+	readCSV := fmt.Sprintf("read_csv('%s', delim=',', quote='\"', escape='\"', header=true)", tmpFile.Name())
+
 	if insert {
-		query = fmt.Sprintf("INSERT OR REPLACE INTO %s SELECT * FROM read_csv('%s', delim=',', quote='\"', escape='\"', header=true);", table, tmpFile.Name())
-	} else {
-		query = fmt.Sprintf("TRUNCATE TABLE %s; COPY %s FROM '%s' (FORMAT CSV, DELIMITER ',', QUOTE '\"', ESCAPE '\"', HEADER);", table, table, tmpFile.Name())
+		res, err := db.upsert(ctx, table, table, func(stage string) (string, error) {
+			return fmt.Sprintf("INSERT INTO %s SELECT * FROM %s;", stage, readCSV), nil
+		})
+		if err != nil {
+			return LoadResult{}, fmt.Errorf("failed to execute INSERT OR REPLACE INTO statement: %w", err)
+		}
+		return res, nil
 	}
 
+	// Use the COPY statement to read the data from the temporary file into DuckDB
+	query := fmt.Sprintf("TRUNCATE TABLE %s; COPY %s FROM '%s' (FORMAT CSV, DELIMITER ',', QUOTE '\"', ESCAPE '\"', HEADER);", table, table, tmpFile.Name())
 	db.Logger.Debug("Executing DuckDB query", "query", query)
 
-	if _, err := db.DB.ExecContext(context.Background(), query); err != nil {
-		return fmt.Errorf("failed to execute COPY or INSERT OR REPLACE INTO statement: %w", err)
+	res, err := db.exec(ctx, table, query)
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("failed to execute COPY statement: %w", err)
 	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	db.AfterCommit(func() { metrics.DuckDBRowsLoaded.WithLabelValues(table).Add(float64(rows)) })
+	return LoadResult{Inserted: rows}, nil
+}
 
-	return nil
+// RunUpsertFile runs the 'insert or replace' query into table in the SQL file, and returns the
+// new, changed and unchanged rows, counted like in LoadTmpFile.
+func (db *DuckDB) RunUpsertFile(ctx context.Context, path, table string) (LoadResult, error) {
+	query, err := db.SQL.Read(path)
+	if err != nil {
+		return LoadResult{}, err
+	}
+
+	return db.upsert(ctx, queryFileLabel(path), table, func(stage string) (string, error) {
+		return stageUpsertQuery(string(query), table, stage)
+	})
+}
+
+// CountRows returns the number of rows in table.
+func (db *DuckDB) CountRows(ctx context.Context, table string) (int64, error) {
+	var n int64
+	if err := db.queryRow(ctx, otherQueries, fmt.Sprintf("select count(*) from %s;", table), &n); err != nil {
+		return 0, fmt.Errorf("failed to count rows of %s: %w", table, err)
+	}
+	return n, nil
 }
 
 func createTmpFile(csv []byte) (*os.File, error) {
@@ -222,36 +296,82 @@ func createTmpFile(csv []byte) (*os.File, error) {
 	return tmpFile, nil
 }
 
-func (db *DuckDB) RunQuery(query string) error {
-	_, err := db.DB.ExecContext(context.Background(), query)
-	if err != nil {
-		return fmt.Errorf("failed to execute query: %w", err)
+// RunQuery executes a query without returning rows. Optional args are bound to
+// the query's placeholders.
+func (db *DuckDB) RunQuery(ctx context.Context, query string, args ...any) error {
+	return db.runQuery(ctx, otherQueries, query, args...)
+}
+
+// Attach attaches the database at path, a local file or e.g. md:prod, under the alias.
+// Credentials in path, e.g. a motherduck_token, are redacted from the log and errors.
+func (db *DuckDB) Attach(ctx context.Context, path, alias string, readOnly bool) error {
+	query := fmt.Sprintf("ATTACH IF NOT EXISTS '%s' AS %s", strings.ReplaceAll(path, "'", "''"), alias)
+	if readOnly {
+		query += " (READ_ONLY)"
 	}
+	if err := db.runQuery(ctx, otherQueries, query+";"); err != nil {
+		return secrets.RedactError(fmt.Errorf("failed to attach %s as %s: %w", path, alias, err))
+	}
+	db.Logger.Info(fmt.Sprintf("Attached %s as %s", secrets.Redact(path), alias), "read_only", readOnly)
 	return nil
 }
 
-func (db *DuckDB) RunQueryFile(path string) error {
-	query, err := readQuery(path)
+// RunQueryFile executes the query in the SQL file. Its duration is recorded
+// with the file name, e.g. insert__daily_adjusted, as table label.
+func (db *DuckDB) RunQueryFile(ctx context.Context, path string) error {
+	query, err := db.SQL.Read(path)
 	if err != nil {
 		return err
 	}
 
-	return db.RunQuery(string(query))
+	return db.runQuery(ctx, queryFileLabel(path), string(query))
 }
 
-func (db *DuckDB) GetQueryResultsFromFile(path string) (map[string][]string, error) {
-	query, err := readQuery(path)
+// GetQueryResultsFromFile is GetQueryResults for the query in the SQL file.
+func (db *DuckDB) GetQueryResultsFromFile(ctx context.Context, path string) (map[string][]string, error) {
+	query, err := db.SQL.Read(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return db.GetQueryResults(string(query))
+	return db.getQueryResults(ctx, queryFileLabel(path), string(query))
+}
+
+// GetQueryResults executes a query and returns the results as a map of column names to slices of values.
+// Optional args are bound to the query's placeholders.
+func (db *DuckDB) GetQueryResults(ctx context.Context, query string, args ...any) (map[string][]string, error) {
+	return db.getQueryResults(ctx, otherQueries, query, args...)
+}
+
+func (db *DuckDB) runQuery(ctx context.Context, label, query string, args ...any) error {
+	if _, err := db.exec(ctx, label, query, args...); err != nil {
+		return fmt.Errorf("failed to execute query: %w", err)
+	}
+	return nil
 }
 
-// GetQueryResults executes a query and returns the results as a map of column names to slices of values
-func (db *DuckDB) GetQueryResults(query string) (map[string][]string, error) {
+// exec executes a query, recording its span and duration with the label.
+func (db *DuckDB) exec(ctx context.Context, label, query string, args ...any) (sql.Result, error) {
+	ctx, done := startQuery(ctx, label)
+	res, err := db.querier().ExecContext(ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+// queryRow scans the single row of a query into dest, recording its span and duration with the label.
+func (db *DuckDB) queryRow(ctx context.Context, label, query string, dest ...any) error {
+	ctx, done := startQuery(ctx, label)
+	err := db.querier().QueryRowContext(ctx, query).Scan(dest...)
+	done(err)
+	return err
+}
+
+func (db *DuckDB) getQueryResults(ctx context.Context, label, query string, args ...any) (_ map[string][]string, err error) {
+	ctx, done := startQuery(ctx, label)
+	defer func() { done(err) }()
+
 	// Execute the query
-	rows, err := db.DB.QueryContext(context.Background(), query)
+	rows, err := db.querier().QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -299,3 +419,19 @@ func (db *DuckDB) GetQueryResults(query string) (map[string][]string, error) {
 
 	return results, nil
 }
+
+// startQuery starts the span of a query, labelled by the table loaded or SQL file run.
+// The returned function ends the span and records the duration of the query.
+func startQuery(ctx context.Context, label string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "duckdb.query", semconv.DBSystemKey.String("duckdb"), tracing.TableKey.String(label))
+	return ctx, func(err error) {
+		metrics.DuckDBQueryDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}
+}
+
+// queryFileLabel returns the metric label of a SQL file, i.e. its name without extension.
+func queryFileLabel(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
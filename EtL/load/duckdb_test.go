@@ -1,10 +1,15 @@
 package load
 
 import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -31,13 +36,67 @@ func TestNewDuckDB(t *testing.T) {
 	assert.NotNil(t, db.DB)
 }
 
+func TestNewDuckDB_SQLFiles(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	t.Run("embedded", func(t *testing.T) {
+		cfg := &config.Config{DuckDB: config.DuckDBConfig{
+			Path:              ":memory:",
+			ConnInitFnQueries: []string{"schemas.sql", "table__daily_adjusted.sql"},
+		}}
+		db, err := NewDuckDB(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create DuckDB instance: %v", err)
+		}
+		defer db.Close()
+
+		assert.Equal(t, "embedded", db.SQL.Source())
+		n, err := db.CountRows(ctx, "daily_adjusted")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+
+	t.Run("sql_dir overrides the embedded files", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, query := range map[string]string{
+			"schemas.sql":          "create table dev (id integer);",
+			"query__dev_count.sql": "select count(*) as n from dev;",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(query), 0o644); err != nil {
+				t.Fatalf("Failed to write %s: %v", name, err)
+			}
+		}
+		cfg := &config.Config{DuckDB: config.DuckDBConfig{
+			Path:              ":memory:",
+			ConnInitFnQueries: []string{"schemas.sql"},
+			SQLDir:            dir,
+		}}
+		db, err := NewDuckDB(cfg, logger)
+		if err != nil {
+			t.Fatalf("Failed to create DuckDB instance: %v", err)
+		}
+		defer db.Close()
+
+		results, err := db.GetQueryResultsFromFile(ctx, "query__dev_count.sql")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"n": {"0"}}, results)
+	})
+
+	t.Run("missing sql_dir", func(t *testing.T) {
+		cfg := &config.Config{DuckDB: config.DuckDBConfig{Path: ":memory:", SQLDir: filepath.Join(t.TempDir(), "missing")}}
+		_, err := NewDuckDB(cfg, logger)
+		assert.ErrorContains(t, err, "error opening SQL directory")
+	})
+}
+
 func TestLoadCSVWithQuery(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
 	// Create a test table
 	createTableQuery := "CREATE TABLE test (id INTEGER, name STRING);"
-	err := db.RunQuery(createTableQuery)
+	err := db.RunQuery(context.Background(), createTableQuery)
 	assert.NoError(t, err)
 
 	// Test data
@@ -46,12 +105,12 @@ func TestLoadCSVWithQuery(t *testing.T) {
 	params := map[string]any{}
 
 	// Execute the templated query
-	res, err := db.LoadCSVWithQuery(csvData, queryTemplate, params)
+	res, err := db.LoadCSVWithQuery(context.Background(), csvData, queryTemplate, params)
 	assert.NoError(t, err)
 	assert.NotNil(t, res)
 
 	// Verify the data was loaded correctly
-	results, err := db.GetQueryResults("SELECT * FROM test ORDER BY id;")
+	results, err := db.GetQueryResults(context.Background(), "SELECT * FROM test ORDER BY id;")
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]string{
 		"id":   {"1", "2"},
@@ -64,7 +123,7 @@ func TestLoadCSVWithEmptyData(t *testing.T) {
 	defer db.Close()
 
 	// Test with empty CSV data
-	err := db.LoadCSV([]byte{}, "test", false)
+	_, err := db.LoadCSV(context.Background(), []byte{}, "test", false)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "received empty CSV data")
 }
@@ -74,7 +133,7 @@ func TestLoadCSVWithNoneResponse(t *testing.T) {
 	defer db.Close()
 
 	// Test with "None%" response
-	err := db.LoadCSV([]byte("None%"), "test", false)
+	_, err := db.LoadCSV(context.Background(), []byte("None%"), "test", false)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "received 'None%' response from API")
 }
@@ -85,17 +144,20 @@ func TestLoadCSV(t *testing.T) {
 
 	// Create a test table
 	createTableQuery := "CREATE TABLE test (id INTEGER, name STRING);"
-	err := db.RunQuery(createTableQuery)
+	err := db.RunQuery(context.Background(), createTableQuery)
 	assert.NoError(t, err)
 
 	// Load CSV data into the test table
+	rowsLoaded := testutil.ToFloat64(metrics.DuckDBRowsLoaded.WithLabelValues("test"))
 	csvData := []byte("id,name\n1,Alice\n2,Bob")
-	err = db.LoadCSV(csvData, "test", false)
+	res, err := db.LoadCSV(context.Background(), csvData, "test", false)
 	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 2}, res)
+	assert.Equal(t, rowsLoaded+2, testutil.ToFloat64(metrics.DuckDBRowsLoaded.WithLabelValues("test")))
 
 	// Verify the data was loaded correctly
 	query := "SELECT * FROM test;"
-	results, err := db.GetQueryResults(query)
+	results, err := db.GetQueryResults(context.Background(), query)
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]string{
 		"id":   {"1", "2"},
@@ -103,23 +165,46 @@ func TestLoadCSV(t *testing.T) {
 	}, results)
 }
 
+func TestLoadCSV_InsertOrReplace(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	err := db.RunQuery(context.Background(), "CREATE TABLE test (id INTEGER PRIMARY KEY, name STRING);")
+	assert.NoError(t, err)
+
+	res, err := db.LoadCSV(context.Background(), []byte("id,name\n1,Alice\n2,Bob"), "test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 2}, res)
+
+	// Bob is changed, Carol is inserted and Alice is unchanged
+	db.ChangedKeysLimit = 10
+	res, err = db.LoadCSV(context.Background(), []byte("id,name\n2,Robert\n3,Carol\n1,Alice"), "test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 1, Changed: 1, Unchanged: 1, ChangedKeys: []string{"2"}}, res)
+	assert.True(t, res.Modified())
+
+	n, err := db.CountRows(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
 func TestRunQuery(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
 	// Create a test table
 	createTableQuery := "CREATE TABLE test (id INTEGER, name STRING);"
-	err := db.RunQuery(createTableQuery)
+	err := db.RunQuery(context.Background(), createTableQuery)
 	assert.NoError(t, err)
 
 	// Insert data into the test table
 	insertQuery := "INSERT INTO test VALUES (1, 'Alice'), (2, 'Bob');"
-	err = db.RunQuery(insertQuery)
+	err = db.RunQuery(context.Background(), insertQuery)
 	assert.NoError(t, err)
 
 	// Verify the data was inserted correctly
 	query := "SELECT * FROM test;"
-	results, err := db.GetQueryResults(query)
+	results, err := db.GetQueryResults(context.Background(), query)
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]string{
 		"id":   {"1", "2"},
@@ -143,12 +228,12 @@ func TestRunQueryFile(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Run the query from the file
-	err = db.RunQueryFile(tmpFile.Name())
+	err = db.RunQueryFile(context.Background(), tmpFile.Name())
 	assert.NoError(t, err)
 
 	// Verify the table was created
 	query = "SELECT * FROM test;"
-	results, err := db.GetQueryResults(query)
+	results, err := db.GetQueryResults(context.Background(), query)
 	assert.NoError(t, err)
 
 	// Check that the columns are present but no rows exist
@@ -165,16 +250,16 @@ func TestGetQueryResults(t *testing.T) {
 
 	// Create a test table and insert data
 	createTableQuery := "CREATE TABLE test (id INTEGER, name STRING);"
-	err := db.RunQuery(createTableQuery)
+	err := db.RunQuery(context.Background(), createTableQuery)
 	assert.NoError(t, err)
 
 	insertQuery := "INSERT INTO test VALUES (1, 'Alice'), (2, 'Bob');"
-	err = db.RunQuery(insertQuery)
+	err = db.RunQuery(context.Background(), insertQuery)
 	assert.NoError(t, err)
 
 	// Get query results
 	query := "SELECT * FROM test;"
-	results, err := db.GetQueryResults(query)
+	results, err := db.GetQueryResults(context.Background(), query)
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]string{
 		"id":   {"1", "2"},
@@ -188,11 +273,11 @@ func TestGetQueryResultsFromFile(t *testing.T) {
 
 	// Create a test table and insert data
 	createTableQuery := "CREATE TABLE test (id INTEGER, name STRING);"
-	err := db.RunQuery(createTableQuery)
+	err := db.RunQuery(context.Background(), createTableQuery)
 	assert.NoError(t, err)
 
 	insertQuery := "INSERT INTO test VALUES (1, 'Alice'), (2, 'Bob');"
-	err = db.RunQuery(insertQuery)
+	err = db.RunQuery(context.Background(), insertQuery)
 	assert.NoError(t, err)
 
 	// Create a temporary query file
@@ -207,7 +292,7 @@ func TestGetQueryResultsFromFile(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Get query results from the file
-	results, err := db.GetQueryResultsFromFile(tmpFile.Name())
+	results, err := db.GetQueryResultsFromFile(context.Background(), tmpFile.Name())
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]string{
 		"id":   {"1", "2"},
@@ -0,0 +1,108 @@
+package load
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Spool is a temporary directory of CSV files to be loaded into a table together with LoadSpool.
+// Downloads are written to it as they stream in, so the memory used by a batch does not grow
+// with the size of the batch or of its responses. Files may be written concurrently.
+type Spool struct {
+	Dir string
+
+	mu    sync.Mutex
+	files []string
+}
+
+// NewSpool creates a spool in a new directory in dir, or in the default directory for
+// temporary files if dir is empty.
+func NewSpool(dir string) (*Spool, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create spool directory: %w", err)
+		}
+	}
+	spoolDir, err := os.MkdirTemp(dir, "spool-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return &Spool{Dir: spoolDir}, nil
+}
+
+// Write writes a new CSV file to the spool with write. If write fails, the file is removed,
+// so only complete files are loaded.
+func (s *Spool) Write(write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(s.Dir, "*.csv")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close spool file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.mu.Lock()
+	s.files = append(s.files, f.Name())
+	s.mu.Unlock()
+	return nil
+}
+
+// Files returns the paths of the files written to the spool.
+func (s *Spool) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.files...)
+}
+
+// Close removes the spool directory and its files.
+func (s *Spool) Close() error {
+	return os.RemoveAll(s.Dir)
+}
+
+// LoadSpool loads the files of the spool into table with 'insert or replace' semantics, and
+// returns the new, changed and unchanged rows, counted like in LoadTmpFile. The files must have
+// the same columns, in the order of the columns of table. If distinct is true, duplicate rows are
+// removed before loading. DuckDB streams the files, spilling to disk if needed, so they are never
+// held in memory.
+func (db *DuckDB) LoadSpool(ctx context.Context, s *Spool, table string, distinct bool) (LoadResult, error) {
+	files := s.Files()
+	if len(files) == 0 {
+		return LoadResult{}, fmt.Errorf("spool %s has no files to load", s.Dir)
+	}
+
+	quoted := make([]string, len(files))
+	for i, f := range files {
+		quoted[i] = "'" + strings.ReplaceAll(f, "'", "''") + "'"
+	}
+	// The values are read as text and cast to the column types of table on insert, since the
+	// types sniffed from each file may disagree. Files are matched by column name, so a file with
+	// other columns adds columns, which fails the insert.
+	readCSV := fmt.Sprintf("read_csv([%s], delim=',', quote='\"', escape='\"', header=true, all_varchar=true, union_by_name=true)", strings.Join(quoted, ", "))
+	selectRows := "SELECT *"
+	if distinct {
+		selectRows = "SELECT DISTINCT *"
+	}
+
+	res, err := db.upsert(ctx, table, table, func(stage string) (string, error) {
+		return fmt.Sprintf("INSERT INTO %s %s FROM %s;", stage, selectRows, readCSV), nil
+	})
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("failed to load spool into %s: %w", table, err)
+	}
+	return res, nil
+}
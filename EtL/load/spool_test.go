@@ -0,0 +1,86 @@
+package load
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCSV writes csv to the spool with the ticker column added.
+func writeCSV(t *testing.T, s *Spool, csv, ticker string) {
+	t.Helper()
+	err := s.Write(func(w io.Writer) error {
+		return AddTickerColumnTo(w, strings.NewReader(csv), ticker)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write to spool: %v", err)
+	}
+}
+
+func TestLoadSpool(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, db.RunQuery(ctx, `
+		CREATE TABLE prices (date DATE, close DECIMAL(18,3), ticker VARCHAR, PRIMARY KEY (ticker, date));`))
+
+	t.Run("loads all files", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir())
+		assert.NoError(t, err)
+		defer s.Close()
+
+		// The first file sniffs as integers and the second as decimals
+		writeCSV(t, s, "date,close\n2024-01-02,1\n2024-01-03,", "AAPL")
+		writeCSV(t, s, "date,close\n2024-01-02,1.5\n2024-01-02,1.5\n", "MSFT")
+		// A failed write leaves no file to load
+		err = s.Write(func(w io.Writer) error {
+			_, _ = w.Write([]byte("date,close,ticker\n2024-01-02,99,TSLA\n"))
+			return errors.New("connection reset")
+		})
+		assert.ErrorContains(t, err, "connection reset")
+		assert.Len(t, s.Files(), 2)
+
+		res, err := db.LoadSpool(ctx, s, "prices", true)
+		assert.NoError(t, err)
+		assert.Equal(t, LoadResult{Inserted: 3}, res)
+
+		rows, err := db.GetQueryResults(ctx, "SELECT ticker, date::VARCHAR AS date, close::VARCHAR AS close FROM prices ORDER BY ticker, date")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{
+			"ticker": {"AAPL", "AAPL", "MSFT"},
+			"date":   {"2024-01-02", "2024-01-03", "2024-01-02"},
+			"close":  {"1.000", "<nil>", "1.500"},
+		}, rows)
+
+		assert.NoError(t, s.Close())
+		_, err = os.Stat(s.Dir)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("files with other columns", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir())
+		assert.NoError(t, err)
+		defer s.Close()
+
+		writeCSV(t, s, "date,close\n2024-01-04,1\n", "AAPL")
+		writeCSV(t, s, "date,open\n2024-01-04,1\n", "MSFT")
+
+		_, err = db.LoadSpool(ctx, s, "prices", false)
+		assert.ErrorContains(t, err, "failed to load spool into prices")
+	})
+
+	t.Run("empty spool", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir())
+		assert.NoError(t, err)
+		defer s.Close()
+
+		_, err = db.LoadSpool(ctx, s, "prices", false)
+		assert.ErrorContains(t, err, "has no files to load")
+	})
+}
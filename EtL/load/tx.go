@@ -0,0 +1,78 @@
+package load
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// querier runs queries on the database, or in a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// InTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+// All queries of the DuckDB passed to fn run in the transaction, so several loads into several
+// tables are committed atomically. Calling InTx on a DuckDB already in a transaction runs fn
+// in that transaction.
+func (db *DuckDB) InTx(ctx context.Context, fn func(tx *DuckDB) error) (err error) {
+	if db.tx != nil {
+		return fn(db)
+	}
+
+	sqlTx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			sqlTx.Rollback()
+			panic(p)
+		}
+	}()
+
+	var committed []func()
+	tx := *db
+	tx.tx, tx.committed = sqlTx, &committed
+	if err := fn(&tx); err != nil {
+		if rbErr := sqlTx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return errors.Join(err, fmt.Errorf("failed to roll back transaction: %w", rbErr))
+		}
+		db.Logger.Debug("Rolled back transaction", "error", err)
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	for _, fn := range committed {
+		fn()
+	}
+	return nil
+}
+
+// AfterCommit runs fn once the queries of db are committed: right away, or when the transaction
+// db is in commits. fn is never run if the transaction is rolled back. Loads report their rows
+// with it, so rolled back rows are never logged or counted as loaded.
+func (db *DuckDB) AfterCommit(fn func()) {
+	if db.tx == nil {
+		fn()
+		return
+	}
+	*db.committed = append(*db.committed, fn)
+}
+
+// InTransaction reports whether the queries of db run in a transaction; see InTx.
+func (db *DuckDB) InTransaction() bool {
+	return db.tx != nil
+}
+
+// querier returns the transaction of db, if any, else the database.
+func (db *DuckDB) querier() querier {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.DB
+}
@@ -0,0 +1,136 @@
+package load
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInTx(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T) *DuckDB {
+		db := setupTestDB(t)
+		t.Cleanup(db.Close)
+		assert.NoError(t, db.RunQuery(ctx, `
+			CREATE TABLE prices (ticker VARCHAR PRIMARY KEY, close DOUBLE);
+			CREATE TABLE latest (ticker VARCHAR, close DOUBLE);`))
+		return db
+	}
+	count := func(t *testing.T, db *DuckDB, table string) int64 {
+		n, err := db.CountRows(ctx, table)
+		assert.NoError(t, err)
+		return n
+	}
+
+	t.Run("commits all tables", func(t *testing.T) {
+		db := setup(t)
+		err := db.InTx(ctx, func(tx *DuckDB) error {
+			if _, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1\nMSFT,2"), "latest", false); err != nil {
+				return err
+			}
+			// The transaction sees its own uncommitted rows
+			assert.Equal(t, int64(2), count(t, tx, "latest"))
+			_, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "prices", true)
+			return err
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), count(t, db, "latest"))
+		assert.Equal(t, int64(1), count(t, db, "prices"))
+	})
+
+	t.Run("rolls back all tables on error", func(t *testing.T) {
+		db := setup(t)
+		errStep := errors.New("step failed")
+		err := db.InTx(ctx, func(tx *DuckDB) error {
+			if _, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "latest", false); err != nil {
+				return err
+			}
+			if _, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "prices", true); err != nil {
+				return err
+			}
+			return errStep
+		})
+		assert.ErrorIs(t, err, errStep)
+		assert.Equal(t, int64(0), count(t, db, "latest"))
+		assert.Equal(t, int64(0), count(t, db, "prices"))
+
+		// The database is usable after the rollback
+		res, err := db.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "prices", true)
+		assert.NoError(t, err)
+		assert.Equal(t, LoadResult{Inserted: 1}, res)
+	})
+
+	t.Run("rolls back on a failed query", func(t *testing.T) {
+		db := setup(t)
+		err := db.InTx(ctx, func(tx *DuckDB) error {
+			if err := tx.RunQuery(ctx, "INSERT INTO latest VALUES ('AAPL', 1);"); err != nil {
+				return err
+			}
+			return tx.RunQuery(ctx, "INSERT INTO missing VALUES (1);")
+		})
+		assert.ErrorContains(t, err, "missing")
+		assert.Equal(t, int64(0), count(t, db, "latest"))
+	})
+
+	t.Run("nested calls join the transaction", func(t *testing.T) {
+		db := setup(t)
+		err := db.InTx(ctx, func(tx *DuckDB) error {
+			assert.NoError(t, tx.InTx(ctx, func(nested *DuckDB) error {
+				assert.Same(t, tx, nested)
+				return nested.RunQuery(ctx, "INSERT INTO latest VALUES ('AAPL', 1);")
+			}))
+			return errors.New("outer step failed")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, int64(0), count(t, db, "latest"))
+	})
+
+	t.Run("reports loads once committed", func(t *testing.T) {
+		db := setup(t)
+		var logs bytes.Buffer
+		db.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+		loaded := func() float64 { return testutil.ToFloat64(metrics.DuckDBRowsLoaded.WithLabelValues("prices")) }
+		before := loaded()
+
+		errStep := errors.New("step failed")
+		err := db.InTx(ctx, func(tx *DuckDB) error {
+			if _, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "prices", true); err != nil {
+				return err
+			}
+			return errStep
+		})
+		assert.ErrorIs(t, err, errStep)
+		assert.Equal(t, before, loaded())
+		assert.NotContains(t, logs.String(), "Upserted rows into prices")
+
+		err = db.InTx(ctx, func(tx *DuckDB) error {
+			_, err := tx.LoadCSV(ctx, []byte("ticker,close\nAAPL,1"), "prices", true)
+			// Not reported before the commit
+			assert.Equal(t, before, loaded())
+			assert.NotContains(t, logs.String(), "Upserted rows into prices")
+			return err
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, loaded())
+		assert.Contains(t, logs.String(), "Upserted rows into prices")
+	})
+
+	t.Run("rolls back on panic", func(t *testing.T) {
+		db := setup(t)
+		assert.Panics(t, func() {
+			db.InTx(ctx, func(tx *DuckDB) error {
+				if err := tx.RunQuery(ctx, "INSERT INTO latest VALUES ('AAPL', 1);"); err != nil {
+					return err
+				}
+				panic("boom")
+			})
+		})
+		assert.Equal(t, int64(0), count(t, db, "latest"))
+	})
+}
@@ -0,0 +1,193 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+)
+
+// LoadResult counts the rows loaded into a table. With 'insert or replace' semantics, rows
+// with a new key are Inserted, and rows replacing an existing row are Changed if any value
+// differs, else Unchanged. When the table is truncated, all rows are Inserted.
+type LoadResult struct {
+	Inserted  int64
+	Changed   int64
+	Unchanged int64
+	// ChangedKeys are the primary keys of up to DuckDB.ChangedKeysLimit changed rows,
+	// with the values of composite keys joined by '|'.
+	ChangedKeys []string
+}
+
+// Modified returns whether the load inserted or changed any rows.
+func (r LoadResult) Modified() bool {
+	return r.Inserted > 0 || r.Changed > 0
+}
+
+// upsert stages rows in a temporary table with the columns of table, counts how many are new,
+// changed and unchanged, and merges them into table with 'insert or replace', all in a
+// single transaction. stageInsert returns the query inserting the rows into the stage table.
+func (db *DuckDB) upsert(ctx context.Context, label, table string, stageInsert func(stage string) (string, error)) (LoadResult, error) {
+	var res LoadResult
+	// Temporary tables are per connection, which the transaction is pinned to
+	err := db.InTx(ctx, func(tx *DuckDB) error {
+		stage := stageTable(table)
+		if _, err := tx.exec(ctx, label, fmt.Sprintf("CREATE OR REPLACE TEMP TABLE %s AS SELECT * FROM %s LIMIT 0;", stage, table)); err != nil {
+			return fmt.Errorf("failed to create stage table for %s: %w", table, err)
+		}
+		query, err := stageInsert(stage)
+		if err != nil {
+			return err
+		}
+		tx.Logger.Debug("Executing DuckDB query", "query", query)
+		if _, err := tx.exec(ctx, label, query); err != nil {
+			return err
+		}
+
+		keys, err := primaryKey(ctx, tx.querier(), table)
+		if err != nil {
+			return err
+		}
+		res, err = tx.compareStage(ctx, label, table, stage, keys)
+		if err != nil {
+			return err
+		}
+
+		// 'insert or replace' is an error without a primary key to conflict on
+		merge := "INSERT OR REPLACE INTO"
+		if len(keys) == 0 {
+			merge = "INSERT INTO"
+		}
+		if _, err := tx.exec(ctx, label, fmt.Sprintf("%s %s SELECT * FROM %s; DROP TABLE %s;", merge, table, stage, stage)); err != nil {
+			return fmt.Errorf("failed to merge stage into %s: %w", table, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return LoadResult{}, err
+	}
+
+	db.AfterCommit(func() {
+		metrics.DuckDBRowsLoaded.WithLabelValues(table).Add(float64(res.Inserted + res.Changed + res.Unchanged))
+		db.Logger.Info(fmt.Sprintf("Upserted rows into %s", table),
+			"inserted", res.Inserted,
+			"changed", res.Changed,
+			"unchanged", res.Unchanged)
+	})
+	return res, nil
+}
+
+// UpsertQuery inserts the rows selected by query into table with 'insert or replace' semantics,
+// and returns the new, changed and unchanged rows, counted like in LoadTmpFile. The table may be
+// qualified by an attached database, e.g. prod.fundamentals.daily.
+func (db *DuckDB) UpsertQuery(ctx context.Context, table, query string) (LoadResult, error) {
+	res, err := db.upsert(ctx, table, table, func(stage string) (string, error) {
+		return fmt.Sprintf("INSERT INTO %s %s", stage, query), nil
+	})
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("failed to upsert into %s: %w", table, err)
+	}
+	return res, nil
+}
+
+// compareStage counts the rows of the stage table that are new, changed and unchanged in table,
+// matching rows on the primary key columns keys. Without a primary key, all rows are new.
+func (db *DuckDB) compareStage(ctx context.Context, label, table, stage string, keys []string) (LoadResult, error) {
+	if len(keys) == 0 {
+		var res LoadResult
+		if err := db.queryRow(ctx, label, fmt.Sprintf("SELECT count(*) FROM %s;", stage), &res.Inserted); err != nil {
+			return LoadResult{}, fmt.Errorf("failed to count staged rows: %w", err)
+		}
+		return res, nil
+	}
+
+	join := make([]string, len(keys))
+	for i, key := range keys {
+		join[i] = fmt.Sprintf("s.%s = t.%s", key, key)
+	}
+	from := fmt.Sprintf("FROM %s s LEFT JOIN %s t ON %s", stage, table, strings.Join(join, " AND "))
+	// s and t are the whole rows as structs, compared on all columns
+	query := fmt.Sprintf(`SELECT
+		count(*) FILTER (WHERE t.%[1]s IS NULL),
+		count(*) FILTER (WHERE t.%[1]s IS NOT NULL AND s IS DISTINCT FROM t),
+		count(*) FILTER (WHERE t.%[1]s IS NOT NULL AND s IS NOT DISTINCT FROM t)
+		%[2]s;`, keys[0], from)
+
+	var res LoadResult
+	if err := db.queryRow(ctx, label, query, &res.Inserted, &res.Changed, &res.Unchanged); err != nil {
+		return LoadResult{}, fmt.Errorf("failed to compare staged rows with %s: %w", table, err)
+	}
+
+	if db.ChangedKeysLimit > 0 && res.Changed > 0 {
+		keyValues := make([]string, len(keys))
+		for i, key := range keys {
+			keyValues[i] = fmt.Sprintf("s.%s::VARCHAR", key)
+		}
+		changed, err := db.getQueryResults(ctx, label, fmt.Sprintf(
+			"SELECT concat_ws('|', %s) AS key %s WHERE t.%s IS NOT NULL AND s IS DISTINCT FROM t ORDER BY key LIMIT %d;",
+			strings.Join(keyValues, ", "), from, keys[0], db.ChangedKeysLimit))
+		if err != nil {
+			return LoadResult{}, fmt.Errorf("failed to get changed keys of %s: %w", table, err)
+		}
+		res.ChangedKeys = changed["key"]
+	}
+
+	return res, nil
+}
+
+// primaryKey returns the primary key columns of table, which may be qualified by its schema,
+// or by its database and schema, e.g. prod.fundamentals.daily.
+func primaryKey(ctx context.Context, q querier, table string) ([]string, error) {
+	// database.table and schema.table are both valid names of two parts
+	var where string
+	var args []any
+	switch parts := strings.Split(table, "."); len(parts) {
+	case 1:
+		where = "database_name = current_database() AND schema_name = 'main' AND table_name = ?"
+		args = []any{parts[0]}
+	case 2:
+		where = `((database_name = current_database() AND schema_name = ?) OR (database_name = ? AND schema_name = 'main'))
+			AND table_name = ?`
+		args = []any{parts[0], parts[0], parts[1]}
+	case 3:
+		where = "database_name = ? AND schema_name = ? AND table_name = ?"
+		args = []any{parts[0], parts[1], parts[2]}
+	default:
+		return nil, fmt.Errorf("invalid table name %s", table)
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT unnest(constraint_column_names)
+		FROM duckdb_constraints()
+		WHERE constraint_type = 'PRIMARY KEY' AND `+where+";", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get primary key of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan primary key of %s: %w", table, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// stageTable returns the name of the temporary stage table of table.
+func stageTable(table string) string {
+	return "stage__" + strings.ReplaceAll(table, ".", "_")
+}
+
+// stageUpsertQuery rewrites an 'insert or replace into table' query to insert into the stage table.
+func stageUpsertQuery(query, table, stage string) (string, error) {
+	re := regexp.MustCompile(`(?i)insert\s+or\s+replace\s+into\s+` + regexp.QuoteMeta(table) + `\b`)
+	if !re.MatchString(query) {
+		return "", fmt.Errorf("query is not an 'insert or replace into %s' query", table)
+	}
+	return re.ReplaceAllLiteralString(query, "insert into "+stage), nil
+}
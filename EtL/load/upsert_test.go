@@ -0,0 +1,154 @@
+package load
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsert_CompositeKey(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, db.RunQuery(ctx, `
+		CREATE SCHEMA fundamentals;
+		CREATE TABLE fundamentals.daily (date DATE, marketCap DECIMAL, ticker VARCHAR, PRIMARY KEY (ticker, date));`))
+
+	res, err := db.LoadCSV(ctx, []byte("date,marketCap,ticker\n2024-01-02,100.5,AAPL\n2024-01-03,101,AAPL\n2024-01-02,50,MSFT"), "fundamentals.daily", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 3}, res)
+
+	// Loading the same rows again changes nothing
+	res, err = db.LoadCSV(ctx, []byte("date,marketCap,ticker\n2024-01-02,100.5,AAPL\n2024-01-03,101,AAPL\n2024-01-02,50,MSFT"), "fundamentals.daily", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Unchanged: 3}, res)
+	assert.False(t, res.Modified())
+
+	// Changed keys are reported up to the limit, in order
+	db.ChangedKeysLimit = 2
+	res, err = db.LoadCSV(ctx, []byte("date,marketCap,ticker\n2024-01-02,50.5,MSFT\n2024-01-03,102,AAPL\n2024-01-02,,AAPL\n2024-01-04,51,MSFT"), "fundamentals.daily", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 1, Changed: 3, ChangedKeys: []string{"AAPL|2024-01-02", "AAPL|2024-01-03"}}, res)
+
+	rows, err := db.GetQueryResults(ctx, "SELECT ticker, date::VARCHAR AS date, marketCap::VARCHAR AS marketCap FROM fundamentals.daily ORDER BY ticker, date")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"ticker":    {"AAPL", "AAPL", "MSFT", "MSFT"},
+		"date":      {"2024-01-02", "2024-01-03", "2024-01-02", "2024-01-04"},
+		"marketCap": {"<nil>", "102.000", "50.500", "51.000"},
+	}, rows)
+}
+
+func TestUpsert_WithoutPrimaryKey(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, db.RunQuery(ctx, "CREATE TABLE test (id INTEGER, name STRING);"))
+	for range 2 {
+		res, err := db.LoadCSV(ctx, []byte("id,name\n1,Alice"), "test", true)
+		assert.NoError(t, err)
+		assert.Equal(t, LoadResult{Inserted: 1}, res)
+	}
+
+	n, err := db.CountRows(ctx, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestUpsert_RollsBackOnError(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, db.RunQuery(ctx, "CREATE TABLE test (id INTEGER PRIMARY KEY, name STRING NOT NULL);"))
+	_, err := db.LoadCSV(ctx, []byte("id,name\n1,Alice"), "test", true)
+	assert.NoError(t, err)
+
+	// The stage table has no constraints, so the merge fails on the missing name
+	_, err = db.LoadCSV(ctx, []byte("id,name\n2,Bob\n1,"), "test", true)
+	assert.ErrorContains(t, err, "failed to merge stage into test")
+
+	rows, err := db.GetQueryResults(ctx, "SELECT id, name FROM test")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"id": {"1"}, "name": {"Alice"}}, rows)
+
+	// The stage table is gone with the rolled back transaction
+	res, err := db.LoadCSV(ctx, []byte("id,name\n2,Bob"), "test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 1}, res)
+}
+
+func TestRunUpsertFile(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	assert.NoError(t, db.RunQuery(ctx, `
+		CREATE TABLE prices (ticker VARCHAR PRIMARY KEY, close DECIMAL);
+		CREATE TABLE latest (ticker VARCHAR, close DECIMAL);
+		INSERT INTO prices VALUES ('AAPL', 1), ('MSFT', 2);
+		INSERT INTO latest VALUES ('AAPL', 1), ('MSFT', 3), ('TSLA', 4);`))
+
+	path := filepath.Join(t.TempDir(), "insert__prices.sql")
+	assert.NoError(t, os.WriteFile(path, []byte("INSERT OR REPLACE INTO prices (ticker, close)\nselect ticker, close from latest;"), 0o644))
+
+	res, err := db.RunUpsertFile(ctx, path, "prices")
+	assert.NoError(t, err)
+	assert.Equal(t, LoadResult{Inserted: 1, Changed: 1, Unchanged: 1}, res)
+
+	// The query must upsert into the table
+	_, err = db.RunUpsertFile(ctx, path, "latest")
+	assert.ErrorContains(t, err, "query is not an 'insert or replace into latest' query")
+}
+
+func TestStageUpsertQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		table   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "lower case with columns",
+			query: "insert or replace into daily_adjusted (date, close)\nselect date, close from x;",
+			table: "daily_adjusted",
+			want:  "insert into stage__daily_adjusted (date, close)\nselect date, close from x;",
+		},
+		{
+			name:  "schema and whitespace",
+			query: "with m as (select 1)\nINSERT OR  REPLACE\nINTO fundamentals.meta\nselect * from m;",
+			table: "fundamentals.meta",
+			want:  "with m as (select 1)\ninsert into stage__fundamentals_meta\nselect * from m;",
+		},
+		{
+			name:    "other table with the same prefix",
+			query:   "insert or replace into daily_adjusted_old select 1;",
+			table:   "daily_adjusted",
+			wantErr: true,
+		},
+		{
+			name:    "plain insert",
+			query:   "insert into daily_adjusted select 1;",
+			table:   "daily_adjusted",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stageUpsertQuery(tt.query, tt.table, stageTable(tt.table))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,12 +1,22 @@
 package logger
 
 import (
+	"io"
 	"log/slog"
 	"os"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
 )
 
+// NewLogger returns a logger writing to stderr, so stdout only carries the output of commands,
+// e.g. reports in --report-format json.
 func NewLogger() *slog.Logger {
-	handler := slog.NewJSONHandler(os.Stdout, nil)
+	return New(os.Stderr)
+}
+
+// New returns a logger writing JSON to w, with secrets redacted from every line.
+func New(w io.Writer) *slog.Logger {
+	handler := secrets.NewHandler(slog.NewJSONHandler(w, nil))
 	logger := slog.New(handler)
 	return logger
 }
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Registry holds the metrics of the ETL. They are served on /metrics by `etl serve`,
+// and pushed to a Pushgateway at the end of batch commands.
+var Registry = prometheus.NewRegistry()
+
+// runtimeRegistry holds the Go runtime and process metrics, which are only served on
+// /metrics, since pushing them from short-lived batch commands is not meaningful.
+var runtimeRegistry = prometheus.NewRegistry()
+
+func init() {
+	runtimeRegistry.MustRegister(collectors.NewGoCollector())
+	runtimeRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+var (
+	TiingoRequests = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "etl_tiingo_requests_total",
+		Help: "HTTP requests to the Tiingo API, including retries, by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	TiingoRetries = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "etl_tiingo_retries_total",
+		Help: "Retried HTTP requests to the Tiingo API, by endpoint.",
+	}, []string{"endpoint"})
+
+	TiingoRequestDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "etl_tiingo_request_duration_seconds",
+		Help:    "Duration of fetches from the Tiingo API, including retries and backoff, by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"endpoint"})
+
+	DuckDBRowsLoaded = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "etl_duckdb_rows_loaded_total",
+		Help: "Rows inserted or replaced in DuckDB tables, by table.",
+	}, []string{"table"})
+
+	DuckDBQueryDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "etl_duckdb_query_duration_seconds",
+		Help:    "Duration of DuckDB queries, by table loaded or SQL file run. Other queries are labelled other.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"table"})
+
+	RunLastCompletion = promauto.With(Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etl_run_last_completion_timestamp_seconds",
+		Help: "Unix time of the last completed batch command, by outcome. The command is a grouping label of the push.",
+	}, []string{"outcome"})
+)
+
+// Handler serves the metrics in Registry, along with the Go runtime and process metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{Registry, runtimeRegistry}, promhttp.HandlerOpts{})
+}
+
+// Push replaces the metrics of the job in the Pushgateway at url with the metrics in Registry.
+// The grouping labels, e.g. the command, tell the batch runs of a job apart.
+func Push(ctx context.Context, url, job string, grouping map[string]string) error {
+	pusher := push.New(url, job).Gatherer(Registry)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if err := pusher.PushContext(ctx); err != nil {
+		return fmt.Errorf("error pushing metrics to %s: %w", url, err)
+	}
+	return nil
+}
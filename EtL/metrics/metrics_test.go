@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPush(t *testing.T) {
+	// Stand-in for a Pushgateway, recording the pushed metric families
+	var method, path string
+	var families []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var family dto.MetricFamily
+			if err := decoder.Decode(&family); err != nil {
+				break
+			}
+			families = append(families, family.GetName())
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	DuckDBRowsLoaded.WithLabelValues("daily_adjusted").Add(3)
+	RunLastCompletion.WithLabelValues("success").SetToCurrentTime()
+
+	err := Push(context.Background(), server.URL, "etl", map[string]string{"command": "eod_daily"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/metrics/job/etl/command/eod_daily", path)
+	assert.Contains(t, families, "etl_duckdb_rows_loaded_total")
+	assert.Contains(t, families, "etl_run_last_completion_timestamp_seconds")
+	// Runtime metrics are only served on /metrics
+	assert.NotContains(t, families, "go_goroutines")
+}
+
+func TestPush_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := Push(context.Background(), server.URL, "etl", nil)
+	assert.ErrorContains(t, err, "error pushing metrics to "+server.URL)
+}
+
+func TestHandler(t *testing.T) {
+	TiingoRequests.WithLabelValues("/tiingo/daily/prices", "200").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `etl_tiingo_requests_total{endpoint="/tiingo/daily/prices",status="200"}`)
+	assert.Contains(t, rec.Body.String(), "go_goroutines")
+}
@@ -0,0 +1,248 @@
+package notify
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+)
+
+// Severity of a notification. Targets are sent the notifications at or above their minimum severity.
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseSeverity parses info, warning or error.
+func ParseSeverity(s string) (Severity, error) {
+	switch strings.ToLower(s) {
+	case "info":
+		return Info, nil
+	case "warning":
+		return Warning, nil
+	case "error":
+		return Error, nil
+	}
+	return 0, fmt.Errorf("invalid severity %q, expected info, warning or error", s)
+}
+
+// Event is the outcome of a run, sent to the targets as a notification.
+type Event struct {
+	Severity Severity  `json:"severity"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Command  string    `json:"command"`
+	RunID    string    `json:"run_id"`
+	Env      string    `json:"env"`
+	Time     time.Time `json:"time"`
+	// Report is the report of the run, if any.
+	Report *pipeline.Report `json:"report,omitempty"`
+}
+
+// RunEvent returns the event of a run of command that returned report and err. Failed runs are
+// errors; data that failed validation, and tickers that failed without failing the run, are warnings.
+func RunEvent(command string, report *pipeline.Report, err error) Event {
+	e := Event{Command: command, Report: report}
+	if report != nil {
+		e.RunID = report.RunID
+	}
+
+	switch {
+	case errors.Is(err, pipeline.ErrValidation):
+		e.Severity = Warning
+		e.Title = fmt.Sprintf("%s: data failed validation", command)
+		e.Message = secrets.Redact(err.Error())
+	case err != nil:
+		e.Severity = Error
+		e.Title = fmt.Sprintf("%s failed", command)
+		e.Message = secrets.Redact(err.Error())
+	case report != nil && len(report.Failed) > 0:
+		e.Severity = Warning
+		e.Title = fmt.Sprintf("%s: %d tickers failed", command, len(report.Failed))
+		tickers := make([]string, len(report.Failed))
+		for i, f := range report.Failed {
+			tickers[i] = f.Ticker
+		}
+		e.Message = "Failed tickers: " + strings.Join(tickers, ", ")
+	default:
+		e.Severity = Info
+		e.Title = fmt.Sprintf("%s succeeded", command)
+		if report != nil {
+			e.Message = fmt.Sprintf("Processed %d", report.Processed)
+		}
+	}
+	return e
+}
+
+// sender sends an event to a target.
+type sender interface {
+	send(ctx context.Context, e Event) error
+}
+
+type target struct {
+	name        string
+	minSeverity Severity
+	sender      sender
+}
+
+// Notifier sends events to the configured targets. The same event is sent at most once per
+// target within the dedup window, tracked in the sent_notifications table.
+type Notifier struct {
+	targets     []target
+	dedupWindow time.Duration
+	db          *load.DuckDB
+	logger      *slog.Logger
+	now         func() time.Time
+}
+
+// New returns a notifier of the targets in cfg. db may be nil, disabling de-duplication.
+func New(cfg config.NotifyConfig, db *load.DuckDB, logger *slog.Logger) (*Notifier, error) {
+	n := &Notifier{
+		dedupWindow: cfg.DedupWindow,
+		db:          db,
+		logger:      logger,
+		now:         time.Now,
+	}
+
+	for i, t := range cfg.Targets {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", t.Type, i)
+		}
+
+		minSeverity := Warning
+		if t.MinSeverity != "" {
+			var err error
+			minSeverity, err = ParseSeverity(t.MinSeverity)
+			if err != nil {
+				return nil, fmt.Errorf("error in notify target %s: %w", name, err)
+			}
+		}
+
+		s, err := newSender(t)
+		if err != nil {
+			return nil, fmt.Errorf("error in notify target %s: %w", name, err)
+		}
+		n.targets = append(n.targets, target{name: name, minSeverity: minSeverity, sender: s})
+	}
+
+	return n, nil
+}
+
+// Notify sends the event to the targets at or below its severity, skipping the targets it
+// was sent to within the dedup window. Failing targets do not stop the others; their errors
+// are joined and returned.
+func (n *Notifier) Notify(ctx context.Context, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = n.now()
+	}
+
+	var errorList []error
+	for _, t := range n.targets {
+		if e.Severity < t.minSeverity {
+			continue
+		}
+
+		key := dedupKey(t.name, e)
+		duplicate, err := n.recentlySent(ctx, key)
+		if err != nil {
+			errorList = append(errorList, err)
+			continue
+		}
+		if duplicate {
+			n.logger.Info(fmt.Sprintf("Not notifying %s, already notified within %s", t.name, n.dedupWindow), "title", e.Title)
+			continue
+		}
+
+		if err := t.sender.send(ctx, e); err != nil {
+			errorList = append(errorList, fmt.Errorf("error notifying %s: %w", t.name, err))
+			continue
+		}
+		n.logger.Info(fmt.Sprintf("Notified %s", t.name), "severity", e.Severity.String(), "title", e.Title)
+
+		if err := n.markSent(ctx, key, t.name, e); err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+
+	return errors.Join(errorList...)
+}
+
+// dedupKey identifies an event sent to a target, ignoring its time, run id and report.
+func dedupKey(target string, e Event) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{target, e.Env, e.Command, e.Severity.String(), e.Title, e.Message}, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// recentlySent returns whether the event with the key was sent within the dedup window,
+// counting it as suppressed if so.
+func (n *Notifier) recentlySent(ctx context.Context, key string) (bool, error) {
+	if n.db == nil || n.dedupWindow <= 0 {
+		return false, nil
+	}
+
+	var lastSent time.Time
+	err := n.db.DB.QueryRowContext(ctx, "select last_sent_at from sent_notifications where dedup_key = ?;", key).Scan(&lastSent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up sent notification: %w", err)
+	}
+	if n.now().UTC().Sub(lastSent) >= n.dedupWindow {
+		return false, nil
+	}
+
+	if _, err := n.db.DB.ExecContext(ctx, "update sent_notifications set suppressed = suppressed + 1 where dedup_key = ?;", key); err != nil {
+		return true, fmt.Errorf("error counting suppressed notification: %w", err)
+	}
+	return true, nil
+}
+
+// markSent records that the event with the key was sent to the target.
+func (n *Notifier) markSent(ctx context.Context, key, target string, e Event) error {
+	if n.db == nil || n.dedupWindow <= 0 {
+		return nil
+	}
+
+	_, err := n.db.DB.ExecContext(ctx, `
+		insert into sent_notifications
+			(dedup_key, target, command, severity, title, first_sent_at, last_sent_at, suppressed)
+		values (?, ?, ?, ?, ?, ?, ?, 0)
+		on conflict (dedup_key) do update set last_sent_at = excluded.last_sent_at;`,
+		key, target, e.Command, e.Severity.String(), e.Title, n.now().UTC(), n.now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("error recording sent notification: %w", err)
+	}
+	return nil
+}
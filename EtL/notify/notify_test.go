@@ -0,0 +1,368 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestDB(t *testing.T) *load.DuckDB {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	db, err := load.NewDuckDB(&config.Config{
+		DuckDB: config.DuckDBConfig{
+			Path:              ":memory:",
+			ConnInitFnQueries: []string{"table__sent_notifications.sql"},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create DuckDB instance: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// hookRecorder stands in for webhooks, recording the requests posted to it.
+type hookRecorder struct {
+	mu      sync.Mutex
+	bodies  []map[string]any
+	headers []http.Header
+	status  int
+}
+
+func setupTestHook(t *testing.T) (*httptest.Server, *hookRecorder) {
+	rec := &hookRecorder{status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.bodies = append(rec.bodies, body)
+		rec.headers = append(rec.headers, r.Header)
+		w.WriteHeader(rec.status)
+	}))
+	t.Cleanup(server.Close)
+	return server, rec
+}
+
+func setupTestNotifier(t *testing.T, cfg config.NotifyConfig, db *load.DuckDB, now time.Time) *Notifier {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	n, err := New(cfg, db, logger)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	n.now = func() time.Time { return now }
+	return n
+}
+
+func TestRunEvent(t *testing.T) {
+	report := &pipeline.Report{RunID: "run-1", Processed: 3}
+	partial := &pipeline.Report{RunID: "run-2", Processed: 1, Failed: []pipeline.TickerError{{Ticker: "AAPL"}, {Ticker: "MSFT"}}}
+
+	tests := []struct {
+		name   string
+		report *pipeline.Report
+		err    error
+		want   Event
+	}{
+		{
+			name:   "succeeded",
+			report: report,
+			want:   Event{Severity: Info, Title: "eod_daily succeeded", Message: "Processed 3", Command: "eod_daily", RunID: "run-1", Report: report},
+		},
+		{
+			name:   "failed tickers",
+			report: partial,
+			want:   Event{Severity: Warning, Title: "eod_daily: 2 tickers failed", Message: "Failed tickers: AAPL, MSFT", Command: "eod_daily", RunID: "run-2", Report: partial},
+		},
+		{
+			name:   "validation failed",
+			report: report,
+			err:    fmt.Errorf("%w: no rows for the last trading day", pipeline.ErrValidation),
+			want:   Event{Severity: Warning, Title: "eod_daily: data failed validation", Message: "data validation failed: no rows for the last trading day", Command: "eod_daily", RunID: "run-1", Report: report},
+		},
+		{
+			name: "failed without report",
+			err:  errors.New("error creating pipeline"),
+			want: Event{Severity: Error, Title: "eod_daily failed", Message: "error creating pipeline", Command: "eod_daily"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, RunEvent("eod_daily", tt.report, tt.err))
+		})
+	}
+}
+
+func TestNotifier_Webhook(t *testing.T) {
+	server, rec := setupTestHook(t)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	n := setupTestNotifier(t, config.NotifyConfig{Targets: []config.NotifyTarget{
+		{Name: "raw", Type: "webhook", URL: server.URL + "/raw", MinSeverity: "info", Headers: map[string]string{"X-Token": "secret"}},
+		{Name: "templated", Type: "webhook", URL: server.URL + "/templated", Template: `{"summary": {{json .Title}}, "severity": "{{.Severity}}", "failed": {{len .Report.Failed}}}`},
+	}}, nil, now)
+
+	report := &pipeline.Report{RunID: "run-1", Failed: []pipeline.TickerError{{Ticker: "AAPL", Reason: "500"}}}
+	assert.NoError(t, n.Notify(context.Background(), Event{Severity: Warning, Title: `"quoted" title`, Command: "eod_daily", Report: report}))
+
+	if assert.Len(t, rec.bodies, 2) {
+		assert.Equal(t, "warning", rec.bodies[0]["severity"])
+		assert.Equal(t, `"quoted" title`, rec.bodies[0]["title"])
+		assert.Equal(t, "2024-01-02T03:04:05Z", rec.bodies[0]["time"])
+		assert.Equal(t, "run-1", rec.bodies[0]["report"].(map[string]any)["run_id"])
+		assert.Equal(t, "secret", rec.headers[0].Get("X-Token"))
+		assert.Equal(t, "application/json", rec.headers[0].Get("Content-Type"))
+
+		assert.Equal(t, map[string]any{"summary": `"quoted" title`, "severity": "warning", "failed": float64(1)}, rec.bodies[1])
+	}
+
+	// Info is only sent to the target with min_severity info
+	assert.NoError(t, n.Notify(context.Background(), Event{Severity: Info, Title: "eod_daily succeeded"}))
+	assert.Len(t, rec.bodies, 3)
+}
+
+func TestNotifier_Slack(t *testing.T) {
+	server, rec := setupTestHook(t)
+	n := setupTestNotifier(t, config.NotifyConfig{Targets: []config.NotifyTarget{
+		{Name: "slack", Type: "slack", URL: server.URL, MinSeverity: "error"},
+	}}, nil, time.Unix(1700000000, 0))
+
+	assert.NoError(t, n.Notify(context.Background(), Event{Severity: Warning, Title: "not sent"}))
+	assert.NoError(t, n.Notify(context.Background(), Event{
+		Severity: Error,
+		Title:    "eod_daily failed",
+		Message:  "error getting supported tickers",
+		Command:  "eod_daily",
+		Env:      "prod",
+		RunID:    "run-1",
+		Report:   &pipeline.Report{Processed: 2, Empty: []string{"NODAILY"}},
+	}))
+
+	if !assert.Len(t, rec.bodies, 1) {
+		return
+	}
+	assert.Equal(t, "[ERROR] eod_daily failed", rec.bodies[0]["text"])
+	attachment := rec.bodies[0]["attachments"].([]any)[0].(map[string]any)
+	assert.Equal(t, "danger", attachment["color"])
+	assert.Equal(t, "error getting supported tickers", attachment["text"])
+	assert.Equal(t, float64(1700000000), attachment["ts"])
+	assert.Contains(t, attachment["fields"], map[string]any{"title": "Env", "value": "prod", "short": true})
+	assert.Contains(t, attachment["fields"], map[string]any{"title": "Empty", "value": "1", "short": true})
+}
+
+func TestNotifier_Dedup(t *testing.T) {
+	server, rec := setupTestHook(t)
+	db := setupTestDB(t)
+	cfg := config.NotifyConfig{DedupWindow: time.Hour, Targets: []config.NotifyTarget{
+		{Name: "a", Type: "webhook", URL: server.URL},
+		{Name: "b", Type: "slack", URL: server.URL},
+	}}
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	n := setupTestNotifier(t, cfg, db, now)
+
+	event := Event{Severity: Error, Title: "eod_daily failed", Message: "timeout", Command: "eod_daily"}
+	assert.NoError(t, n.Notify(context.Background(), event))
+	assert.Len(t, rec.bodies, 2)
+
+	// The same event within the window is suppressed, also for a later run of the process
+	event.RunID = "run-2"
+	n = setupTestNotifier(t, cfg, db, now.Add(30*time.Minute))
+	assert.NoError(t, n.Notify(context.Background(), event))
+	assert.Len(t, rec.bodies, 2)
+
+	// A different message is sent
+	assert.NoError(t, n.Notify(context.Background(), Event{Severity: Error, Title: "eod_daily failed", Message: "401", Command: "eod_daily"}))
+	assert.Len(t, rec.bodies, 4)
+
+	// After the window, the event is sent again
+	n.now = func() time.Time { return now.Add(2 * time.Hour) }
+	assert.NoError(t, n.Notify(context.Background(), event))
+	assert.Len(t, rec.bodies, 6)
+
+	rows, err := db.GetQueryResults(context.Background(), "select target, suppressed, last_sent_at from sent_notifications where title = 'eod_daily failed' and suppressed > 0 order by target")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, rows["target"])
+	assert.Equal(t, []string{"1", "1"}, rows["suppressed"])
+	assert.Equal(t, []string{"2024-01-02 05:00:00 +0000 UTC", "2024-01-02 05:00:00 +0000 UTC"}, rows["last_sent_at"])
+}
+
+func TestNotifier_FailingTarget(t *testing.T) {
+	failing, failingRec := setupTestHook(t)
+	failingRec.status = http.StatusBadGateway
+	server, rec := setupTestHook(t)
+	db := setupTestDB(t)
+
+	n := setupTestNotifier(t, config.NotifyConfig{DedupWindow: time.Hour, Targets: []config.NotifyTarget{
+		{Name: "failing", Type: "webhook", URL: failing.URL},
+		{Name: "ok", Type: "webhook", URL: server.URL},
+	}}, db, time.Now())
+
+	event := Event{Severity: Error, Title: "eod_daily failed"}
+	err := n.Notify(context.Background(), event)
+	assert.ErrorContains(t, err, "error notifying failing: notification rejected with status 502")
+	assert.Len(t, rec.bodies, 1)
+
+	// The failed notification is not recorded as sent, so it is retried
+	failingRec.status = http.StatusOK
+	assert.NoError(t, n.Notify(context.Background(), event))
+	assert.Len(t, failingRec.bodies, 2)
+	assert.Len(t, rec.bodies, 1)
+}
+
+// smtpRecorder stands in for an SMTP server, recording the messages sent to it.
+type smtpRecorder struct {
+	mu       sync.Mutex
+	from     string
+	to       []string
+	messages []string
+}
+
+func setupTestSMTP(t *testing.T) (host string, port int, rec *smtpRecorder) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	rec = &smtpRecorder{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rec.serve(conn)
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, rec
+}
+
+func (r *smtpRecorder) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			r.mu.Lock()
+			r.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+			r.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			r.mu.Lock()
+			r.to = append(r.to, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+			r.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.messages = append(r.messages, string(data))
+			r.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestNotifier_Email(t *testing.T) {
+	host, port, rec := setupTestSMTP(t)
+	n := setupTestNotifier(t, config.NotifyConfig{Targets: []config.NotifyTarget{
+		{Name: "email", Type: "email", SMTPHost: host, SMTPPort: port, From: "etl@example.com", To: []string{"a@example.com", "b@example.com"}},
+	}}, nil, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	err := n.Notify(context.Background(), Event{
+		Severity: Warning,
+		Title:    "fundamentals_daily: 1 tickers failed",
+		Message:  "Failed tickers: .DOT",
+		Command:  "fundamentals_daily",
+		RunID:    "run-1",
+		Report:   &pipeline.Report{RunID: "run-1", Failed: []pipeline.TickerError{{Ticker: ".DOT", Reason: "500"}}},
+	})
+	assert.NoError(t, err)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	assert.Equal(t, "etl@example.com", rec.from)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, rec.to)
+	if !assert.Len(t, rec.messages, 1) {
+		return
+	}
+	msg := rec.messages[0]
+	assert.Contains(t, msg, "Subject: [etl warning] fundamentals_daily: 1 tickers failed\n")
+	assert.Contains(t, msg, "Date: Tue, 02 Jan 2024 03:04:05 +0000\n")
+	assert.Contains(t, msg, "To: a@example.com, b@example.com\n")
+	assert.Contains(t, msg, "Failed tickers: .DOT\n")
+	assert.Contains(t, msg, "Run: run-1\n")
+	// Lines starting with a dot survive the SMTP transfer
+	assert.Contains(t, msg, "\n.DOT    500\n")
+}
+
+func TestNotifier_EmailUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	n := setupTestNotifier(t, config.NotifyConfig{Targets: []config.NotifyTarget{
+		{Name: "email", Type: "email", SMTPHost: "127.0.0.1", SMTPPort: port, From: "etl@example.com", To: []string{"a@example.com"}},
+	}}, nil, time.Now())
+	err = n.Notify(context.Background(), Event{Severity: Error})
+	assert.ErrorContains(t, err, "error notifying email: error connecting to 127.0.0.1:"+strconv.Itoa(port))
+}
+
+func TestNew_InvalidTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  config.NotifyTarget
+		wantErr string
+	}{
+		{name: "unknown type", target: config.NotifyTarget{Name: "x", Type: "pager"}, wantErr: `error in notify target x: invalid type "pager"`},
+		{name: "webhook without url", target: config.NotifyTarget{Type: "webhook"}, wantErr: "error in notify target webhook-0: url is required"},
+		{name: "invalid template", target: config.NotifyTarget{Name: "x", Type: "webhook", URL: "http://localhost", Template: "{{.Title"}, wantErr: "error parsing template"},
+		{name: "email without recipients", target: config.NotifyTarget{Name: "x", Type: "email", SMTPHost: "localhost", From: "etl@example.com"}, wantErr: "smtp_host, from and to are required"},
+		{name: "invalid severity", target: config.NotifyTarget{Name: "x", Type: "slack", URL: "http://localhost", MinSeverity: "critical"}, wantErr: `invalid severity "critical"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(config.NotifyConfig{Targets: []config.NotifyTarget{tt.target}}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+)
+
+// sendTimeout bounds the time spent sending a notification to a target.
+const sendTimeout = 10 * time.Second
+
+var httpClient = &http.Client{Timeout: sendTimeout}
+
+func newSender(t config.NotifyTarget) (sender, error) {
+	switch t.Type {
+	case "webhook":
+		return newWebhook(t)
+	case "slack":
+		if t.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		return &slack{url: t.URL}, nil
+	case "email":
+		return newEmail(t)
+	}
+	return nil, fmt.Errorf("invalid type %q, expected webhook, slack or email", t.Type)
+}
+
+// webhook posts the event as JSON, or the JSON rendered by its template.
+type webhook struct {
+	url     string
+	tmpl    *template.Template
+	headers map[string]string
+}
+
+func newWebhook(t config.NotifyTarget) (*webhook, error) {
+	if t.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	w := &webhook{url: t.URL, headers: t.Headers}
+	if t.Template != "" {
+		tmpl, err := template.New(t.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(t.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template: %w", err)
+		}
+		w.tmpl = tmpl
+	}
+	return w, nil
+}
+
+// toJSON encodes v as JSON, so templates can embed strings and objects safely.
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (w *webhook) send(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	if w.tmpl != nil {
+		var buf bytes.Buffer
+		if err := w.tmpl.Execute(&buf, e); err != nil {
+			return fmt.Errorf("error executing template: %w", err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			return fmt.Errorf("template rendered invalid JSON: %s", buf.String())
+		}
+		body = buf.Bytes()
+	}
+	return postJSON(ctx, w.url, body, w.headers)
+}
+
+// slack posts the event to a Slack incoming webhook, as an attachment colored by severity.
+type slack struct {
+	url string
+}
+
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Title  string       `json:"title"`
+	Text   string       `json:"text"`
+	Fields []slackField `json:"fields"`
+	Ts     int64        `json:"ts"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+var slackColors = map[Severity]string{
+	Info:    "good",
+	Warning: "warning",
+	Error:   "danger",
+}
+
+func (s *slack) send(ctx context.Context, e Event) error {
+	fields := []slackField{
+		{Title: "Command", Value: e.Command, Short: true},
+		{Title: "Env", Value: e.Env, Short: true},
+		{Title: "Run", Value: e.RunID, Short: true},
+	}
+	if e.Report != nil {
+		fields = append(fields,
+			slackField{Title: "Processed", Value: strconv.Itoa(e.Report.Processed), Short: true},
+			slackField{Title: "Failed", Value: strconv.Itoa(len(e.Report.Failed)), Short: true},
+			slackField{Title: "Empty", Value: strconv.Itoa(len(e.Report.Empty)), Short: true},
+		)
+	}
+
+	body, err := json.Marshal(slackPayload{
+		Text: fmt.Sprintf("[%s] %s", strings.ToUpper(e.Severity.String()), e.Title),
+		Attachments: []slackAttachment{{
+			Color:  slackColors[e.Severity],
+			Title:  e.Title,
+			Text:   e.Message,
+			Fields: fields,
+			Ts:     e.Time.Unix(),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding Slack payload: %w", err)
+	}
+	return postJSON(ctx, s.url, body, nil)
+}
+
+func postJSON(ctx context.Context, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("notification rejected with status %d: %s", resp.StatusCode, strings.TrimSpace(string(excerpt)))
+	}
+	return nil
+}
+
+// email sends the event as a plain text email over SMTP, using STARTTLS if the server supports it.
+type email struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func newEmail(t config.NotifyTarget) (*email, error) {
+	if t.SMTPHost == "" || t.From == "" || len(t.To) == 0 {
+		return nil, errors.New("smtp_host, from and to are required")
+	}
+	port := t.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	return &email{
+		addr:     net.JoinHostPort(t.SMTPHost, strconv.Itoa(port)),
+		host:     t.SMTPHost,
+		username: t.Username,
+		password: t.Password,
+		from:     t.From,
+		to:       t.To,
+	}, nil
+}
+
+func (m *email) send(ctx context.Context, e Event) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %w", m.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error greeting %s: %w", m.addr, err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("error authenticating: %w", err)
+		}
+	}
+
+	if err := c.Mail(m.from); err != nil {
+		return fmt.Errorf("error setting sender: %w", err)
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("error adding recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error starting message: %w", err)
+	}
+	if _, err := w.Write(m.message(e)); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return c.Quit()
+}
+
+// message returns the email of the event, with the run report as a table if any.
+func (m *email) message(e Event) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&buf, "Subject: [etl %s] %s\r\n", e.Severity, e.Title)
+	fmt.Fprintf(&buf, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s\n\nCommand: %s\nEnv: %s\nRun: %s\n", e.Message, e.Command, e.Env, e.RunID)
+	if e.Report != nil {
+		body.WriteString("\n")
+		e.Report.WriteTable(&body)
+	}
+	buf.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return buf.Bytes()
+}
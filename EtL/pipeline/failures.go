@@ -0,0 +1,324 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+)
+
+// bodyExcerptLength is the maximum number of bytes of a response body stored in failed_tickers.
+const bodyExcerptLength = 500
+
+// tickerFailure describes why fetching or loading data for a single ticker failed.
+type tickerFailure struct {
+	Ticker string
+	Err    error
+}
+
+// FailedTicker is a row in the failed_tickers table.
+type FailedTicker struct {
+	Ticker        string
+	Endpoint      string
+	StatusCode    int // 0 if the failure was not an HTTP error response
+	BodyExcerpt   string
+	Error         string
+	Attempts      int
+	FirstFailedAt time.Time
+	LastFailedAt  time.Time
+}
+
+// now returns the current time from the time provider, falling back to the system clock.
+func (p *Pipeline) now() time.Time {
+	if p.timeProvider == nil {
+		return time.Now()
+	}
+	return p.timeProvider.Now()
+}
+
+// recordFailures upserts the failures into failed_tickers in db, incrementing the attempt
+// count for tickers that have failed before on the same endpoint.
+func (p *Pipeline) recordFailures(ctx context.Context, db *load.DuckDB, endpoint string, failures []tickerFailure) error {
+	now := p.now()
+	var errorList []error
+	for _, failure := range failures {
+		var statusCode sql.NullInt64
+		var bodyExcerpt string
+		var respErr *extract.ResponseError
+		if errors.As(failure.Err, &respErr) {
+			statusCode = sql.NullInt64{Int64: int64(respErr.StatusCode), Valid: true}
+			bodyExcerpt = respErr.Body
+			if len(bodyExcerpt) > bodyExcerptLength {
+				bodyExcerpt = bodyExcerpt[:bodyExcerptLength]
+			}
+		}
+
+		err := db.RunQuery(ctx, `
+			insert into failed_tickers
+				(ticker, endpoint, status_code, body_excerpt, error, attempts, first_failed_at, last_failed_at)
+			values (?, ?, ?, ?, ?, 1, ?, ?)
+			on conflict (ticker, endpoint) do update set
+				status_code = excluded.status_code,
+				body_excerpt = excluded.body_excerpt,
+				error = excluded.error,
+				attempts = failed_tickers.attempts + 1,
+				last_failed_at = excluded.last_failed_at;`,
+			strings.ToUpper(failure.Ticker), endpoint, statusCode, bodyExcerpt, secrets.Redact(failure.Err.Error()), now, now,
+		)
+		if err != nil {
+			errorList = append(errorList, fmt.Errorf("error recording failure for ticker %s: %w", failure.Ticker, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		skipped := len(failures) - len(failureErrors(failures))
+		p.Logger.Warn(fmt.Sprintf("Recorded %d failed tickers", len(failures)),
+			"endpoint", endpoint,
+			"skipped_no_data", skipped)
+	}
+
+	return errors.Join(errorList...)
+}
+
+// resolveFailures deletes the failed_tickers rows in db of tickers that succeeded on the endpoint,
+// which resets their consecutive failure count.
+func (p *Pipeline) resolveFailures(ctx context.Context, db *load.DuckDB, endpoint string, tickers []string) error {
+	if len(tickers) == 0 {
+		return nil
+	}
+
+	upper := make([]string, len(tickers))
+	for i, ticker := range tickers {
+		upper[i] = strings.ToUpper(ticker)
+	}
+
+	if err := db.RunQuery(ctx,
+		"delete from failed_tickers where endpoint = ? and list_contains(string_split(?, ','), ticker);",
+		endpoint, strings.Join(upper, ","),
+	); err != nil {
+		return fmt.Errorf("error resolving failed tickers: %w", err)
+	}
+	return nil
+}
+
+type ignoreDeadLetterKey struct{}
+
+// withoutDeadLetter returns a context in which no tickers are dead-lettered, used when retrying
+// them. It is kept in the context rather than the pipeline, which runs concurrently.
+func withoutDeadLetter(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ignoreDeadLetterKey{}, true)
+}
+
+// deadLetteredTickers returns the tickers that have failed at least MaxAttempts times in a row
+// on the endpoint, with the last failure within the cooldown period.
+func (p *Pipeline) deadLetteredTickers(ctx context.Context, endpoint string) ([]string, error) {
+	if ignore, _ := ctx.Value(ignoreDeadLetterKey{}).(bool); ignore || p.failures.MaxAttempts <= 0 {
+		return nil, nil
+	}
+
+	cutoff := p.now().Add(-p.failures.Cooldown)
+	res, err := p.DuckDB.GetQueryResults(ctx,
+		"select ticker from failed_tickers where endpoint = ? and attempts >= ? and last_failed_at >= ? order by ticker;",
+		endpoint, p.failures.MaxAttempts, cutoff,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting dead-lettered tickers: %w", err)
+	}
+
+	if len(res["ticker"]) > 0 {
+		p.Logger.Info(fmt.Sprintf("Skipping %d tickers that failed %d times in a row", len(res["ticker"]), p.failures.MaxAttempts),
+			"endpoint", endpoint,
+			"tickers", strings.Join(res["ticker"], ","))
+	}
+
+	return res["ticker"], nil
+}
+
+// handleFailures records the failed tickers of a loaded batch in failed_tickers
+// and clears earlier failures of the tickers that succeeded.
+func (p *Pipeline) handleFailures(ctx context.Context, db *load.DuckDB, endpoint string, batch []string, failures []tickerFailure) error {
+	if err := p.recordFailures(ctx, db, endpoint, failures); err != nil {
+		return err
+	}
+	return p.resolveFailures(ctx, db, endpoint, succeededTickers(batch, failures))
+}
+
+// succeededTickers returns the tickers that are not in failures.
+func succeededTickers(tickers []string, failures []tickerFailure) []string {
+	failed := make([]string, len(failures))
+	for i, f := range failures {
+		failed[i] = f.Ticker
+	}
+	return filterOutSkippedTickers(slices.Clone(tickers), failed)
+}
+
+// skippedTickers returns the tickers that are dead-lettered, case insensitively.
+func skippedTickers(tickers []string, deadLettered []string) []string {
+	skipped := make([]string, 0)
+	for _, t := range tickers {
+		if slices.ContainsFunc(deadLettered, func(d string) bool { return strings.EqualFold(t, d) }) {
+			skipped = append(skipped, strings.ToUpper(t))
+		}
+	}
+	return skipped
+}
+
+// failureErrors returns the errors of the failures that should fail the job,
+// i.e. all except the skippable ones.
+func failureErrors(failures []tickerFailure) []error {
+	errs := make([]error, 0, len(failures))
+	for _, f := range failures {
+		if !isSkippable(f.Err) {
+			errs = append(errs, f.Err)
+		}
+	}
+	return errs
+}
+
+// isSkippable reports whether a ticker failed because Tiingo has no data for it that we are
+// entitled to, rather than because something is wrong with the job. Such tickers are still
+// recorded in failed_tickers, but are skipped instead of failing the job.
+func isSkippable(err error) bool {
+	return errors.Is(err, extract.ErrNoEntitlement) || errors.Is(err, extract.ErrNotFound)
+}
+
+// loadError is a failure to load the data of a ticker into DuckDB. It aborts the transaction
+// the load runs in, if any, so no other ticker loaded in the same transaction can succeed either.
+type loadError struct {
+	err error
+}
+
+func (e *loadError) Error() string { return e.err.Error() }
+
+func (e *loadError) Unwrap() error { return e.err }
+
+// isLoadError reports whether err is, or wraps, a loadError.
+func isLoadError(err error) bool {
+	var loadErr *loadError
+	return errors.As(err, &loadErr)
+}
+
+// fatalFailure returns the first failure that means no other ticker can succeed either,
+// e.g. an invalid token or an exceeded deadline, or nil if there is none.
+func fatalFailure(failures []tickerFailure) error {
+	for _, f := range failures {
+		if errors.Is(f.Err, extract.ErrUnauthorized) ||
+			errors.Is(f.Err, context.DeadlineExceeded) ||
+			errors.Is(f.Err, context.Canceled) {
+			return f.Err
+		}
+	}
+	return nil
+}
+
+// ListFailures returns the rows in failed_tickers, optionally filtered on endpoint.
+func (p *Pipeline) ListFailures(ctx context.Context, endpoint string) ([]FailedTicker, error) {
+	query := `
+		select ticker, endpoint, coalesce(status_code, 0), coalesce(body_excerpt, ''), coalesce(error, ''),
+			attempts, first_failed_at, last_failed_at
+		from failed_tickers
+		where ? = '' or endpoint = ?
+		order by endpoint, ticker;`
+
+	rows, err := p.DuckDB.DB.QueryContext(ctx, query, endpoint, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error querying failed_tickers: %w", err)
+	}
+	defer rows.Close()
+
+	var failed []FailedTicker
+	for rows.Next() {
+		var f FailedTicker
+		if err := rows.Scan(&f.Ticker, &f.Endpoint, &f.StatusCode, &f.BodyExcerpt, &f.Error,
+			&f.Attempts, &f.FirstFailedAt, &f.LastFailedAt); err != nil {
+			return nil, fmt.Errorf("error scanning failed_tickers row: %w", err)
+		}
+		failed = append(failed, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over failed_tickers: %w", err)
+	}
+
+	return failed, nil
+}
+
+// ClearFailures deletes rows from failed_tickers, optionally filtered on endpoint and tickers.
+// It returns the number of rows deleted.
+func (p *Pipeline) ClearFailures(ctx context.Context, endpoint string, tickers []string) (int, error) {
+	upper := make([]string, len(tickers))
+	for i, ticker := range tickers {
+		upper[i] = strings.ToUpper(ticker)
+	}
+
+	res, err := p.DuckDB.DB.ExecContext(ctx, `
+		delete from failed_tickers
+		where (? = '' or endpoint = ?)
+			and (? = '' or list_contains(string_split(?, ','), ticker));`,
+		endpoint, endpoint, strings.Join(upper, ","), strings.Join(upper, ","),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error clearing failed_tickers: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected: %w", err)
+	}
+	return int(n), nil
+}
+
+// RetryFailures re-fetches the tickers recorded in failed_tickers, ignoring the dead-letter
+// cooldown. Tickers that succeed are removed from the table; the others get their attempt
+// count incremented. If tickers is non-empty, only those tickers are retried.
+func (p *Pipeline) RetryFailures(ctx context.Context, endpoint string, tickers []string) (*Report, error) {
+	return p.run(ctx, func(ctx context.Context, r *Report) error {
+		return p.retryFailures(ctx, r, endpoint, tickers)
+	})
+}
+
+func (p *Pipeline) retryFailures(ctx context.Context, r *Report, endpoint string, tickers []string) error {
+	failed, err := p.ListFailures(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+
+	perEndpoint := make(map[string][]string)
+	var endpoints []string
+	for _, f := range failed {
+		if len(tickers) > 0 && !slices.ContainsFunc(tickers, func(t string) bool { return strings.EqualFold(t, f.Ticker) }) {
+			continue
+		}
+		if _, ok := perEndpoint[f.Endpoint]; !ok {
+			endpoints = append(endpoints, f.Endpoint)
+		}
+		perEndpoint[f.Endpoint] = append(perEndpoint[f.Endpoint], f.Ticker)
+	}
+
+	ctx = withoutDeadLetter(ctx)
+	var errorList []error
+	for _, ep := range endpoints {
+		var err error
+		switch ep {
+		case "fundamentals.daily":
+			err = p.fetchFundamentalsData(ctx, r, perEndpoint[ep], false, p.TiingoClient.OpenDailyFundamentals, ep, 0, nil, false, "")
+		case "fundamentals.statements":
+			err = p.fetchFundamentalsData(ctx, r, perEndpoint[ep], false, p.TiingoClient.OpenStatements, ep, 0, nil, false, "")
+		case "daily_adjusted":
+			err = p.backfillEndOfDay(ctx, r, p.DuckDB, perEndpoint[ep])
+		default:
+			err = fmt.Errorf("unknown endpoint %s", ep)
+		}
+		if err != nil {
+			errorList = append(errorList, fmt.Errorf("error retrying %s: %w", ep, err))
+		}
+	}
+
+	return errors.Join(errorList...)
+}
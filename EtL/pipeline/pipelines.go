@@ -1,29 +1,44 @@
 package pipeline
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
-	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/constants"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/template"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/utils"
 	"github.com/sourcegraph/conc/iter"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Pipeline struct {
 	DuckDB       *load.DuckDB
 	TiingoClient *extract.TiingoClient
 	Logger       *slog.Logger
-	sqlDir       string
 	timeProvider utils.TimeProvider
-	InTest       bool
+	failures     config.FailuresConfig
+	spoolDir     string
+	// env is the environment of the configuration, e.g. prod. Fundamentals are sampled outside of prod.
+	env    string
+	InTest bool
+
+	// tickersMu guards the refresh of supported_tickers, which is shared by all pipeline methods
+	// and reused for tickersMaxAge; see supportedTickers.
+	tickersMu          sync.Mutex
+	tickersRefreshedAt time.Time
+	tickersMaxAge      time.Duration
 }
 
 func NewPipeline(config *config.Config, logger *slog.Logger, timeProvider utils.TimeProvider) (*Pipeline, error) {
@@ -37,22 +52,15 @@ func NewPipeline(config *config.Config, logger *slog.Logger, timeProvider utils.
 		return nil, fmt.Errorf("error creating Tiingo HTTP client: %v", err)
 	}
 
-	// Determine SQL directory based on working directory
-	sqlDir := "sql"
-	if _, err := os.Stat(sqlDir); os.IsNotExist(err) {
-		// If sql/ doesn't exist in current directory, try parent
-		sqlDir = filepath.Join("..", "sql")
-		if _, err := os.Stat(sqlDir); os.IsNotExist(err) {
-			return nil, fmt.Errorf("cannot find SQL directory in either current or parent directory")
-		}
-	}
-
 	return &Pipeline{
-		DuckDB:       db,
-		TiingoClient: httpClient,
-		Logger:       logger,
-		sqlDir:       sqlDir,
-		timeProvider: timeProvider,
+		DuckDB:        db,
+		TiingoClient:  httpClient,
+		Logger:        logger,
+		timeProvider:  timeProvider,
+		failures:      config.Failures,
+		spoolDir:      config.Extract.SpoolDir,
+		env:           config.Env,
+		tickersMaxAge: config.Extract.SupportedTickersMaxAge,
 	}, nil
 }
 
@@ -60,60 +68,133 @@ func (p *Pipeline) Close() {
 	p.DuckDB.Close()
 }
 
-func (p *Pipeline) DailyEndOfDay() (int, error) {
-	err := p.supportedTickers()
-	if err != nil {
-		return 0, fmt.Errorf("error getting supported tickers: %v", err)
-	}
+// ErrInterrupted is returned when a pipeline stops early because its context was cancelled,
+// e.g. on SIGINT/SIGTERM. Batches that were in flight when that happened are still loaded.
+var ErrInterrupted = errors.New("pipeline interrupted")
 
-	lastTradingDay, err := p.TiingoClient.GetLastTradingDay()
-	if err != nil {
-		return 0, fmt.Errorf("error getting ticker data from last trading day: %v", err)
+// detachCancel returns a context that is not cancelled when ctx is, but keeps its deadline.
+// It lets an in-flight step or batch finish and be committed after a shutdown signal,
+// while a deadline (e.g. from --timeout) still aborts it.
+func detachCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
 	}
+	return context.WithCancel(detached)
+}
 
-	if err := p.DuckDB.LoadCSV(lastTradingDay, "last_trading_day", false); err != nil {
-		return 0, fmt.Errorf("error loading last_trading_day into DB: %v", err)
-	}
+// interrupted logs how far a run got before ctx was cancelled and returns an ErrInterrupted error.
+func (p *Pipeline) interrupted(ctx context.Context, dataType string, processed int, remaining []string) error {
+	p.Logger.Warn(fmt.Sprintf("Interrupted while processing %s data", dataType),
+		"processed", processed,
+		"remaining", len(remaining),
+		"remaining_tickers", strings.Join(remaining, ","))
+	return fmt.Errorf("%w after processing %d tickers, %d remaining: %w", ErrInterrupted, processed, len(remaining), context.Cause(ctx))
+}
 
-	if err := p.DuckDB.RunQueryFile(p.getSQLPath("insert__daily_adjusted.sql")); err != nil {
-		return 0, fmt.Errorf("error inserting last trading day into daily_adjusted: %v", err)
-	}
+// run runs fn with a new report, and returns the report when fn is done.
+func (p *Pipeline) run(ctx context.Context, fn func(ctx context.Context, r *Report) error) (*Report, error) {
+	report, ctx := p.newReport(ctx)
+	err := fn(ctx, report)
+	report.finish(p.now(), err)
+	return report, err
+}
 
-	res, err := p.DuckDB.GetQueryResultsFromFile(p.getSQLPath("query__selected_backfill.sql"))
+// inTx runs fn in a transaction of p.DuckDB. If the transaction is rolled back, the loads and
+// the succeeded tickers fn added to the report are discarded, since none of their rows were
+// committed.
+func (p *Pipeline) inTx(ctx context.Context, r *Report, fn func(tx *load.DuckDB) error) error {
+	tables, dataChanged := slices.Clone(r.Tables), r.DataChanged
+	succeeded, processed := len(r.Succeeded), r.Processed
+	err := p.DuckDB.InTx(ctx, fn)
 	if err != nil {
-		return 0, fmt.Errorf("error getting backfill results: %v", err)
+		r.Tables, r.DataChanged = tables, dataChanged
+		r.Succeeded, r.Processed = r.Succeeded[:succeeded], processed
 	}
+	return err
+}
 
-	tickers, ok := res["ticker"]
-	if !ok {
-		return 0, errors.New("ticker key not found in selected_backfill.sql results")
-	}
-	if len(tickers) == 0 {
-		return 0, nil
+// DailyEndOfDay loads the last trading day into daily_adjusted and backfills the
+// tickers with splits or dividends, committing both in a single transaction that is rolled
+// back if a load fails. Tickers whose history could not be fetched are recorded in
+// failed_tickers, and a shutdown signal stops the backfill between tickers; in both cases what
+// was loaded is committed before the error is returned. The report counts the backfilled
+// tickers as processed.
+func (p *Pipeline) DailyEndOfDay(ctx context.Context) (*Report, error) {
+	return p.run(ctx, p.dailyEndOfDay)
+}
+
+func (p *Pipeline) dailyEndOfDay(ctx context.Context, r *Report) (err error) {
+	ctx, span := tracing.Start(ctx, "pipeline.DailyEndOfDay")
+	defer func() { tracing.End(span, err) }()
+
+	stepCtx, cancel := detachCancel(ctx)
+	defer cancel()
+
+	err = p.supportedTickers(stepCtx, r)
+	if err != nil {
+		return fmt.Errorf("error getting supported tickers: %w", err)
 	}
 
-	nTickers, err := p.BackfillEndOfDay(tickers)
+	start := time.Now()
+	lastTradingDay, err := p.TiingoClient.GetLastTradingDay(stepCtx)
+	r.addStage(stageFetch, start)
 	if err != nil {
-		return nTickers, fmt.Errorf("error backfilling tickers: %v", err)
+		return fmt.Errorf("error getting ticker data from last trading day: %w", err)
 	}
 
-	return len(tickers), nil
-}
+	var backfillErr error
+	err = p.inTx(stepCtx, r, func(tx *load.DuckDB) error {
+		start := time.Now()
+		loaded, err := tx.LoadCSV(stepCtx, lastTradingDay, "last_trading_day", false)
+		if err != nil {
+			return fmt.Errorf("error loading last_trading_day into DB: %w", err)
+		}
+		r.addLoad("last_trading_day", loaded)
 
-func (p *Pipeline) selectedFundamentals(filter string) ([]string, error) {
+		loaded, err = tx.RunUpsertFile(stepCtx, "insert__daily_adjusted.sql", "daily_adjusted")
+		r.addStage(stageLoad, start)
+		if err != nil {
+			return fmt.Errorf("error inserting last trading day into daily_adjusted: %w", err)
+		}
+		r.addUpsert("daily_adjusted", loaded)
 
-	query := "select distinct ticker from fundamentals.selected_fundamentals"
-	query += " " + filter
-	if !p.InTest && os.Getenv("APP_ENV") != "prod" {
-		query += " using sample 20"
+		start = time.Now()
+		res, err := tx.GetQueryResultsFromFile(stepCtx, "query__selected_backfill.sql")
+		r.addStage(stageSelect, start)
+		if err != nil {
+			return fmt.Errorf("error getting backfill results: %w", err)
+		}
+
+		tickers, ok := res["ticker"]
+		if !ok {
+			return errors.New("ticker key not found in selected_backfill.sql results")
+		}
+		if len(tickers) == 0 {
+			return nil
+		}
+
+		// Only a failed load rolls back the day; other failures are committed and reported below
+		backfillErr = p.backfillEndOfDay(ctx, r, tx, tickers)
+		if isLoadError(backfillErr) {
+			return fmt.Errorf("error backfilling tickers: %w", backfillErr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if backfillErr != nil {
+		return fmt.Errorf("error backfilling tickers: %w", backfillErr)
 	}
-	query += " order by ticker;"
+	return nil
+}
 
-	res, err := p.DuckDB.GetQueryResults(query)
+func (p *Pipeline) selectedFundamentals(ctx context.Context, filter string) ([]string, error) {
+	res, err := p.DuckDB.GetQueryResults(ctx, p.selectedFundamentalsQuery(filter))
 	if err != nil {
 		return nil, fmt.Errorf("error getting fundamentals.selected_fundamentals results: %w", err)
 	}
-	fmt.Println("res_tickers", res)
 
 	tickers, ok := res["ticker"]
 	if !ok {
@@ -126,79 +207,113 @@ func (p *Pipeline) selectedFundamentals(filter string) ([]string, error) {
 	return tickers, nil
 }
 
-type csvPerTicker func(ticker string) (csv []byte, err error)
+// selectedFundamentalsQuery returns the query selecting the tickers of
+// fundamentals.selected_fundamentals matching filter, a sample of 20 of them outside of prod.
+func (p *Pipeline) selectedFundamentalsQuery(filter string) string {
+	query := "select distinct ticker from fundamentals.selected_fundamentals"
+	query += " " + filter
+	if !p.InTest && p.env != "prod" {
+		query += " using sample 20"
+	}
+	return query + " order by ticker;"
+}
+
+// csvPerTicker opens the CSV of a ticker to be streamed. The caller must close it.
+type csvPerTicker func(ctx context.Context, ticker string) (csv io.ReadCloser, err error)
 
-func fetchCSVs(tickers []string, fetch csvPerTicker) ([]byte, []string, error) {
-	// TODO: This part should probably have more tailored error handling
-	// Like some HTTP error codes should be ignored (I might not have access).
-	// BUT: it seems the API sends 400 Bad Request with body: None if no access,
-	// which is the same as if the request were incorrect. Not optimal.
-	// UPDATE: with 20+ years of historical data avaiable, one gets 200 OK with body: None
-	// if data does not exists.
+// tickerSpool is the result of spooling the CSV of a single ticker in spoolCSVs.
+type tickerSpool struct {
+	empty bool
+	err   error
+}
+
+// spoolCSVs fetches the CSV for each ticker concurrently, adds the ticker column and writes the
+// non-empty ones to the spool as they stream in. Tickers responding with "None" are returned as
+// empty responses, and tickers whose fetch failed are returned as failures; neither stops the
+// other tickers from being fetched.
+func spoolCSVs(ctx context.Context, spool *load.Spool, tickers []string, fetch csvPerTicker) ([]string, []tickerFailure) {
+	ctx, span := tracing.Start(ctx, "pipeline.spoolCSVs", tracing.BatchSizeKey.Int(len(tickers)))
+	defer span.End()
+
+	// The API sends 400 Bad Request with body: None if we have no access, and 200 OK with
+	// body: None if the data does not exist. The former is classified as extract.ErrNoEntitlement
+	// and the latter is returned as an empty response; see isSkippable for how failures are handled.
 	// Remaining question: what is the HTTP code on 3 year subscription and requesting >3 years?
 	// If it is still 200 but with body: None, I should probably just default to query data from 1995-01-01.
 
-	mapper := iter.Mapper[string, []byte]{
+	mapper := iter.Mapper[string, tickerSpool]{
 		MaxGoroutines: 20,
 	}
 
-	// Map over tickers concurrently, fetching CSV data for each
-	csvs, err := mapper.MapErr(tickers, func(ticker *string) ([]byte, error) {
-		body, err := fetch(*ticker)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching data for ticker %s: %w", *ticker, err)
-		}
-
-		// Handle empty responses by returning nil
-		if string(body) == "None" {
-			return nil, nil
-		}
+	// Map over tickers concurrently, spooling the CSV data of each
+	results := mapper.Map(tickers, func(ticker *string) (res tickerSpool) {
+		ctx, span := tracing.Start(ctx, "pipeline.fetchTicker", tracing.TickerKey.String(*ticker))
+		defer func() { tracing.End(span, res.err) }()
 
-		csv, err := load.AddTickerColumn(body, *ticker)
-		if err != nil {
-			return nil, fmt.Errorf("error adding ticker column to CSV for ticker %s: %w", *ticker, err)
-		}
-
-		return csv, nil
+		spooled, err := spoolTicker(ctx, spool, *ticker, fetch)
+		return tickerSpool{empty: !spooled, err: err}
 	})
 
-	// Track empty responses
+	// Track empty responses and failures
 	emptyResponses := make([]string, 0)
-	validCSVs := make([][]byte, 0)
-
-	// Process results, separating valid CSVs and empty responses
-	for i, csv := range csvs {
-		if csv == nil {
+	failures := make([]tickerFailure, 0)
+	for i, res := range results {
+		switch {
+		case res.err != nil:
+			failures = append(failures, tickerFailure{Ticker: tickers[i], Err: res.err})
+		case res.empty:
 			emptyResponses = append(emptyResponses, tickers[i])
-		} else {
-			validCSVs = append(validCSVs, csv)
 		}
 	}
 
-	// If we got an error during fetching, return it
+	span.SetAttributes(
+		attribute.Int("etl.empty_responses", len(emptyResponses)),
+		attribute.Int("etl.failures", len(failures)),
+	)
+
+	return emptyResponses, failures
+}
+
+// spoolTicker fetches the CSV of a ticker and writes it to the spool with the ticker column
+// added. It returns false if the response was "None", and nothing was written.
+func spoolTicker(ctx context.Context, spool *load.Spool, ticker string, fetch csvPerTicker) (bool, error) {
+	body, err := fetch(ctx, ticker)
 	if err != nil {
-		return nil, emptyResponses, err
+		return false, fmt.Errorf("error fetching data for ticker %s: %w", ticker, err)
 	}
+	defer body.Close()
 
-	// Concatenate valid CSVs
-	if len(validCSVs) == 0 {
-		return nil, emptyResponses, nil
+	csv := bufio.NewReader(body)
+	if isNone(csv) {
+		return false, nil
 	}
-	finalCsv, err := load.ConcatCSVs(validCSVs)
+
+	err = spool.Write(func(w io.Writer) error {
+		return load.AddTickerColumnTo(w, csv, ticker)
+	})
 	if err != nil {
-		return nil, emptyResponses, fmt.Errorf("error concatenating CSVs: %w", err)
+		return false, fmt.Errorf("error adding ticker column to CSV for ticker %s: %w", ticker, err)
 	}
+	return true, nil
+}
 
-	return finalCsv, emptyResponses, nil
+// isNone reports whether the body is "None", which Tiingo responds with when there is no data.
+func isNone(body *bufio.Reader) bool {
+	b, err := body.Peek(len("None") + 1)
+	return errors.Is(err, io.EOF) && string(b) == "None"
 }
 
 // TODO: should document all parameters for this method, it has many.
 // TODO: should add some integration tests for this method, with batchsize, skipExisting, and skipTickers populated with different values.
 // fetchFundamentalsData handles fetching and loading fundamentals data (daily or statements)
 // for the specified tickers into DuckDB. If no tickers provided, uses selectedFundamentals().
-// If batchSize > 0, processes tickers in batches to manage memory usage.
-// Skips any tickers specified in skipTickers.
+// If batchSize > 0, processes tickers in batches, each loaded and committed on its own.
+// Skips any tickers specified in skipTickers, and tickers dead-lettered in failed_tickers.
+// Tickers that fail are recorded in failed_tickers and do not stop the remaining tickers
+// from being processed; their errors are joined and returned after all batches are done.
 func (p *Pipeline) fetchFundamentalsData(
+	ctx context.Context,
+	r *Report,
 	tickers []string,
 	half bool,
 	fetchFn csvPerTicker,
@@ -207,34 +322,42 @@ func (p *Pipeline) fetchFundamentalsData(
 	skipTickers []string,
 	skipExisting bool,
 	filter string,
-) (int, error) {
+) (err error) {
+	ctx, span := tracing.Start(ctx, "pipeline.fetchFundamentalsData", tracing.TableKey.String(tableName), tracing.BatchSizeKey.Int(batchSize))
+	defer func() { tracing.End(span, err) }()
+
+	// Preparations run to completion on a shutdown signal; batches are checked for it below
+	prepCtx, cancel := detachCancel(ctx)
+	defer cancel()
+
 	// Get tickers if none provided
-	var err error
 	if len(tickers) == 0 {
+		start := time.Now()
 		if filter != "" {
 			// Look up tickers with filter on the data
-			tickers, err = p.selectedFundamentals(filter)
+			tickers, err = p.selectedFundamentals(prepCtx, filter)
 			if err != nil {
-				return 0, fmt.Errorf("error getting selected fundamentals with filter: %w", err)
+				return fmt.Errorf("error getting selected fundamentals with filter: %w", err)
 			}
 		} else {
 			// Look up all tickers in selected_fundamentals
-			tickers, err = p.selectedFundamentals("")
+			tickers, err = p.selectedFundamentals(prepCtx, "")
 			if err != nil {
-				return 0, fmt.Errorf("error getting selected fundamentals without filter: %w", err)
+				return fmt.Errorf("error getting selected fundamentals without filter: %w", err)
 			}
 		}
+		r.addStage(stageSelect, start)
 	}
 	// Make sure we have the latest supported tickers
-	err = p.supportedTickers()
+	err = p.supportedTickers(prepCtx, r)
 	if err != nil {
-		return 0, fmt.Errorf("error getting supported tickers: %v", err)
+		return fmt.Errorf("error getting supported tickers: %w", err)
 	}
 
 	// Make sure we have the latest fundamentals metadata
-	_, err = p.UpdateMetadata()
+	_, err = p.updateMetadata(prepCtx, r)
 	if err != nil {
-		return 0, fmt.Errorf("error updating metadata: %v", err)
+		return fmt.Errorf("error updating metadata: %w", err)
 	}
 
 	// Handle half processing if requested
@@ -247,13 +370,21 @@ func (p *Pipeline) fetchFundamentalsData(
 
 	if skipExisting {
 		// Filter out tickers that already exist in the database
-		existingTickers, err := p.DuckDB.GetQueryResults("select distinct ticker from " + tableName)
+		existingTickers, err := p.DuckDB.GetQueryResults(prepCtx, "select distinct ticker from "+tableName)
 		if err != nil {
-			return 0, fmt.Errorf("error getting existing tickers: %w", err)
+			return fmt.Errorf("error getting existing tickers: %w", err)
 		}
 		skipTickers = append(skipTickers, existingTickers["ticker"]...)
 	}
 
+	// Skip tickers that have failed repeatedly
+	deadLettered, err := p.deadLetteredTickers(prepCtx, tableName)
+	if err != nil {
+		return err
+	}
+	r.Skipped = append(r.Skipped, skippedTickers(tickers, deadLettered)...)
+	skipTickers = append(skipTickers, deadLettered...)
+
 	// Filter out skipped tickers before any processing
 	if len(skipTickers) > 0 {
 		tickers = filterOutSkippedTickers(tickers, skipTickers)
@@ -264,6 +395,7 @@ func (p *Pipeline) fetchFundamentalsData(
 	for i, ticker := range tickers {
 		upperCaseTickers[i] = strings.ToUpper(ticker)
 	}
+	r.Requested = append(r.Requested, upperCaseTickers...)
 
 	// Parse table name for logging
 	dataType := strings.TrimPrefix(tableName, "fundamentals.")
@@ -271,60 +403,121 @@ func (p *Pipeline) fetchFundamentalsData(
 
 	totalEmptyResponses := make([]string, 0)
 	totalProcessed := 0
+	var fetchErrors []error
+	defer func() { r.Processed += totalProcessed }()
+
+	if ctx.Err() != nil {
+		return p.interrupted(ctx, dataType, 0, upperCaseTickers)
+	}
 
 	// Process all tickers at once if batchSize is 0
 	if batchSize == 0 {
-		finalCsv, emptyResponses, err := fetchCSVs(upperCaseTickers, fetchFn)
+		res, err := p.loadBatch(ctx, r, upperCaseTickers, fetchFn, tableName, false)
 		if err != nil {
-			return 0, fmt.Errorf("error fetching %s data: %w", dataType, err)
-		}
-
-		if len(finalCsv) > 0 {
-			if err := p.DuckDB.LoadCSV(finalCsv, tableName, true); err != nil {
-				return 0, fmt.Errorf("error loading %s data to DB: %w", dataType, err)
-			}
+			return fmt.Errorf("error processing %s data: %w", dataType, err)
 		}
-		totalEmptyResponses = emptyResponses
-		totalProcessed = len(upperCaseTickers) - len(emptyResponses)
+		fetchErrors = append(fetchErrors, failureErrors(res.failures)...)
+		totalEmptyResponses = res.emptyResponses
+		totalProcessed = res.processed
 	} else {
 		// Process tickers in batches
 		for i := 0; i < len(upperCaseTickers); i += batchSize {
+			// Stop between batches on a shutdown signal
+			if ctx.Err() != nil {
+				return p.interrupted(ctx, dataType, totalProcessed, upperCaseTickers[i:])
+			}
+
 			end := i + batchSize
 			if end > len(upperCaseTickers) {
 				end = len(upperCaseTickers)
 			}
 			batch := upperCaseTickers[i:end]
 
-			finalCsv, emptyResponses, err := fetchCSVs(batch, fetchFn)
+			res, err := p.loadBatch(ctx, r, batch, fetchFn, tableName, true)
 			if err != nil {
-				return totalProcessed, fmt.Errorf("error fetching %s data for batch %d-%d: %w", dataType, i, end-1, err)
-			}
-
-			if len(finalCsv) > 0 {
-				finalCsvDeduped, err := load.RemoveDuplicateRows(finalCsv)
-				if err != nil {
-					return totalProcessed, fmt.Errorf("error removing duplicates from %s data for batch %d-%d: %w", dataType, i, end-1, err)
-				}
-
-				if err := p.DuckDB.LoadCSV(finalCsvDeduped, tableName, true); err != nil {
-					return totalProcessed, fmt.Errorf("error loading %s data to DB for batch %d-%d: %w", dataType, i, end-1, err)
-				}
+				return fmt.Errorf("error processing %s data for batch %d-%d: %w", dataType, i, end-1, err)
 			}
+			fetchErrors = append(fetchErrors, failureErrors(res.failures)...)
 
-			totalEmptyResponses = append(totalEmptyResponses, emptyResponses...)
-			batchProcessed := len(batch) - len(emptyResponses)
-			totalProcessed += batchProcessed
+			totalEmptyResponses = append(totalEmptyResponses, res.emptyResponses...)
+			totalProcessed += res.processed
 
 			p.Logger.Info(fmt.Sprintf("Successfully processed batch of %s data", dataType),
 				"batch", fmt.Sprintf("%d-%d", i, end-1),
-				"processed", batchProcessed,
-				"empty_responses", len(emptyResponses))
+				"processed", res.processed,
+				"empty_responses", len(res.emptyResponses),
+				"failed", len(res.failures))
 		}
 	}
 
 	p.Logger.Info(fmt.Sprintf("Total number of empty responses: %d", len(totalEmptyResponses)))
 
-	return totalProcessed, nil
+	if len(fetchErrors) > 0 {
+		return fmt.Errorf("failed to fetch %s data for %d tickers: %w", dataType, len(fetchErrors), errors.Join(fetchErrors...))
+	}
+
+	return nil
+}
+
+// batchResult summarises a batch of tickers processed by loadBatch.
+type batchResult struct {
+	processed      int
+	emptyResponses []string
+	failures       []tickerFailure
+}
+
+// loadBatch streams the CSVs of a batch of tickers to a spool, loads them into tableName and
+// records the tickers that failed, committing the load and the failures in a single transaction.
+// The batch runs to completion even if ctx is cancelled, so a shutdown signal never leaves a
+// fetched batch unloaded; ctx's deadline still applies.
+// If dedupe is true, duplicate rows are removed while loading.
+func (p *Pipeline) loadBatch(ctx context.Context, r *Report, batch []string, fetchFn csvPerTicker, tableName string, dedupe bool) (_ batchResult, err error) {
+	ctx, cancel := detachCancel(ctx)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "pipeline.loadBatch", tracing.TableKey.String(tableName), tracing.BatchSizeKey.Int(len(batch)))
+	defer func() { tracing.End(span, err) }()
+
+	spool, err := load.NewSpool(p.spoolDir)
+	if err != nil {
+		return batchResult{}, err
+	}
+	defer spool.Close()
+
+	start := time.Now()
+	emptyResponses, failures := spoolCSVs(ctx, spool, batch, fetchFn)
+	r.addStage(stageFetch, start)
+	if err := fatalFailure(failures); err != nil {
+		return batchResult{}, fmt.Errorf("aborting fetch: %w", err)
+	}
+
+	err = p.inTx(ctx, r, func(tx *load.DuckDB) error {
+		if len(spool.Files()) > 0 {
+			start := time.Now()
+			loaded, err := tx.LoadSpool(ctx, spool, tableName, dedupe)
+			r.addStage(stageLoad, start)
+			if err != nil {
+				return fmt.Errorf("error loading data to DB: %w", err)
+			}
+			r.addUpsert(tableName, loaded)
+		}
+
+		start := time.Now()
+		defer r.addStage(stageFailures, start)
+		return p.handleFailures(ctx, tx, tableName, batch, failures)
+	})
+	if err != nil {
+		return batchResult{}, err
+	}
+
+	r.Succeeded = append(r.Succeeded, filterOutSkippedTickers(succeededTickers(batch, failures), emptyResponses)...)
+	r.Empty = append(r.Empty, emptyResponses...)
+	r.addFailures(failures)
+
+	return batchResult{
+		processed:      len(batch) - len(emptyResponses) - len(failures),
+		emptyResponses: emptyResponses,
+		failures:       failures,
+	}, nil
 }
 
 // filterOutSkippedTickers removes any tickers that should be skipped from the input slice
@@ -341,40 +534,62 @@ func filterOutSkippedTickers(tickers []string, skipTickers []string) []string {
 	})
 }
 
-func (p *Pipeline) DailyFundamentals(tickers []string, half bool, batchSize int, skipTickers []string, skipExisting bool, lookback int) (int, error) {
+func (p *Pipeline) DailyFundamentals(ctx context.Context, tickers []string, half bool, batchSize int, skipTickers []string, skipExisting bool, lookback int) (*Report, error) {
 	var filter string
 	if lookback > 0 {
 		// TODO: add tests for this functionality
 		filter = fmt.Sprintf("where dailyLastUpdated >= current_date - interval '%d days'", lookback)
 	}
-	return p.fetchFundamentalsData(tickers, half, p.TiingoClient.GetDailyFundamentals, "fundamentals.daily", batchSize, skipTickers, skipExisting, filter)
+	return p.run(ctx, func(ctx context.Context, r *Report) error {
+		return p.fetchFundamentalsData(ctx, r, tickers, half, p.TiingoClient.OpenDailyFundamentals, "fundamentals.daily", batchSize, skipTickers, skipExisting, filter)
+	})
 }
 
-func (p *Pipeline) Statements(tickers []string, half bool, batchSize int, skipTickers []string, skipExisting bool, lookback int) (int, error) {
+func (p *Pipeline) Statements(ctx context.Context, tickers []string, half bool, batchSize int, skipTickers []string, skipExisting bool, lookback int) (*Report, error) {
 	var filter string
 	if lookback > 0 {
 		// TODO: add tests for this functionality
 		filter = fmt.Sprintf("where statementLastUpdated >= current_date - interval '%d days'", lookback)
 	}
-	return p.fetchFundamentalsData(tickers, half, p.TiingoClient.GetStatements, "fundamentals.statements", batchSize, skipTickers, skipExisting, filter)
+	return p.run(ctx, func(ctx context.Context, r *Report) error {
+		return p.fetchFundamentalsData(ctx, r, tickers, half, p.TiingoClient.OpenStatements, "fundamentals.statements", batchSize, skipTickers, skipExisting, filter)
+	})
 }
 
-func (p *Pipeline) UpdateMetadata() (int, error) {
-	err := p.supportedTickers()
+// UpdateMetadata loads the fundamentals metadata of all tickers into fundamentals.meta.
+// It runs to completion on a shutdown signal, but not past ctx's deadline.
+// The report counts the metadata rows loaded as processed.
+func (p *Pipeline) UpdateMetadata(ctx context.Context) (*Report, error) {
+	return p.run(ctx, func(ctx context.Context, r *Report) error {
+		n, err := p.updateMetadata(ctx, r)
+		r.Processed += n
+		return err
+	})
+}
+
+func (p *Pipeline) updateMetadata(ctx context.Context, r *Report) (n int, err error) {
+	ctx, cancel := detachCancel(ctx)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "pipeline.UpdateMetadata")
+	defer func() { tracing.End(span, err) }()
+
+	err = p.supportedTickers(ctx, r)
 	if err != nil {
-		return 0, fmt.Errorf("error getting supported tickers: %v", err)
+		return 0, fmt.Errorf("error getting supported tickers: %w", err)
 	}
 
+	start := time.Now()
+	defer func() { r.addStage(stageMetadata, start) }()
+
 	// Get fundamentals metadata for all tickers from Tiingo API
-	metadata, err := p.TiingoClient.GetMeta("")
+	metadata, err := p.TiingoClient.GetMeta(ctx, "")
 	if err != nil {
 		return 0, fmt.Errorf("error fetching metadata from Tiingo: %w", err)
 	}
 
-	insertMetaFile := p.getSQLPath("insert__fundamentals_meta.sql")
-	templateContent, err := os.ReadFile(insertMetaFile)
+	templateContent, err := p.DuckDB.SQL.Read("insert__fundamentals_meta.sql")
 	if err != nil {
-		return 0, fmt.Errorf("error reading %s file: %w", insertMetaFile, err)
+		return 0, err
 	}
 
 	sqlParams := map[string]any{
@@ -382,36 +597,94 @@ func (p *Pipeline) UpdateMetadata() (int, error) {
 	}
 
 	// Load metadata into DuckDB
-	res, err := p.DuckDB.LoadCSVWithQuery(metadata, string(templateContent), sqlParams)
+	loaded, err := p.DuckDB.UpsertCSVWithQuery(ctx, metadata, string(templateContent), sqlParams, "fundamentals.meta")
 	if err != nil {
 		return 0, fmt.Errorf("error loading metadata into DB: %w", err)
 	}
+	r.addUpsert("fundamentals.meta", loaded)
 
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, fmt.Errorf("error getting rows affected: %w", err)
-	}
+	return int(loaded.Inserted + loaded.Changed + loaded.Unchanged), nil
+}
 
-	return int(rowsAffected), nil
+// BackfillEndOfDay reloads the full price history of the tickers into daily_adjusted.
+// Tickers dead-lettered in failed_tickers are skipped, and failing tickers are recorded there.
+// On a shutdown signal, the ticker being backfilled is finished before returning ErrInterrupted.
+// The report counts the backfilled tickers as processed.
+func (p *Pipeline) BackfillEndOfDay(ctx context.Context, tickers []string) (*Report, error) {
+	return p.run(ctx, func(ctx context.Context, r *Report) error {
+		return p.backfillEndOfDay(ctx, r, p.DuckDB, tickers)
+	})
 }
 
-func (p *Pipeline) BackfillEndOfDay(tickers []string) (int, error) {
+// backfillEndOfDay loads the history of the tickers into daily_adjusted in db, which may be
+// in a transaction. Failures are recorded outside of it, so they are kept if it is rolled back,
+// and earlier failures of the backfilled tickers are cleared once it commits.
+// A failed load aborts the backfill only in a transaction, since the transaction is rolled back.
+func (p *Pipeline) backfillEndOfDay(ctx context.Context, r *Report, db *load.DuckDB, tickers []string) (err error) {
+	ctx, span := tracing.Start(ctx, "pipeline.BackfillEndOfDay", tracing.BatchSizeKey.Int(len(tickers)))
+	defer func() { tracing.End(span, err) }()
+
+	// Bookkeeping in failed_tickers is done even if interrupted
+	bookkeepingCtx, cancel := detachCancel(ctx)
+	defer cancel()
+
+	deadLettered, err := p.deadLetteredTickers(bookkeepingCtx, "daily_adjusted")
+	if err != nil {
+		return err
+	}
+	r.Skipped = append(r.Skipped, skippedTickers(tickers, deadLettered)...)
+	tickers = filterOutSkippedTickers(slices.Clone(tickers), deadLettered)
+	r.Requested = append(r.Requested, tickers...)
+
 	var errorList []error
+	var failures []tickerFailure
+	defer func() {
+		r.Processed += len(tickers) - len(failures)
+		r.Succeeded = append(r.Succeeded, succeededTickers(tickers, failures)...)
+		r.addFailures(failures)
+
+		// The failures are recorded on every return, so failing tickers are dead-lettered even
+		// if the backfill is aborted. Earlier failures of the tickers backfilled are only
+		// cleared once their loads are committed.
+		start := time.Now()
+		failuresErr := p.recordFailures(bookkeepingCtx, p.DuckDB, "daily_adjusted", failures)
+		succeeded := succeededTickers(tickers, failures)
+		if db.InTransaction() {
+			resolveCtx := context.WithoutCancel(ctx)
+			db.AfterCommit(func() {
+				if err := p.resolveFailures(resolveCtx, p.DuckDB, "daily_adjusted", succeeded); err != nil {
+					p.Logger.Error(fmt.Sprintf("Error after committing the backfill: %v", err))
+				}
+			})
+		} else {
+			failuresErr = errors.Join(failuresErr, p.resolveFailures(bookkeepingCtx, p.DuckDB, "daily_adjusted", succeeded))
+		}
+		r.addStage(stageFailures, start)
+		err = errors.Join(err, failuresErr)
+	}()
 	for i, ticker := range tickers {
-		history, err := p.TiingoClient.GetHistory(ticker)
-		if err != nil {
-			errorList = append(errorList, fmt.Errorf("error fetching history for ticker %s: %w", ticker, err))
-			continue
+		if ctx.Err() != nil {
+			errorList = append(errorList, p.interrupted(ctx, "backfill", i-len(failures), tickers[i:]))
+			tickers = tickers[:i]
+			break
 		}
 
-		historyWithTicker, err := load.AddTickerColumn(history, ticker)
+		tickerCtx, cancel := detachCancel(ctx)
+		err := p.backfillTicker(tickerCtx, r, db, ticker)
+		cancel()
 		if err != nil {
-			errorList = append(errorList, fmt.Errorf("error adding ticker column to history for ticker %s: %w", ticker, err))
-			continue
-		}
-
-		if err := p.DuckDB.LoadCSV(historyWithTicker, "daily_adjusted", true); err != nil {
-			errorList = append(errorList, fmt.Errorf("error loading history to DB for ticker %s: %w", ticker, err))
+			failures = append(failures, tickerFailure{Ticker: ticker, Err: err})
+			fatal := fatalFailure(failures[len(failures)-1:])
+			if fatal == nil && isLoadError(err) && db.InTransaction() {
+				fatal = err
+			}
+			if fatal != nil {
+				tickers = tickers[:i+1]
+				return fmt.Errorf("aborting backfill: %w", fatal)
+			}
+			if !isSkippable(err) {
+				errorList = append(errorList, err)
+			}
 			continue
 		}
 
@@ -424,32 +697,119 @@ func (p *Pipeline) BackfillEndOfDay(tickers []string) (int, error) {
 		}
 	}
 
-	if len(errorList) > 0 {
-		return len(tickers) - len(errorList), errors.Join(errorList...)
+	return errors.Join(errorList...)
+}
+
+// backfillTicker fetches the full price history of a ticker and loads it into daily_adjusted in db.
+func (p *Pipeline) backfillTicker(ctx context.Context, r *Report, db *load.DuckDB, ticker string) (err error) {
+	ctx, span := tracing.Start(ctx, "pipeline.backfillTicker", tracing.TickerKey.String(ticker))
+	defer func() { tracing.End(span, err) }()
+
+	// Full histories are large, so they are streamed to disk rather than read into memory
+	spool, err := load.NewSpool(p.spoolDir)
+	if err != nil {
+		return err
 	}
+	defer spool.Close()
 
-	return len(tickers), nil
-}
+	start := time.Now()
+	spooled, err := spoolTicker(ctx, spool, ticker, p.TiingoClient.OpenHistory)
+	r.addStage(stageFetch, start)
+	if err != nil {
+		return err
+	}
+	if !spooled {
+		p.Logger.Info(fmt.Sprintf("No history to backfill for ticker %s", ticker))
+		return nil
+	}
 
-// Add this helper method
-func (p *Pipeline) getSQLPath(filename string) string {
-	return filepath.Join(p.sqlDir, filename)
+	start = time.Now()
+	loaded, err := db.LoadSpool(ctx, spool, "daily_adjusted", false)
+	r.addStage(stageLoad, start)
+	if err != nil {
+		return &loadError{fmt.Errorf("error loading history to DB for ticker %s: %w", ticker, err)}
+	}
+	r.addUpsert("daily_adjusted", loaded)
+
+	return nil
 }
 
-func (p *Pipeline) supportedTickers() error {
-	zipSupportedTickers, err := p.TiingoClient.GetSupportedTickers()
+// supportedTickers refreshes supported_tickers, unless it was refreshed within the max age by
+// another step or run of this process. The zip is only downloaded if it changed since it was
+// cached, and only reloaded if its hash differs from the one last loaded.
+func (p *Pipeline) supportedTickers(ctx context.Context, r *Report) (err error) {
+	p.tickersMu.Lock()
+	defer p.tickersMu.Unlock()
+	if !p.tickersRefreshedAt.IsZero() && (p.tickersMaxAge == 0 || time.Since(p.tickersRefreshedAt) < p.tickersMaxAge) {
+		p.Logger.Debug("supported_tickers already refreshed", "refreshed_at", p.tickersRefreshedAt)
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "pipeline.supportedTickers")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	defer func() { r.addStage(stageSupportedTickers, start) }()
+
+	zipSupportedTickers, err := p.TiingoClient.GetSupportedTickers(ctx)
 	if err != nil {
-		return fmt.Errorf("error getting supported_tickers.zip: %v", err)
+		return fmt.Errorf("error getting supported_tickers.zip: %w", err)
 	}
 
-	csvSupportedTickers, err := extract.UnzipSingleCSV(zipSupportedTickers)
+	res, err := p.DuckDB.GetQueryResults(ctx, "SELECT sha256 FROM loaded_files WHERE name = 'supported_tickers.zip';")
 	if err != nil {
-		return fmt.Errorf("error unzipping supported_tickers.zip: %v", err)
+		return fmt.Errorf("error getting hash of loaded supported_tickers.zip: %w", err)
 	}
+	if slices.Contains(res["sha256"], zipSupportedTickers.SHA256) {
+		p.Logger.Info("supported_tickers.zip is unchanged, skipping reload", "sha256", zipSupportedTickers.SHA256)
+		// The tickers are still seen, even if not reloaded
+		if err := p.updateTickersHistory(ctx, p.DuckDB); err != nil {
+			return err
+		}
+		p.tickersRefreshedAt = time.Now()
+		return nil
+	}
+
+	csvSupportedTickers, err := extract.UnzipSingleCSV(zipSupportedTickers.Body)
+	if err != nil {
+		return fmt.Errorf("error unzipping supported_tickers.zip: %w", err)
+	}
+
+	err = p.inTx(ctx, r, func(tx *load.DuckDB) error {
+		loaded, err := tx.LoadCSV(ctx, csvSupportedTickers, "supported_tickers", false)
+		if err != nil {
+			return fmt.Errorf("error loading supported_tickers.csv into DB: %w", err)
+		}
+		r.addLoad("supported_tickers", loaded)
 
-	if err := p.DuckDB.LoadCSV(csvSupportedTickers, "supported_tickers", false); err != nil {
-		return fmt.Errorf("error loading supported_tickers.csv into DB: %v", err)
+		err = tx.RunQuery(ctx, "INSERT OR REPLACE INTO loaded_files VALUES ('supported_tickers.zip', ?, ?);", zipSupportedTickers.SHA256, p.now())
+		if err != nil {
+			return fmt.Errorf("error recording hash of supported_tickers.zip: %w", err)
+		}
+		return p.updateTickersHistory(ctx, tx)
+	})
+	if err != nil {
+		return err
 	}
+	p.tickersRefreshedAt = time.Now()
 
 	return nil
 }
+
+// updateTickersHistory records the tickers in supported_tickers as seen now in supported_tickers_history.
+func (p *Pipeline) updateTickersHistory(ctx context.Context, db *load.DuckDB) error {
+	content, err := db.SQL.Read("update__supported_tickers_history.sql")
+	if err != nil {
+		return err
+	}
+	query, err := template.ExecuteSqlTemplateString(string(content), map[string]any{
+		"SeenAt": p.now().UTC().Format("2006-01-02 15:04:05.000000"),
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering update__supported_tickers_history.sql: %w", err)
+	}
+	if err := db.RunQuery(ctx, query); err != nil {
+		return fmt.Errorf("error updating supported_tickers_history: %w", err)
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package pipeline
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
@@ -11,23 +13,27 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
 	"github.com/rasnes/tiingo-duckdb-framework/EtL/utils"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 )
 
-func setupTestServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Verify token is present
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
+func setupTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/docs/tiingo/daily/supported_tickers.zip":
 			// Create a minimal zip file with supported tickers CSV
@@ -154,11 +160,23 @@ CN000000000002,600000,Shanghai Pudong Development Bank,True,False,Financial Serv
 			w.Header().Set("Content-Type", "text/csv")
 			_, _ = w.Write([]byte("None"))
 
+		case "/tiingo/fundamentals/NOACCESS/daily", "/tiingo/daily/NOACCESS/prices":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("None"))
+
+		case "/tiingo/fundamentals/REVOKED/daily", "/tiingo/daily/REVOKED/prices":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"detail":"Invalid token."}`))
+
+		case "/tiingo/fundamentals/BROKEN/daily", "/tiingo/daily/BROKEN/prices":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Internal Server Error"))
+
 		default:
 			w.WriteHeader(http.StatusNotFound)
 			_, _ = w.Write([]byte("Not found"))
 		}
-	}))
+	})))
 }
 
 // TODO: add test where columns in daily are randomised. The API says it may change order of columns.
@@ -204,35 +222,12 @@ func setupTestConfig(t *testing.T) *config.Config {
 	// Override the DuckDB path to use in-memory database
 	cfg.DuckDB.Path = ":memory:"
 
-	// Update SQL file paths for test environment
-	var updatedQueries []string
-	for _, query := range cfg.DuckDB.ConnInitFnQueries {
-		// Handle both relative and absolute paths
-		if strings.HasPrefix(query, "./sql/") {
-			query = strings.TrimPrefix(query, "./")
-		}
-		if strings.HasPrefix(query, "../sql/") {
-			query = strings.TrimPrefix(query, "../")
-		}
-		// Always use the parent directory in tests
-		updatedQueries = append(updatedQueries, filepath.Join("..", query))
-	}
-
-	// Add all SQL files from the test directory
-	testSQLFiles, err := filepath.Glob("../sql/test/*.sql")
-	if err != nil {
-		t.Fatalf("Failed to glob test SQL files: %v", err)
-	}
-
-	// Sort the files to ensure consistent ordering
-	sort.Strings(testSQLFiles)
-
-	cfg.DuckDB.ConnInitFnQueries = append(updatedQueries, testSQLFiles...)
-
 	// Add required configuration for fundamentals statements
 	cfg.Tiingo.Fundamentals.Statements.StartDate = "2024-01-01"
 	cfg.Tiingo.Fundamentals.Daily.StartDate = "2024-01-01"
 
+	cfg.Extract.CacheDir = t.TempDir()
+
 	return cfg
 }
 
@@ -251,6 +246,17 @@ func setupTestPipeline(t *testing.T, server *httptest.Server, timeProvider utils
 	pipeline, err := NewPipeline(cfg, logger, timeProvider)
 	assert.NoError(t, err)
 
+	// Insert the mock data once, not per connection like the init queries,
+	// since transactions use more than one connection
+	testSQLFiles, err := filepath.Glob("../sql/test/*.sql")
+	if err != nil {
+		t.Fatalf("Failed to glob test SQL files: %v", err)
+	}
+	sort.Strings(testSQLFiles)
+	for _, file := range testSQLFiles {
+		assert.NoError(t, pipeline.DuckDB.RunQueryFile(context.Background(), file))
+	}
+
 	// Override the base URL to use our test server and set the time provider
 	pipeline.TiingoClient.BaseURL = server.URL
 	pipeline.TiingoClient.InTest = true
@@ -266,32 +272,102 @@ func setupTestPipeline(t *testing.T, server *httptest.Server, timeProvider utils
 	return pipeline, cleanup
 }
 
+func TestNewPipeline_MultipleConfigs(t *testing.T) {
+	t.Setenv("TIINGO_TOKEN", "test-token")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	dir := t.TempDir()
+	stageCfg, prodCfg := setupTestConfig(t), setupTestConfig(t)
+	stageCfg.DuckDB.Path = filepath.Join(dir, "stage.db")
+	stageCfg.Tiingo.Eod.StartDate = "2024-01-01"
+	prodCfg.DuckDB.Path = filepath.Join(dir, "prod.db")
+
+	stage, err := NewPipeline(stageCfg, logger, nil)
+	if err != nil {
+		t.Fatalf("Failed to create stage pipeline: %v", err)
+	}
+	defer stage.Close()
+	prod, err := NewPipeline(prodCfg, logger, nil)
+	if err != nil {
+		t.Fatalf("Failed to create prod pipeline: %v", err)
+	}
+	defer prod.Close()
+
+	// Changing a config after creating its pipeline does not affect the pipeline
+	stageCfg.Tiingo.Eod.StartDate = "2000-01-01"
+	stageCfg.DuckDB.ConnInitFnQueries = nil
+
+	// Without idle connections every query opens a new connection, which runs the init queries
+	// the pipeline was created with
+	stage.DuckDB.DB.SetMaxIdleConns(0)
+	ctx := context.Background()
+	assert.NoError(t, stage.DuckDB.RunQuery(ctx, "insert into failed_tickers values ('AAPL', 'daily_adjusted', 500, 'boom', 'server error', 1, now(), now())"))
+
+	count := func(p *Pipeline) int {
+		var n int
+		if err := p.DuckDB.DB.QueryRowContext(ctx, "select count(*) from failed_tickers").Scan(&n); err != nil {
+			t.Fatalf("Failed to count failed tickers: %v", err)
+		}
+		return n
+	}
+	assert.Equal(t, 1, count(stage))
+	assert.Equal(t, 0, count(prod))
+	assert.Equal(t, "2024-01-01", stage.TiingoClient.TiingoConfig.Eod.StartDate)
+	assert.Equal(t, prodCfg.Tiingo.Eod.StartDate, prod.TiingoClient.TiingoConfig.Eod.StartDate)
+}
+
+func TestPipeline_SelectedFundamentalsSample(t *testing.T) {
+	t.Setenv("TIINGO_TOKEN", "test-token")
+	// The environment of the config decides, not the process environment
+	t.Setenv("APP_ENV", "dev")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for env, sampled := range map[string]bool{"prod": false, "dev": true} {
+		t.Run(env, func(t *testing.T) {
+			// As with --env
+			cfg, _, err := config.Load(config.Options{File: "../config.base.yaml", Env: env})
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			cfg.DuckDB.Path = ":memory:"
+
+			p, err := NewPipeline(cfg, logger, nil)
+			if err != nil {
+				t.Fatalf("Failed to create pipeline: %v", err)
+			}
+			defer p.Close()
+
+			assert.Equal(t, sampled, strings.Contains(p.selectedFundamentalsQuery(""), "using sample 20"))
+		})
+	}
+}
+
 func TestPipeline_UpdateMetadata(t *testing.T) {
 	// Setup test server
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// Run the metadata update
-	count, err := pipeline.UpdateMetadata()
+	report, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
-	assert.Equal(t, 5, count, "Expected 5 rows to be inserted into fundamentals.meta")
+	assert.Equal(t, 5, report.Processed, "Expected 5 rows to be inserted into fundamentals.meta")
 
 	// Verify the data in DuckDB
 	// First verify total count
-	rowsTotal, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM fundamentals.meta;")
+	rowsTotal, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM fundamentals.meta;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"5"}, rowsTotal["count"], "Expected 5 total rows in fundamentals.meta")
 
 	// Then verify US tickers specifically through the view
-	rowsUS, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM fundamentals.selected_fundamentals;")
+	rowsUS, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM fundamentals.selected_fundamentals;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"3"}, rowsUS["count"], "Expected 3 US tickers in selected_fundamentals view")
 
 	// Verify specific fields for a known ticker
-	appleData, err := pipeline.DuckDB.GetQueryResults(`
+	appleData, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
 		SELECT permaTicker, name, sector, industry, location
 		FROM fundamentals.meta
 		WHERE ticker = 'aapl';
@@ -304,6 +380,46 @@ func TestPipeline_UpdateMetadata(t *testing.T) {
 	assert.Equal(t, []string{"California, USA"}, appleData["location"])
 }
 
+func TestPipeline_SupportedTickers(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	ctx := context.Background()
+
+	tables := func(r *Report) []string {
+		var tables []string
+		for _, table := range r.Tables {
+			tables = append(tables, table.Table)
+		}
+		return tables
+	}
+
+	// The first step of the process loads supported_tickers
+	report, err := pipeline.UpdateMetadata(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, tables(report), "supported_tickers")
+	assert.Equal(t, int64(2), report.APICalls)
+
+	// Later steps reuse the refresh
+	report, err = pipeline.UpdateMetadata(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, tables(report), "supported_tickers")
+	assert.Equal(t, int64(1), report.APICalls)
+
+	// Once expired, the zip is downloaded again, but not reloaded since it is unchanged
+	pipeline.tickersMaxAge = time.Nanosecond
+	report, err = pipeline.UpdateMetadata(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, tables(report), "supported_tickers")
+	assert.Equal(t, int64(2), report.APICalls)
+
+	n, err := pipeline.DuckDB.CountRows(ctx, "supported_tickers")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), n)
+}
+
 // MockTimeProvider implements TimeProvider for testing with fixed hour
 type MockTimeProvider struct {
 	hour int
@@ -351,7 +467,7 @@ func TestPipeline_DailyFundamentals(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Setup test server
-			server := setupTestServer()
+			server := setupTestServer(t)
 			defer server.Close()
 
 			// Setup pipeline with mock time provider
@@ -360,17 +476,17 @@ func TestPipeline_DailyFundamentals(t *testing.T) {
 
 			// First populate meta table if we're testing automatic ticker selection
 			if tt.tickers == nil {
-				_, err := pipeline.UpdateMetadata()
+				_, err := pipeline.UpdateMetadata(context.Background())
 				assert.NoError(t, err)
 			}
 
 			// Run the test
-			count, err := pipeline.DailyFundamentals(tt.tickers, tt.half, 0, nil, false, 0)
+			report, err := pipeline.DailyFundamentals(context.Background(), tt.tickers, tt.half, 0, nil, false, 0)
 			assert.NoError(t, err)
-			assert.Equal(t, tt.wantCount, count)
+			assert.Equal(t, tt.wantCount, report.Processed)
 
 			// Verify the correct tickers were processed
-			rows, err := pipeline.DuckDB.GetQueryResults(`
+			rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
                 SELECT DISTINCT ticker
                 FROM fundamentals.daily
                 ORDER BY ticker;
@@ -419,7 +535,7 @@ func TestPipeline_Statements(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Setup test server
-			server := setupTestServer()
+			server := setupTestServer(t)
 			defer server.Close()
 
 			// Setup pipeline with mock time provider
@@ -428,17 +544,17 @@ func TestPipeline_Statements(t *testing.T) {
 
 			// First populate meta table if we're testing automatic ticker selection
 			if tt.tickers == nil {
-				_, err := pipeline.UpdateMetadata()
+				_, err := pipeline.UpdateMetadata(context.Background())
 				assert.NoError(t, err)
 			}
 
 			// Run the test
-			count, err := pipeline.Statements(tt.tickers, tt.half, 0, nil, false, 0)
+			report, err := pipeline.Statements(context.Background(), tt.tickers, tt.half, 0, nil, false, 0)
 			assert.NoError(t, err)
-			assert.Equal(t, tt.wantCount, count)
+			assert.Equal(t, tt.wantCount, report.Processed)
 
 			// Verify the correct tickers were processed
-			rows, err := pipeline.DuckDB.GetQueryResults(`
+			rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
                 SELECT DISTINCT ticker
                 FROM fundamentals.statements
                 ORDER BY ticker;
@@ -504,23 +620,29 @@ func TestFilterOutSkippedTickers(t *testing.T) {
 
 func TestPipeline_DailyFundamentals_BatchProcessing(t *testing.T) {
 	// Setup test server
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
+	pipeline.spoolDir = t.TempDir()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// Test with batch size of 2
-	count, err := pipeline.DailyFundamentals([]string{"AAPL", "MSFT", "TSLA"}, false, 2, nil, false, 0)
+	report, err := pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "MSFT", "TSLA"}, false, 2, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Processed)
+
+	// The spools of the batches are removed once loaded
+	spools, err := os.ReadDir(pipeline.spoolDir)
 	assert.NoError(t, err)
-	assert.Equal(t, 3, count)
+	assert.Empty(t, spools)
 
 	// Verify all data was loaded despite batching
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.daily
         ORDER BY ticker;
@@ -530,18 +652,18 @@ func TestPipeline_DailyFundamentals_BatchProcessing(t *testing.T) {
 }
 
 func TestPipeline_DailyFundamentals_SkipTickers(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// Test skipping specific tickers
-	count, err := pipeline.DailyFundamentals(
+	report, err := pipeline.DailyFundamentals(context.Background(),
 		[]string{"AAPL", "MSFT", "TSLA"},
 		false,
 		0,
@@ -550,10 +672,10 @@ func TestPipeline_DailyFundamentals_SkipTickers(t *testing.T) {
 		0,
 	)
 	assert.NoError(t, err)
-	assert.Equal(t, 1, count)
+	assert.Equal(t, 1, report.Processed)
 
 	// Verify only non-skipped ticker was processed
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.daily
         ORDER BY ticker;
@@ -563,22 +685,22 @@ func TestPipeline_DailyFundamentals_SkipTickers(t *testing.T) {
 }
 
 func TestPipeline_DailyFundamentals_SkipExisting(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// First insertion
-	_, err = pipeline.DailyFundamentals([]string{"AAPL"}, false, 0, nil, false, 0)
+	_, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL"}, false, 0, nil, false, 0)
 	assert.NoError(t, err)
 
 	// Second insertion with skipExisting=true
-	count, err := pipeline.DailyFundamentals(
+	report, err := pipeline.DailyFundamentals(context.Background(),
 		[]string{"AAPL", "MSFT", "TSLA"},
 		false,
 		0,
@@ -587,10 +709,10 @@ func TestPipeline_DailyFundamentals_SkipExisting(t *testing.T) {
 		0,
 	)
 	assert.NoError(t, err)
-	assert.Equal(t, 2, count) // Should only process MSFT and TSLA
+	assert.Equal(t, 2, report.Processed) // Should only process MSFT and TSLA
 
 	// Verify all tickers are present
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.daily
         ORDER BY ticker;
@@ -600,23 +722,23 @@ func TestPipeline_DailyFundamentals_SkipExisting(t *testing.T) {
 }
 
 func TestPipeline_DailyFundamentals_Lookback(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// Test with lookback period
-	count, err := pipeline.DailyFundamentals(nil, false, 0, nil, false, 20000)
+	report, err := pipeline.DailyFundamentals(context.Background(), nil, false, 0, nil, false, 20000)
 	assert.NoError(t, err)
-	assert.Greater(t, count, 0)
+	assert.Greater(t, report.Processed, 0)
 
 	// Verify data was loaded
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.daily
         ORDER BY ticker;
@@ -626,18 +748,18 @@ func TestPipeline_DailyFundamentals_Lookback(t *testing.T) {
 }
 
 func TestPipeline_Statements_BatchAndSkip(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// Test combination of batch processing and skipping
-	count, err := pipeline.Statements(
+	report, err := pipeline.Statements(context.Background(),
 		[]string{"AAPL", "MSFT", "TSLA"},
 		false,
 		2,                // batch size
@@ -646,10 +768,10 @@ func TestPipeline_Statements_BatchAndSkip(t *testing.T) {
 		0,
 	)
 	assert.NoError(t, err)
-	assert.Equal(t, 2, count) // Should process AAPL and TSLA in batches
+	assert.Equal(t, 2, report.Processed) // Should process AAPL and TSLA in batches
 
 	// Verify correct tickers were processed
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.statements
         ORDER BY ticker;
@@ -659,24 +781,24 @@ func TestPipeline_Statements_BatchAndSkip(t *testing.T) {
 }
 
 func TestPipeline_DailyFundamentals_AllNoneResponses(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// Test with tickers that will return "None"
 	tickers := []string{"NODAILY", "NODATA"}
-	count, err := pipeline.DailyFundamentals(tickers, false, 1, nil, false, 0) // batch size of 1 to ensure multiple requests
+	report, err := pipeline.DailyFundamentals(context.Background(), tickers, false, 1, nil, false, 0) // batch size of 1 to ensure multiple requests
 	assert.NoError(t, err)
-	assert.Equal(t, 0, count) // Should process 0 tickers since all returned "None"
+	assert.Equal(t, 0, report.Processed) // Should process 0 tickers since all returned "None"
 
 	// Verify no data was loaded
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT COUNT(*) as count
         FROM fundamentals.daily;
     `)
@@ -684,12 +806,12 @@ func TestPipeline_DailyFundamentals_AllNoneResponses(t *testing.T) {
 	assert.Equal(t, []string{"0"}, rows["count"])
 
 	// Verify we can still successfully process other tickers after receiving "None" responses
-	count, err = pipeline.DailyFundamentals([]string{"AAPL"}, false, 0, nil, false, 0)
+	report, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL"}, false, 0, nil, false, 0)
 	assert.NoError(t, err)
-	assert.Equal(t, 1, count)
+	assert.Equal(t, 1, report.Processed)
 
 	// Verify only AAPL data was loaded
-	rows, err = pipeline.DuckDB.GetQueryResults(`
+	rows, err = pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT DISTINCT ticker
         FROM fundamentals.daily
         ORDER BY ticker;
@@ -699,22 +821,22 @@ func TestPipeline_DailyFundamentals_AllNoneResponses(t *testing.T) {
 }
 
 func TestPipeline_Statements_SkipExistingAndLookback(t *testing.T) {
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	pipeline, cleanup := setupTestPipeline(t, server, nil)
 	defer cleanup()
 
 	// First populate meta table
-	_, err := pipeline.UpdateMetadata()
+	_, err := pipeline.UpdateMetadata(context.Background())
 	assert.NoError(t, err)
 
 	// First insertion
-	_, err = pipeline.Statements([]string{"AAPL"}, false, 0, nil, false, 0)
+	_, err = pipeline.Statements(context.Background(), []string{"AAPL"}, false, 0, nil, false, 0)
 	assert.NoError(t, err)
 
 	// Second insertion with skipExisting and lookback
-	count, err := pipeline.Statements(
+	report, err := pipeline.Statements(context.Background(),
 		nil, // use selected_fundamentals
 		false,
 		0,
@@ -723,10 +845,10 @@ func TestPipeline_Statements_SkipExistingAndLookback(t *testing.T) {
 		20000, // lookback days
 	)
 	assert.NoError(t, err)
-	assert.Greater(t, count, 0)
+	assert.Greater(t, report.Processed, 0)
 
 	// Verify AAPL wasn't processed again
-	rows, err := pipeline.DuckDB.GetQueryResults(`
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), `
         SELECT COUNT(*) as count
         FROM (
             SELECT ticker, date
@@ -749,7 +871,7 @@ func TestPipeline_DailyEndOfDay(t *testing.T) {
 	expectedBackfillRows := 4 // 4 in addition to the 2 with same date as in LastTradingDay
 
 	// Setup test server
-	server := setupTestServer()
+	server := setupTestServer(t)
 	defer server.Close()
 
 	// Setup pipeline with no time provider (not needed for this test)
@@ -757,10 +879,10 @@ func TestPipeline_DailyEndOfDay(t *testing.T) {
 	defer cleanup()
 
 	// Asserting that existing mock data in the database is as expected
-	rowsLastTradingDayPre, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM main.last_trading_day;")
+	rowsLastTradingDayPre, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM main.last_trading_day;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedInitRowsLastTradingDay)}, rowsLastTradingDayPre["count"], fmt.Sprintf("Expected %d rows in last_trading_day table", expectedInitRowsLastTradingDay))
-	rowsDailyAdjustedPre, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM main.daily_adjusted;")
+	rowsDailyAdjustedPre, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM main.daily_adjusted;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedInitRowsDailyAdjusted)}, rowsDailyAdjustedPre["count"], fmt.Sprintf("Expected %d rows in daily_adjusted table", expectedInitRowsDailyAdjusted))
 
@@ -769,27 +891,529 @@ func TestPipeline_DailyEndOfDay(t *testing.T) {
 	pipeline.TiingoClient.InTest = true
 
 	// Run the pipeline
-	count, err := pipeline.DailyEndOfDay() // Count here is only if backfill happens, not if no backfills are needed.
+	report, err := pipeline.DailyEndOfDay(context.Background()) // Count here is only if backfill happens, not if no backfills are needed.
 	assert.NoError(t, err)
 	nBackfills := 2 // We expect 2 backfills since TSLA and AMZN has divCash or splitFactor in non-normal values
-	assert.Equal(t, nBackfills, count)
+	assert.Equal(t, nBackfills, report.Processed)
 
 	// Verify the data in DuckDB
 	// Verify selected_us_tickers table
-	rowsSelectedUSTickers, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM main.selected_us_tickers;")
+	rowsSelectedUSTickers, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM main.selected_us_tickers;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedPostRowsSelectedUSTickers)}, rowsSelectedUSTickers["count"], fmt.Sprintf("Expected %d rows in selected_us_tickers table", expectedPostRowsSelectedUSTickers))
 	// Verify that the last_trading_day table has been overwritten
-	rowsLastTradingDayPost, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM last_trading_day;")
+	rowsLastTradingDayPost, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM last_trading_day;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedPostRowsLastTradingDay)}, rowsLastTradingDayPost["count"], fmt.Sprintf("Expected %d rows in last_trading_day table", expectedPostRowsLastTradingDay))
 	// Verify that selected_last_trading_day view returns the expected number of rows
-	rowsSelectedLastTradingDay, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM selected_last_trading_day;")
+	rowsSelectedLastTradingDay, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM selected_last_trading_day;")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedPostRowsSelectedLastTradingDay)}, rowsSelectedLastTradingDay["count"], fmt.Sprintf("Expected %d rows in selected_last_trading_day view", expectedPostRowsSelectedLastTradingDay))
 	// Verify that the daily_adjusted table has been updated with newly inserted rows
-	rowsDailyAdjustedPost, err := pipeline.DuckDB.GetQueryResults("SELECT count(*) as count FROM daily_adjusted;")
+	rowsDailyAdjustedPost, err := pipeline.DuckDB.GetQueryResults(context.Background(), "SELECT count(*) as count FROM daily_adjusted;")
 	assert.NoError(t, err)
 	expectedPostRowsDailyAdjusted := expectedInitRowsDailyAdjusted + expectedPostRowsSelectedLastTradingDay + expectedBackfillRows
 	assert.Equal(t, []string{fmt.Sprintf("%d", expectedPostRowsDailyAdjusted)}, rowsDailyAdjustedPost["count"], fmt.Sprintf("Expected %d rows in daily_adjusted table", expectedPostRowsDailyAdjusted))
 }
+
+func TestPipeline_DailyEndOfDay_RollsBack(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// The history of TSLA fails to load, after the daily insert and the backfill of AMZN
+	var broken atomic.Bool
+	broken.Store(true)
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tiingo/daily/TSLA/prices" && broken.Load() {
+			_, _ = w.Write([]byte("date,close,adjClose,adjVolume\nnot-a-date,1,1,1\n"))
+			return
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	report, err := pipeline.DailyEndOfDay(context.Background())
+	assert.ErrorContains(t, err, "error loading history to DB for ticker TSLA")
+
+	// Neither the daily insert nor the backfills were committed
+	for table, count := range map[string]string{"last_trading_day": "7", "daily_adjusted": "6"} {
+		res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from "+table)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{count}, res["count"], table)
+	}
+	for _, table := range report.Tables {
+		assert.Equal(t, "supported_tickers", table.Table)
+	}
+	assert.False(t, report.DataChanged)
+	assert.Empty(t, report.Succeeded)
+	assert.Equal(t, 0, report.Processed)
+
+	// The failing ticker is recorded, even though the transaction was rolled back
+	failed, err := pipeline.ListFailures(context.Background(), "daily_adjusted")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "TSLA", failed[0].Ticker)
+	}
+
+	// The next run loads the day
+	broken.Store(false)
+	_, err = pipeline.DailyEndOfDay(context.Background())
+	assert.NoError(t, err)
+	res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from daily_adjusted")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"14"}, res["count"])
+}
+
+func TestPipeline_DailyEndOfDay_FetchFailure(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// The history of TSLA cannot be fetched
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tiingo/daily/TSLA/prices" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	pipeline.TiingoClient.HTTPClient.RetryMax = 0
+
+	report, err := pipeline.DailyEndOfDay(context.Background())
+	assert.ErrorContains(t, err, "TSLA")
+	assert.Equal(t, 1, report.Processed)
+	assert.Equal(t, []string{"AMZN"}, report.Succeeded)
+
+	// The daily insert and the backfill of AMZN are committed, and TSLA is recorded
+	res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from last_trading_day")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"4"}, res["count"])
+	res, err = pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from daily_adjusted where ticker = 'AMZN'")
+	assert.NoError(t, err)
+	assert.NotEqual(t, []string{"0"}, res["count"])
+	failed, err := pipeline.ListFailures(context.Background(), "daily_adjusted")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "TSLA", failed[0].Ticker)
+	}
+}
+
+func TestPipeline_DailyEndOfDay_Interrupted(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// A shutdown signal arrives while the first ticker is backfilled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/prices") && r.URL.Path != "/tiingo/daily/prices" {
+			cancel()
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	report, err := pipeline.DailyEndOfDay(ctx)
+	assert.ErrorIs(t, err, ErrInterrupted)
+	assert.Contains(t, err.Error(), "1 remaining")
+	assert.Equal(t, 1, report.Processed)
+
+	// The daily insert and the in-flight backfill are committed
+	res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from last_trading_day")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"4"}, res["count"])
+	res, err = pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as count from daily_adjusted")
+	assert.NoError(t, err)
+	// The tickers are backfilled in no particular order, but either has more rows than the daily insert
+	assert.NotEqual(t, []string{"10"}, res["count"])
+	assert.Len(t, report.Succeeded, 1)
+}
+
+func TestPipeline_BackfillEndOfDay_LoadError(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// The history of TSLA cannot be loaded
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tiingo/daily/TSLA/prices" {
+			_, _ = w.Write([]byte("date,close,adjClose,adjVolume\nnot-a-date,1,1,1\n"))
+			return
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	// Outside of a transaction, a failed load does not stop the other tickers
+	report, err := pipeline.BackfillEndOfDay(context.Background(), []string{"TSLA", "AMZN"})
+	assert.ErrorContains(t, err, "error loading history to DB for ticker TSLA")
+	assert.Equal(t, 1, report.Processed)
+	assert.Equal(t, []string{"AMZN"}, report.Succeeded)
+
+	failed, err := pipeline.ListFailures(context.Background(), "daily_adjusted")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "TSLA", failed[0].Ticker)
+	}
+}
+
+func TestPipeline_BackfillEndOfDay_InTx(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	ctx := context.Background()
+
+	earlier := []tickerFailure{{Ticker: "AMZN", Err: fmt.Errorf("earlier failure")}}
+	if err := pipeline.recordFailures(ctx, pipeline.DuckDB, "daily_adjusted", earlier); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+	listFailed := func() []string {
+		failed, err := pipeline.ListFailures(ctx, "daily_adjusted")
+		assert.NoError(t, err)
+		tickers := []string{}
+		for _, f := range failed {
+			tickers = append(tickers, f.Ticker)
+		}
+		return tickers
+	}
+
+	// The earlier failure is kept until the backfill is committed, and if it is rolled back
+	err := pipeline.DuckDB.InTx(ctx, func(tx *load.DuckDB) error {
+		assert.NoError(t, pipeline.backfillEndOfDay(ctx, &Report{}, tx, []string{"AMZN"}))
+		assert.Equal(t, []string{"AMZN"}, listFailed())
+		return fmt.Errorf("rolled back")
+	})
+	assert.EqualError(t, err, "rolled back")
+	assert.Equal(t, []string{"AMZN"}, listFailed())
+
+	err = pipeline.DuckDB.InTx(ctx, func(tx *load.DuckDB) error {
+		return pipeline.backfillEndOfDay(ctx, &Report{}, tx, []string{"AMZN"})
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, listFailed())
+}
+
+func TestPipeline_DailyFundamentals_DeadLetter(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	pipeline.TiingoClient.HTTPClient.RetryMax = 0
+	pipeline.failures.MaxAttempts = 2
+	pipeline.failures.Cooldown = time.Hour
+
+	_, err := pipeline.UpdateMetadata(context.Background())
+	assert.NoError(t, err)
+
+	// A failing ticker does not stop the other tickers from being loaded, but fails the job
+	report, err := pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "BROKEN"}, false, 0, nil, false, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "BROKEN")
+	assert.Equal(t, 1, report.Processed)
+	assert.Equal(t, []string{"AAPL"}, report.Succeeded)
+	if assert.Len(t, report.Failed, 1) {
+		assert.Equal(t, "BROKEN", report.Failed[0].Ticker)
+		assert.Contains(t, report.Failed[0].Reason, "500")
+	}
+	assert.Contains(t, report.Error, "BROKEN")
+
+	failed, err := pipeline.ListFailures(context.Background(), "fundamentals.daily")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "BROKEN", failed[0].Ticker)
+		assert.Equal(t, 500, failed[0].StatusCode)
+		assert.Equal(t, "Internal Server Error", failed[0].BodyExcerpt)
+		assert.Equal(t, 1, failed[0].Attempts)
+	}
+
+	// Second consecutive failure reaches MaxAttempts
+	_, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "BROKEN"}, false, 2, nil, false, 0)
+	assert.Error(t, err)
+	failed, err = pipeline.ListFailures(context.Background(), "")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, 2, failed[0].Attempts)
+	}
+
+	// Third run skips the dead-lettered ticker and succeeds
+	report, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "BROKEN"}, false, 0, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Processed)
+	assert.Equal(t, []string{"BROKEN"}, report.Skipped)
+	assert.Equal(t, []string{"AAPL"}, report.Requested)
+
+	// Retrying ignores the cooldown and increments the attempt count
+	_, err = pipeline.RetryFailures(context.Background(), "fundamentals.daily", nil)
+	assert.Error(t, err)
+	failed, err = pipeline.ListFailures(context.Background(), "fundamentals.daily")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, 3, failed[0].Attempts)
+	}
+
+	// Only the retry ignores the cooldown, other runs still skip the ticker
+	report, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "BROKEN"}, false, 0, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BROKEN"}, report.Skipped)
+
+	// Clearing removes the ticker from the table
+	nCleared, err := pipeline.ClearFailures(context.Background(), "fundamentals.daily", []string{"broken"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, nCleared)
+	failed, err = pipeline.ListFailures(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, failed)
+}
+
+func TestPipeline_BackfillEndOfDay_DeadLetter(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	pipeline.TiingoClient.HTTPClient.RetryMax = 0
+	pipeline.failures.MaxAttempts = 1
+	pipeline.failures.Cooldown = time.Hour
+
+	report, err := pipeline.BackfillEndOfDay(context.Background(), []string{"TSLA", "BROKEN"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, report.Processed)
+
+	failed, err := pipeline.ListFailures(context.Background(), "daily_adjusted")
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "BROKEN", failed[0].Ticker)
+	}
+
+	// BROKEN is skipped on the next run since MaxAttempts is 1
+	report, err = pipeline.BackfillEndOfDay(context.Background(), []string{"TSLA", "BROKEN"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Processed)
+}
+
+func TestPipeline_DailyFundamentals_ErrorClassification(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	pipeline.TiingoClient.HTTPClient.RetryMax = 0
+
+	_, err := pipeline.UpdateMetadata(context.Background())
+	assert.NoError(t, err)
+
+	// Unknown tickers (404) and tickers without entitlement (400 None) are skipped, not job failures
+	report, err := pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "UNKNOWN", "NOACCESS"}, false, 0, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Processed)
+
+	failed, err := pipeline.ListFailures(context.Background(), "fundamentals.daily")
+	assert.NoError(t, err)
+	var failedTickers []string
+	for _, f := range failed {
+		failedTickers = append(failedTickers, f.Ticker)
+	}
+	assert.Equal(t, []string{"NOACCESS", "UNKNOWN"}, failedTickers)
+
+	// An invalid token aborts the job
+	_, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL", "REVOKED"}, false, 1, nil, false, 0)
+	assert.ErrorIs(t, err, extract.ErrUnauthorized)
+}
+
+func TestPipeline_BackfillEndOfDay_ErrorClassification(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+	pipeline.TiingoClient.HTTPClient.RetryMax = 0
+
+	report, err := pipeline.BackfillEndOfDay(context.Background(), []string{"TSLA", "NOACCESS"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Processed)
+
+	// An invalid token aborts the backfill, and the failures so far are recorded
+	_, err = pipeline.BackfillEndOfDay(context.Background(), []string{"BROKEN", "REVOKED", "TSLA"})
+	assert.ErrorIs(t, err, extract.ErrUnauthorized)
+
+	failed, err := pipeline.ListFailures(context.Background(), "daily_adjusted")
+	assert.NoError(t, err)
+	var failedTickers []string
+	for _, f := range failed {
+		failedTickers = append(failedTickers, f.Ticker)
+	}
+	assert.Equal(t, []string{"BROKEN", "NOACCESS", "REVOKED"}, failedTickers)
+}
+
+func TestPipeline_DailyFundamentals_Interrupted(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// Cancel the context while the first batch is being fetched, like a SIGINT would
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/tiingo/fundamentals/") && strings.HasSuffix(r.URL.Path, "/daily") {
+			cancel()
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	report, err := pipeline.DailyFundamentals(ctx, []string{"AAPL", "MSFT", "TSLA"}, false, 1, nil, false, 0)
+	assert.ErrorIs(t, err, ErrInterrupted)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), "2 remaining")
+	assert.Equal(t, 1, report.Processed)
+
+	// The in-flight batch was loaded before stopping
+	res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select distinct ticker from fundamentals.daily")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AAPL"}, res["ticker"])
+}
+
+func TestPipeline_BackfillEndOfDay_Interrupted(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := pipeline.BackfillEndOfDay(ctx, []string{"TSLA", "AMZN"})
+	assert.ErrorIs(t, err, ErrInterrupted)
+	assert.Contains(t, err.Error(), "2 remaining")
+	assert.Equal(t, 0, report.Processed)
+
+	res, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select count(*) as n from daily_adjusted where ticker = 'TSLA'")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0"}, res["n"])
+}
+
+func TestPipeline_DailyFundamentals_Timeout(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	// A deadline is not a shutdown signal: it aborts in-flight steps too
+	_, err := pipeline.DailyFundamentals(ctx, []string{"AAPL"}, false, 0, nil, false, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrInterrupted)
+}
+
+// setupTestCollector stands in for an OTLP/HTTP collector, and exports the spans of the
+// pipeline to it. The returned function flushes the spans and returns them.
+func setupTestCollector(t *testing.T) func() []*tracepb.Span {
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req coltracepb.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(body, &req))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+
+	shutdown, err := tracing.Setup(context.Background(), config.TracingConfig{Endpoint: collector.URL})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		collector.Close()
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	return func() []*tracepb.Span {
+		assert.NoError(t, shutdown(context.Background()))
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func spanAttribute(span *tracepb.Span, key string) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestPipeline_DailyFundamentals_Tracing(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	flush := setupTestCollector(t)
+	ctx := tracing.WithRunID(context.Background(), "run-1")
+	report, err := pipeline.DailyFundamentals(ctx, []string{"AAPL", "MSFT"}, false, 1, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Processed)
+
+	spans := flush()
+	names := make(map[string]int)
+	byID := make(map[string]*tracepb.Span)
+	var fetchedTickers []string
+	for _, span := range spans {
+		names[span.Name]++
+		byID[string(span.SpanId)] = span
+		// Every span of the run carries its run id
+		assert.Equal(t, "run-1", spanAttribute(span, "etl.run_id"), span.Name)
+		if span.Name == "pipeline.fetchTicker" {
+			fetchedTickers = append(fetchedTickers, spanAttribute(span, "etl.ticker"))
+		}
+	}
+	sort.Strings(fetchedTickers)
+	assert.Equal(t, []string{"AAPL", "MSFT"}, fetchedTickers)
+
+	assert.Equal(t, 1, names["pipeline.fetchFundamentalsData"])
+	assert.Equal(t, 1, names["pipeline.UpdateMetadata"])
+	assert.Equal(t, 2, names["pipeline.loadBatch"])
+	assert.Equal(t, 2, names["pipeline.spoolCSVs"])
+	assert.Greater(t, names["tiingo.get"], 2)
+	assert.Greater(t, names["duckdb.query"], 2)
+
+	// Each batch is loaded into the table by a query within the batch span
+	for _, span := range spans {
+		if span.Name != "duckdb.query" || spanAttribute(span, "etl.table") != "fundamentals.daily" {
+			continue
+		}
+		parent := byID[string(span.ParentSpanId)]
+		if assert.NotNil(t, parent) {
+			assert.Equal(t, "pipeline.loadBatch", parent.Name)
+		}
+	}
+}
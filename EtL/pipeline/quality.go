@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrValidation is returned when loaded data fails the quality checks. Tiingo may respond
+// 200 OK with incomplete or stale data shortly after market close, which is worse than an error.
+var ErrValidation = errors.New("data validation failed")
+
+const (
+	// minEndOfDayCoverage is the minimum number of tickers in the last trading day,
+	// relative to the number of tickers on the previous trading day.
+	minEndOfDayCoverage = 0.9
+	// maxEndOfDayUnchanged is the maximum share of tickers whose close is unchanged
+	// from the previous trading day, which indicates that Tiingo served stale prices.
+	maxEndOfDayUnchanged = 0.5
+)
+
+// ValidateEndOfDay checks that the last trading day loaded by DailyEndOfDay is complete and
+// fresh. It returns an error wrapping ErrValidation that lists the failed checks, if any.
+func (p *Pipeline) ValidateEndOfDay(ctx context.Context) error {
+	res, err := p.DuckDB.GetQueryResultsFromFile(ctx, "query__validate_last_trading_day.sql")
+	if err != nil {
+		return fmt.Errorf("error getting validation metrics: %w", err)
+	}
+
+	metrics := make(map[string]int, len(res))
+	for name, values := range res {
+		if len(values) != 1 {
+			return fmt.Errorf("expected a single value for validation metric %s, got %d", name, len(values))
+		}
+		value, err := strconv.Atoi(values[0])
+		if err != nil {
+			return fmt.Errorf("error parsing validation metric %s: %w", name, err)
+		}
+		metrics[name] = value
+	}
+
+	var failed []string
+	if metrics["n_rows"] == 0 {
+		failed = append(failed, "no rows for the last trading day")
+	}
+	if metrics["n_dates"] > 1 {
+		failed = append(failed, fmt.Sprintf("%d different dates in the last trading day", metrics["n_dates"]))
+	}
+	if metrics["n_invalid_prices"] > 0 {
+		failed = append(failed, fmt.Sprintf("%d tickers with missing or non-positive close", metrics["n_invalid_prices"]))
+	}
+	if previous := metrics["n_previous"]; previous > 0 {
+		if coverage := float64(metrics["n_rows"]) / float64(previous); coverage < minEndOfDayCoverage {
+			failed = append(failed, fmt.Sprintf("%d tickers, only %.0f%% of the %d on the previous trading day",
+				metrics["n_rows"], coverage*100, previous))
+		}
+		if unchanged := float64(metrics["n_unchanged"]) / float64(previous); unchanged > maxEndOfDayUnchanged {
+			failed = append(failed, fmt.Sprintf("%.0f%% of the tickers have the same close as on the previous trading day",
+				unchanged*100))
+		}
+	}
+
+	if len(failed) > 0 {
+		p.Logger.Warn("Last trading day failed validation", "failed_checks", strings.Join(failed, "; "))
+		return fmt.Errorf("%w: %s", ErrValidation, strings.Join(failed, "; "))
+	}
+
+	p.Logger.Info("Last trading day passed validation",
+		"rows", metrics["n_rows"],
+		"previous_rows", metrics["n_previous"],
+		"unchanged", metrics["n_unchanged"])
+	return nil
+}
@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_ValidateEndOfDay(t *testing.T) {
+	// With the supported tickers of the test server, the mock last_trading_day has
+	// AAPL, MSFT and TSLA on 2024-11-04, and daily_adjusted has AAPL, MSFT and GOOGL on 2023-01-04.
+	tests := []struct {
+		name       string
+		setupQuery string
+		wantErr    string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:       "no rows",
+			setupQuery: "delete from last_trading_day;",
+			wantErr:    "no rows for the last trading day",
+		},
+		{
+			name:       "too few tickers",
+			setupQuery: "delete from last_trading_day where ticker in ('MSFT', 'TSLA');",
+			wantErr:    "1 tickers, only 33% of the 3 on the previous trading day",
+		},
+		{
+			name:       "stale prices",
+			setupQuery: "update last_trading_day set close = 152.00 where ticker = 'AAPL'; update last_trading_day set close = 91.25 where ticker = 'MSFT';",
+			wantErr:    "67% of the tickers have the same close as on the previous trading day",
+		},
+		{
+			name:       "invalid prices",
+			setupQuery: "update last_trading_day set close = 0 where ticker = 'TSLA';",
+			wantErr:    "1 tickers with missing or non-positive close",
+		},
+		{
+			name:       "several dates",
+			setupQuery: "update last_trading_day set date = '2024-11-01' where ticker = 'TSLA';",
+			wantErr:    "2 different dates in the last trading day",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := setupTestServer(t)
+			defer server.Close()
+
+			pipeline, cleanup := setupTestPipeline(t, server, nil)
+			defer cleanup()
+
+			err := pipeline.supportedTickers(context.Background(), &Report{})
+			assert.NoError(t, err)
+			if tt.setupQuery != "" {
+				err = pipeline.DuckDB.RunQuery(context.Background(), tt.setupQuery)
+				assert.NoError(t, err)
+			}
+
+			err = pipeline.ValidateEndOfDay(context.Background())
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrValidation)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+)
+
+// Report summarises a pipeline run: the tickers requested and their outcome, the rows loaded
+// per table, the Tiingo API usage and the time spent per stage. Pipeline methods return a
+// report even when they fail, covering the work done until then.
+type Report struct {
+	RunID      string    `json:"run_id"`
+	Command    string    `json:"command"` // set by the caller, e.g. eod_daily
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+
+	// Processed is the number of tickers loaded, or of rows for runs that are not per ticker
+	// such as the metadata update.
+	Processed int           `json:"processed"`
+	Requested []string      `json:"requested"`
+	Succeeded []string      `json:"succeeded"`
+	Empty     []string      `json:"empty"`   // tickers Tiingo responded "None" for
+	Failed    []TickerError `json:"failed"`  // tickers whose fetch or load failed
+	Skipped   []string      `json:"skipped"` // tickers dead-lettered in failed_tickers
+	Tables    []TableReport `json:"tables"`
+	APICalls  int64         `json:"api_calls"` // including retries
+	APIBytes  int64         `json:"api_bytes"`
+	Stages    []StageReport `json:"stages"`
+	// DataChanged is whether any upsert inserted or changed rows. Downstream transformations
+	// can be skipped when it is false.
+	DataChanged bool `json:"data_changed"`
+
+	usage extract.RunUsage
+}
+
+// TickerError is a ticker that failed, with the reason why.
+type TickerError struct {
+	Ticker string `json:"ticker"`
+	Reason string `json:"reason"`
+}
+
+// TableReport counts the rows loaded into a table in a run, as in load.LoadResult.
+type TableReport struct {
+	Table       string   `json:"table"`
+	Inserted    int64    `json:"inserted"`
+	Changed     int64    `json:"changed"`
+	Unchanged   int64    `json:"unchanged"`
+	ChangedKeys []string `json:"changed_keys,omitempty"`
+}
+
+// StageReport is the time spent in a stage of a run, summed over batches and tickers.
+type StageReport struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Stages of a run in its report.
+const (
+	stageSupportedTickers = "supported_tickers"
+	stageMetadata         = "metadata"
+	stageSelect           = "select_tickers"
+	stageFetch            = "fetch"
+	stageLoad             = "load"
+	stageFailures         = "failures"
+)
+
+// newReport starts the report of a run, returning a context counting its Tiingo API usage.
+func (p *Pipeline) newReport(ctx context.Context) (*Report, context.Context) {
+	r := &Report{
+		RunID:     tracing.RunID(ctx),
+		StartedAt: p.now(),
+		Requested: []string{},
+		Succeeded: []string{},
+		Empty:     []string{},
+		Failed:    []TickerError{},
+		Skipped:   []string{},
+		Tables:    []TableReport{},
+		Stages:    []StageReport{},
+	}
+	return r, extract.WithRunUsage(ctx, &r.usage)
+}
+
+// finish completes the report of a run that returned err.
+func (r *Report) finish(now time.Time, err error) {
+	r.FinishedAt = now
+	r.APICalls = r.usage.Requests()
+	r.APIBytes = r.usage.Bytes()
+	if err != nil {
+		r.Error = secrets.Redact(err.Error())
+	}
+}
+
+// addLoad counts rows loaded into table, truncating it.
+func (r *Report) addLoad(table string, res load.LoadResult) {
+	t := r.table(table)
+	t.Inserted += res.Inserted
+	t.Changed += res.Changed
+	t.Unchanged += res.Unchanged
+	t.ChangedKeys = append(t.ChangedKeys, res.ChangedKeys...)
+}
+
+// addUpsert counts rows upserted into table, marking the data as changed if any row was
+// inserted or changed.
+func (r *Report) addUpsert(table string, res load.LoadResult) {
+	r.addLoad(table, res)
+	r.DataChanged = r.DataChanged || res.Modified()
+}
+
+// table returns the report of table, adding it if missing.
+func (r *Report) table(table string) *TableReport {
+	for i := range r.Tables {
+		if r.Tables[i].Table == table {
+			return &r.Tables[i]
+		}
+	}
+	r.Tables = append(r.Tables, TableReport{Table: table})
+	return &r.Tables[len(r.Tables)-1]
+}
+
+// addStage adds the time since start to the stage.
+func (r *Report) addStage(stage string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	for i := range r.Stages {
+		if r.Stages[i].Stage == stage {
+			r.Stages[i].Seconds += seconds
+			return
+		}
+	}
+	r.Stages = append(r.Stages, StageReport{Stage: stage, Seconds: seconds})
+}
+
+// addFailures adds the failed tickers.
+func (r *Report) addFailures(failures []tickerFailure) {
+	for _, f := range failures {
+		r.Failed = append(r.Failed, TickerError{Ticker: f.Ticker, Reason: secrets.Redact(f.Err.Error())})
+	}
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("error writing report as JSON: %w", err)
+	}
+	return nil
+}
+
+// WriteTable writes the report as aligned, human readable tables.
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	status := "succeeded"
+	if r.Error != "" {
+		status = "failed: " + r.Error
+	}
+	fmt.Fprintf(tw, "Run\t%s %s\n", r.Command, r.RunID)
+	fmt.Fprintf(tw, "Status\t%s\n", status)
+	fmt.Fprintf(tw, "Duration\t%s\n", r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond))
+	fmt.Fprintf(tw, "Processed\t%d\n", r.Processed)
+	fmt.Fprintf(tw, "Tickers\trequested %d, succeeded %d, empty %d, failed %d, skipped %d\n",
+		len(r.Requested), len(r.Succeeded), len(r.Empty), len(r.Failed), len(r.Skipped))
+	if len(r.Empty) > 0 {
+		fmt.Fprintf(tw, "Empty\t%s\n", strings.Join(r.Empty, ", "))
+	}
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(tw, "Skipped\t%s\n", strings.Join(r.Skipped, ", "))
+	}
+	fmt.Fprintf(tw, "API calls\t%d (%d bytes)\n", r.APICalls, r.APIBytes)
+	fmt.Fprintf(tw, "Data changed\t%t\n", r.DataChanged)
+
+	if len(r.Failed) > 0 {
+		fmt.Fprintf(tw, "\nFailed\tReason\n")
+		for _, f := range r.Failed {
+			fmt.Fprintf(tw, "%s\t%s\n", f.Ticker, f.Reason)
+		}
+	}
+	if len(r.Tables) > 0 {
+		fmt.Fprintf(tw, "\nTable\tInserted\tChanged\tUnchanged\tChanged keys\n")
+		for _, t := range r.Tables {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", t.Table, t.Inserted, t.Changed, t.Unchanged, strings.Join(t.ChangedKeys, ", "))
+		}
+	}
+	if len(r.Stages) > 0 {
+		fmt.Fprintf(tw, "\nStage\tDuration\n")
+		for _, s := range r.Stages {
+			fmt.Fprintf(tw, "%s\t%s\n", s.Stage, time.Duration(s.Seconds*float64(time.Second)).Round(time.Millisecond))
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+// SaveReport persists the report in run_reports, replacing an earlier report of the run.
+func (p *Pipeline) SaveReport(ctx context.Context, r *Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding report: %w", err)
+	}
+
+	_, err = p.DuckDB.DB.ExecContext(ctx, `
+		insert or replace into run_reports
+			(run_id, command, started_at, finished_at, error, processed, requested, succeeded, empty, failed, api_calls, report)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		r.RunID, r.Command, r.StartedAt, r.FinishedAt, r.Error, r.Processed,
+		len(r.Requested), len(r.Succeeded), len(r.Empty), len(r.Failed), r.APICalls, string(body),
+	)
+	if err != nil {
+		return fmt.Errorf("error saving report of run %s: %w", r.RunID, err)
+	}
+	return nil
+}
+
+// GetReport returns the report of a run from run_reports, and false if there is none.
+func (p *Pipeline) GetReport(ctx context.Context, runID string) (*Report, bool, error) {
+	var body string
+	err := p.DuckDB.DB.QueryRowContext(ctx, "select report from run_reports where run_id = ?;", runID).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting report of run %s: %w", runID, err)
+	}
+
+	var r Report
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		return nil, false, fmt.Errorf("error decoding report of run %s: %w", runID, err)
+	}
+	return &r, true, nil
+}
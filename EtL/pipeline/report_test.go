@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_DailyFundamentals_Report(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	ctx := tracing.WithRunID(context.Background(), "run-1")
+	report, err := pipeline.DailyFundamentals(ctx, []string{"aapl", "NODAILY", "MSFT"}, false, 2, nil, false, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "run-1", report.RunID)
+	assert.Equal(t, 2, report.Processed)
+	assert.Equal(t, []string{"AAPL", "NODAILY", "MSFT"}, report.Requested)
+	assert.Equal(t, []string{"AAPL", "MSFT"}, report.Succeeded)
+	assert.Equal(t, []string{"NODAILY"}, report.Empty)
+	assert.Empty(t, report.Failed)
+	assert.Empty(t, report.Error)
+	assert.False(t, report.FinishedAt.Before(report.StartedAt))
+
+	tables := make(map[string]TableReport)
+	for _, table := range report.Tables {
+		tables[table.Table] = table
+	}
+	assert.Equal(t, TableReport{Table: "fundamentals.daily", Inserted: 6}, tables["fundamentals.daily"])
+	assert.Equal(t, TableReport{Table: "fundamentals.meta", Inserted: 5}, tables["fundamentals.meta"])
+	assert.Contains(t, tables, "supported_tickers")
+	assert.True(t, report.DataChanged)
+
+	// supported_tickers.zip once for the run and the metadata update, metadata and one request per ticker
+	assert.Equal(t, int64(5), report.APICalls)
+	assert.Greater(t, report.APIBytes, int64(0))
+
+	stages := make([]string, len(report.Stages))
+	for i, stage := range report.Stages {
+		stages[i] = stage.Stage
+	}
+	assert.ElementsMatch(t, []string{stageSupportedTickers, stageMetadata, stageFetch, stageLoad, stageFailures}, stages)
+
+	// Loading the same tickers again leaves their rows unchanged
+	report, err = pipeline.DailyFundamentals(context.Background(), []string{"AAPL"}, false, 0, nil, false, 0)
+	assert.NoError(t, err)
+	for _, table := range report.Tables {
+		if table.Table == "fundamentals.daily" {
+			assert.Equal(t, TableReport{Table: "fundamentals.daily", Unchanged: 3}, table)
+		}
+	}
+	assert.False(t, report.DataChanged)
+}
+
+func TestPipeline_SaveReport(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	pipeline, cleanup := setupTestPipeline(t, server, nil)
+	defer cleanup()
+
+	_, ok, err := pipeline.GetReport(context.Background(), "run-1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ctx := tracing.WithRunID(context.Background(), "run-1")
+	report, err := pipeline.BackfillEndOfDay(ctx, []string{"TSLA"})
+	assert.NoError(t, err)
+	report.Command = "eod_backfill"
+	assert.NoError(t, pipeline.SaveReport(context.Background(), report))
+
+	// Saving again replaces the report of the run
+	report.Processed = 2
+	assert.NoError(t, pipeline.SaveReport(context.Background(), report))
+
+	got, ok, err := pipeline.GetReport(context.Background(), "run-1")
+	assert.NoError(t, err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "eod_backfill", got.Command)
+		assert.Equal(t, 2, got.Processed)
+		assert.Equal(t, []string{"TSLA"}, got.Succeeded)
+		assert.Equal(t, report.Tables, got.Tables)
+		assert.Equal(t, report.APICalls, got.APICalls)
+	}
+
+	rows, err := pipeline.DuckDB.GetQueryResults(context.Background(), "select command, processed, succeeded, failed from run_reports")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"command":   {"eod_backfill"},
+		"processed": {"2"},
+		"succeeded": {"1"},
+		"failed":    {"0"},
+	}, rows)
+}
+
+func TestReport_Write(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := &Report{
+		RunID:      "run-1",
+		Command:    "fundamentals_daily",
+		StartedAt:  start,
+		FinishedAt: start.Add(1500 * time.Millisecond),
+		Error:      "failed to fetch daily data for 1 tickers",
+		Processed:  1,
+		Requested:  []string{"AAPL", "NODAILY", "BROKEN"},
+		Succeeded:  []string{"AAPL"},
+		Empty:      []string{"NODAILY"},
+		Failed:     []TickerError{{Ticker: "BROKEN", Reason: "500 Internal Server Error"}},
+		Skipped:    []string{},
+		Tables: []TableReport{{
+			Table:       "fundamentals.daily",
+			Inserted:    2,
+			Changed:     1,
+			Unchanged:   3,
+			ChangedKeys: []string{"AAPL|2024-01-02"},
+		}},
+		DataChanged: true,
+		APICalls:    4,
+		APIBytes:    1024,
+		Stages:      []StageReport{{Stage: stageFetch, Seconds: 1.25}},
+	}
+
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, report.WriteTable(&buf))
+		assert.Equal(t, `Run           fundamentals_daily run-1
+Status        failed: failed to fetch daily data for 1 tickers
+Duration      1.5s
+Processed     1
+Tickers       requested 3, succeeded 1, empty 1, failed 1, skipped 0
+Empty         NODAILY
+API calls     4 (1024 bytes)
+Data changed  true
+
+Failed  Reason
+BROKEN  500 Internal Server Error
+
+Table               Inserted  Changed  Unchanged  Changed keys
+fundamentals.daily  2         1        3          AAPL|2024-01-02
+
+Stage  Duration
+fetch  1.25s
+`, buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, report.WriteJSON(&buf))
+
+		var got map[string]any
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+		assert.Equal(t, "run-1", got["run_id"])
+		assert.Equal(t, []any{"NODAILY"}, got["empty"])
+		assert.Equal(t, []any{map[string]any{"ticker": "BROKEN", "reason": "500 Internal Server Error"}}, got["failed"])
+		assert.Equal(t, []any{map[string]any{
+			"table":        "fundamentals.daily",
+			"inserted":     float64(2),
+			"changed":      float64(1),
+			"unchanged":    float64(3),
+			"changed_keys": []any{"AAPL|2024-01-02"},
+		}}, got["tables"])
+		assert.Equal(t, true, got["data_changed"])
+		assert.Equal(t, float64(4), got["api_calls"])
+	})
+}
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/calendar"
+)
+
+// Freshness statuses of a table.
+const (
+	FreshnessOK    = "ok"
+	FreshnessWarn  = "warn"
+	FreshnessStale = "stale"
+)
+
+// freshnessTables are the tables reported by Freshness, with the date column telling how
+// up to date they are, the view of the tickers the table should cover, and the number of
+// trading days behind at which the table is reported as warn and stale.
+var freshnessTables = []struct {
+	table      string
+	dateColumn string
+	universe   string // empty if the table has no universe to cover
+	warnAfter  int
+	staleAfter int
+}{
+	// Loaded nightly, so a day behind is expected between the close and the load
+	{"daily_adjusted", "date", "selected_us_tickers", 2, 3},
+	{"last_trading_day", "date", "selected_us_tickers", 2, 3},
+	{"supported_tickers", "endDate", "", 2, 3},
+	// Loaded weekly
+	{"fundamentals.meta", "dailyLastUpdated", "fundamentals.selected_fundamentals", 6, 10},
+	{"fundamentals.daily", "date", "fundamentals.selected_fundamentals", 6, 10},
+	// Dated by the end of the fiscal quarter, and filed up to a quarter later
+	{"fundamentals.statements", "date", "fundamentals.selected_fundamentals", 70, 100},
+}
+
+// TableFreshness tells how up to date a table is.
+type TableFreshness struct {
+	Table   string `json:"table"`
+	MaxDate string `json:"max_date"` // YYYY-MM-DD, empty if the table has no rows
+	Rows    int64  `json:"rows"`
+	Tickers int64  `json:"tickers"` // distinct tickers, case insensitively
+	// Coverage is the percentage of the tickers of the selected universe with rows in the table,
+	// or nil if the table has no universe or the universe is empty.
+	Coverage *float64 `json:"coverage"`
+	// StaleDays is the number of trading days after MaxDate up to the last closed session,
+	// or nil if the table has no rows.
+	StaleDays *int   `json:"stale_days"`
+	Status    string `json:"status"` // ok, warn or stale
+}
+
+// Freshness returns the latest date, row count, ticker coverage and staleness of each table loaded
+// by the pipeline. Staleness is counted in trading days up to the last session closed at p.now().
+func (p *Pipeline) Freshness(ctx context.Context) ([]TableFreshness, error) {
+	lastSession := calendar.LastSession(p.now())
+	freshness := make([]TableFreshness, 0, len(freshnessTables))
+	for _, t := range freshnessTables {
+		var maxDate sql.NullString
+		f := TableFreshness{Table: t.table}
+		query := fmt.Sprintf("select strftime(max(%s), '%%Y-%%m-%%d'), count(*), count(distinct upper(ticker)) from %s;", t.dateColumn, t.table)
+		if err := p.DuckDB.DB.QueryRowContext(ctx, query).Scan(&maxDate, &f.Rows, &f.Tickers); err != nil {
+			return nil, fmt.Errorf("error getting freshness of %s: %w", t.table, err)
+		}
+		f.MaxDate = maxDate.String
+
+		if t.universe != "" {
+			coverage, err := p.coverage(ctx, t.table, t.universe)
+			if err != nil {
+				return nil, err
+			}
+			f.Coverage = coverage
+		}
+
+		f.Status = FreshnessStale
+		if f.MaxDate != "" {
+			date, err := time.Parse(time.DateOnly, f.MaxDate)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max date of %s: %w", t.table, err)
+			}
+			staleDays := calendar.TradingDaysBetween(date, lastSession)
+			f.StaleDays = &staleDays
+			switch {
+			case staleDays < t.warnAfter:
+				f.Status = FreshnessOK
+			case staleDays < t.staleAfter:
+				f.Status = FreshnessWarn
+			}
+		}
+		freshness = append(freshness, f)
+	}
+	return freshness, nil
+}
+
+// coverage returns the percentage of the tickers in the universe view with rows in table,
+// or nil if the universe is empty.
+func (p *Pipeline) coverage(ctx context.Context, table, universe string) (*float64, error) {
+	query := fmt.Sprintf(`
+		with universe as (select distinct upper(ticker) as ticker from %s)
+		select
+			count(*),
+			count(*) filter (where ticker in (select upper(ticker) from %s))
+		from universe;`, universe, table)
+	var total, covered int64
+	if err := p.DuckDB.DB.QueryRowContext(ctx, query).Scan(&total, &covered); err != nil {
+		return nil, fmt.Errorf("error getting coverage of %s: %w", table, err)
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	pct := 100 * float64(covered) / float64(total)
+	return &pct, nil
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_Freshness(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	// After the close on Wednesday 2024-11-06
+	c := &clock{}
+	c.set(time.Date(2024, 11, 6, 22, 0, 0, 0, time.UTC))
+	pipeline, cleanup := setupTestPipeline(t, server, c)
+	defer cleanup()
+
+	// The selected universe is AAPL, MSFT, NVDA and TSLA
+	err := pipeline.DuckDB.RunQuery(context.Background(), `
+		insert into supported_tickers values
+			('aapl', 'NASDAQ', 'Stock', 'USD', '1980-12-12', '2024-11-05'),
+			('MSFT', 'NASDAQ', 'Stock', 'USD', '1986-03-13', '2024-11-05'),
+			('NVDA', 'NASDAQ', 'Stock', 'USD', '1999-01-22', '2024-11-05'),
+			('TSLA', 'NASDAQ', 'Stock', 'USD', '2010-06-29', '2024-11-05'),
+			('000001', 'SHE', 'Stock', 'CNY', '2007-01-04', '2024-11-05');`)
+	if err != nil {
+		t.Fatalf("Failed to insert supported tickers: %v", err)
+	}
+
+	pct := func(f float64) *float64 { return &f }
+	days := func(n int) *int { return &n }
+
+	freshness, err := pipeline.Freshness(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []TableFreshness{
+		{Table: "daily_adjusted", MaxDate: "2023-01-04", Rows: 6, Tickers: 3, Coverage: pct(50), StaleDays: days(463), Status: FreshnessStale},
+		{Table: "last_trading_day", MaxDate: "2024-11-04", Rows: 7, Tickers: 7, Coverage: pct(100), StaleDays: days(2), Status: FreshnessWarn},
+		{Table: "supported_tickers", MaxDate: "2024-11-05", Rows: 5, Tickers: 5, StaleDays: days(1), Status: FreshnessOK},
+		{Table: "fundamentals.meta", Status: FreshnessStale},
+		{Table: "fundamentals.daily", Status: FreshnessStale},
+		{Table: "fundamentals.statements", Status: FreshnessStale},
+	}, freshness)
+}
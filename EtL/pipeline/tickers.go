@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TickerVersion is a version of a ticker's listing in supported_tickers_history, seen in the
+// loads of supported_tickers from FirstSeen to LastSeen.
+type TickerVersion struct {
+	Ticker        string    `json:"ticker"`
+	Exchange      string    `json:"exchange"`
+	AssetType     string    `json:"asset_type"`
+	PriceCurrency string    `json:"price_currency"`
+	StartDate     string    `json:"start_date"` // YYYY-MM-DD, empty if unknown
+	EndDate       string    `json:"end_date"`   // YYYY-MM-DD, empty if unknown
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	// Current is true if the version was seen in the latest load of supported_tickers.
+	Current bool `json:"current"`
+}
+
+// TickerHistory returns the versions of a ticker in supported_tickers_history, oldest first.
+// The ticker is matched case-insensitively.
+func (p *Pipeline) TickerHistory(ctx context.Context, ticker string) ([]TickerVersion, error) {
+	query := `
+		select ticker, coalesce(exchange, ''), coalesce(assetType, ''), coalesce(priceCurrency, ''),
+			strftime(startDate, '%Y-%m-%d'), strftime(endDate, '%Y-%m-%d'), first_seen, last_seen,
+			last_seen = (select max(last_seen) from supported_tickers_history)
+		from supported_tickers_history
+		where upper(ticker) = upper(?)
+		order by first_seen, last_seen, exchange, assetType;`
+
+	rows, err := p.DuckDB.DB.QueryContext(ctx, query, ticker)
+	if err != nil {
+		return nil, fmt.Errorf("error querying supported_tickers_history: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []TickerVersion
+	for rows.Next() {
+		var v TickerVersion
+		var startDate, endDate sql.NullString
+		if err := rows.Scan(&v.Ticker, &v.Exchange, &v.AssetType, &v.PriceCurrency,
+			&startDate, &endDate, &v.FirstSeen, &v.LastSeen, &v.Current); err != nil {
+			return nil, fmt.Errorf("error scanning supported_tickers_history row: %w", err)
+		}
+		v.StartDate, v.EndDate = startDate.String, endDate.String
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over supported_tickers_history: %w", err)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a TimeProvider whose time is set by the test.
+type clock struct {
+	now atomic.Pointer[time.Time]
+}
+
+func (c *clock) Now() time.Time {
+	return *c.now.Load()
+}
+
+func (c *clock) set(t time.Time) {
+	c.now.Store(&t)
+}
+
+func TestPipeline_TickerHistory(t *testing.T) {
+	upstream := setupTestServer(t)
+	defer upstream.Close()
+
+	// AAPL gets an endDate in the second load, and MSFT is delisted in the third
+	loads := []string{
+		"ticker,exchange,assetType,priceCurrency,startDate,endDate\nAAPL,NASDAQ,Stock,USD,1980-12-12,\nMSFT,NASDAQ,Stock,USD,1986-03-13,2024-01-02\n",
+		"ticker,exchange,assetType,priceCurrency,startDate,endDate\nAAPL,NASDAQ,Stock,USD,1980-12-12,2024-01-03\nMSFT,NASDAQ,Stock,USD,1986-03-13,2024-01-02\n",
+		"ticker,exchange,assetType,priceCurrency,startDate,endDate\nAAPL,NASDAQ,Stock,USD,1980-12-12,2024-01-03\n",
+	}
+	var load atomic.Int32
+	server := httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/docs/tiingo/daily/supported_tickers.zip" {
+			_, _ = w.Write(createTestZip(loads[load.Load()]))
+			return
+		}
+		upstream.Config.Handler.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	c := &clock{}
+	pipeline, cleanup := setupTestPipeline(t, server, c)
+	defer cleanup()
+	pipeline.tickersMaxAge = time.Nanosecond
+	ctx := context.Background()
+
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 6, 0, 0, 0, time.UTC) }
+	for i, seen := range []time.Time{day(2), day(3), day(4), day(5)} {
+		// The last load is unchanged, so it is not reloaded, but its tickers are still seen
+		load.Store(int32(min(i, len(loads)-1)))
+		c.set(seen)
+		_, err := pipeline.UpdateMetadata(ctx)
+		assert.NoError(t, err)
+	}
+
+	versions, err := pipeline.TickerHistory(ctx, "aapl")
+	assert.NoError(t, err)
+	assert.Equal(t, []TickerVersion{
+		{Ticker: "AAPL", Exchange: "NASDAQ", AssetType: "Stock", PriceCurrency: "USD", StartDate: "1980-12-12",
+			FirstSeen: day(2), LastSeen: day(2)},
+		{Ticker: "AAPL", Exchange: "NASDAQ", AssetType: "Stock", PriceCurrency: "USD", StartDate: "1980-12-12", EndDate: "2024-01-03",
+			FirstSeen: day(3), LastSeen: day(5), Current: true},
+	}, versions)
+
+	versions, err = pipeline.TickerHistory(ctx, "MSFT")
+	assert.NoError(t, err)
+	assert.Equal(t, []TickerVersion{
+		{Ticker: "MSFT", Exchange: "NASDAQ", AssetType: "Stock", PriceCurrency: "USD", StartDate: "1986-03-13", EndDate: "2024-01-02",
+			FirstSeen: day(2), LastSeen: day(3)},
+	}, versions)
+
+	versions, err = pipeline.TickerHistory(ctx, "TSLA")
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+}
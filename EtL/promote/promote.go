@@ -0,0 +1,378 @@
+package promote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+)
+
+// ErrCheckFailed is returned when the stage rows to promote fail the data-quality checks.
+// Nothing is promoted then.
+var ErrCheckFailed = errors.New("data-quality checks failed")
+
+// errDryRun rolls back the merge of a dry run.
+var errDryRun = errors.New("dry run")
+
+// table is a table that can be promoted.
+type table struct {
+	// dateColumn selects the rows to promote, those on or after the since date.
+	dateColumn string
+	// positive are the columns that must be positive in the rows to promote.
+	positive []string
+}
+
+// tables are the tables that can be promoted.
+var tables = map[string]table{
+	"daily_adjusted":          {dateColumn: "date", positive: []string{"close", "adjClose"}},
+	"fundamentals.daily":      {dateColumn: "date"},
+	"fundamentals.statements": {dateColumn: "date"},
+	"fundamentals.meta":       {dateColumn: "dailyLastUpdated"},
+}
+
+// Tables returns the names of the tables that can be promoted.
+func Tables() []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Result is the outcome of a promotion, with the rows merged per table.
+type Result struct {
+	Source string      `json:"source"`
+	Target string      `json:"target"`
+	Since  string      `json:"since"`
+	DryRun bool        `json:"dry_run"`
+	Tables []TableDiff `json:"tables"`
+	// Failed are the data-quality checks that failed, if any.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// TableDiff counts the stage rows of a table that are new, changed and unchanged in prod.
+type TableDiff struct {
+	Table       string   `json:"table"`
+	StageRows   int64    `json:"stage_rows"`
+	Inserted    int64    `json:"inserted"`
+	Changed     int64    `json:"changed"`
+	Unchanged   int64    `json:"unchanged"`
+	ChangedKeys []string `json:"changed_keys,omitempty"`
+}
+
+// Promoter merges validated rows from the stage database into the prod database, both attached
+// to an in-memory DuckDB.
+type Promoter struct {
+	db     *load.DuckDB
+	logger *slog.Logger
+	source string
+	target string
+	// stage and prod are the aliases the databases are attached as.
+	stage string
+	prod  string
+}
+
+// New attaches the source database read-only and the target database, e.g. md:stage and md:prod.
+// The token of MotherDuck databases is read from the secrets providers, like in load.NewDuckDB.
+// changedKeysLimit is the maximum number of changed keys reported per table.
+func New(ctx context.Context, source, target string, changedKeysLimit int, secretsCfg config.SecretsConfig, logger *slog.Logger) (*Promoter, error) {
+	if source == "" || target == "" {
+		return nil, errors.New("source and target databases are required")
+	}
+	if source == target {
+		return nil, fmt.Errorf("source and target are the same database %s", source)
+	}
+
+	sourcePath, targetPath, err := withMotherDuckToken(ctx, secretsCfg, source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := load.NewDuckDB(&config.Config{DuckDB: config.DuckDBConfig{
+		Path:             ":memory:",
+		ChangedKeysLimit: changedKeysLimit,
+	}}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error opening DuckDB: %w", err)
+	}
+
+	p := &Promoter{
+		db:     db,
+		logger: logger,
+		source: source,
+		target: target,
+		stage:  alias(source, "stage"),
+		prod:   alias(target, "prod"),
+	}
+	if p.stage == p.prod {
+		p.prod = "prod"
+	}
+	if err := db.Attach(ctx, sourcePath, p.stage, true); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Attach(ctx, targetPath, p.prod, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// withMotherDuckToken returns the source and target paths with the MotherDuck token added to
+// those of MotherDuck databases. The token is only read if there are any.
+func withMotherDuckToken(ctx context.Context, secretsCfg config.SecretsConfig, source, target string) (string, string, error) {
+	if !isMotherDuck(source) && !isMotherDuck(target) {
+		return source, target, nil
+	}
+
+	provider, err := secrets.New(secretsCfg)
+	if err != nil {
+		return "", "", fmt.Errorf("error creating secrets provider: %w", err)
+	}
+	token, err := provider.Secret(ctx, "MOTHERDUCK_TOKEN")
+	if err != nil {
+		return "", "", err
+	}
+
+	withToken := func(path string) string {
+		if !isMotherDuck(path) {
+			return path
+		}
+		return fmt.Sprintf("%s?motherduck_token=%s", path, token)
+	}
+	return withToken(source), withToken(target), nil
+}
+
+func isMotherDuck(path string) bool {
+	return strings.HasPrefix(path, "md:")
+}
+
+// alias returns the alias a database is attached as. MotherDuck databases keep their name.
+func alias(path, fallback string) string {
+	if name, ok := strings.CutPrefix(path, "md:"); ok && name != "" {
+		return name
+	}
+	return fallback
+}
+
+func (p *Promoter) Close() {
+	p.db.Close()
+}
+
+// Promote checks the rows of the tables on or after since in the stage database, and merges
+// them into the prod database with 'insert or replace' semantics, in a single transaction.
+// If any check fails, nothing is merged and the error wraps ErrCheckFailed. A dry run
+// counts the rows that would be merged and rolls the merge back.
+func (p *Promoter) Promote(ctx context.Context, names []string, since time.Time, dryRun bool) (*Result, error) {
+	res := &Result{
+		Source: p.source,
+		Target: p.target,
+		Since:  since.Format(time.DateOnly),
+		DryRun: dryRun,
+		Tables: []TableDiff{},
+	}
+	if len(names) == 0 {
+		return res, errors.New("no tables to promote")
+	}
+	for _, name := range names {
+		if _, ok := tables[name]; !ok {
+			return res, fmt.Errorf("table %s cannot be promoted, expected one of %s", name, strings.Join(Tables(), ", "))
+		}
+	}
+
+	for _, name := range names {
+		failed, err := p.check(ctx, name, since)
+		if err != nil {
+			return res, err
+		}
+		res.Failed = append(res.Failed, failed...)
+	}
+	if len(res.Failed) > 0 {
+		p.logger.Warn("Stage rows failed the data-quality checks", "failed_checks", strings.Join(res.Failed, "; "))
+		return res, fmt.Errorf("%w: %s", ErrCheckFailed, strings.Join(res.Failed, "; "))
+	}
+
+	diffs := make([]TableDiff, 0, len(names))
+	err := p.db.InTx(ctx, func(tx *load.DuckDB) error {
+		for _, name := range names {
+			loaded, err := tx.UpsertQuery(ctx, p.qualify(p.prod, name), p.selectQuery(name, since))
+			if err != nil {
+				return err
+			}
+			diffs = append(diffs, TableDiff{
+				Table:       name,
+				StageRows:   loaded.Inserted + loaded.Changed + loaded.Unchanged,
+				Inserted:    loaded.Inserted,
+				Changed:     loaded.Changed,
+				Unchanged:   loaded.Unchanged,
+				ChangedKeys: loaded.ChangedKeys,
+			})
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return res, fmt.Errorf("error merging into %s: %w", p.target, err)
+	}
+	res.Tables = diffs
+
+	if dryRun {
+		p.logger.Info(fmt.Sprintf("Dry run, not promoted from %s to %s", p.source, p.target), "tables", len(diffs))
+	} else {
+		p.logger.Info(fmt.Sprintf("Promoted from %s to %s", p.source, p.target), "tables", len(diffs))
+	}
+	return res, nil
+}
+
+// check runs the data-quality checks of the stage rows of a table on or after since, and
+// returns the checks that failed.
+func (p *Promoter) check(ctx context.Context, name string, since time.Time) ([]string, error) {
+	stageColumns, err := p.columns(ctx, p.stage, name)
+	if err != nil {
+		return nil, err
+	}
+	prodColumns, err := p.columns(ctx, p.prod, name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(stageColumns) == 0:
+		return []string{fmt.Sprintf("%s does not exist in %s", name, p.source)}, nil
+	case len(prodColumns) == 0:
+		return []string{fmt.Sprintf("%s does not exist in %s", name, p.target)}, nil
+	case !slices.Equal(stageColumns, prodColumns):
+		return []string{fmt.Sprintf("%s has columns (%s) in %s, but (%s) in %s", name,
+			strings.Join(stageColumns, ", "), p.source, strings.Join(prodColumns, ", "), p.target)}, nil
+	}
+
+	keys, err := p.primaryKey(ctx, p.prod, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return []string{fmt.Sprintf("%s has no primary key in %s to merge on", name, p.target)}, nil
+	}
+
+	t := tables[name]
+	checks := []struct{ name, condition string }{
+		{"rows with a null primary key", strings.Join(keys, " IS NULL OR ") + " IS NULL"},
+		{"rows dated in the future", fmt.Sprintf("%s > current_date", t.dateColumn)},
+	}
+	for _, column := range t.positive {
+		checks = append(checks, struct{ name, condition string }{
+			fmt.Sprintf("rows with a missing or non-positive %s", column),
+			fmt.Sprintf("%s IS NULL OR %s <= 0", column, column),
+		})
+	}
+
+	selects := make([]string, len(checks))
+	for i, c := range checks {
+		selects[i] = fmt.Sprintf("count(*) FILTER (WHERE %s) AS check_%d", c.condition, i)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s >= '%s';",
+		strings.Join(selects, ", "), p.qualify(p.stage, name), t.dateColumn, since.Format(time.DateOnly))
+	counts, err := p.db.GetQueryResults(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error checking %s: %w", name, err)
+	}
+
+	var failed []string
+	for i, c := range checks {
+		if n := counts[fmt.Sprintf("check_%d", i)]; len(n) == 1 && n[0] != "0" {
+			failed = append(failed, fmt.Sprintf("%s: %s %s", name, n[0], c.name))
+		}
+	}
+	return failed, nil
+}
+
+// columns returns the columns of a table in an attached database as "name type", in order.
+func (p *Promoter) columns(ctx context.Context, database, name string) ([]string, error) {
+	schema, tableName := splitName(name)
+	res, err := p.db.GetQueryResults(ctx, `
+		SELECT column_name || ' ' || data_type AS col
+		FROM duckdb_columns()
+		WHERE database_name = ? AND schema_name = ? AND table_name = ?
+		ORDER BY column_index;`, database, schema, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting columns of %s in %s: %w", name, database, err)
+	}
+	return res["col"], nil
+}
+
+// primaryKey returns the primary key columns of a table in an attached database.
+func (p *Promoter) primaryKey(ctx context.Context, database, name string) ([]string, error) {
+	schema, tableName := splitName(name)
+	res, err := p.db.GetQueryResults(ctx, `
+		SELECT unnest(constraint_column_names) AS col
+		FROM duckdb_constraints()
+		WHERE constraint_type = 'PRIMARY KEY' AND database_name = ? AND schema_name = ? AND table_name = ?;`,
+		database, schema, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting primary key of %s in %s: %w", name, database, err)
+	}
+	return res["col"], nil
+}
+
+// selectQuery selects the stage rows of a table on or after since.
+func (p *Promoter) selectQuery(name string, since time.Time) string {
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s >= '%s';",
+		p.qualify(p.stage, name), tables[name].dateColumn, since.Format(time.DateOnly))
+}
+
+// qualify returns the name of a table in an attached database, e.g. prod.main.daily_adjusted.
+func (p *Promoter) qualify(database, name string) string {
+	schema, tableName := splitName(name)
+	return fmt.Sprintf("%s.%s.%s", database, schema, tableName)
+}
+
+// splitName splits a table name into its schema, main by default, and name.
+func splitName(name string) (string, string) {
+	if schema, tableName, ok := strings.Cut(name, "."); ok {
+		return schema, tableName
+	}
+	return "main", name
+}
+
+// WriteTable writes the result as aligned text, one row per table.
+func (r *Result) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	mode := "promoted"
+	if r.DryRun {
+		mode = "dry run, nothing promoted"
+	}
+	fmt.Fprintf(tw, "Promote\t%s -> %s since %s (%s)\n", r.Source, r.Target, r.Since, mode)
+	for _, failed := range r.Failed {
+		fmt.Fprintf(tw, "Failed\t%s\n", failed)
+	}
+
+	if len(r.Tables) > 0 {
+		fmt.Fprintf(tw, "\nTable\tStage rows\tInserted\tChanged\tUnchanged\tChanged keys\n")
+		for _, t := range r.Tables {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", t.Table, t.StageRows, t.Inserted, t.Changed, t.Unchanged, strings.Join(t.ChangedKeys, ", "))
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the result as indented JSON.
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("error writing promote result as JSON: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package promote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/stretchr/testify/assert"
+)
+
+var since = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+// setupDB creates a DuckDB file with the pipeline's tables, and runs query in it.
+func setupDB(t *testing.T, path, query string) {
+	t.Helper()
+	db, err := load.NewDuckDB(&config.Config{DuckDB: config.DuckDBConfig{
+		Path: path,
+		ConnInitFnQueries: []string{
+			"../sql/schemas.sql",
+			"../sql/table__daily_adjusted.sql",
+			"../sql/table__fundamentals_daily.sql",
+		},
+	}}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	if err != nil {
+		t.Fatalf("Failed to create DuckDB at %s: %v", path, err)
+	}
+	defer db.Close()
+	if err := db.RunQuery(context.Background(), query); err != nil {
+		t.Fatalf("Failed to set up DuckDB at %s: %v", path, err)
+	}
+}
+
+// setupPromoter creates the stage and prod databases as local files, and returns a promoter of them.
+func setupPromoter(t *testing.T, stageQuery string) (*Promoter, string) {
+	t.Helper()
+	dir := t.TempDir()
+	stage, prod := filepath.Join(dir, "stage.db"), filepath.Join(dir, "prod.db")
+	setupDB(t, stage, stageQuery)
+	setupDB(t, prod, `
+		INSERT INTO daily_adjusted VALUES
+			('2024-01-02', 100, 100, 1000, 'AAPL'),
+			('2024-01-02', 50, 50, 500, 'MSFT');`)
+
+	p, err := New(context.Background(), stage, prod, 10, config.SecretsConfig{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	if err != nil {
+		t.Fatalf("Failed to create promoter: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p, prod
+}
+
+const validStage = `
+	INSERT INTO daily_adjusted VALUES
+		('2023-12-29', 99, 99, 900, 'AAPL'),
+		('2024-01-02', 101, 101, 1000, 'AAPL'),
+		('2024-01-03', 102, 102, 1100, 'AAPL'),
+		('2024-01-02', 50, 50, 500, 'MSFT');
+	INSERT INTO fundamentals.daily VALUES ('2024-01-02', 3000, 3100, 30, 40, 2, 'AAPL');`
+
+// prodRows returns the daily_adjusted rows in prod.
+func prodRows(t *testing.T, p *Promoter) map[string][]string {
+	t.Helper()
+	rows, err := p.db.GetQueryResults(context.Background(),
+		"SELECT ticker, strftime(date, '%Y-%m-%d') AS date, close::VARCHAR AS close FROM prod.daily_adjusted ORDER BY ticker, date")
+	assert.NoError(t, err)
+	return rows
+}
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("merges the rows since the date", func(t *testing.T) {
+		p, prodPath := setupPromoter(t, validStage)
+
+		res, err := p.Promote(ctx, []string{"daily_adjusted", "fundamentals.daily"}, since, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []TableDiff{
+			{Table: "daily_adjusted", StageRows: 3, Inserted: 1, Changed: 1, Unchanged: 1, ChangedKeys: []string{"AAPL|2024-01-02"}},
+			{Table: "fundamentals.daily", StageRows: 1, Inserted: 1},
+		}, res.Tables)
+		assert.Empty(t, res.Failed)
+
+		assert.Equal(t, map[string][]string{
+			"ticker": {"AAPL", "AAPL", "MSFT"},
+			"date":   {"2024-01-02", "2024-01-03", "2024-01-02"},
+			"close":  {"101.000", "102.000", "50.000"},
+		}, prodRows(t, p))
+
+		// The rows are committed to the prod file
+		p.Close()
+		db, err := load.NewDuckDB(&config.Config{DuckDB: config.DuckDBConfig{Path: prodPath}}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+		if err != nil {
+			t.Fatalf("Failed to open prod: %v", err)
+		}
+		defer db.Close()
+		n, err := db.CountRows(ctx, "fundamentals.daily")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+	})
+
+	t.Run("dry run rolls back", func(t *testing.T) {
+		p, _ := setupPromoter(t, validStage)
+		before := prodRows(t, p)
+
+		res, err := p.Promote(ctx, []string{"daily_adjusted"}, since, true)
+		assert.NoError(t, err)
+		assert.True(t, res.DryRun)
+		assert.Equal(t, []TableDiff{
+			{Table: "daily_adjusted", StageRows: 3, Inserted: 1, Changed: 1, Unchanged: 1, ChangedKeys: []string{"AAPL|2024-01-02"}},
+		}, res.Tables)
+		assert.Equal(t, before, prodRows(t, p))
+	})
+
+	t.Run("failed checks merge nothing", func(t *testing.T) {
+		p, _ := setupPromoter(t, `
+			INSERT INTO daily_adjusted VALUES
+				('2024-01-03', 102, 102, 1100, 'AAPL'),
+				('2024-01-03', 0, 0, 500, 'MSFT'),
+				('2099-01-01', 1, 1, 1, 'TSLA');
+			INSERT INTO fundamentals.daily VALUES ('2024-01-02', 3000, 3100, 30, 40, 2, 'AAPL');`)
+		before := prodRows(t, p)
+
+		res, err := p.Promote(ctx, []string{"fundamentals.daily", "daily_adjusted"}, since, false)
+		assert.ErrorIs(t, err, ErrCheckFailed)
+		assert.Equal(t, []string{
+			"daily_adjusted: 1 rows dated in the future",
+			"daily_adjusted: 1 rows with a missing or non-positive close",
+			"daily_adjusted: 1 rows with a missing or non-positive adjClose",
+		}, res.Failed)
+		assert.Empty(t, res.Tables)
+		assert.Equal(t, before, prodRows(t, p))
+
+		n, err := p.db.CountRows(ctx, "prod.fundamentals.daily")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+
+	t.Run("different schemas", func(t *testing.T) {
+		p, _ := setupPromoter(t, "ALTER TABLE daily_adjusted ADD COLUMN open DECIMAL;")
+
+		res, err := p.Promote(ctx, []string{"daily_adjusted"}, since, false)
+		assert.ErrorIs(t, err, ErrCheckFailed)
+		if assert.Len(t, res.Failed, 1) {
+			assert.Contains(t, res.Failed[0], "daily_adjusted has columns (date DATE, close DECIMAL(18,3), adjClose DECIMAL(18,3), adjVolume UBIGINT, ticker VARCHAR, open DECIMAL(18,3))")
+		}
+	})
+
+	t.Run("unknown table", func(t *testing.T) {
+		p, _ := setupPromoter(t, validStage)
+
+		_, err := p.Promote(ctx, []string{"failed_tickers"}, since, false)
+		assert.ErrorContains(t, err, "table failed_tickers cannot be promoted")
+	})
+}
+
+func TestNew_SameDatabase(t *testing.T) {
+	_, err := New(context.Background(), "md:prod", "md:prod", 0, config.SecretsConfig{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	assert.ErrorContains(t, err, "same database")
+}
+
+func TestNew_MotherDuckToken(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// Only the file provider is configured, so the env variable is not used
+	t.Setenv("MOTHERDUCK_TOKEN", "env-token")
+	secretsCfg := config.SecretsConfig{Providers: []string{"file"}, Dir: dir}
+
+	_, err := New(ctx, "md:stage", "md:prod", 0, secretsCfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.ErrorContains(t, err, "MOTHERDUCK_TOKEN is not set in file")
+
+	if err := os.WriteFile(filepath.Join(dir, "MOTHERDUCK_TOKEN"), []byte("file-token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	source, target, err := withMotherDuckToken(ctx, secretsCfg, "stage.db", "md:prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "stage.db", source)
+	assert.Equal(t, "md:prod?motherduck_token=file-token", target)
+
+	// Local databases need no token
+	source, target, err = withMotherDuckToken(ctx, config.SecretsConfig{Providers: []string{"file"}}, "stage.db", "prod.db")
+	assert.NoError(t, err)
+	assert.Equal(t, "stage.db", source)
+	assert.Equal(t, "prod.db", target)
+}
+
+func TestResult_WriteTable(t *testing.T) {
+	res := &Result{
+		Source: "md:stage",
+		Target: "md:prod",
+		Since:  "2024-01-02",
+		Tables: []TableDiff{{Table: "daily_adjusted", StageRows: 3, Inserted: 1, Changed: 1, Unchanged: 1, ChangedKeys: []string{"AAPL|2024-01-02"}}},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, res.WriteTable(&buf))
+	assert.Equal(t, `Promote  md:stage -> md:prod since 2024-01-02 (promoted)
+
+Table           Stage rows  Inserted  Changed  Unchanged  Changed keys
+daily_adjusted  3           1         1        1          AAPL|2024-01-02
+`, buf.String())
+}
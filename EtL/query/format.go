@@ -0,0 +1,237 @@
+package query
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// writer writes the rows of a query in an output format.
+type writer interface {
+	header(columns []string) error
+	row(values []any) error
+	flush() error
+}
+
+func newWriter(format string, w io.Writer) (writer, error) {
+	switch format {
+	case FormatTable:
+		return &tableWriter{w: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}, nil
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatJSON:
+		return &jsonWriter{w: bufio.NewWriter(w)}, nil
+	case FormatParquet:
+		return nil, fmt.Errorf("parquet is written to a file with CopyParquet")
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be one of %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+// tableWriter writes aligned columns, with NULL for null values.
+type tableWriter struct {
+	w *tabwriter.Writer
+}
+
+func (t *tableWriter) header(columns []string) error {
+	_, err := fmt.Fprintln(t.w, strings.Join(columns, "\t"))
+	return err
+}
+
+func (t *tableWriter) row(values []any) error {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		if v == nil {
+			fields[i] = "NULL"
+		} else {
+			// Tabs and newlines would break the alignment
+			fields[i] = strings.NewReplacer("\t", `\t`, "\n", `\n`).Replace(text(v))
+		}
+	}
+	_, err := fmt.Fprintln(t.w, strings.Join(fields, "\t"))
+	return err
+}
+
+func (t *tableWriter) flush() error { return t.w.Flush() }
+
+// csvWriter writes CSV with a header, with empty fields for null values.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) header(columns []string) error { return c.w.Write(columns) }
+
+func (c *csvWriter) row(values []any) error {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = text(v)
+	}
+	return c.w.Write(fields)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonWriter writes an array of objects, one per row and line, with keys in column order.
+type jsonWriter struct {
+	w       *bufio.Writer
+	columns [][]byte
+	rows    int
+}
+
+func (j *jsonWriter) header(columns []string) error {
+	j.columns = make([][]byte, len(columns))
+	for i, c := range columns {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		j.columns[i] = b
+	}
+	_, err := j.w.WriteString("[")
+	return err
+}
+
+func (j *jsonWriter) row(values []any) error {
+	if j.rows > 0 {
+		j.w.WriteString(",")
+	}
+	j.w.WriteString("\n  {")
+	for i, v := range values {
+		if i > 0 {
+			j.w.WriteString(", ")
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error encoding %s as JSON: %w", j.columns[i], err)
+		}
+		j.w.Write(j.columns[i])
+		j.w.WriteString(": ")
+		j.w.Write(b)
+	}
+	_, err := j.w.WriteString("}")
+	j.rows++
+	return err
+}
+
+func (j *jsonWriter) flush() error {
+	if j.rows > 0 {
+		j.w.WriteString("\n")
+	}
+	j.w.WriteString("]\n")
+	return j.w.Flush()
+}
+
+// normalize converts a value scanned from a column of the DuckDB type to nil, a bool, a string,
+// a json.Number, or a list or map of those.
+func normalize(v any, dbType string) any {
+	switch v := v.(type) {
+	case nil, bool, string:
+		return v
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return json.Number(fmt.Sprint(v))
+	case float32:
+		return float(float64(v), 32)
+	case float64:
+		return float(v, 64)
+	case *big.Int:
+		return json.Number(v.String())
+	case duckdb.Decimal:
+		return json.Number(decimal(v))
+	case time.Time:
+		return timestamp(v, dbType)
+	case duckdb.Interval:
+		return fmt.Sprintf("%d months %d days %s", v.Months, v.Days, time.Duration(v.Micros)*time.Microsecond)
+	case []byte:
+		if dbType == "UUID" && len(v) == duckdb.UUIDLength {
+			h := hex.EncodeToString(v)
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+		}
+		return `\x` + hex.EncodeToString(v)
+	case []any:
+		list := make([]any, len(v))
+		for i, e := range v {
+			list[i] = normalize(e, "")
+		}
+		return list
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = normalize(e, "")
+		}
+		return m
+	case duckdb.Map:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[text(normalize(k, ""))] = normalize(e, "")
+		}
+		return m
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// float returns f as a number, or as a string if it is NaN or infinite, which JSON cannot represent.
+func float(f float64, bitSize int) any {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, bitSize)
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
+
+// decimal formats d exactly, with all the digits of its scale.
+func decimal(d duckdb.Decimal) string {
+	if d.Value == nil {
+		return "0"
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.Scale)), nil)
+	return new(big.Rat).SetFrac(d.Value, scale).FloatString(int(d.Scale))
+}
+
+// timestamp formats t like DuckDB casts the column type to text. Times nested in lists and
+// structs have no column type, and are formatted as timestamps.
+func timestamp(t time.Time, dbType string) string {
+	switch dbType {
+	case "DATE":
+		return t.Format(time.DateOnly)
+	case "TIME":
+		return t.Format("15:04:05.999999")
+	case "TIMESTAMPTZ":
+		return t.Format("2006-01-02 15:04:05.999999-07:00")
+	default:
+		return t.Format("2006-01-02 15:04:05.999999")
+	}
+}
+
+// text returns a normalized value as text, with lists and maps as JSON with sorted keys.
+func text(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,101 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/template"
+)
+
+// Formats of the results of a query.
+const (
+	FormatTable   = "table"
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatParquet = "parquet"
+)
+
+// Formats are the supported output formats.
+var Formats = []string{FormatTable, FormatCSV, FormatJSON, FormatParquet}
+
+// Render executes the SQL template with params, like the SQL files of the pipelines. SQL without
+// template actions is returned unchanged.
+func Render(sql string, params map[string]string) (string, error) {
+	templateParams := make(map[string]any, len(params))
+	for k, v := range params {
+		templateParams[k] = v
+	}
+	rendered, err := template.ExecuteSqlTemplateString(sql, templateParams)
+	if err != nil {
+		return "", fmt.Errorf("error rendering query template: %w", err)
+	}
+	return rendered, nil
+}
+
+// Run runs the query on db and writes its rows to w in format, which is table, csv or json.
+// Rows are written as they are read, except for tables, which are aligned once all rows are read.
+// It returns the number of rows written.
+func Run(ctx context.Context, db *load.DuckDB, sql, format string, w io.Writer) (int, error) {
+	out, err := newWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.DB.QueryContext(ctx, sql)
+	if err != nil {
+		return 0, fmt.Errorf("error running query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, fmt.Errorf("error getting columns: %w", err)
+	}
+	names := make([]string, len(columns))
+	types := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name()
+		types[i] = c.DatabaseTypeName()
+	}
+	if err := out.header(names); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, fmt.Errorf("error scanning row: %w", err)
+		}
+		row := make([]any, len(values))
+		for i, v := range values {
+			row[i] = normalize(v, types[i])
+		}
+		if err := out.row(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return n, out.flush()
+}
+
+// CopyParquet runs the query on db and writes its rows to a Parquet file at path with DuckDB's COPY.
+// The query must be a single statement.
+func CopyParquet(ctx context.Context, db *load.DuckDB, sql, path string) error {
+	query := strings.TrimRight(strings.TrimSpace(sql), ";")
+	stmt := fmt.Sprintf("COPY (%s) TO '%s' (FORMAT PARQUET);", query, strings.ReplaceAll(path, "'", "''"))
+	if _, err := db.DB.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestDB(t *testing.T) *load.DuckDB {
+	t.Helper()
+	db, err := load.NewDuckDB(&config.Config{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	if err != nil {
+		t.Fatalf("Failed to open DuckDB: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	err = db.RunQuery(context.Background(), `
+		CREATE TABLE prices (ticker VARCHAR, date DATE, close DECIMAL(18,3), volume BIGINT, tags VARCHAR[]);
+		INSERT INTO prices VALUES
+			('AAPL', '2024-01-02', 185.64, 1000, ['tech', 'us']),
+			('MSFT', '2024-01-02', 370.87, NULL, NULL);`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	return db
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		sql    string
+		params map[string]string
+		want   string
+	}{
+		{
+			name: "without template actions",
+			sql:  "SELECT * FROM prices",
+			want: "SELECT * FROM prices",
+		},
+		{
+			name:   "with parameters",
+			sql:    "SELECT * FROM {{.Table}} WHERE ticker = '{{.Ticker}}'",
+			params: map[string]string{"Table": "prices", "Ticker": "AAPL"},
+			want:   "SELECT * FROM prices WHERE ticker = 'AAPL'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(tt.sql, tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := Render("SELECT {{.Table", nil)
+	assert.ErrorContains(t, err, "error rendering query template")
+}
+
+func TestRun(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	sql := "SELECT * FROM prices ORDER BY ticker"
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: FormatTable,
+			want: "ticker  date        close    volume  tags\n" +
+				"AAPL    2024-01-02  185.640  1000    [\"tech\",\"us\"]\n" +
+				"MSFT    2024-01-02  370.870  NULL    NULL\n",
+		},
+		{
+			format: FormatCSV,
+			want: "ticker,date,close,volume,tags\n" +
+				"AAPL,2024-01-02,185.640,1000,\"[\"\"tech\"\",\"\"us\"\"]\"\n" +
+				"MSFT,2024-01-02,370.870,,\n",
+		},
+		{
+			format: FormatJSON,
+			want: "[\n" +
+				`  {"ticker": "AAPL", "date": "2024-01-02", "close": 185.640, "volume": 1000, "tags": ["tech","us"]},` + "\n" +
+				`  {"ticker": "MSFT", "date": "2024-01-02", "close": 370.870, "volume": null, "tags": null}` + "\n" +
+				"]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := Run(ctx, db, sql, tt.format, &buf)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, n)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+
+	t.Run("empty result as JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := Run(ctx, db, "SELECT * FROM prices WHERE false", FormatJSON, &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, "[]\n", buf.String())
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := Run(ctx, db, sql, "xml", &bytes.Buffer{})
+		assert.ErrorContains(t, err, `unknown format "xml"`)
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		_, err := Run(ctx, db, "SELECT * FROM missing", FormatCSV, &bytes.Buffer{})
+		assert.ErrorContains(t, err, "error running query")
+	})
+}
+
+func TestCopyParquet(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "prices.parquet")
+
+	assert.NoError(t, CopyParquet(ctx, db, "SELECT ticker, close FROM prices ORDER BY ticker;\n", path))
+
+	res, err := db.GetQueryResults(ctx, "SELECT ticker, close::VARCHAR AS close FROM read_parquet(?)", path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"ticker": {"AAPL", "MSFT"},
+		"close":  {"185.640", "370.870"},
+	}, res)
+}
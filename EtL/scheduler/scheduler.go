@@ -0,0 +1,554 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Statuses of a run in the job_runs table.
+const (
+	StatusRunning          = "running"
+	StatusSucceeded        = "succeeded"
+	StatusFailed           = "failed"
+	StatusValidationFailed = "validation_failed"
+	StatusInterrupted      = "interrupted"
+	StatusSkipped          = "skipped"
+	// StatusAbandoned marks runs that were still running when the process stopped.
+	StatusAbandoned = "abandoned"
+)
+
+// Triggers of a run in the job_runs table.
+const (
+	TriggerSchedule = "schedule"
+	TriggerCatchUp  = "catch_up"
+	TriggerManual   = "manual"
+)
+
+// ErrJobRunning is returned by Trigger when the job is already running.
+var ErrJobRunning = errors.New("job is already running")
+
+// Task does the work of a job and returns the number of tickers or rows processed.
+type Task func(ctx context.Context, job config.JobConfig) (int, error)
+
+// Run is a row in the job_runs table.
+type Run struct {
+	ID           string     `json:"run_id"`
+	Job          string     `json:"job"`
+	Task         string     `json:"task"`
+	Trigger      string     `json:"trigger"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"` // nil while running
+	Status       string     `json:"status"`
+	Processed    int        `json:"processed"`
+	Message      string     `json:"message,omitempty"`
+}
+
+type job struct {
+	cfg      config.JobConfig
+	schedule cron.Schedule
+	task     Task
+	// mu is held while the job is running, so runs of the same job never overlap.
+	mu sync.Mutex
+}
+
+// Scheduler runs jobs on cron schedules and records their runs in the job_runs table.
+type Scheduler struct {
+	db            *load.DuckDB
+	logger        *slog.Logger
+	location      *time.Location
+	catchUpWindow time.Duration
+	jobs          []*job
+	now           func() time.Time
+
+	// mu guards manualJobs, the jobs started with Trigger that are not configured.
+	mu         sync.Mutex
+	manualJobs map[string]*job
+	// writer is held by the running job, so runs of different jobs, which share the pipeline
+	// and may write the same tables, run one after the other. DuckDB would abort one of two
+	// conflicting transactions otherwise.
+	writer chan struct{}
+
+	cron *cron.Cron
+	// ctx is the context of runs started by the scheduler, cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a scheduler for the jobs in cfg. Each job's task must be in tasks.
+func New(cfg config.ServeConfig, db *load.DuckDB, tasks map[string]Task, logger *slog.Logger) (*Scheduler, error) {
+	location := time.UTC
+	if cfg.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("error loading timezone %s: %w", cfg.Timezone, err)
+		}
+	}
+
+	s := &Scheduler{
+		db:            db,
+		logger:        logger,
+		location:      location,
+		catchUpWindow: cfg.CatchUpWindow,
+		now:           time.Now,
+		manualJobs:    make(map[string]*job),
+		writer:        make(chan struct{}, 1),
+	}
+
+	names := make(map[string]bool, len(cfg.Jobs))
+	for _, jobCfg := range cfg.Jobs {
+		if jobCfg.Name == "" {
+			return nil, fmt.Errorf("job with schedule %q has no name", jobCfg.Schedule)
+		}
+		if names[jobCfg.Name] {
+			return nil, fmt.Errorf("duplicate job name %s", jobCfg.Name)
+		}
+		names[jobCfg.Name] = true
+
+		schedule, err := cron.ParseStandard(jobCfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing schedule of job %s: %w", jobCfg.Name, err)
+		}
+		task, ok := tasks[jobCfg.Task]
+		if !ok {
+			return nil, fmt.Errorf("unknown task %q of job %s", jobCfg.Task, jobCfg.Name)
+		}
+		s.jobs = append(s.jobs, &job{cfg: jobCfg, schedule: schedule, task: task})
+	}
+
+	for _, j := range s.jobs {
+		if j.cfg.OnlyIfFailed != "" && !names[j.cfg.OnlyIfFailed] {
+			return nil, fmt.Errorf("job %s depends on unknown job %s", j.cfg.Name, j.cfg.OnlyIfFailed)
+		}
+	}
+
+	return s, nil
+}
+
+// Start marks runs left running by a previous process as abandoned, catches up on missed
+// runs in the background and starts the cron schedules. Running jobs are interrupted
+// between batches when ctx is cancelled or Stop is called.
+func (s *Scheduler) Start(ctx context.Context) error {
+	if err := s.abandonRuns(ctx); err != nil {
+		return err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = ctx
+	s.cron = cron.New(cron.WithLocation(s.location))
+	for _, j := range s.jobs {
+		s.cron.Schedule(j.schedule, cron.FuncJob(func() {
+			scheduledFor := s.now().In(s.location).Truncate(time.Minute)
+			if _, err := s.RunJob(ctx, j.cfg.Name, TriggerSchedule, scheduledFor); err != nil {
+				s.logger.Error(fmt.Sprintf("Error running job %s: %v", j.cfg.Name, err))
+			}
+		}))
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.CatchUp(ctx)
+	}()
+	s.cron.Start()
+
+	return nil
+}
+
+// Stop stops the cron schedules, interrupts running jobs and waits for them to return.
+func (s *Scheduler) Stop() {
+	if s.cron == nil {
+		return
+	}
+	stopped := s.cron.Stop()
+	s.cancel()
+	<-stopped.Done()
+	s.wg.Wait()
+}
+
+// CatchUp runs, once, each job whose latest scheduled time within the catch-up window has
+// no recorded run. Missed runs are run in the order they were scheduled, so that a
+// conditional job sees the outcome of the job it depends on.
+func (s *Scheduler) CatchUp(ctx context.Context) {
+	if s.catchUpWindow <= 0 {
+		return
+	}
+
+	type missedRun struct {
+		job          *job
+		scheduledFor time.Time
+	}
+
+	now := s.now().In(s.location)
+	var missed []missedRun
+	for _, j := range s.jobs {
+		scheduledFor, ok := lastOccurrence(j.schedule, now.Add(-s.catchUpWindow), now)
+		if !ok {
+			continue
+		}
+
+		latest, found, err := s.latestRun(ctx, j.cfg.Name, true)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Error checking missed runs of job %s: %v", j.cfg.Name, err))
+			continue
+		}
+		if found && !latest.ScheduledFor.Before(scheduledFor) {
+			continue
+		}
+		missed = append(missed, missedRun{job: j, scheduledFor: scheduledFor})
+	}
+
+	sort.SliceStable(missed, func(i, k int) bool {
+		return missed[i].scheduledFor.Before(missed[k].scheduledFor)
+	})
+
+	for _, m := range missed {
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Info(fmt.Sprintf("Catching up on missed run of job %s", m.job.cfg.Name),
+			"scheduled_for", m.scheduledFor.Format(time.RFC3339))
+		if _, err := s.RunJob(ctx, m.job.cfg.Name, TriggerCatchUp, m.scheduledFor); err != nil {
+			s.logger.Error(fmt.Sprintf("Error running job %s: %v", m.job.cfg.Name, err))
+		}
+	}
+}
+
+// RunJob runs the job now and records the run in job_runs. The run is skipped if the job is
+// already running, or if it depends on another job whose latest run succeeded. The returned
+// error is only about running the job; the outcome of the task is in the status of the run.
+func (s *Scheduler) RunJob(ctx context.Context, name, trigger string, scheduledFor time.Time) (Run, error) {
+	j := s.job(name)
+	if j == nil {
+		return Run{}, fmt.Errorf("unknown job %s", name)
+	}
+
+	run := Run{
+		ID:           NewRunID(),
+		Job:          name,
+		Task:         j.cfg.Task,
+		Trigger:      trigger,
+		ScheduledFor: scheduledFor,
+		StartedAt:    s.now(),
+		Status:       StatusRunning,
+	}
+
+	// Bookkeeping is done even if the run is interrupted
+	dbCtx := context.WithoutCancel(ctx)
+
+	if !j.mu.TryLock() {
+		return s.skip(dbCtx, run, "previous run is still in progress")
+	}
+	defer j.mu.Unlock()
+
+	if dependency := j.cfg.OnlyIfFailed; dependency != "" {
+		latest, found, err := s.latestRun(dbCtx, dependency, false)
+		if err != nil {
+			return run, err
+		}
+		if found && latest.Status == StatusSucceeded {
+			return s.skip(dbCtx, run, fmt.Sprintf("latest run of %s succeeded", dependency))
+		}
+		if found && latest.Status == StatusRunning {
+			return s.skip(dbCtx, run, fmt.Sprintf("%s is still running", dependency))
+		}
+	}
+
+	if err := s.insertRun(dbCtx, run); err != nil {
+		return run, err
+	}
+
+	return s.execute(ctx, run, func(ctx context.Context) (int, error) {
+		return j.task(ctx, j.cfg)
+	})
+}
+
+// Trigger starts fn in the background as a run of the named job, and returns the run so it
+// can be polled with GetRun. The job need not be configured; runs with the same job name
+// never overlap, and ErrJobRunning is returned if the job is already running.
+func (s *Scheduler) Trigger(name, task string, fn func(ctx context.Context) (int, error)) (Run, error) {
+	if s.ctx == nil {
+		return Run{}, errors.New("scheduler is not started")
+	}
+
+	j := s.job(name)
+	if j == nil {
+		s.mu.Lock()
+		j = s.manualJobs[name]
+		if j == nil {
+			j = &job{cfg: config.JobConfig{Name: name, Task: task}}
+			s.manualJobs[name] = j
+		}
+		s.mu.Unlock()
+	}
+
+	if !j.mu.TryLock() {
+		return Run{}, fmt.Errorf("%w: %s", ErrJobRunning, name)
+	}
+
+	now := s.now()
+	run := Run{
+		ID:           NewRunID(),
+		Job:          name,
+		Task:         task,
+		Trigger:      TriggerManual,
+		ScheduledFor: now,
+		StartedAt:    now,
+		Status:       StatusRunning,
+	}
+	if err := s.insertRun(context.WithoutCancel(s.ctx), run); err != nil {
+		j.mu.Unlock()
+		return Run{}, err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer j.mu.Unlock()
+		if _, err := s.execute(s.ctx, run, fn); err != nil {
+			s.logger.Error(fmt.Sprintf("Error running job %s: %v", name, err))
+		}
+	}()
+
+	return run, nil
+}
+
+// execute runs fn for a run already recorded as running, and records its outcome.
+func (s *Scheduler) execute(ctx context.Context, run Run, fn func(ctx context.Context) (int, error)) (Run, error) {
+	name := run.Job
+	s.logger.Info(fmt.Sprintf("Running job %s", name), "run_id", run.ID, "task", run.Task, "trigger", run.Trigger)
+
+	ctx = tracing.WithRunID(ctx, run.ID)
+	ctx, span := tracing.Start(ctx, "scheduler.run",
+		attribute.String("etl.job", name),
+		attribute.String("etl.task", run.Task),
+		attribute.String("etl.trigger", run.Trigger))
+	processed, err := s.withWriter(ctx, run, fn)
+	tracing.End(span, err)
+	finishedAt := s.now()
+	run.FinishedAt = &finishedAt
+	run.Processed = processed
+	run.Status = runStatus(err)
+	if err != nil {
+		run.Message = secrets.Redact(err.Error())
+	}
+
+	if err := s.finishRun(context.WithoutCancel(ctx), run); err != nil {
+		return run, err
+	}
+
+	if run.Status == StatusSucceeded {
+		s.logger.Info(fmt.Sprintf("Job %s succeeded", name),
+			"run_id", run.ID,
+			"processed", processed,
+			"duration", finishedAt.Sub(run.StartedAt).String())
+	} else {
+		s.logger.Error(fmt.Sprintf("Job %s %s: %s", name, run.Status, run.Message),
+			"run_id", run.ID,
+			"processed", processed)
+	}
+
+	return run, nil
+}
+
+// withWriter runs fn once no other job is running. Waiting is interrupted if ctx is cancelled.
+func (s *Scheduler) withWriter(ctx context.Context, run Run, fn func(ctx context.Context) (int, error)) (int, error) {
+	select {
+	case s.writer <- struct{}{}:
+	default:
+		s.logger.Info(fmt.Sprintf("Job %s is waiting for another job to finish", run.Job), "run_id", run.ID)
+		select {
+		case s.writer <- struct{}{}:
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%w while waiting for another job to finish: %w", pipeline.ErrInterrupted, context.Cause(ctx))
+		}
+	}
+	defer func() { <-s.writer }()
+	return fn(ctx)
+}
+
+// runStatus maps the error returned by a task to the status of its run.
+func runStatus(err error) string {
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case errors.Is(err, pipeline.ErrValidation):
+		return StatusValidationFailed
+	case errors.Is(err, pipeline.ErrInterrupted):
+		return StatusInterrupted
+	default:
+		return StatusFailed
+	}
+}
+
+// skip records a skipped run with the reason in its message.
+func (s *Scheduler) skip(ctx context.Context, run Run, reason string) (Run, error) {
+	run.Status = StatusSkipped
+	run.Message = reason
+	run.FinishedAt = &run.StartedAt
+	s.logger.Info(fmt.Sprintf("Skipping job %s: %s", run.Job, reason), "run_id", run.ID)
+	return run, s.insertRun(ctx, run)
+}
+
+// JobForTask returns the name of the first configured job running task, or fallback if there is
+// none. Triggered runs of a task use it, so they never overlap with its scheduled runs.
+func (s *Scheduler) JobForTask(task, fallback string) string {
+	for _, j := range s.jobs {
+		if j.cfg.Task == task {
+			return j.cfg.Name
+		}
+	}
+	return fallback
+}
+
+func (s *Scheduler) job(name string) *job {
+	for _, j := range s.jobs {
+		if j.cfg.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) insertRun(ctx context.Context, run Run) error {
+	var finishedAt sql.NullTime
+	if run.FinishedAt != nil {
+		finishedAt = sql.NullTime{Time: run.FinishedAt.UTC(), Valid: true}
+	}
+	if err := s.db.RunQuery(ctx, `
+		insert into job_runs
+			(run_id, job, task, trigger, scheduled_for, started_at, finished_at, status, processed, message)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		run.ID, run.Job, run.Task, run.Trigger, run.ScheduledFor.UTC(), run.StartedAt.UTC(), finishedAt,
+		run.Status, run.Processed, run.Message,
+	); err != nil {
+		return fmt.Errorf("error recording run of job %s: %w", run.Job, err)
+	}
+	return nil
+}
+
+func (s *Scheduler) finishRun(ctx context.Context, run Run) error {
+	if err := s.db.RunQuery(ctx,
+		"update job_runs set finished_at = ?, status = ?, processed = ?, message = ? where run_id = ?;",
+		run.FinishedAt.UTC(), run.Status, run.Processed, run.Message, run.ID,
+	); err != nil {
+		return fmt.Errorf("error recording outcome of job %s: %w", run.Job, err)
+	}
+	return nil
+}
+
+// abandonRuns marks the runs left running by a previous process as abandoned.
+func (s *Scheduler) abandonRuns(ctx context.Context) error {
+	if err := s.db.RunQuery(ctx,
+		"update job_runs set status = ?, finished_at = ?, message = 'process stopped while running' where status = ?;",
+		StatusAbandoned, s.now().UTC(), StatusRunning,
+	); err != nil {
+		return fmt.Errorf("error marking abandoned job runs: %w", err)
+	}
+	return nil
+}
+
+// runColumns are the job_runs columns scanned by scanRun.
+const runColumns = `run_id, job, task, trigger, scheduled_for, started_at, finished_at, status,
+	coalesce(processed, 0), coalesce(message, '')`
+
+// scanRun scans a row selected with runColumns.
+func scanRun(row interface{ Scan(dest ...any) error }) (Run, error) {
+	var run Run
+	var finishedAt sql.NullTime
+	err := row.Scan(&run.ID, &run.Job, &run.Task, &run.Trigger, &run.ScheduledFor, &run.StartedAt, &finishedAt,
+		&run.Status, &run.Processed, &run.Message)
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	return run, err
+}
+
+// latestRun returns the latest run of the job, by scheduled time. Skipped runs are
+// only included if includeSkipped is true.
+func (s *Scheduler) latestRun(ctx context.Context, name string, includeSkipped bool) (Run, bool, error) {
+	run, err := scanRun(s.db.DB.QueryRowContext(ctx, `
+		select `+runColumns+`
+		from job_runs
+		where job = ? and (? or status <> ?)
+		order by scheduled_for desc, started_at desc
+		limit 1;`,
+		name, includeSkipped, StatusSkipped,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Run{}, false, nil
+	}
+	if err != nil {
+		return Run{}, false, fmt.Errorf("error getting latest run of job %s: %w", name, err)
+	}
+	return run, true, nil
+}
+
+// GetRun returns the run with the given id, and false if there is none.
+func (s *Scheduler) GetRun(ctx context.Context, id string) (Run, bool, error) {
+	run, err := scanRun(s.db.DB.QueryRowContext(ctx, "select "+runColumns+" from job_runs where run_id = ?;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Run{}, false, nil
+	}
+	if err != nil {
+		return Run{}, false, fmt.Errorf("error getting run %s: %w", id, err)
+	}
+	return run, true, nil
+}
+
+// Runs returns the latest runs of all jobs, most recently started first.
+func (s *Scheduler) Runs(ctx context.Context, limit int) ([]Run, error) {
+	rows, err := s.db.DB.QueryContext(ctx,
+		"select "+runColumns+" from job_runs order by started_at desc limit ?;", limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying job_runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make([]Run, 0, limit)
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning job_runs row: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over job_runs: %w", err)
+	}
+	return runs, nil
+}
+
+// lastOccurrence returns the latest time in (from, to] matching the schedule.
+func lastOccurrence(schedule cron.Schedule, from, to time.Time) (time.Time, bool) {
+	var last time.Time
+	for t := schedule.Next(from); !t.IsZero() && !t.After(to); t = schedule.Next(t) {
+		last = t
+	}
+	return last, !last.IsZero()
+}
+
+// NewRunID returns a random identifier of a run.
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,418 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/tracing"
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestDB(t *testing.T) *load.DuckDB {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	db, err := load.NewDuckDB(&config.Config{
+		DuckDB: config.DuckDBConfig{
+			Path:              ":memory:",
+			ConnInitFnQueries: []string{"../sql/table__job_runs.sql"},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create DuckDB instance: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// taskRecorder is a task that records the jobs it runs and returns the error configured per job.
+type taskRecorder struct {
+	mu     sync.Mutex
+	calls  []string
+	runIDs []string
+	errs   map[string]error
+}
+
+func (r *taskRecorder) task(ctx context.Context, job config.JobConfig) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, job.Name)
+	r.runIDs = append(r.runIDs, tracing.RunID(ctx))
+	return 1, r.errs[job.Name]
+}
+
+func setupTestScheduler(t *testing.T, cfg config.ServeConfig, tasks map[string]Task, now time.Time) *Scheduler {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	s, err := New(cfg, setupTestDB(t), tasks, logger)
+	if err != nil {
+		t.Fatalf("Failed to create scheduler: %v", err)
+	}
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestNew(t *testing.T) {
+	tasks := map[string]Task{"noop": func(context.Context, config.JobConfig) (int, error) { return 0, nil }}
+	tests := []struct {
+		name    string
+		cfg     config.ServeConfig
+		wantErr string
+	}{
+		{
+			name: "valid",
+			cfg: config.ServeConfig{Jobs: []config.JobConfig{
+				{Name: "a", Schedule: "0 4 * * 2-6", Task: "noop"},
+				{Name: "b", Schedule: "0 7 * * 2-6", Task: "noop", OnlyIfFailed: "a"},
+			}},
+		},
+		{
+			name:    "invalid schedule",
+			cfg:     config.ServeConfig{Jobs: []config.JobConfig{{Name: "a", Schedule: "every day", Task: "noop"}}},
+			wantErr: "error parsing schedule of job a",
+		},
+		{
+			name:    "unknown task",
+			cfg:     config.ServeConfig{Jobs: []config.JobConfig{{Name: "a", Schedule: "0 4 * * *", Task: "missing"}}},
+			wantErr: `unknown task "missing" of job a`,
+		},
+		{
+			name: "duplicate name",
+			cfg: config.ServeConfig{Jobs: []config.JobConfig{
+				{Name: "a", Schedule: "0 4 * * *", Task: "noop"},
+				{Name: "a", Schedule: "0 7 * * *", Task: "noop"},
+			}},
+			wantErr: "duplicate job name a",
+		},
+		{
+			name:    "unknown dependency",
+			cfg:     config.ServeConfig{Jobs: []config.JobConfig{{Name: "a", Schedule: "0 4 * * *", Task: "noop", OnlyIfFailed: "b"}}},
+			wantErr: "job a depends on unknown job b",
+		},
+		{
+			name:    "invalid timezone",
+			cfg:     config.ServeConfig{Timezone: "Mars/Olympus"},
+			wantErr: "error loading timezone Mars/Olympus",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg, nil, tasks, slog.Default())
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestScheduler_RunJob(t *testing.T) {
+	now := time.Date(2024, 11, 5, 4, 0, 0, 0, time.UTC)
+	recorder := &taskRecorder{errs: map[string]error{
+		"failing": errors.New("tiingo is down"),
+		"invalid": fmt.Errorf("%w: no rows for the last trading day", pipeline.ErrValidation),
+		"stopped": fmt.Errorf("%w after processing 1 tickers", pipeline.ErrInterrupted),
+	}}
+	s := setupTestScheduler(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "ok", Schedule: "0 4 * * *", Task: "task"},
+		{Name: "failing", Schedule: "0 4 * * *", Task: "task"},
+		{Name: "invalid", Schedule: "0 4 * * *", Task: "task"},
+		{Name: "stopped", Schedule: "0 4 * * *", Task: "task"},
+	}}, map[string]Task{"task": recorder.task}, now)
+
+	tests := []struct {
+		job        string
+		wantStatus string
+	}{
+		{job: "ok", wantStatus: StatusSucceeded},
+		{job: "failing", wantStatus: StatusFailed},
+		{job: "invalid", wantStatus: StatusValidationFailed},
+		{job: "stopped", wantStatus: StatusInterrupted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.job, func(t *testing.T) {
+			run, err := s.RunJob(context.Background(), tt.job, TriggerSchedule, now)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, run.Status)
+			// The spans of the task are attributed to the run
+			assert.Equal(t, run.ID, recorder.runIDs[len(recorder.runIDs)-1])
+
+			latest, found, err := s.latestRun(context.Background(), tt.job, true)
+			assert.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, run.ID, latest.ID)
+			assert.Equal(t, tt.wantStatus, latest.Status)
+			assert.Equal(t, 1, latest.Processed)
+			assert.Equal(t, run.Message, latest.Message)
+			assert.Equal(t, now, latest.ScheduledFor)
+		})
+	}
+
+	_, err := s.RunJob(context.Background(), "missing", TriggerSchedule, now)
+	assert.ErrorContains(t, err, "unknown job missing")
+}
+
+func TestScheduler_RunJob_OnlyIfFailed(t *testing.T) {
+	now := time.Date(2024, 11, 5, 7, 0, 0, 0, time.UTC)
+	recorder := &taskRecorder{errs: map[string]error{}}
+	s := setupTestScheduler(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "early", Schedule: "0 4 * * *", Task: "task"},
+		{Name: "rerun", Schedule: "0 7 * * *", Task: "task", OnlyIfFailed: "early"},
+	}}, map[string]Task{"task": recorder.task}, now)
+
+	// Runs if the dependency has never run
+	run, err := s.RunJob(context.Background(), "rerun", TriggerSchedule, now)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, run.Status)
+
+	// Skipped if the dependency succeeded
+	_, err = s.RunJob(context.Background(), "early", TriggerSchedule, now.Add(-3*time.Hour))
+	assert.NoError(t, err)
+	run, err = s.RunJob(context.Background(), "rerun", TriggerSchedule, now)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSkipped, run.Status)
+	assert.Equal(t, "latest run of early succeeded", run.Message)
+
+	// Runs if the dependency failed validation the next day
+	recorder.errs["early"] = pipeline.ErrValidation
+	nextDay := now.AddDate(0, 0, 1)
+	s.now = func() time.Time { return nextDay }
+	_, err = s.RunJob(context.Background(), "early", TriggerSchedule, nextDay.Add(-3*time.Hour))
+	assert.NoError(t, err)
+	run, err = s.RunJob(context.Background(), "rerun", TriggerSchedule, nextDay)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, run.Status)
+
+	assert.Equal(t, []string{"rerun", "early", "early", "rerun"}, recorder.calls)
+}
+
+func TestScheduler_RunJob_Overlap(t *testing.T) {
+	now := time.Date(2024, 11, 5, 4, 0, 0, 0, time.UTC)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, job config.JobConfig) (int, error) {
+		close(started)
+		<-release
+		return 0, nil
+	}
+	s := setupTestScheduler(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "slow", Schedule: "* * * * *", Task: "blocking"},
+	}}, map[string]Task{"blocking": blocking}, now)
+
+	done := make(chan Run)
+	go func() {
+		run, err := s.RunJob(context.Background(), "slow", TriggerSchedule, now)
+		assert.NoError(t, err)
+		done <- run
+	}()
+	<-started
+
+	// A second run while the first is in progress is skipped
+	run, err := s.RunJob(context.Background(), "slow", TriggerSchedule, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSkipped, run.Status)
+	assert.Equal(t, "previous run is still in progress", run.Message)
+
+	close(release)
+	assert.Equal(t, StatusSucceeded, (<-done).Status)
+}
+
+func TestScheduler_RunJob_Serialized(t *testing.T) {
+	now := time.Date(2024, 11, 5, 4, 0, 0, 0, time.UTC)
+	var s *Scheduler
+	var mu sync.Mutex
+	var events []string
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	// Both jobs upsert the same rows in a transaction, which conflicts if they overlap
+	upsert := func(ctx context.Context, job config.JobConfig) (int, error) {
+		mu.Lock()
+		events = append(events, "start "+job.Name)
+		mu.Unlock()
+		started <- struct{}{}
+		err := s.db.InTx(ctx, func(tx *load.DuckDB) error {
+			if err := tx.RunQuery(ctx, "insert or replace into prices values ('AAPL', ?)", job.Name); err != nil {
+				return err
+			}
+			<-release
+			return nil
+		})
+		mu.Lock()
+		events = append(events, "end "+job.Name)
+		mu.Unlock()
+		return 1, err
+	}
+	s = setupTestScheduler(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "daily", Schedule: "0 4 * * *", Task: "upsert"},
+		{Name: "backfill", Schedule: "0 5 * * *", Task: "upsert"},
+	}}, map[string]Task{"upsert": upsert}, now)
+	if err := s.db.RunQuery(context.Background(), "create table prices (ticker varchar primary key, job varchar)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	done := make(chan Run, 2)
+	for _, name := range []string{"daily", "backfill"} {
+		go func() {
+			run, err := s.RunJob(context.Background(), name, TriggerSchedule, now)
+			assert.NoError(t, err)
+			done <- run
+		}()
+	}
+
+	// The second job waits for the first to finish before it starts
+	<-started
+	select {
+	case <-started:
+		t.Fatalf("Second job started while the first was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	for range 2 {
+		assert.Equal(t, StatusSucceeded, (<-done).Status)
+	}
+	assert.Len(t, events, 4)
+	assert.Equal(t, events[0][len("start "):], events[1][len("end "):])
+	assert.Equal(t, events[2][len("start "):], events[3][len("end "):])
+}
+
+func TestScheduler_CatchUp(t *testing.T) {
+	// Started at 08:00 on a Tuesday, after both morning runs were missed
+	now := time.Date(2024, 11, 5, 8, 0, 0, 0, time.UTC)
+	recorder := &taskRecorder{errs: map[string]error{"early": pipeline.ErrValidation}}
+	s := setupTestScheduler(t, config.ServeConfig{
+		CatchUpWindow: 12 * time.Hour,
+		Jobs: []config.JobConfig{
+			{Name: "rerun", Schedule: "0 7 * * 2-6", Task: "task", OnlyIfFailed: "early"},
+			{Name: "early", Schedule: "0 4 * * 2-6", Task: "task"},
+			{Name: "later", Schedule: "0 9 * * *", Task: "task"},
+			{Name: "weekly", Schedule: "0 5 * * 6", Task: "task"},
+		},
+	}, map[string]Task{"task": recorder.task}, now)
+
+	// Missed runs are run in scheduled order, so the rerun sees the failed early run
+	s.CatchUp(context.Background())
+	assert.Equal(t, []string{"early", "rerun"}, recorder.calls)
+
+	latest, found, err := s.latestRun(context.Background(), "early", true)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, TriggerCatchUp, latest.Trigger)
+	assert.Equal(t, time.Date(2024, 11, 5, 4, 0, 0, 0, time.UTC), latest.ScheduledFor)
+
+	// Nothing left to catch up on
+	s.CatchUp(context.Background())
+	assert.Equal(t, []string{"early", "rerun"}, recorder.calls)
+}
+
+func TestScheduler_StartAbandonsRuns(t *testing.T) {
+	now := time.Date(2024, 11, 5, 8, 0, 0, 0, time.UTC)
+	s := setupTestScheduler(t, config.ServeConfig{}, nil, now)
+
+	err := s.insertRun(context.Background(), Run{
+		ID: "stale", Job: "early", Task: "task", Trigger: TriggerSchedule,
+		ScheduledFor: now, StartedAt: now, Status: StatusRunning,
+	})
+	assert.NoError(t, err)
+
+	err = s.Start(context.Background())
+	assert.NoError(t, err)
+	s.Stop()
+
+	latest, found, err := s.latestRun(context.Background(), "early", true)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, StatusAbandoned, latest.Status)
+	if assert.NotNil(t, latest.FinishedAt) {
+		assert.Equal(t, now, *latest.FinishedAt)
+	}
+}
+
+func TestLastOccurrence(t *testing.T) {
+	to := time.Date(2024, 11, 5, 8, 0, 0, 0, time.UTC) // Tuesday
+	tests := []struct {
+		name     string
+		schedule string
+		window   time.Duration
+		want     time.Time
+		wantOK   bool
+	}{
+		{name: "earlier today", schedule: "0 4 * * *", window: 12 * time.Hour, want: time.Date(2024, 11, 5, 4, 0, 0, 0, time.UTC), wantOK: true},
+		{name: "latest of several", schedule: "0 * * * *", window: 12 * time.Hour, want: to, wantOK: true},
+		{name: "outside window", schedule: "0 9 * * *", window: 12 * time.Hour, wantOK: false},
+		{name: "weekly within window", schedule: "0 5 * * 6", window: 7 * 24 * time.Hour, want: time.Date(2024, 11, 2, 5, 0, 0, 0, time.UTC), wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := cron.ParseStandard(tt.schedule)
+			assert.NoError(t, err)
+			got, ok := lastOccurrence(schedule, to.Add(-tt.window), to)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestScheduler_Trigger(t *testing.T) {
+	now := time.Date(2024, 11, 5, 12, 0, 0, 0, time.UTC)
+	s := setupTestScheduler(t, config.ServeConfig{}, nil, now)
+
+	_, err := s.Trigger("backfill", "eod_backfill", nil)
+	assert.ErrorContains(t, err, "scheduler is not started")
+
+	assert.NoError(t, s.Start(context.Background()))
+	defer s.Stop()
+
+	release := make(chan struct{})
+	run, err := s.Trigger("backfill", "eod_backfill", func(ctx context.Context) (int, error) {
+		<-release
+		return 2, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRunning, run.Status)
+
+	// The run is recorded before it finishes, and the job cannot be triggered again meanwhile
+	got, found, err := s.GetRun(context.Background(), run.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, StatusRunning, got.Status)
+	assert.Nil(t, got.FinishedAt)
+
+	_, err = s.Trigger("backfill", "eod_backfill", func(ctx context.Context) (int, error) { return 0, nil })
+	assert.ErrorIs(t, err, ErrJobRunning)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		got, _, err = s.GetRun(context.Background(), run.ID)
+		return err == nil && got.Status == StatusSucceeded
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, got.Processed)
+
+	runs, err := s.Runs(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 1)
+}
+
+func TestScheduler_JobForTask(t *testing.T) {
+	noop := func(context.Context, config.JobConfig) (int, error) { return 0, nil }
+	s := setupTestScheduler(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "eod-daily", Schedule: "0 4 * * *", Task: "eod_daily"},
+		{Name: "eod-daily-rerun", Schedule: "0 7 * * *", Task: "eod_daily"},
+		{Name: "statements", Schedule: "0 5 * * 6", Task: "fundamentals_statements"},
+	}}, map[string]Task{"eod_daily": noop, "fundamentals_statements": noop}, time.Now())
+
+	assert.Equal(t, "eod-daily", s.JobForTask("eod_daily", "eod"))
+	assert.Equal(t, "statements", s.JobForTask("fundamentals_statements", "fundamentals-statements"))
+	assert.Equal(t, "eod-backfill", s.JobForTask("eod_backfill", "eod-backfill"))
+}
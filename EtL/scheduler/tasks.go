@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+)
+
+// PipelineTasks returns the tasks jobs can run on the pipeline, by name.
+func PipelineTasks(p *pipeline.Pipeline) map[string]Task {
+	return map[string]Task{
+		// eod_daily validates the loaded data, so a job can be re-run if Tiingo served bad data
+		"eod_daily": func(ctx context.Context, job config.JobConfig) (int, error) {
+			n, err := Reported(ctx, p, "eod_daily", p.DailyEndOfDay)
+			if err != nil {
+				return n, err
+			}
+			return n, p.ValidateEndOfDay(ctx)
+		},
+		"fundamentals_daily": func(ctx context.Context, job config.JobConfig) (int, error) {
+			return Reported(ctx, p, "fundamentals_daily", func(ctx context.Context) (*pipeline.Report, error) {
+				return p.DailyFundamentals(ctx, nil, job.HalfOnly, job.BatchSize, nil, false, job.Lookback)
+			})
+		},
+		"fundamentals_statements": func(ctx context.Context, job config.JobConfig) (int, error) {
+			return Reported(ctx, p, "fundamentals_statements", func(ctx context.Context) (*pipeline.Report, error) {
+				return p.Statements(ctx, nil, job.HalfOnly, job.BatchSize, nil, false, job.Lookback)
+			})
+		},
+		"fundamentals_metadata": func(ctx context.Context, job config.JobConfig) (int, error) {
+			return Reported(ctx, p, "fundamentals_metadata", p.UpdateMetadata)
+		},
+	}
+}
+
+// Reported runs fn and saves its report in run_reports under the run id of ctx, returning
+// the number of tickers or rows processed as the result of a run.
+func Reported(ctx context.Context, p *pipeline.Pipeline, command string, fn func(ctx context.Context) (*pipeline.Report, error)) (int, error) {
+	report, err := fn(ctx)
+	if report == nil {
+		return 0, err
+	}
+	report.Command = command
+	if saveErr := p.SaveReport(context.WithoutCancel(ctx), report); saveErr != nil {
+		err = errors.Join(err, saveErr)
+	}
+	return report.Processed, err
+}
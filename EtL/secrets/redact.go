@@ -0,0 +1,124 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in redacted text.
+const Redacted = "[REDACTED]"
+
+// minRegistered is the length below which values are not registered for redaction, since
+// redacting them would mangle unrelated text.
+const minRegistered = 6
+
+var (
+	mu         sync.RWMutex
+	registered []string
+)
+
+// credentialParam matches the values of query parameters and key=value pairs that hold
+// credentials, e.g. token=... in a Tiingo URL or motherduck_token=... in a DuckDB path.
+var credentialParam = regexp.MustCompile(`(?i)\b([a-z_]*(?:token|password|secret|api_?key)=)[^&\s"',;:)]+`)
+
+// Register registers secrets to be redacted by Redact. The providers register the secrets they
+// read, so only secrets read in other ways need to be registered.
+func Register(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minRegistered && !slices.Contains(registered, v) {
+			registered = append(registered, v)
+		}
+	}
+}
+
+// Redact replaces the registered secrets and the values of credential parameters in s.
+func Redact(s string) string {
+	mu.RLock()
+	for _, v := range registered {
+		s = strings.ReplaceAll(s, v, Redacted)
+	}
+	mu.RUnlock()
+	return credentialParam.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// RedactError returns an error whose message is redacted, and which wraps err, so errors.Is and
+// errors.As still see through it. Nil is returned as is.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string { return Redact(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Handler redacts the message and the attributes of log records before passing them on; see Redact.
+type Handler struct {
+	handler slog.Handler
+}
+
+// NewHandler returns a handler redacting the records passed on to h.
+func NewHandler(h slog.Handler) *Handler {
+	return &Handler{handler: h}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &Handler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{handler: h.handler.WithGroup(name)}
+}
+
+// redactAttr redacts strings, errors and values formatted with String, e.g. URLs.
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, Redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Redact(x.String()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
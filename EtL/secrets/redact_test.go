@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	Register("registered-secret", "short")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "tiingo URL",
+			in:   "GET https://api.tiingo.com/tiingo/daily/AAPL/prices?format=csv&token=abc123&startDate=2024-01-01",
+			want: "GET https://api.tiingo.com/tiingo/daily/AAPL/prices?format=csv&token=[REDACTED]&startDate=2024-01-01",
+		},
+		{
+			name: "motherduck path",
+			in:   `failed to open md:prod?motherduck_token=eyJhbGciOi.payload.sig: unauthorized`,
+			want: `failed to open md:prod?motherduck_token=[REDACTED]: unauthorized`,
+		},
+		{
+			name: "key value pairs",
+			in:   `password=hunter2 API_KEY=k1, apikey=k2`,
+			want: `password=[REDACTED] API_KEY=[REDACTED], apikey=[REDACTED]`,
+		},
+		{
+			name: "registered secret",
+			in:   "Authorization: Token registered-secret",
+			want: "Authorization: Token [REDACTED]",
+		},
+		{
+			name: "short values are not registered",
+			in:   "a short message",
+			want: "a short message",
+		},
+		{
+			name: "nothing to redact",
+			in:   "fetched 42 tickers",
+			want: "fetched 42 tickers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Redact(tt.in))
+		})
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	err := RedactError(fmt.Errorf("error fetching: %w", &url.Error{Op: "Get", URL: "https://api.tiingo.com/api/test?token=abc123", Err: errors.New("EOF")}))
+	assert.EqualError(t, err, `error fetching: Get "https://api.tiingo.com/api/test?token=[REDACTED]": EOF`)
+	var urlErr *url.Error
+	assert.ErrorAs(t, err, &urlErr)
+	assert.Nil(t, RedactError(nil))
+}
+
+func TestHandler(t *testing.T) {
+	Register("registered-secret")
+	var buf bytes.Buffer
+	log := slog.New(NewHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		// Drop the time, so the output is deterministic
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	u, _ := url.Parse("https://api.tiingo.com/api/test?token=abc123")
+	log.With("token", "registered-secret").WithGroup("request").Info(
+		"Fetching https://api.tiingo.com/api/test?token=abc123",
+		"url", u,
+		"error", errors.New("dial tcp: token=abc123"),
+		slog.Group("auth", "header", "Token registered-secret"),
+		"attempt", 1,
+	)
+
+	assert.Equal(t, `level=INFO msg="Fetching https://api.tiingo.com/api/test?token=[REDACTED]" token=[REDACTED] `+
+		`request.url="https://api.tiingo.com/api/test?token=[REDACTED]" request.error="dial tcp: token=[REDACTED]" `+
+		`request.auth.header="Token [REDACTED]" request.attempt=1`+"\n", buf.String())
+}
@@ -0,0 +1,157 @@
+// Package secrets reads secrets, e.g. TIINGO_TOKEN, from environment variables, files, the .env
+// file or HashiCorp Vault, and redacts them from logs and error messages.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+)
+
+// ErrNotFound is returned when no provider has the secret.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider reads secrets by name.
+type Provider interface {
+	// Name is the name of the provider in SecretsConfig.Providers, e.g. env.
+	Name() string
+	// Secret returns the value of the secret, or an error wrapping ErrNotFound if the provider
+	// does not have it.
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// New returns the providers of the configuration, tried in order.
+func New(cfg config.SecretsConfig) (Chain, error) {
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = []string{"env"}
+	}
+
+	var chain Chain
+	for _, name := range names {
+		switch name {
+		case "env":
+			chain = append(chain, Env{})
+		case "file":
+			chain = append(chain, Files{Dir: cfg.Dir})
+		case "dotenv":
+			chain = append(chain, &DotEnv{Path: cfg.DotEnv})
+		case "vault":
+			vault, err := NewVault(cfg.Vault)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, vault)
+		default:
+			return nil, fmt.Errorf("unknown secrets provider %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// Chain tries its providers in order, and registers the secrets it finds for redaction.
+type Chain []Provider
+
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+func (c Chain) Secret(ctx context.Context, name string) (string, error) {
+	value, _, err := c.Find(ctx, name)
+	return value, err
+}
+
+// Find returns the secret from the first provider that has it, with the name of that provider.
+func (c Chain) Find(ctx context.Context, name string) (string, string, error) {
+	for _, p := range c {
+		value, err := p.Secret(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %s from %s: %w", name, p.Name(), err)
+		}
+		Register(value)
+		return value, p.Name(), nil
+	}
+	return "", "", fmt.Errorf("%w: %s is not set in %s", ErrNotFound, name, c.Name())
+}
+
+// Env reads secrets from environment variables of the same name.
+type Env struct{}
+
+func (Env) Name() string { return "env" }
+
+func (Env) Secret(_ context.Context, name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	return "", ErrNotFound
+}
+
+// Files reads secrets from files in Dir named like the secret, in upper or lower case, as Docker
+// and Kubernetes mount them. Surrounding whitespace, e.g. a trailing newline, is trimmed.
+type Files struct {
+	Dir string
+}
+
+func (Files) Name() string { return "file" }
+
+func (f Files) Secret(_ context.Context, name string) (string, error) {
+	for _, file := range []string{name, strings.ToLower(name)} {
+		b, err := os.ReadFile(filepath.Join(f.Dir, file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if value := strings.TrimSpace(string(b)); value != "" {
+			return value, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// DotEnv reads secrets from a .env file, which is read once. A missing file has no secrets.
+type DotEnv struct {
+	// Path of the file. Defaults to .env.
+	Path string
+
+	once   sync.Once
+	values map[string]string
+	err    error
+}
+
+func (*DotEnv) Name() string { return "dotenv" }
+
+func (d *DotEnv) Secret(_ context.Context, name string) (string, error) {
+	d.once.Do(func() {
+		path := d.Path
+		if path == "" {
+			path = ".env"
+		}
+		d.values, d.err = godotenv.Read(path)
+		if errors.Is(d.err, os.ErrNotExist) {
+			d.err = nil
+		}
+	})
+	if d.err != nil {
+		return "", d.err
+	}
+	if value := d.values[name]; value != "" {
+		return value, nil
+	}
+	return "", ErrNotFound
+}
@@ -0,0 +1,84 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "tiingo_token"), "file-tiingo-token\n")
+	writeFile(t, filepath.Join(dir, "MOTHERDUCK_TOKEN"), "file-motherduck-token")
+	dotEnv := filepath.Join(dir, ".env")
+	writeFile(t, dotEnv, "TIINGO_TOKEN=dotenv-tiingo-token\nVAULT_ROLE=dotenv-role\n")
+
+	t.Setenv("TIINGO_TOKEN", "env-tiingo-token")
+	t.Setenv("MOTHERDUCK_TOKEN", "")
+
+	chain, err := New(config.SecretsConfig{Providers: []string{"env", "file", "dotenv"}, Dir: dir, DotEnv: dotEnv})
+	if err != nil {
+		t.Fatalf("Failed to create providers: %v", err)
+	}
+	assert.Equal(t, "env, file, dotenv", chain.Name())
+
+	tests := []struct {
+		name       string
+		wantValue  string
+		wantSource string
+		wantErr    string
+	}{
+		{name: "TIINGO_TOKEN", wantValue: "env-tiingo-token", wantSource: "env"},
+		{name: "MOTHERDUCK_TOKEN", wantValue: "file-motherduck-token", wantSource: "file"},
+		{name: "VAULT_ROLE", wantValue: "dotenv-role", wantSource: "dotenv"},
+		{name: "OTHER_TOKEN", wantErr: "secret not found: OTHER_TOKEN is not set in env, file, dotenv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, source, err := chain.Find(context.Background(), tt.name)
+			if tt.wantErr != "" {
+				assert.ErrorIs(t, err, ErrNotFound)
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantValue, value)
+			assert.Equal(t, tt.wantSource, source)
+		})
+	}
+
+	// The secrets found are redacted
+	assert.Equal(t, "token is "+Redacted, Redact("token is file-motherduck-token"))
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("TIINGO_TOKEN", "env-tiingo-token")
+
+	chain, err := New(config.SecretsConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, Chain{Env{}}, chain)
+
+	// A missing .env file has no secrets
+	chain, err = New(config.SecretsConfig{Providers: []string{"dotenv"}, DotEnv: filepath.Join(t.TempDir(), ".env")})
+	assert.NoError(t, err)
+	_, err = chain.Secret(context.Background(), "TIINGO_TOKEN")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = New(config.SecretsConfig{Providers: []string{"keychain"}})
+	assert.EqualError(t, err, `unknown secrets provider "keychain"`)
+
+	t.Setenv("VAULT_ADDR", "")
+	_, err = New(config.SecretsConfig{Providers: []string{"vault"}, Vault: config.VaultConfig{Path: "etl/prod"}})
+	assert.EqualError(t, err, "vault address is not set, set secrets.vault.address or VAULT_ADDR")
+}
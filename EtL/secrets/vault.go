@@ -0,0 +1,125 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+)
+
+// vaultTimeout bounds the request reading the secret from Vault.
+const vaultTimeout = 10 * time.Second
+
+// Vault reads secrets from the keys of a secret in a HashiCorp Vault KV version 2 secrets engine,
+// e.g. TIINGO_TOKEN of secret/etl/prod. The secret is read once, with the first secret asked for.
+//
+// To try it locally, run a dev server with `vault server -dev`, which mounts a KV version 2
+// secrets engine at secret, and write the tokens with
+// `vault kv put secret/etl/prod TIINGO_TOKEN=... MOTHERDUCK_TOKEN=...`.
+type Vault struct {
+	Address string
+	Token   string
+	Mount   string
+	Path    string
+	Client  *http.Client
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// NewVault returns the vault provider of the configuration, which defaults to VAULT_ADDR for the
+// address and reads the Vault token from VAULT_TOKEN.
+func NewVault(cfg config.VaultConfig) (*Vault, error) {
+	v := &Vault{
+		Address: cfg.Address,
+		Token:   os.Getenv("VAULT_TOKEN"),
+		Mount:   cfg.Mount,
+		Path:    cfg.Path,
+		Client:  &http.Client{Timeout: vaultTimeout},
+	}
+	if v.Address == "" {
+		v.Address = os.Getenv("VAULT_ADDR")
+	}
+	if v.Mount == "" {
+		v.Mount = "secret"
+	}
+
+	switch {
+	case v.Address == "":
+		return nil, fmt.Errorf("vault address is not set, set secrets.vault.address or VAULT_ADDR")
+	case v.Token == "":
+		return nil, fmt.Errorf("VAULT_TOKEN env variable is not set")
+	case v.Path == "":
+		return nil, fmt.Errorf("secrets.vault.path is not set")
+	}
+	Register(v.Token)
+	return v, nil
+}
+
+func (*Vault) Name() string { return "vault" }
+
+func (v *Vault) Secret(ctx context.Context, name string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		values, err := v.read(ctx)
+		if err != nil {
+			return "", err
+		}
+		v.values = values
+	}
+	if value := v.values[name]; value != "" {
+		return value, nil
+	}
+	return "", ErrNotFound
+}
+
+// read reads the keys of the secret. A secret that does not exist has no keys.
+func (v *Vault) read(ctx context.Context) (map[string]string, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(v.Address, "/"), strings.Trim(v.Mount, "/"), strings.Trim(v.Path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]string{}, nil
+	}
+
+	var secret struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("error parsing vault response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault responded %s: %s", resp.Status, strings.Join(secret.Errors, "; "))
+	}
+
+	values := make(map[string]string, len(secret.Data.Data))
+	for key, value := range secret.Data.Data {
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
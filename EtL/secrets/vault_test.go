@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupVaultServer stands in for a Vault dev server, with a KV version 2 secrets engine mounted at
+// secret holding secret/etl/prod.
+func setupVaultServer(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	reads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/etl/prod":
+			reads++
+			_, _ = w.Write([]byte(`{
+				"request_id": "c2a8d3b4-8e0b-4f3c-9a3e-1d2f3a4b5c6d",
+				"lease_id": "",
+				"renewable": false,
+				"lease_duration": 0,
+				"data": {
+					"data": {"TIINGO_TOKEN": "vault-tiingo-token", "MOTHERDUCK_TOKEN": "vault-motherduck-token"},
+					"metadata": {"created_time": "2024-11-06T10:00:00Z", "deletion_time": "", "destroyed": false, "version": 3}
+				},
+				"wrap_info": null,
+				"warnings": null,
+				"auth": null
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &reads
+}
+
+func TestVault(t *testing.T) {
+	server, reads := setupVaultServer(t)
+	ctx := context.Background()
+
+	t.Run("reads the secret once", func(t *testing.T) {
+		t.Setenv("VAULT_TOKEN", "root-token")
+		t.Setenv("VAULT_ADDR", server.URL)
+		vault, err := NewVault(config.VaultConfig{Path: "etl/prod"})
+		if err != nil {
+			t.Fatalf("Failed to create vault provider: %v", err)
+		}
+
+		value, err := vault.Secret(ctx, "TIINGO_TOKEN")
+		assert.NoError(t, err)
+		assert.Equal(t, "vault-tiingo-token", value)
+		value, err = vault.Secret(ctx, "MOTHERDUCK_TOKEN")
+		assert.NoError(t, err)
+		assert.Equal(t, "vault-motherduck-token", value)
+		_, err = vault.Secret(ctx, "OTHER_TOKEN")
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Equal(t, 1, *reads)
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		t.Setenv("VAULT_TOKEN", "root-token")
+		vault, err := NewVault(config.VaultConfig{Address: server.URL, Mount: "secret", Path: "etl/stage"})
+		if err != nil {
+			t.Fatalf("Failed to create vault provider: %v", err)
+		}
+		_, err = vault.Secret(ctx, "TIINGO_TOKEN")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("permission denied", func(t *testing.T) {
+		t.Setenv("VAULT_TOKEN", "wrong-token")
+		chain, err := New(config.SecretsConfig{
+			Providers: []string{"env", "vault"},
+			Vault:     config.VaultConfig{Address: server.URL, Path: "etl/prod"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create providers: %v", err)
+		}
+		t.Setenv("TIINGO_TOKEN", "")
+		_, err = chain.Secret(ctx, "TIINGO_TOKEN")
+		assert.EqualError(t, err, "error reading TIINGO_TOKEN from vault: vault responded 403 Forbidden: permission denied")
+		assert.NotErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/metrics"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/scheduler"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+)
+
+const (
+	defaultRunsLimit = 50
+	maxRunsLimit     = 1000
+)
+
+// Server is the HTTP status and control API of `etl serve`. Runs triggered through the API
+// are started asynchronously by the scheduler, and recorded in job_runs like scheduled runs.
+type Server struct {
+	pipeline  *pipeline.Pipeline
+	scheduler *scheduler.Scheduler
+	// token is required as a bearer token by the POST endpoints, unless empty.
+	token  string
+	logger *slog.Logger
+}
+
+func New(p *pipeline.Pipeline, s *scheduler.Scheduler, token string, logger *slog.Logger) *Server {
+	return &Server{pipeline: p, scheduler: s, token: token, logger: logger}
+}
+
+// CheckListen returns an error if the API would listen on addr, e.g. :8080, for other hosts than
+// the loopback interface without a token, as anyone reaching it could then start runs.
+func CheckListen(addr, token string) error {
+	if token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("error parsing listen address %s: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("the API listens on %s, which is not a loopback address, and ETL_API_TOKEN is not set", addr)
+}
+
+// Handler returns the routes of the API:
+//
+//	GET  /healthz               liveness check
+//	GET  /runs?limit=N          latest runs, most recent first
+//	GET  /runs/{id}             a single run, for polling triggered runs
+//	GET  /freshness             latest date and row count per table
+//	GET  /quota                 Tiingo API usage of this process
+//	POST /eod/backfill          backfill daily_adjusted, body {"tickers": ["AAPL"]}
+//	POST /fundamentals/refresh  refresh fundamentals, body {"type": "daily", "tickers": [], "batch_size": 0, "lookback": 0}
+//	GET  /metrics               Prometheus metrics
+//
+// The POST endpoints require the header "Authorization: Bearer <token>" if the server has a token.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.health)
+	mux.HandleFunc("GET /runs", s.listRuns)
+	mux.HandleFunc("GET /runs/{id}", s.getRun)
+	mux.HandleFunc("GET /freshness", s.freshness)
+	mux.HandleFunc("GET /quota", s.quota)
+	mux.HandleFunc("POST /eod/backfill", s.authorized(s.triggerBackfill))
+	mux.HandleFunc("POST /fundamentals/refresh", s.authorized(s.triggerFundamentals))
+	mux.Handle("GET /metrics", metrics.Handler())
+	return mux
+}
+
+// authorized responds with 401 to requests without the token of the server.
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				s.writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRunsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxRunsLimit {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxRunsLimit))
+			return
+		}
+		limit = n
+	}
+
+	runs, err := s.scheduler.Runs(r.Context(), limit)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	run, found, err := s.scheduler.GetRun(r.Context(), id)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("run %s not found", id))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, run)
+}
+
+func (s *Server) freshness(w http.ResponseWriter, r *http.Request) {
+	freshness, err := s.pipeline.Freshness(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, freshness)
+}
+
+func (s *Server) quota(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.pipeline.TiingoClient.QuotaUsage())
+}
+
+type backfillRequest struct {
+	Tickers []string `json:"tickers"`
+}
+
+func (s *Server) triggerBackfill(w http.ResponseWriter, r *http.Request) {
+	var req backfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	tickers := upperCase(req.Tickers)
+	if len(tickers) == 0 {
+		s.writeError(w, http.StatusBadRequest, errors.New("tickers is required"))
+		return
+	}
+
+	s.trigger(w, s.scheduler.JobForTask("eod_backfill", "eod-backfill"), "eod_backfill", func(ctx context.Context) (int, error) {
+		return scheduler.Reported(ctx, s.pipeline, "eod_backfill", func(ctx context.Context) (*pipeline.Report, error) {
+			return s.pipeline.BackfillEndOfDay(ctx, tickers)
+		})
+	})
+}
+
+type fundamentalsRequest struct {
+	// Type is one of daily, statements and metadata.
+	Type      string   `json:"type"`
+	Tickers   []string `json:"tickers"`
+	BatchSize int      `json:"batch_size"`
+	Lookback  int      `json:"lookback"`
+}
+
+func (s *Server) triggerFundamentals(w http.ResponseWriter, r *http.Request) {
+	var req fundamentalsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	tickers := upperCase(req.Tickers)
+
+	var fn func(ctx context.Context) (*pipeline.Report, error)
+	switch req.Type {
+	case "daily":
+		fn = func(ctx context.Context) (*pipeline.Report, error) {
+			return s.pipeline.DailyFundamentals(ctx, tickers, false, req.BatchSize, nil, false, req.Lookback)
+		}
+	case "statements":
+		fn = func(ctx context.Context) (*pipeline.Report, error) {
+			return s.pipeline.Statements(ctx, tickers, false, req.BatchSize, nil, false, req.Lookback)
+		}
+	case "metadata":
+		fn = s.pipeline.UpdateMetadata
+	default:
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("type must be daily, statements or metadata, got %q", req.Type))
+		return
+	}
+
+	// Run as the scheduled job of the task, if any, so they never overlap
+	task := "fundamentals_" + req.Type
+	s.trigger(w, s.scheduler.JobForTask(task, "fundamentals-"+req.Type), task, func(ctx context.Context) (int, error) {
+		return scheduler.Reported(ctx, s.pipeline, task, fn)
+	})
+}
+
+// trigger starts fn as a run of the job and responds with the run, or 409 if the job is running.
+func (s *Server) trigger(w http.ResponseWriter, job, task string, fn func(ctx context.Context) (int, error)) {
+	run, err := s.scheduler.Trigger(job, task, fn)
+	if errors.Is(err, scheduler.ErrJobRunning) {
+		s.writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Location", "/runs/"+run.ID)
+	s.writeJSON(w, http.StatusAccepted, run)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error(fmt.Sprintf("Error writing response: %v", err))
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		s.logger.Error(fmt.Sprintf("Error handling request: %v", err))
+	}
+	s.writeJSON(w, status, map[string]string{"error": secrets.Redact(err.Error())})
+}
+
+func upperCase(tickers []string) []string {
+	upper := make([]string, 0, len(tickers))
+	for _, ticker := range tickers {
+		if ticker = strings.TrimSpace(ticker); ticker != "" {
+			upper = append(upper, strings.ToUpper(ticker))
+		}
+	}
+	return upper
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/extract/tiingotest"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/pipeline"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/scheduler"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupTiingoServer stands in for the Tiingo API, serving the price history of AAPL.
+func setupTiingoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(tiingotest.RequireToken(t, "test-token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tiingo/daily/AAPL/prices":
+			w.Header().Set("Content-Type", "text/csv")
+			_, _ = w.Write([]byte("date,close,adjClose,adjVolume\n2024-01-02,185.64,184.53,82488700\n2024-01-03,184.25,183.15,58414500\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})))
+}
+
+// setupTestServer starts the API with the jobs of serveCfg, requiring token if not empty.
+func setupTestServer(t *testing.T, serveCfg config.ServeConfig, token string) (*httptest.Server, *pipeline.Pipeline) {
+	t.Setenv("TIINGO_TOKEN", "test-token")
+
+	baseConfig, err := os.Open("../config.base.yaml")
+	assert.NoError(t, err)
+	defer baseConfig.Close()
+	cfg, err := config.NewConfig(baseConfig, nil, "test")
+	assert.NoError(t, err)
+	cfg.DuckDB.Path = ":memory:"
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	p, err := pipeline.NewPipeline(cfg, logger, nil)
+	assert.NoError(t, err)
+	tiingo := setupTiingoServer(t)
+	p.TiingoClient.BaseURL = tiingo.URL
+	p.TiingoClient.InTest = true
+
+	sched, err := scheduler.New(serveCfg, p.DuckDB, scheduler.PipelineTasks(p), logger)
+	assert.NoError(t, err)
+	assert.NoError(t, sched.Start(context.Background()))
+
+	api := httptest.NewServer(New(p, sched, token, logger).Handler())
+	t.Cleanup(func() {
+		api.Close()
+		sched.Stop()
+		tiingo.Close()
+		p.Close()
+	})
+	return api, p
+}
+
+func decode[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+	defer resp.Body.Close()
+	var v T
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+	return v
+}
+
+// waitForRun polls the run until it is no longer running.
+func waitForRun(t *testing.T, api *httptest.Server, id string) scheduler.Run {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(api.URL + "/runs/" + id)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		run := decode[scheduler.Run](t, resp)
+		if run.Status != scheduler.StatusRunning {
+			return run
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("run %s did not finish", id)
+	return scheduler.Run{}
+}
+
+func TestServer_TriggerBackfill(t *testing.T) {
+	api, p := setupTestServer(t, config.ServeConfig{}, "")
+
+	resp, err := http.Post(api.URL+"/eod/backfill", "application/json", strings.NewReader(`{"tickers": ["aapl"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	run := decode[scheduler.Run](t, resp)
+	assert.Equal(t, "/runs/"+run.ID, resp.Header.Get("Location"))
+	assert.Equal(t, "eod-backfill", run.Job)
+	assert.Equal(t, scheduler.TriggerManual, run.Trigger)
+
+	run = waitForRun(t, api, run.ID)
+	assert.Equal(t, scheduler.StatusSucceeded, run.Status)
+	assert.Equal(t, 1, run.Processed)
+	assert.NotNil(t, run.FinishedAt)
+
+	// The report of the run is saved under its id
+	report, ok, err := p.GetReport(context.Background(), run.ID)
+	assert.NoError(t, err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "eod_backfill", report.Command)
+		assert.Equal(t, []string{"AAPL"}, report.Succeeded)
+	}
+
+	// The run is listed, and the loaded rows show up in the freshness and quota usage
+	resp, err = http.Get(api.URL + "/runs?limit=10")
+	assert.NoError(t, err)
+	runs := decode[[]scheduler.Run](t, resp)
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, run.ID, runs[0].ID)
+	}
+
+	resp, err = http.Get(api.URL + "/freshness")
+	assert.NoError(t, err)
+	freshness := decode[[]pipeline.TableFreshness](t, resp)
+	if assert.NotEmpty(t, freshness) {
+		assert.Equal(t, "daily_adjusted", freshness[0].Table)
+		assert.Equal(t, "2024-01-03", freshness[0].MaxDate)
+		assert.Equal(t, int64(2), freshness[0].Rows)
+	}
+
+	resp, err = http.Get(api.URL + "/quota")
+	assert.NoError(t, err)
+	quota := decode[map[string]any](t, resp)
+	assert.Equal(t, float64(1), quota["requests_last_hour"])
+	assert.Equal(t, float64(10000), quota["requests_per_hour_limit"])
+
+	resp, err = http.Get(api.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `etl_tiingo_requests_total{endpoint="/tiingo/daily/{ticker}/prices",status="200"}`)
+	assert.Contains(t, string(body), `etl_duckdb_rows_loaded_total{table="daily_adjusted"}`)
+}
+
+func TestServer_TriggerFundamentals_FailedRun(t *testing.T) {
+	api, _ := setupTestServer(t, config.ServeConfig{}, "")
+
+	// The Tiingo stand-in has no fundamentals metadata, so the run fails
+	resp, err := http.Post(api.URL+"/fundamentals/refresh", "application/json", strings.NewReader(`{"type": "metadata"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	run := decode[scheduler.Run](t, resp)
+	assert.Equal(t, "fundamentals-metadata", run.Job)
+
+	run = waitForRun(t, api, run.ID)
+	assert.Equal(t, scheduler.StatusFailed, run.Status)
+	assert.NotEmpty(t, run.Message)
+}
+
+func TestServer_TriggerFundamentals_ScheduledJob(t *testing.T) {
+	// Runs of the task are triggered as the scheduled job, so they never overlap
+	api, _ := setupTestServer(t, config.ServeConfig{Jobs: []config.JobConfig{
+		{Name: "weekly-metadata", Schedule: "0 5 * * 6", Task: "fundamentals_metadata"},
+	}}, "")
+
+	resp, err := http.Post(api.URL+"/fundamentals/refresh", "application/json", strings.NewReader(`{"type": "metadata"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	run := decode[scheduler.Run](t, resp)
+	assert.Equal(t, "weekly-metadata", run.Job)
+	waitForRun(t, api, run.ID)
+}
+
+func TestServer_Token(t *testing.T) {
+	api, _ := setupTestServer(t, config.ServeConfig{}, "api-token")
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "trigger without token", method: http.MethodPost, path: "/eod/backfill", wantStatus: http.StatusUnauthorized},
+		{name: "trigger with wrong token", method: http.MethodPost, path: "/eod/backfill", authorization: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "trigger with token", method: http.MethodPost, path: "/eod/backfill", authorization: "Bearer api-token", wantStatus: http.StatusBadRequest},
+		{name: "status without token", method: http.MethodGet, path: "/runs", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, api.URL+tt.path, strings.NewReader(`{"tickers": []}`))
+			assert.NoError(t, err)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestCheckListen(t *testing.T) {
+	tests := []struct {
+		addr    string
+		token   string
+		wantErr string
+	}{
+		{addr: "localhost:8080"},
+		{addr: "127.0.0.1:8080"},
+		{addr: "[::1]:8080"},
+		{addr: ":8080", wantErr: "not a loopback address"},
+		{addr: "0.0.0.0:8080", wantErr: "not a loopback address"},
+		{addr: ":8080", token: "api-token"},
+		{addr: "8080", wantErr: "error parsing listen address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := CheckListen(tt.addr, tt.token)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestServer_BadRequests(t *testing.T) {
+	api, _ := setupTestServer(t, config.ServeConfig{}, "")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "backfill without tickers", method: http.MethodPost, path: "/eod/backfill", body: `{"tickers": []}`, wantStatus: http.StatusBadRequest, wantError: "tickers is required"},
+		{name: "backfill with invalid body", method: http.MethodPost, path: "/eod/backfill", body: `AAPL`, wantStatus: http.StatusBadRequest, wantError: "invalid request body"},
+		{name: "unknown fundamentals type", method: http.MethodPost, path: "/fundamentals/refresh", body: `{"type": "weekly"}`, wantStatus: http.StatusBadRequest, wantError: `got "weekly"`},
+		{name: "invalid limit", method: http.MethodGet, path: "/runs?limit=0", wantStatus: http.StatusBadRequest, wantError: "limit must be between 1 and 1000"},
+		{name: "unknown run", method: http.MethodGet, path: "/runs/missing", wantStatus: http.StatusNotFound, wantError: "run missing not found"},
+		{name: "wrong method", method: http.MethodGet, path: "/eod/backfill", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, api.URL+tt.path, strings.NewReader(tt.body))
+			assert.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantError == "" {
+				resp.Body.Close()
+				return
+			}
+			body := decode[map[string]string](t, resp)
+			assert.Contains(t, body["error"], tt.wantError)
+		})
+	}
+}
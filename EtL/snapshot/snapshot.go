@@ -0,0 +1,380 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+)
+
+// ManifestFile is the file in a snapshot directory describing the snapshot. It is written
+// last, so directories without it are incomplete snapshots.
+const ManifestFile = "manifest.json"
+
+// nameFormat is the time format of snapshot names, which sort chronologically.
+const nameFormat = "20060102T150405Z"
+
+// Manifest describes a snapshot: the rows of each table, the checksums of the exported files
+// and the version of the schema.
+type Manifest struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Database  string    `json:"database"`
+	// SchemaVersion hashes the columns of all tables, so a restore can tell that the restored
+	// schema is the one snapshotted.
+	SchemaVersion string  `json:"schema_version"`
+	Tables        []Table `json:"tables"`
+	Files         []File  `json:"files"`
+
+	// Dir is the directory of the snapshot.
+	Dir string `json:"-"`
+}
+
+// Table is the row count of a table in a snapshot.
+type Table struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// File is a file exported in a snapshot, with its SHA-256 checksum.
+type File struct {
+	Path   string `json:"path"` // relative to the snapshot directory
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Bytes returns the total size of the exported files.
+func (m *Manifest) Bytes() int64 {
+	var n int64
+	for _, f := range m.Files {
+		n += f.Bytes
+	}
+	return n
+}
+
+// Create exports all schemas of db as Parquet to a new directory in dir named by the time now,
+// and writes its manifest. The row counts and the export see the same state of the database.
+func Create(ctx context.Context, db *load.DuckDB, dir string, now time.Time) (*Manifest, error) {
+	m := &Manifest{
+		Name:      now.UTC().Format(nameFormat),
+		CreatedAt: now.UTC(),
+		Database:  db.DBType,
+	}
+	m.Dir = filepath.Join(dir, m.Name)
+	if _, err := os.Stat(m.Dir); err == nil {
+		return nil, fmt.Errorf("snapshot %s already exists", m.Dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+
+	err := db.InTx(ctx, func(tx *load.DuckDB) error {
+		var err error
+		if m.Tables, err = countRows(ctx, tx); err != nil {
+			return err
+		}
+		if m.SchemaVersion, err = SchemaVersion(ctx, tx); err != nil {
+			return err
+		}
+		if err := tx.RunQuery(ctx, fmt.Sprintf("EXPORT DATABASE '%s' (FORMAT PARQUET);", quote(m.Dir))); err != nil {
+			return fmt.Errorf("error exporting database: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(m.Dir)
+		return nil, err
+	}
+
+	if m.Files, err = checksums(m.Dir); err != nil {
+		return nil, err
+	}
+	if err := m.write(); err != nil {
+		return nil, err
+	}
+	db.Logger.Info(fmt.Sprintf("Created snapshot %s", m.Dir), "tables", len(m.Tables), "bytes", m.Bytes())
+	return m, nil
+}
+
+// OpenTarget opens the database at path to restore a snapshot into, with the configuration of cfg,
+// e.g. its secrets for a MotherDuck database, but without the init queries, which would create
+// the tables the snapshot is about to import.
+func OpenTarget(cfg *config.Config, path string, logger *slog.Logger) (*load.DuckDB, error) {
+	target := cfg.Clone()
+	target.DuckDB.Path = path
+	target.DuckDB.ConnInitFnQueries = nil
+	return load.NewDuckDB(target, logger)
+}
+
+// Restore verifies the checksums of the snapshot at dir and imports it into db, checking that
+// the restored row counts and schema match the manifest. The import is rolled back if they do
+// not. db must have no tables, unless force is true, in which case they are dropped first.
+func Restore(ctx context.Context, db *load.DuckDB, dir string, force bool) (*Manifest, error) {
+	m, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.verify(); err != nil {
+		return nil, err
+	}
+
+	err = db.InTx(ctx, func(tx *load.DuckDB) error {
+		existing, err := countRows(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			if !force {
+				return fmt.Errorf("database has %d tables, restore with force to replace them", len(existing))
+			}
+			if err := dropAll(ctx, tx); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.RunQuery(ctx, fmt.Sprintf("IMPORT DATABASE '%s';", quote(m.Dir))); err != nil {
+			return fmt.Errorf("error importing snapshot: %w", err)
+		}
+
+		restored, err := countRows(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(restored, m.Tables) {
+			return fmt.Errorf("restored tables %v do not match the manifest %v", restored, m.Tables)
+		}
+		version, err := SchemaVersion(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if version != m.SchemaVersion {
+			return fmt.Errorf("restored schema version %s does not match the manifest %s", version, m.SchemaVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.Logger.Info(fmt.Sprintf("Restored snapshot %s", m.Dir), "tables", len(m.Tables), "schema_version", m.SchemaVersion)
+	return m, nil
+}
+
+// Read reads the manifest of the snapshot at dir.
+func Read(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest of snapshot %s: %w", dir, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest of snapshot %s: %w", dir, err)
+	}
+	m.Dir = dir
+	return &m, nil
+}
+
+// List returns the complete snapshots in dir, newest first.
+func List(dir string) ([]*Manifest, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+
+	var snapshots []*Manifest
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), ManifestFile)); err != nil {
+			continue
+		}
+		m, err := Read(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, m)
+	}
+	slices.SortFunc(snapshots, func(a, b *Manifest) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return snapshots, nil
+}
+
+// Prune deletes the snapshots in dir but the newest keep, and returns the deleted ones.
+// A keep of 0 or less keeps all snapshots.
+func Prune(dir string, keep int) ([]*Manifest, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	snapshots, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) <= keep {
+		return nil, nil
+	}
+
+	pruned := snapshots[keep:]
+	for _, m := range pruned {
+		if err := os.RemoveAll(m.Dir); err != nil {
+			return nil, fmt.Errorf("error deleting snapshot %s: %w", m.Dir, err)
+		}
+	}
+	return pruned, nil
+}
+
+// write writes the manifest to the snapshot directory.
+func (m *Manifest) write() error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.Dir, ManifestFile), append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
+
+// verify checks that the files of the snapshot match their checksums in the manifest.
+func (m *Manifest) verify() error {
+	files, err := checksums(m.Dir)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(files, m.Files) {
+		for _, want := range m.Files {
+			if !slices.Contains(files, want) {
+				return fmt.Errorf("snapshot %s is corrupt: %s is missing or does not match its checksum", m.Dir, want.Path)
+			}
+		}
+		return fmt.Errorf("snapshot %s is corrupt: it has files not in the manifest", m.Dir)
+	}
+	return nil
+}
+
+// checksums returns the files of the snapshot at dir with their checksums, excluding the manifest.
+func checksums(dir string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == ManifestFile {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error computing checksums of snapshot %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// countRows returns the row count of each table in the database, ordered by name.
+func countRows(ctx context.Context, db *load.DuckDB) ([]Table, error) {
+	res, err := db.GetQueryResults(ctx, `
+		SELECT schema_name || '.' || table_name AS name
+		FROM duckdb_tables()
+		WHERE database_name = current_database() AND NOT temporary AND NOT internal
+		ORDER BY schema_name, table_name;`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %w", err)
+	}
+
+	tables := make([]Table, 0, len(res["name"]))
+	for _, name := range res["name"] {
+		name = strings.TrimPrefix(name, "main.")
+		rows, err := db.CountRows(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, Table{Table: name, Rows: rows})
+	}
+	return tables, nil
+}
+
+// SchemaVersion hashes the columns and types of all tables in the database.
+func SchemaVersion(ctx context.Context, db *load.DuckDB) (string, error) {
+	res, err := db.GetQueryResults(ctx, `
+		SELECT c.schema_name || '.' || c.table_name || '.' || c.column_name || ' ' || c.data_type AS col
+		FROM duckdb_columns() c
+		JOIN duckdb_tables() t USING (database_name, schema_name, table_name)
+		WHERE c.database_name = current_database() AND NOT t.temporary AND NOT t.internal
+		ORDER BY c.schema_name, c.table_name, c.column_index;`)
+	if err != nil {
+		return "", fmt.Errorf("error getting schema: %w", err)
+	}
+	h := sha256.Sum256([]byte(strings.Join(res["col"], "\n")))
+	return hex.EncodeToString(h[:8]), nil
+}
+
+// dropAll drops all schemas, tables and views in the database.
+func dropAll(ctx context.Context, db *load.DuckDB) error {
+	res, err := db.GetQueryResults(ctx, `
+		SELECT schema_name
+		FROM duckdb_schemas()
+		WHERE database_name = current_database() AND NOT internal AND schema_name <> 'main';`)
+	if err != nil {
+		return fmt.Errorf("error listing schemas: %w", err)
+	}
+	for _, schema := range res["schema_name"] {
+		if err := db.RunQuery(ctx, fmt.Sprintf("DROP SCHEMA %s CASCADE;", strconv.Quote(schema))); err != nil {
+			return fmt.Errorf("error dropping schema %s: %w", schema, err)
+		}
+	}
+
+	for _, obj := range []struct{ kind, catalog, column string }{
+		{"VIEW", "duckdb_views()", "view_name"},
+		{"TABLE", "duckdb_tables()", "table_name"},
+	} {
+		res, err := db.GetQueryResults(ctx, fmt.Sprintf(`
+			SELECT %s AS name FROM %s
+			WHERE database_name = current_database() AND schema_name = 'main' AND NOT temporary AND NOT internal;`,
+			obj.column, obj.catalog))
+		if err != nil {
+			return fmt.Errorf("error listing %ss: %w", strings.ToLower(obj.kind), err)
+		}
+		for _, name := range res["name"] {
+			if err := db.RunQuery(ctx, fmt.Sprintf("DROP %s IF EXISTS %s CASCADE;", obj.kind, strconv.Quote(name))); err != nil {
+				return fmt.Errorf("error dropping %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// quote escapes single quotes in a SQL string literal.
+func quote(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
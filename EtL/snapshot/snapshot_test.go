@@ -0,0 +1,209 @@
+package snapshot
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/load"
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/secrets"
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// openDB opens a DuckDB file at path, creating the pipeline's tables if initQueries.
+func openDB(t *testing.T, path string, initQueries bool) *load.DuckDB {
+	t.Helper()
+	cfg := &config.Config{DuckDB: config.DuckDBConfig{Path: path}}
+	if initQueries {
+		cfg.DuckDB.ConnInitFnQueries = []string{
+			"schemas.sql",
+			"table__daily_adjusted.sql",
+			"table__fundamentals_daily.sql",
+		}
+	}
+	db, err := load.NewDuckDB(cfg, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	if err != nil {
+		t.Fatalf("Failed to open DuckDB at %s: %v", path, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// setupSnapshot creates a database with rows in two schemas, and snapshots it to a directory.
+func setupSnapshot(t *testing.T) (*Manifest, string) {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+	db := openDB(t, filepath.Join(dir, "source.db"), true)
+	err := db.RunQuery(ctx, `
+		INSERT INTO daily_adjusted VALUES
+			('2024-01-02', 100, 100, 1000, 'AAPL'),
+			('2024-01-02', 50, 50, 500, 'MSFT');
+		INSERT INTO fundamentals.daily VALUES ('2024-01-02', 3000, 3100, 30, 40, 2, 'AAPL');`)
+	if err != nil {
+		t.Fatalf("Failed to insert rows: %v", err)
+	}
+
+	m, err := Create(ctx, db, filepath.Join(dir, "snapshots"), now)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	return m, dir
+}
+
+func TestCreate(t *testing.T) {
+	m, dir := setupSnapshot(t)
+
+	assert.Equal(t, "20240102T030405Z", m.Name)
+	assert.Equal(t, filepath.Join(dir, "snapshots", m.Name), m.Dir)
+	assert.Equal(t, []Table{
+		{Table: "fundamentals.daily", Rows: 1},
+		{Table: "daily_adjusted", Rows: 2},
+	}, m.Tables)
+	assert.NotEmpty(t, m.SchemaVersion)
+	assert.NotEmpty(t, m.Files)
+	assert.Positive(t, m.Bytes())
+
+	read, err := Read(m.Dir)
+	assert.NoError(t, err)
+	assert.Equal(t, m, read)
+
+	_, err = Create(context.Background(), openDB(t, filepath.Join(dir, "other.db"), false), filepath.Join(dir, "snapshots"), now)
+	assert.ErrorContains(t, err, "already exists")
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("into an empty database", func(t *testing.T) {
+		m, dir := setupSnapshot(t)
+		db := openDB(t, filepath.Join(dir, "restored.db"), false)
+
+		restored, err := Restore(ctx, db, m.Dir, false)
+		assert.NoError(t, err)
+		assert.Equal(t, m.Tables, restored.Tables)
+
+		n, err := db.CountRows(ctx, "fundamentals.daily")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+	})
+
+	t.Run("into a database with tables", func(t *testing.T) {
+		m, dir := setupSnapshot(t)
+		db := openDB(t, filepath.Join(dir, "restored.db"), true)
+		if err := db.RunQuery(ctx, "INSERT INTO daily_adjusted VALUES ('2024-01-03', 1, 1, 1, 'TSLA');"); err != nil {
+			t.Fatalf("Failed to insert rows: %v", err)
+		}
+
+		_, err := Restore(ctx, db, m.Dir, false)
+		assert.ErrorContains(t, err, "restore with force")
+		n, err := db.CountRows(ctx, "daily_adjusted")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		_, err = Restore(ctx, db, m.Dir, true)
+		assert.NoError(t, err)
+		res, err := db.GetQueryResults(ctx, "SELECT ticker FROM daily_adjusted ORDER BY ticker")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"AAPL", "MSFT"}, res["ticker"])
+	})
+
+	t.Run("corrupt snapshot", func(t *testing.T) {
+		m, dir := setupSnapshot(t)
+		if err := os.WriteFile(filepath.Join(m.Dir, m.Files[0].Path), []byte("corrupt"), 0o644); err != nil {
+			t.Fatalf("Failed to corrupt snapshot: %v", err)
+		}
+
+		_, err := Restore(ctx, openDB(t, filepath.Join(dir, "restored.db"), false), m.Dir, false)
+		assert.ErrorContains(t, err, m.Files[0].Path+" is missing or does not match its checksum")
+	})
+}
+
+func TestOpenTarget(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	dir := t.TempDir()
+	cfg := &config.Config{
+		DuckDB: config.DuckDBConfig{Path: ":memory:", ConnInitFnQueries: []string{"schemas.sql", "table__daily_adjusted.sql"}},
+		// The token is read from a file rather than the environment
+		Secrets: config.SecretsConfig{Providers: []string{"file"}, Dir: dir},
+	}
+
+	t.Run("without the init queries", func(t *testing.T) {
+		db, err := OpenTarget(cfg, filepath.Join(dir, "restored.db"), logger)
+		if err != nil {
+			t.Fatalf("Failed to open target: %v", err)
+		}
+		defer db.Close()
+		tables, err := countRows(ctx, db)
+		assert.NoError(t, err)
+		assert.Empty(t, tables)
+		assert.Len(t, cfg.DuckDB.ConnInitFnQueries, 2)
+	})
+
+	t.Run("with the secrets of the config", func(t *testing.T) {
+		_, err := OpenTarget(cfg, "md:restored", logger)
+		assert.ErrorIs(t, err, secrets.ErrNotFound)
+
+		if err := os.WriteFile(filepath.Join(dir, "MOTHERDUCK_TOKEN"), []byte("md-token\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write token: %v", err)
+		}
+		// Connecting fails without MotherDuck, but only after the token was found
+		db, err := OpenTarget(cfg, "md:restored", logger)
+		if err == nil {
+			db.Close()
+		}
+		assert.NotErrorIs(t, err, secrets.ErrNotFound)
+	})
+}
+
+func TestListAndPrune(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshots := filepath.Join(dir, "snapshots")
+	db := openDB(t, filepath.Join(dir, "source.db"), true)
+
+	for i := range 3 {
+		if _, err := Create(ctx, db, snapshots, now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("Failed to create snapshot: %v", err)
+		}
+	}
+	// An incomplete snapshot without a manifest is ignored
+	if err := os.MkdirAll(filepath.Join(snapshots, "20240102T090000Z"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	names := func(ms []*Manifest) []string {
+		var names []string
+		for _, m := range ms {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	list, err := List(snapshots)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20240102T050405Z", "20240102T040405Z", "20240102T030405Z"}, names(list))
+
+	pruned, err := Prune(snapshots, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	pruned, err = Prune(snapshots, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20240102T040405Z", "20240102T030405Z"}, names(pruned))
+
+	list, err = List(snapshots)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20240102T050405Z"}, names(list))
+
+	list, err = List(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
@@ -0,0 +1,18 @@
+-- Metrics used to validate the last trading day after it is loaded, see Pipeline.ValidateEndOfDay.
+-- The previous trading day is the latest date in daily_adjusted before the last trading day.
+with latest as (
+  select ticker, date, close from selected_last_trading_day
+),
+previous as (
+  select ticker, close
+  from daily_adjusted
+  where date = (
+    select max(date) from daily_adjusted where date < (select max(date) from latest)
+  )
+)
+select
+  (select count(*) from latest) as n_rows,
+  (select count(distinct date) from latest) as n_dates,
+  (select count(*) from latest where close is null or close <= 0) as n_invalid_prices,
+  (select count(*) from previous) as n_previous,
+  (select count(*) from latest join previous using (ticker) where latest.close = previous.close) as n_unchanged;
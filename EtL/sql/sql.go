@@ -0,0 +1,86 @@
+// Package sql embeds the SQL files of the pipelines and the schema, so the binary runs from any
+// directory, and resolves them by name through a Registry.
+package sql
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Registry reads SQL files by name, e.g. schemas.sql, from the files embedded in the binary, or
+// from a directory when developing the queries. Names with a directory, e.g. ./sql/db__stage.sql,
+// are paths of files read from disk, relative to the working directory.
+type Registry struct {
+	fsys fs.FS
+	dir  string
+}
+
+// Embedded returns the registry of the SQL files embedded in the binary.
+func Embedded() *Registry {
+	return &Registry{fsys: files}
+}
+
+// New returns the registry of the SQL files in dir, or of the embedded files if dir is empty.
+func New(dir string) (*Registry, error) {
+	if dir == "" {
+		return Embedded(), nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQL directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("SQL directory %s is not a directory", dir)
+	}
+	return &Registry{fsys: os.DirFS(dir), dir: dir}, nil
+}
+
+// IsPath reports whether name is the path of a file on disk rather than the name of a file in a
+// registry.
+func IsPath(name string) bool {
+	return filepath.Base(name) != name
+}
+
+// Source describes where the files are read from, i.e. the directory or "embedded".
+func (r *Registry) Source() string {
+	if r.dir == "" {
+		return "embedded"
+	}
+	return r.dir
+}
+
+// Read returns the content of the SQL file.
+func (r *Registry) Read(name string) ([]byte, error) {
+	if IsPath(name) {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SQL file: %w", err)
+		}
+		return b, nil
+	}
+
+	b, err := fs.ReadFile(r.fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SQL file %s from %s: %w", name, r.Source(), err)
+	}
+	return b, nil
+}
+
+// Stat returns the file info of the SQL file, like os.Stat.
+func (r *Registry) Stat(name string) (fs.FileInfo, error) {
+	if IsPath(name) {
+		return os.Stat(name)
+	}
+	return fs.Stat(r.fsys, name)
+}
+
+// Names returns the names of the SQL files, sorted.
+func (r *Registry) Names() ([]string, error) {
+	return fs.Glob(r.fsys, "*.sql")
+}
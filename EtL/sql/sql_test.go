@@ -0,0 +1,105 @@
+package sql
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedded(t *testing.T) {
+	r := Embedded()
+	assert.Equal(t, "embedded", r.Source())
+
+	// The embedded files are the files of this directory
+	onDisk, err := filepath.Glob("*.sql")
+	if err != nil {
+		t.Fatalf("Failed to glob SQL files: %v", err)
+	}
+	names, err := r.Names()
+	assert.NoError(t, err)
+	assert.Equal(t, onDisk, names)
+
+	for _, name := range names {
+		want, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		got, err := r.Read(name)
+		assert.NoError(t, err)
+		assert.Equal(t, string(want), string(got), name)
+	}
+
+	_, err = r.Read("missing.sql")
+	assert.ErrorContains(t, err, "error reading SQL file missing.sql from embedded")
+	_, err = r.Stat("missing.sql")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "schemas.sql"), []byte("select 1;"), 0o644); err != nil {
+		t.Fatalf("Failed to write SQL file: %v", err)
+	}
+
+	t.Run("directory overrides the embedded files", func(t *testing.T) {
+		r, err := New(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, dir, r.Source())
+
+		got, err := r.Read("schemas.sql")
+		assert.NoError(t, err)
+		assert.Equal(t, "select 1;", string(got))
+
+		// Files missing from the directory are not read from the embedded files
+		_, err = r.Read("table__daily_adjusted.sql")
+		assert.ErrorContains(t, err, "error reading SQL file table__daily_adjusted.sql from "+dir)
+
+		names, err := r.Names()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"schemas.sql"}, names)
+	})
+
+	t.Run("paths are read from disk", func(t *testing.T) {
+		path := filepath.Join(dir, "schemas.sql")
+		got, err := Embedded().Read(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "select 1;", string(got))
+
+		_, err = Embedded().Stat(path)
+		assert.NoError(t, err)
+	})
+
+	t.Run("empty directory is embedded", func(t *testing.T) {
+		r, err := New("")
+		assert.NoError(t, err)
+		assert.Equal(t, "embedded", r.Source())
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		_, err := New(filepath.Join(dir, "missing"))
+		assert.ErrorContains(t, err, "error opening SQL directory")
+
+		_, err = New(filepath.Join(dir, "schemas.sql"))
+		assert.ErrorContains(t, err, "is not a directory")
+	})
+}
+
+func TestIsPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"schemas.sql", false},
+		{"./sql/schemas.sql", true},
+		{"../sql/db__stage.sql", true},
+		{"/etc/etl/init.sql", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsPath(tt.name))
+		})
+	}
+}
@@ -0,0 +1,14 @@
+-- Dead-letter table for tickers that fail to be fetched or loaded.
+-- `endpoint` is the table the ticker was being loaded into, e.g. fundamentals.daily.
+-- `attempts` counts consecutive failures; the row is deleted on the next success.
+create table if not exists failed_tickers (
+  ticker VARCHAR,
+  endpoint VARCHAR,
+  status_code INTEGER,
+  body_excerpt VARCHAR,
+  error VARCHAR,
+  attempts INTEGER,
+  first_failed_at TIMESTAMP,
+  last_failed_at TIMESTAMP,
+  primary key (ticker, endpoint)
+);
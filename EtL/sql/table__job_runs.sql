@@ -0,0 +1,15 @@
+-- Runs of the jobs scheduled by `etl serve`, one row per run.
+-- `status` is one of running, succeeded, failed, validation_failed, interrupted, skipped and abandoned.
+-- `scheduled_for` is the cron time the run belongs to, also for catch-up runs.
+create table if not exists job_runs (
+  run_id VARCHAR primary key,
+  job VARCHAR,
+  task VARCHAR,
+  trigger VARCHAR,
+  scheduled_for TIMESTAMP,
+  started_at TIMESTAMP,
+  finished_at TIMESTAMP,
+  status VARCHAR,
+  processed INTEGER,
+  message VARCHAR
+);
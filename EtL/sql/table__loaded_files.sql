@@ -0,0 +1,7 @@
+-- SHA-256 hashes of the source files last loaded into a table, e.g. supported_tickers.zip,
+-- so unchanged files are not reloaded.
+create table if not exists loaded_files (
+  name VARCHAR primary key,
+  sha256 VARCHAR,
+  loaded_at TIMESTAMP
+);
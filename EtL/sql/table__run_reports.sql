@@ -0,0 +1,17 @@
+-- End-of-run reports of the pipeline commands and of the jobs run by `etl serve`, one row per run.
+-- `report` is the full report as JSON; the other columns summarise it for querying.
+-- `error` is empty if the run succeeded.
+create table if not exists run_reports (
+  run_id VARCHAR primary key,
+  command VARCHAR,
+  started_at TIMESTAMP,
+  finished_at TIMESTAMP,
+  error VARCHAR,
+  processed INTEGER,
+  requested INTEGER,
+  succeeded INTEGER,
+  empty INTEGER,
+  failed INTEGER,
+  api_calls BIGINT,
+  report VARCHAR
+);
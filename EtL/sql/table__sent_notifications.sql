@@ -0,0 +1,12 @@
+-- Notifications sent by the batch commands, used to not send the same notification to a
+-- target again within the dedup window. `dedup_key` hashes the target, command, severity and message.
+create table if not exists sent_notifications (
+  dedup_key VARCHAR primary key,
+  target VARCHAR,
+  command VARCHAR,
+  severity VARCHAR,
+  title VARCHAR,
+  first_sent_at TIMESTAMP,
+  last_sent_at TIMESTAMP,
+  suppressed INTEGER
+);
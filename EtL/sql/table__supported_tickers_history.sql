@@ -0,0 +1,13 @@
+-- Change history of supported_tickers, one row per version of a ticker's listing.
+-- A version is seen in all loads of supported_tickers from `first_seen` to `last_seen`;
+-- versions not seen in the latest load were changed, e.g. got an endDate, or were delisted.
+create table if not exists supported_tickers_history (
+  ticker VARCHAR,
+  exchange VARCHAR,
+  assetType VARCHAR,
+  priceCurrency VARCHAR,
+  startDate DATE,
+  endDate DATE,
+  first_seen TIMESTAMP,
+  last_seen TIMESTAMP
+);
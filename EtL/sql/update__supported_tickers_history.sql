@@ -0,0 +1,33 @@
+-- Records a load of supported_tickers seen at {{.SeenAt}} in supported_tickers_history:
+-- versions still in supported_tickers are seen again, and new or changed ones are added.
+update supported_tickers_history h
+set last_seen = timestamp '{{.SeenAt}}'
+from supported_tickers s
+where h.ticker is not distinct from s.ticker
+  and h.exchange is not distinct from s.exchange
+  and h.assetType is not distinct from s.assetType
+  and h.priceCurrency is not distinct from s.priceCurrency
+  and h.startDate is not distinct from s.startDate
+  and h.endDate is not distinct from s.endDate;
+
+insert into supported_tickers_history
+select distinct
+  s.ticker,
+  s.exchange,
+  s.assetType,
+  s.priceCurrency,
+  s.startDate,
+  s.endDate,
+  timestamp '{{.SeenAt}}' as first_seen,
+  timestamp '{{.SeenAt}}' as last_seen
+from supported_tickers s
+where not exists (
+  select 1
+  from supported_tickers_history h
+  where h.ticker is not distinct from s.ticker
+    and h.exchange is not distinct from s.exchange
+    and h.assetType is not distinct from s.assetType
+    and h.priceCurrency is not distinct from s.priceCurrency
+    and h.startDate is not distinct from s.startDate
+    and h.endDate is not distinct from s.endDate
+);
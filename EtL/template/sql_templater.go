@@ -14,8 +14,13 @@ func ExecuteSqlTemplate(templatePath string, params map[string]any) (string, err
 		return "", err
 	}
 
+	return ExecuteSqlTemplateString(string(content), params)
+}
+
+// ExecuteSqlTemplateString executes the SQL template content with params, like ExecuteSqlTemplate.
+func ExecuteSqlTemplateString(content string, params map[string]any) (string, error) {
 	// Parse and execute the template
-	tmpl, err := template.New("sql").Parse(string(content))
+	tmpl, err := template.New("sql").Parse(content)
 	if err != nil {
 		return "", err
 	}
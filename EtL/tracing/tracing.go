@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rasnes/tiingo-duckdb-framework/EtL"
+
+// Span attributes set by the ETL.
+const (
+	RunIDKey     = attribute.Key("etl.run_id")
+	CommandKey   = attribute.Key("etl.command")
+	TickerKey    = attribute.Key("etl.ticker")
+	TableKey     = attribute.Key("etl.table")
+	BatchSizeKey = attribute.Key("etl.batch_size")
+	EndpointKey  = attribute.Key("etl.endpoint")
+)
+
+// Setup exports the spans of the ETL to the OTLP/HTTP collector in cfg, and returns a function
+// flushing and stopping the export. Tracing is disabled, and spans are no-ops, if no endpoint
+// is configured.
+func Setup(ctx context.Context, cfg config.TracingConfig) (shutdown func(context.Context) error, err error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q, expected e.g. http://localhost:4318", cfg.Endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint)}
+	// Like OTEL_EXPORTER_OTLP_ENDPOINT, an endpoint without a path is the base URL of the collector
+	if strings.Trim(endpoint.Path, "/") == "" {
+		opts = append(opts, otlptracehttp.WithURLPath("/v1/traces"))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter for %s: %w", cfg.Endpoint, err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "etl"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		if err := provider.Shutdown(ctx); err != nil {
+			return fmt.Errorf("error flushing spans to %s: %w", cfg.Endpoint, err)
+		}
+		return nil
+	}, nil
+}
+
+type runIDKey struct{}
+
+// WithRunID returns a context whose spans are attributed to the run id.
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// RunID returns the run id of ctx, or an empty string if it has none.
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// Start starts a span, with the run id of ctx as attribute. The span must be ended with End.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if runID := RunID(ctx); runID != "" {
+		attrs = append(attrs, RunIDKey.String(runID))
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, recording err as its error status if not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
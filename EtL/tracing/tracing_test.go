@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rasnes/tiingo-duckdb-framework/EtL/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OTLP/HTTP collector, recording the spans exported to it.
+type collector struct {
+	mu    sync.Mutex
+	paths []string
+	spans []*tracepb.Span
+}
+
+func setupCollector(t *testing.T) (*httptest.Server, *collector) {
+	c := &collector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req coltracepb.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(body, &req))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.paths = append(c.paths, r.URL.Path)
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+	return server, c
+}
+
+// attributes returns the string and int attributes of a span.
+func attributes(span *tracepb.Span) map[string]any {
+	attrs := make(map[string]any)
+	for _, kv := range span.Attributes {
+		switch v := kv.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			attrs[kv.Key] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			attrs[kv.Key] = v.IntValue
+		}
+	}
+	return attrs
+}
+
+func TestSetup(t *testing.T) {
+	server, c := setupCollector(t)
+
+	shutdown, err := Setup(context.Background(), config.TracingConfig{Endpoint: server.URL, ServiceName: "etl-test"})
+	assert.NoError(t, err)
+
+	ctx := WithRunID(context.Background(), "run-1")
+	ctx, parent := Start(ctx, "parent", TableKey.String("daily_adjusted"))
+	_, child := Start(ctx, "child", TickerKey.String("AAPL"))
+	End(child, errors.New("fetch failed"))
+	End(parent, nil)
+
+	// Spans are exported when flushed by shutdown
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, []string{"/v1/traces"}, c.paths)
+	if !assert.Len(t, c.spans, 2) {
+		return
+	}
+
+	spans := make(map[string]*tracepb.Span)
+	for _, span := range c.spans {
+		spans[span.Name] = span
+	}
+	assert.Equal(t, map[string]any{"etl.table": "daily_adjusted", "etl.run_id": "run-1"}, attributes(spans["parent"]))
+	assert.Equal(t, map[string]any{"etl.ticker": "AAPL", "etl.run_id": "run-1"}, attributes(spans["child"]))
+	assert.Equal(t, spans["parent"].SpanId, spans["child"].ParentSpanId)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, spans["child"].Status.Code)
+	assert.Equal(t, "fetch failed", spans["child"].Status.Message)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_UNSET, spans["parent"].Status.Code)
+}
+
+func TestSetup_Disabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), config.TracingConfig{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestSetup_InvalidEndpoint(t *testing.T) {
+	_, err := Setup(context.Background(), config.TracingConfig{Endpoint: "localhost:4318"})
+	assert.ErrorContains(t, err, `invalid tracing endpoint "localhost:4318"`)
+}
+
+func TestRunID(t *testing.T) {
+	assert.Equal(t, "", RunID(context.Background()))
+	assert.Equal(t, "abc", RunID(WithRunID(context.Background(), "abc")))
+}